@@ -4,13 +4,13 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/spf13/viper"
 	"maunium.net/go/mautrix"
 
@@ -18,6 +18,7 @@ import (
 	"github.com/feline-dis/matrix-claude-bot/internal/config"
 	"github.com/feline-dis/matrix-claude-bot/internal/crypto"
 	"github.com/feline-dis/matrix-claude-bot/internal/tools"
+	"github.com/feline-dis/matrix-claude-bot/internal/tracing"
 )
 
 var configFile string
@@ -41,23 +42,99 @@ func initConfig() {
 	viper.BindEnv("matrix.homeserver_url", "MATRIX_HOMESERVER_URL")
 	viper.BindEnv("matrix.user_id", "MATRIX_USER_ID")
 	viper.BindEnv("matrix.access_token", "MATRIX_ACCESS_TOKEN")
+	viper.BindEnv("matrix.allowed_rooms", "MATRIX_ALLOWED_ROOMS")
+	viper.BindEnv("matrix.autojoin_allowed_inviters", "MATRIX_AUTOJOIN_ALLOWED_INVITERS")
+	viper.BindEnv("matrix.autojoin_allowed_servers", "MATRIX_AUTOJOIN_ALLOWED_SERVERS")
+	viper.BindEnv("matrix.admins", "MATRIX_ADMINS")
+	viper.BindEnv("matrix.reply_prefix", "MATRIX_REPLY_PREFIX")
+	viper.BindEnv("matrix.reply_suffix", "MATRIX_REPLY_SUFFIX")
+	viper.BindEnv("matrix.reply_style", "MATRIX_REPLY_STYLE")
+	viper.BindEnv("matrix.thread_root", "MATRIX_THREAD_ROOT")
+	viper.BindEnv("matrix.include_room_context", "MATRIX_INCLUDE_ROOM_CONTEXT")
+	viper.BindEnv("matrix.quote_question", "MATRIX_QUOTE_QUESTION")
+	viper.BindEnv("matrix.ignore_broadcasts", "MATRIX_IGNORE_BROADCASTS")
+	viper.BindEnv("matrix.display_name", "MATRIX_DISPLAY_NAME")
+	viper.BindEnv("matrix.avatar_url", "MATRIX_AVATAR_URL")
 	viper.BindEnv("anthropic.api_key", "ANTHROPIC_API_KEY")
+	viper.BindEnv("claude.provider", "CLAUDE_PROVIDER")
+	viper.BindEnv("claude.compat.base_url", "CLAUDE_COMPAT_BASE_URL")
+	viper.BindEnv("claude.compat.api_key", "CLAUDE_COMPAT_API_KEY")
 	viper.BindEnv("claude.model", "CLAUDE_MODEL")
+	viper.BindEnv("claude.fallback_models", "CLAUDE_FALLBACK_MODELS")
 	viper.BindEnv("claude.max_tokens", "CLAUDE_MAX_TOKENS")
+	viper.BindEnv("claude.daily_token_budget", "CLAUDE_DAILY_TOKEN_BUDGET")
 	viper.BindEnv("claude.system_prompt", "CLAUDE_SYSTEM_PROMPT")
+	viper.BindEnv("claude.include_sender_name", "CLAUDE_INCLUDE_SENDER_NAME")
+	viper.BindEnv("claude.ask_clarification", "CLAUDE_ASK_CLARIFICATION")
+	viper.BindEnv("claude.clarification_prompt", "CLAUDE_CLARIFICATION_PROMPT")
+	viper.BindEnv("claude.empty_response_text", "CLAUDE_EMPTY_RESPONSE_TEXT")
+	viper.BindEnv("claude.strip_tags", "CLAUDE_STRIP_TAGS")
+	viper.BindEnv("claude.temperature", "CLAUDE_TEMPERATURE")
+	viper.BindEnv("claude.top_p", "CLAUDE_TOP_P")
+	viper.BindEnv("claude.top_k", "CLAUDE_TOP_K")
 	viper.BindEnv("tools.web_search_enabled", "TOOLS_WEB_SEARCH_ENABLED")
+	viper.BindEnv("tools.server_tools", "TOOLS_SERVER_TOOLS")
+	viper.BindEnv("tools.web_search.allowed_domains", "TOOLS_WEB_SEARCH_ALLOWED_DOMAINS")
+	viper.BindEnv("tools.web_search.blocked_domains", "TOOLS_WEB_SEARCH_BLOCKED_DOMAINS")
+	viper.BindEnv("tools.web_search.max_uses", "TOOLS_WEB_SEARCH_MAX_USES")
+	viper.BindEnv("tools.datetime_enabled", "TOOLS_DATETIME_ENABLED")
+	viper.BindEnv("tools.base64_enabled", "TOOLS_BASE64_ENABLED")
+	viper.BindEnv("tools.chart_enabled", "TOOLS_CHART_ENABLED")
+	viper.BindEnv("tools.reminders_enabled", "TOOLS_REMINDERS_ENABLED")
+	viper.BindEnv("tools.history_enabled", "TOOLS_HISTORY_ENABLED")
+	viper.BindEnv("tools.room_pins_enabled", "TOOLS_ROOM_PINS_ENABLED")
 	viper.BindEnv("tools.sandbox_dir", "TOOLS_SANDBOX_DIR")
+	viper.BindEnv("tools.cache_ttl", "TOOLS_CACHE_TTL")
+	viper.BindEnv("tools.schema_hints", "TOOLS_SCHEMA_HINTS")
+	viper.BindEnv("tools.sandbox_per_room", "TOOLS_SANDBOX_PER_ROOM")
+	viper.BindEnv("tools.sandbox_readonly", "TOOLS_SANDBOX_READONLY")
+	viper.BindEnv("tools.sandbox_ephemeral", "TOOLS_SANDBOX_EPHEMERAL")
+	viper.BindEnv("tools.shell_enabled", "TOOLS_SHELL_ENABLED")
+	viper.BindEnv("tools.shell_allowed_commands", "TOOLS_SHELL_ALLOWED_COMMANDS")
 	viper.BindEnv("tools.max_iterations", "TOOLS_MAX_ITERATIONS")
+	viper.BindEnv("tools.max_calls_per_turn", "TOOLS_MAX_CALLS_PER_TURN")
 	viper.BindEnv("tools.timeout_seconds", "TOOLS_TIMEOUT_SECONDS")
+	viper.BindEnv("tools.show_activity", "TOOLS_SHOW_ACTIVITY")
+	viper.BindEnv("tools.narrate", "TOOLS_NARRATE")
+	viper.BindEnv("tools.echo_results", "TOOLS_ECHO_RESULTS")
+	viper.BindEnv("tools.disabled", "TOOLS_DISABLED")
+	viper.BindEnv("tools.tool_choice", "TOOLS_TOOL_CHOICE")
+	viper.BindEnv("conversation.ttl", "CONVERSATION_TTL")
+	viper.BindEnv("conversation.scope", "CONVERSATION_SCOPE")
+	viper.BindEnv("conversation.flush_interval", "CONVERSATION_FLUSH_INTERVAL")
+	viper.BindEnv("conversation.flush_threshold", "CONVERSATION_FLUSH_THRESHOLD")
+	viper.BindEnv("conversation.max_threads", "CONVERSATION_MAX_THREADS")
+	viper.BindEnv("conversation.persist_path", "CONVERSATION_PERSIST_PATH")
+	viper.BindEnv("handler.edit_on_correction", "HANDLER_EDIT_ON_CORRECTION")
+	viper.BindEnv("handler.respond_to_notices", "HANDLER_RESPOND_TO_NOTICES")
+	viper.BindEnv("handler.ignore_bot_senders", "HANDLER_IGNORE_BOT_SENDERS")
+	viper.BindEnv("handler.stop_on_reaction", "HANDLER_STOP_ON_REACTION")
+	viper.BindEnv("handler.max_concurrent", "HANDLER_MAX_CONCURRENT")
+	viper.BindEnv("handler.queue_notice_seconds", "HANDLER_QUEUE_NOTICE_SECONDS")
+	viper.BindEnv("handler.thinking_notice_seconds", "HANDLER_THINKING_NOTICE_SECONDS")
+	viper.BindEnv("handler.dedupe_size", "HANDLER_DEDUPE_SIZE")
+	viper.BindEnv("ratelimit.per_room_per_minute", "RATELIMIT_PER_ROOM_PER_MINUTE")
+	viper.BindEnv("ratelimit.per_user_per_minute", "RATELIMIT_PER_USER_PER_MINUTE")
+	viper.BindEnv("monitoring.admin_room", "MONITORING_ADMIN_ROOM")
+	viper.BindEnv("monitoring.sync_timeout", "MONITORING_SYNC_TIMEOUT")
 
 	viper.BindEnv("crypto.pickle_key", "CRYPTO_PICKLE_KEY")
 	viper.BindEnv("crypto.database_path", "CRYPTO_DATABASE_PATH")
+	viper.BindEnv("crypto.bootstrap_cross_signing", "CRYPTO_BOOTSTRAP_CROSS_SIGNING")
+	viper.BindEnv("crypto.recovery_key", "CRYPTO_RECOVERY_KEY")
+	viper.BindEnv("crypto.share_keys_with", "CRYPTO_SHARE_KEYS_WITH")
+	viper.BindEnv("crypto.fail_open", "CRYPTO_FAIL_OPEN")
+	viper.BindEnv("tracing.endpoint", "TRACING_ENDPOINT")
+	viper.BindEnv("settings.database_path", "SETTINGS_DATABASE_PATH")
 
 	viper.SetDefault("claude.model", "claude-sonnet-4-20250514")
 	viper.SetDefault("claude.max_tokens", 4096)
 	viper.SetDefault("tools.max_iterations", 10)
 	viper.SetDefault("tools.timeout_seconds", 30)
+	viper.SetDefault("handler.queue_notice_seconds", 2)
+	viper.SetDefault("handler.dedupe_size", 1000)
 	viper.SetDefault("crypto.database_path", "matrix-claude-bot.db")
+	viper.SetDefault("crypto.share_keys_with", "trusted")
 
 	if err := viper.ReadInConfig(); err != nil {
 		var notFound viper.ConfigFileNotFoundError
@@ -67,6 +144,108 @@ func initConfig() {
 	}
 }
 
+// reloadOnSighup re-reads the config file and applies it to the running bot
+// each time the process receives SIGHUP, until ctx is done.
+func reloadOnSighup(ctx context.Context, b *bot.Bot) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := viper.ReadInConfig(); err != nil {
+				var notFound viper.ConfigFileNotFoundError
+				if !errors.As(err, &notFound) {
+					log.Printf("Reload failed: could not parse config file: %v", err)
+					continue
+				}
+			}
+			cfg, err := config.LoadConfig()
+			if err != nil {
+				log.Printf("Reload failed: %v", err)
+				continue
+			}
+			b.Reload(cfg)
+		}
+	}
+}
+
+// useSettingsDB moves the bot's room settings into the SQLite database at
+// path and returns a func that closes it. On failure settings stay in memory
+// and it returns nil.
+func useSettingsDB(ctx context.Context, b *bot.Bot, path string) func() {
+	db, err := crypto.OpenDB(path)
+	if err != nil {
+		log.Printf("Warning: could not open settings database, keeping settings in memory: %v", err)
+		return nil
+	}
+	store, err := bot.NewSQLSettingsStore(ctx, db)
+	if err == nil {
+		err = b.UseSettings(ctx, store)
+	}
+	if err != nil {
+		db.Close()
+		log.Printf("Warning: could not load settings, keeping them in memory: %v", err)
+		return nil
+	}
+	log.Printf("Room settings persisted in %s", path)
+	return func() { db.Close() }
+}
+
+// runConversationCommand runs the export-conversations or
+// import-conversations subcommand on the store at
+// conversation.persist_path. A file of "-" means stdout or stdin. Importing
+// while the bot runs is unsafe: its next write would discard the import.
+func runConversationCommand(ctx context.Context, cfg config.Config, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: matrix-claude-bot [-config file] %s <file>", args[0])
+	}
+	if cfg.ConversationPersistPath == "" {
+		return errors.New("conversation.persist_path is not set, so there is no stored conversation state")
+	}
+	store, err := bot.NewPersistentConversationStore(cfg.ConversationPersistPath)
+	if err != nil {
+		return err
+	}
+
+	switch cmd, file := args[0], args[1]; cmd {
+	case "export-conversations":
+		out := os.Stdout
+		if file != "-" {
+			if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+				return err
+			}
+		}
+		if err := store.Export(out); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		log.Printf("Exported %d conversations from %s", store.Len(), cfg.ConversationPersistPath)
+	case "import-conversations":
+		in := os.Stdin
+		if file != "-" {
+			if in, err = os.Open(file); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		n, err := store.Import(in)
+		if err != nil {
+			return err
+		}
+		log.Printf("Imported %d conversations into %s", n, cfg.ConversationPersistPath)
+	default:
+		return fmt.Errorf("unknown command %q: use export-conversations or import-conversations", cmd)
+	}
+	return nil
+}
+
 func main() {
 	initConfig()
 	cfg, err := config.LoadConfig()
@@ -74,6 +253,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if args := flag.Args(); len(args) > 0 {
+		if err := runConversationCommand(context.Background(), cfg, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	matrixClient, err := mautrix.NewClient(cfg.HomeserverURL, cfg.UserID, cfg.AccessToken)
 	if err != nil {
 		log.Fatalf("Failed to create Matrix client: %v", err)
@@ -82,6 +268,18 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	shutdownTracing, err := tracing.Setup(ctx, cfg.TracingEndpoint)
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Printf("Warning: failed to flush traces: %v", err)
+		}
+	}()
+
 	if cfg.PickleKey != "" {
 		whoami, err := matrixClient.Whoami(ctx)
 		if err != nil {
@@ -89,44 +287,141 @@ func main() {
 		}
 		matrixClient.DeviceID = whoami.DeviceID
 
-		cryptoHelper, err := crypto.Setup(ctx, matrixClient, cfg)
+		cryptoHelper, err := crypto.SetupWithFallback(ctx, matrixClient, cfg)
 		if err != nil {
 			log.Fatalf("Failed to setup E2EE: %v", err)
 		}
-		defer cryptoHelper.Close()
+		if cryptoHelper != nil {
+			defer cryptoHelper.Close()
+		}
+	}
+
+	if err := bot.SyncProfile(ctx, matrixClient, cfg); err != nil {
+		log.Printf("Warning: could not update profile: %v", err)
 	}
 
 	reg := tools.NewRegistry()
+	if cfg.ToolCacheTTL > 0 {
+		reg.EnableResultCache(cfg.ToolCacheTTL)
+	}
+	if len(cfg.ToolConcurrency) > 0 {
+		reg.SetConcurrencyLimits(cfg.ToolConcurrency)
+	}
+	if len(cfg.ToolOutputFormatters) > 0 {
+		if err := reg.SetOutputFormatters(cfg.ToolOutputFormatters); err != nil {
+			log.Fatalf("Invalid tools.output_formatters: %v", err)
+		}
+	}
+
+	for _, name := range cfg.ServerTools {
+		def, err := tools.NewServerTool(name, cfg)
+		if err != nil {
+			log.Fatalf("Invalid tools.server_tools: %v", err)
+		}
+		reg.AddServerTool(def)
+		log.Printf("Server tool %s enabled", name)
+	}
 
-	if cfg.WebSearchEnabled {
-		reg.AddServerTool(anthropic.ToolUnionParam{
-			OfWebSearchTool20250305: &anthropic.WebSearchTool20250305Param{},
-		})
-		log.Println("Web search tool enabled")
+	if cfg.DateTimeEnabled {
+		reg.Register(tools.NewDateTimeTool())
+		log.Println("Datetime tool enabled")
+	}
+
+	if cfg.Base64Enabled {
+		for _, t := range tools.NewBase64Tools() {
+			reg.Register(t)
+		}
+		log.Println("Base64 tools enabled")
+	}
+
+	if cfg.ChartEnabled {
+		reg.Register(tools.NewChartTool())
+		log.Println("Chart tool enabled")
 	}
 
 	if cfg.SandboxDir != "" {
 		if err := os.MkdirAll(cfg.SandboxDir, 0o755); err != nil {
 			log.Fatalf("Failed to create sandbox directory %s: %v", cfg.SandboxDir, err)
 		}
-		for _, t := range tools.NewFilesystemTools(cfg.SandboxDir) {
+		for _, t := range tools.NewFilesystemTools(cfg.SandboxDir, cfg.SandboxPerRoom, cfg.SandboxReadOnly) {
 			reg.Register(t)
 		}
-		log.Printf("Filesystem tools enabled (sandbox: %s)", cfg.SandboxDir)
+		log.Printf("Filesystem tools enabled (sandbox: %s, per room: %v, read-only: %v, ephemeral: %v)", cfg.SandboxDir, cfg.SandboxPerRoom, cfg.SandboxReadOnly, cfg.SandboxEphemeral)
+
+		if cfg.ShellEnabled {
+			reg.Register(tools.NewShellTool(cfg.SandboxDir, cfg.SandboxPerRoom, cfg.ShellAllowed, cfg.ToolTimeout))
+			log.Printf("Shell tool enabled (allowed commands: %v)", cfg.ShellAllowed)
+		}
+	}
+
+	for _, httpCfg := range cfg.HTTPTools {
+		t, err := tools.NewHTTPTool(httpCfg, cfg.ToolTimeout)
+		if err != nil {
+			log.Fatalf("Invalid tools.http_tools: %v", err)
+		}
+		reg.Register(t)
+		log.Printf("HTTP tool %s enabled (%s %s)", httpCfg.Name, httpCfg.Method, httpCfg.URL)
 	}
 
 	var mcpManager *tools.MCPManager
 	if len(cfg.MCPServers) > 0 {
 		mcpManager = tools.NewMCPManager()
 		connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-		if err := mcpManager.Connect(connectCtx, cfg.MCPServers, reg); err != nil {
-			log.Printf("Warning: MCP connection error: %v", err)
-		}
+		mcpManager.Connect(connectCtx, cfg.MCPServers, reg)
 		cancel()
+		for _, s := range mcpManager.Status() {
+			switch {
+			case s.Err == nil:
+				log.Printf("MCP server %q connected: %d tools", s.Name, s.ToolCount)
+			case s.Connected:
+				log.Printf("Warning: MCP server %q connected with %d tools, but: %v", s.Name, s.ToolCount, s.Err)
+			default:
+				log.Printf("Warning: MCP server %q unavailable: %v", s.Name, s.Err)
+			}
+		}
 	}
 
-	b := bot.NewBot(matrixClient, bot.NewClaudeAdapter(), cfg, reg)
+	claude := bot.NewClaudeAdapter()
+	if cfg.Provider == "compat" {
+		claude = bot.NewCompatAdapter(cfg.CompatBaseURL, cfg.CompatAPIKey)
+		log.Printf("Using OpenAI-compatible endpoint %s instead of Anthropic", cfg.CompatBaseURL)
+	}
+	b := bot.NewBot(matrixClient, claude, cfg, reg)
+	if mcpManager != nil {
+		b.SetMCPStatus(mcpManager.Status())
+	}
+	// Room settings are saved in settings.database_path, or alongside the
+	// crypto state when E2EE is on. Otherwise they stay in memory, so a bot
+	// without E2EE doesn't create a database it was never asked for.
+	settingsPath := cfg.SettingsDatabasePath
+	if settingsPath == "" && cfg.PickleKey != "" {
+		settingsPath = cfg.CryptoDatabasePath
+	}
+	if settingsPath != "" {
+		if closeSettings := useSettingsDB(ctx, b, settingsPath); closeSettings != nil {
+			defer closeSettings()
+		}
+	}
+	if cfg.SandboxEphemeral {
+		b.UseEphemeralSandboxes(tools.NewEphemeralSandboxes(cfg.SandboxDir))
+	}
 	bot.RegisterHandlers(matrixClient, b)
+	go reloadOnSighup(ctx, b)
+	if cfg.ConversationTTL > 0 {
+		go b.SweepConversations(ctx, cfg.ConversationTTL)
+	}
+	if cfg.MonitoringSyncTimeout > 0 {
+		go b.WatchSync(ctx, cfg.MonitoringSyncTimeout)
+	}
+	flushed := make(chan struct{})
+	if cfg.ConversationPersistPath != "" && cfg.ConversationFlushInterval > 0 {
+		go func() {
+			b.FlushConversations(ctx, cfg.ConversationFlushInterval)
+			close(flushed)
+		}()
+	} else {
+		close(flushed)
+	}
 
 	log.Printf("Bot started as %s", cfg.UserID)
 
@@ -135,6 +430,8 @@ func main() {
 		log.Fatalf("Sync failed: %v", err)
 	}
 
+	<-flushed
+	b.Close()
 	if mcpManager != nil {
 		mcpManager.Close()
 	}
@@ -1,12 +1,29 @@
 package bot
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"log"
+	"maps"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	_ "golang.org/x/image/webp"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
@@ -17,38 +34,588 @@ import (
 type Bot struct {
 	matrix        MatrixClient
 	claude        ClaudeMessenger
+	configMu      sync.RWMutex
 	config        config.Config
 	conversations *ConversationStore
 	tools         *tools.Registry
+	clock         Clock
 	startTime     time.Time
+	lastReplies   *replyTracker
+	latencies     *latencyTracker
+	reminders     *reminderScheduler
+	tracer        trace.Tracer
+
+	// slots limits how many generations run at once; nil means unlimited.
+	slots chan struct{}
+
+	// joins holds rooms the bot is joining or has joined, so repeated
+	// invite events don't trigger duplicate joins.
+	joins roomSet
+
+	// seen holds recently handled event IDs for handler.dedupe_size.
+	seen seenEvents
+
+	// budget counts today's token usage against claude.daily_token_budget.
+	budget tokenBudget
+
+	// running tracks in-flight generations so "stop" can cancel them.
+	running generationTracker
+
+	// settings holds per-room overrides such as the room's model and
+	// persona, saved to a database once UseSettings is called.
+	settings roomSettings
+
+	// roomRate and userRate count recent answers per room and per sender
+	// for ratelimit.per_room_per_minute and ratelimit.per_user_per_minute.
+	roomRate rateLimiter
+	userRate rateLimiter
+
+	// names caches sender display names for claude.include_sender_name.
+	names displayNameCache
+
+	// roomContexts caches room names and topics for
+	// matrix.include_room_context.
+	roomContexts roomContextCache
+
+	// syncWatch records the last sync for monitoring.sync_timeout.
+	syncWatch syncWatch
+
+	// schedules posts the answers to config schedules; nil without any.
+	schedules *promptScheduler
+
+	// sandboxes holds each conversation's directory when
+	// tools.sandbox_ephemeral is on; nil otherwise.
+	sandboxes *tools.EphemeralSandboxes
+
+	// mcpStatus is how each configured MCP server fared at startup.
+	mcpStatus []tools.MCPServerStatus
+}
+
+// roomSet is a mutex-guarded set of room IDs. The zero value is ready to use.
+type roomSet struct {
+	mu    sync.Mutex
+	rooms map[id.RoomID]struct{}
+}
+
+// add inserts roomID and reports whether it was newly added.
+func (s *roomSet) add(roomID id.RoomID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[roomID]; ok {
+		return false
+	}
+	if s.rooms == nil {
+		s.rooms = make(map[id.RoomID]struct{})
+	}
+	s.rooms[roomID] = struct{}{}
+	return true
+}
+
+func (s *roomSet) remove(roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rooms, roomID)
+}
+
+// errStopped is the cancellation cause when a user stops a generation.
+var errStopped = errors.New("stopped by user")
+
+// errRemovedFromRoom is the cancellation cause when the bot leaves or is
+// removed from the room it was answering in.
+var errRemovedFromRoom = errors.New("removed from room")
+
+// generationTracker holds the cancel func of the latest generation in each
+// conversation, along with the turn that started it. The zero value is
+// ready to use.
+type generationTracker struct {
+	mu      sync.Mutex
+	seq     uint64
+	cancels map[id.EventID]runningGeneration
+}
+
+type runningGeneration struct {
+	seq    uint64
+	turn   turn
+	cancel context.CancelCauseFunc
+}
+
+// start records cancel as the running generation of t's conversation. The
+// returned func forgets it again unless a newer generation has replaced it.
+func (g *generationTracker) start(t turn, cancel context.CancelCauseFunc) (done func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cancels == nil {
+		g.cancels = make(map[id.EventID]runningGeneration)
+	}
+	g.seq++
+	seq := g.seq
+	convID := t.conversationID
+	g.cancels[convID] = runningGeneration{seq: seq, turn: t, cancel: cancel}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.cancels[convID].seq == seq {
+			delete(g.cancels, convID)
+		}
+	}
+}
+
+// stop cancels the conversation's running generation on behalf of by. It
+// reports whether there was one and whether it was stopped: only the
+// generation's requester or an admin may stop it.
+func (g *generationTracker) stop(convID id.EventID, by id.UserID, admin bool) (running, stopped bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gen, ok := g.cancels[convID]
+	if !ok {
+		return false, false
+	}
+	if gen.turn.sender != by && !admin {
+		return true, false
+	}
+	gen.cancel(errStopped)
+	delete(g.cancels, convID)
+	return true, true
+}
+
+// stopRoom cancels every running generation in roomID and returns how many
+// there were.
+func (g *generationTracker) stopRoom(roomID id.RoomID) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stopped := 0
+	for convID, gen := range g.cancels {
+		if gen.turn.roomID == roomID {
+			gen.cancel(errRemovedFromRoom)
+			delete(g.cancels, convID)
+			stopped++
+		}
+	}
+	return stopped
+}
+
+// stopTriggeredBy cancels the running generation that is answering the
+// given message, returning its turn. Only the generation's requester may
+// stop it this way.
+func (g *generationTracker) stopTriggeredBy(eventID id.EventID, requester id.UserID) (turn, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for convID, gen := range g.cancels {
+		if gen.turn.eventID == eventID && gen.turn.sender == requester {
+			gen.cancel(errStopped)
+			delete(g.cancels, convID)
+			return gen.turn, true
+		}
+	}
+	return turn{}, false
+}
+
+const tracerName = "github.com/feline-dis/matrix-claude-bot/internal/bot"
+
+const busyNotice = "⏳ I'm a bit busy, I'll get to this shortly."
+
+const stoppedNotice = "⏹️ Stopped."
+
+// replyTracker remembers the bot's most recent reply in each thread, and
+// the message it answered, for as long as it is the last message there.
+type replyTracker struct {
+	mu      sync.Mutex
+	replies map[id.EventID]trackedReply
+}
+
+// trackedReply is the bot's reply to a question in a thread.
+type trackedReply struct {
+	question id.EventID
+	asker    id.UserID
+	reply    id.EventID
+}
+
+func newReplyTracker() *replyTracker {
+	return &replyTracker{replies: make(map[id.EventID]trackedReply)}
+}
+
+func (r *replyTracker) set(threadID id.EventID, reply trackedReply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replies[threadID] = reply
+}
+
+// answerTo finds the tracked reply to questionID, if asker asked it, and
+// the thread it is in.
+func (r *replyTracker) answerTo(questionID id.EventID, asker id.UserID) (id.EventID, trackedReply, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for threadID, reply := range r.replies {
+		if reply.question == questionID && reply.asker == asker {
+			return threadID, reply, true
+		}
+	}
+	return "", trackedReply{}, false
+}
+
+func (r *replyTracker) clear(threadID id.EventID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.replies, threadID)
+}
+
+// displayNameTTL is how long a looked-up display name is reused before the
+// profile is fetched again.
+const displayNameTTL = time.Hour
+
+// displayNameCache holds recently fetched display names. The zero value is
+// ready to use.
+type displayNameCache struct {
+	mu      sync.Mutex
+	entries map[id.UserID]cachedName
+}
+
+type cachedName struct {
+	name    string
+	fetched time.Time
+}
+
+func (c *displayNameCache) get(userID id.UserID, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[userID]
+	if !ok || now.Sub(e.fetched) >= displayNameTTL {
+		return "", false
+	}
+	return e.name, true
+}
+
+func (c *displayNameCache) set(userID id.UserID, name string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[id.UserID]cachedName)
+	}
+	c.entries[userID] = cachedName{name: name, fetched: now}
+}
+
+// displayName returns the sender's profile display name, falling back to
+// the localpart of their user ID if it isn't set or can't be fetched.
+func (b *Bot) displayName(ctx context.Context, userID id.UserID) string {
+	now := b.clock.Now()
+	if name, ok := b.names.get(userID, now); ok {
+		return name
+	}
+
+	resp, err := b.matrix.GetDisplayName(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to fetch display name for %s: %v", userID, err)
+		return userID.Localpart()
+	}
+	name := strings.Join(strings.Fields(resp.DisplayName), " ")
+	if name == "" {
+		name = userID.Localpart()
+	}
+	b.names.set(userID, name, now)
+	return name
 }
 
 func NewBot(matrix MatrixClient, claude ClaudeMessenger, cfg config.Config, reg *tools.Registry) *Bot {
-	return &Bot{
+	var slots chan struct{}
+	if cfg.MaxConcurrent > 0 {
+		slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+
+	conversations := NewConversationStore()
+	if cfg.ConversationPersistPath != "" {
+		stored, err := NewPersistentConversationStore(cfg.ConversationPersistPath)
+		if err != nil {
+			log.Printf("Warning: could not load conversations, keeping them in memory only: %v", err)
+		} else {
+			conversations = stored
+			if cfg.ConversationFlushInterval > 0 {
+				conversations.BufferWrites(cfg.ConversationFlushThreshold)
+			}
+		}
+	}
+
+	var clock Clock = realClock{}
+	conversations.now = clock.Now
+	conversations.SetMaxThreads(cfg.ConversationMaxThreads)
+	warnMaxTokens(cfg)
+
+	b := &Bot{
 		matrix:        matrix,
 		claude:        claude,
 		config:        cfg,
-		conversations: NewConversationStore(),
+		conversations: conversations,
 		tools:         reg,
-		startTime:     time.Now(),
+		clock:         clock,
+		startTime:     clock.Now(),
+		lastReplies:   newReplyTracker(),
+		latencies:     newLatencyTracker(latencyWindow),
+		tracer:        otel.Tracer(tracerName),
+		slots:         slots,
+	}
+
+	if cfg.RemindersEnabled && reg != nil {
+		var path string
+		if cfg.ConversationPersistPath != "" {
+			path = cfg.ConversationPersistPath + ".reminders"
+		}
+		b.reminders = newReminderScheduler(path, clock, b.postReminder)
+		if err := b.reminders.load(); err != nil {
+			log.Printf("Warning: could not load reminders: %v", err)
+		}
+		reg.Register(&setReminderTool{scheduler: b.reminders})
+		log.Println("Reminder tool enabled")
+	}
+
+	if len(cfg.Schedules) > 0 {
+		b.schedules = newPromptScheduler(cfg.Schedules, clock, b.runScheduledPrompt)
+		log.Printf("Scheduled %d prompt(s)", len(cfg.Schedules))
+	}
+
+	if cfg.HistoryEnabled && reg != nil {
+		reg.Register(&conversationHistoryTool{conversations: conversations})
+		log.Println("Conversation history tool enabled")
+	}
+
+	if cfg.RoomPinsEnabled && reg != nil {
+		reg.Register(&roomPinsTool{bot: b})
+		log.Println("Room pins tool enabled")
 	}
+
+	return b
 }
 
-// RegisterHandlers needs the concrete *mautrix.Client for syncer type-assertion.
-func RegisterHandlers(matrixClient *mautrix.Client, b *Bot) {
-	syncer := matrixClient.Syncer.(*mautrix.DefaultSyncer)
+// SetMCPStatus records the per-server MCP connection results for the status
+// command. Call it before the bot starts handling events.
+func (b *Bot) SetMCPStatus(status []tools.MCPServerStatus) {
+	b.mcpStatus = status
+}
 
-	syncer.OnEventType(event.EventMessage, func(ctx context.Context, evt *event.Event) {
-		go b.handleMessage(ctx, evt)
+// UseEphemeralSandboxes gives each conversation's tool calls its own
+// directory in sandboxes, deleted when the conversation is dropped. Call it
+// before the bot starts handling events.
+func (b *Bot) UseEphemeralSandboxes(sandboxes *tools.EphemeralSandboxes) {
+	b.sandboxes = sandboxes
+	b.conversations.OnDrop(func(convID id.EventID) {
+		sandboxes.Remove(string(convID))
 	})
+}
+
+// Close stops background work owned by the bot and deletes ephemeral
+// sandboxes. Persisted reminders are rescheduled on the next start.
+func (b *Bot) Close() {
+	if b.reminders != nil {
+		b.reminders.stop()
+	}
+	if b.schedules != nil {
+		b.schedules.stop()
+	}
+	if b.sandboxes != nil {
+		b.sandboxes.RemoveAll()
+	}
+}
 
-	syncer.OnEventType(event.StateMember, func(ctx context.Context, evt *event.Event) {
-		b.handleMemberEvent(ctx, evt)
+// toolsConfigChanged reports whether any setting that decides which tools
+// are registered, or how, differs between old and new. Those are only read
+// at startup.
+func toolsConfigChanged(old, new config.Config) bool {
+	return old.WebSearchEnabled != new.WebSearchEnabled ||
+		!slices.Equal(old.ServerTools, new.ServerTools) ||
+		!slices.Equal(old.WebSearchAllowedDomains, new.WebSearchAllowedDomains) ||
+		!slices.Equal(old.WebSearchBlockedDomains, new.WebSearchBlockedDomains) ||
+		old.WebSearchMaxUses != new.WebSearchMaxUses ||
+		old.DateTimeEnabled != new.DateTimeEnabled ||
+		old.Base64Enabled != new.Base64Enabled ||
+		old.ChartEnabled != new.ChartEnabled ||
+		old.RemindersEnabled != new.RemindersEnabled ||
+		old.HistoryEnabled != new.HistoryEnabled ||
+		old.RoomPinsEnabled != new.RoomPinsEnabled ||
+		old.SandboxDir != new.SandboxDir ||
+		old.SandboxPerRoom != new.SandboxPerRoom ||
+		old.SandboxReadOnly != new.SandboxReadOnly ||
+		old.SandboxEphemeral != new.SandboxEphemeral ||
+		old.ToolCacheTTL != new.ToolCacheTTL ||
+		!maps.Equal(old.ToolConcurrency, new.ToolConcurrency) ||
+		!maps.Equal(old.ToolOutputFormatters, new.ToolOutputFormatters) ||
+		old.ShellEnabled != new.ShellEnabled ||
+		!slices.Equal(old.ShellAllowed, new.ShellAllowed) ||
+		!reflect.DeepEqual(old.MCPServers, new.MCPServers) ||
+		!slices.Equal(old.HTTPTools, new.HTTPTools)
+}
+
+// turn identifies the user message being answered, where the bot's replies
+// to it should go, and any per-request overrides.
+type turn struct {
+	roomID       id.RoomID
+	threadRootID id.EventID
+	eventID      id.EventID
+	sender       id.UserID
+	// senderName, when set, is prefixed to the user's message so Claude
+	// knows who is asking.
+	senderName string
+	// conversationID keys the conversation store: the thread root, or the
+	// room itself in room scope.
+	conversationID id.EventID
+
+	// toolChoice overrides the configured tools.tool_choice when non-empty.
+	toolChoice string
+	// temperature overrides the sampling temperature when non-nil.
+	temperature *float64
+	// jsonMode asks for the answer as a single JSON value.
+	jsonMode bool
+	// webSearch offers Claude the web search server tool for this turn even
+	// if it isn't configured.
+	webSearch bool
+	// debug, when set, collects each Claude exchange for the "debug"
+	// command's attachment.
+	debug *debugCapture
+
+	// cfg is the configuration snapshot handleMessage took for the event,
+	// so everything done for the turn sees the same settings even if a
+	// Reload lands midway.
+	cfg config.Config
+}
+
+// cfg returns a snapshot of the current configuration. Handlers should take
+// one snapshot per event so a concurrent Reload can't change settings midway.
+func (b *Bot) cfg() config.Config {
+	b.configMu.RLock()
+	defer b.configMu.RUnlock()
+	return b.config
+}
+
+// Reload swaps in a freshly loaded configuration. Settings that are wired up
+// once at startup (credentials, homeserver, crypto, tool registration) can't
+// change at runtime; differences in those are logged and ignored.
+func (b *Bot) Reload(next config.Config) {
+	b.configMu.Lock()
+	defer b.configMu.Unlock()
+
+	cur := b.config
+	if next.HomeserverURL != cur.HomeserverURL || next.UserID != cur.UserID || next.AccessToken != cur.AccessToken {
+		log.Println("Warning: matrix credential changes require a restart, ignoring")
+	}
+	if next.PickleKey != cur.PickleKey || next.CryptoDatabasePath != cur.CryptoDatabasePath ||
+		next.ShareKeysWith != cur.ShareKeysWith || next.BootstrapCrossSigning != cur.BootstrapCrossSigning ||
+		next.RecoveryKey != cur.RecoveryKey || next.CryptoFailOpen != cur.CryptoFailOpen {
+		log.Println("Warning: crypto setting changes require a restart, ignoring")
+	}
+	if next.MaxConcurrent != cur.MaxConcurrent || next.ConversationTTL != cur.ConversationTTL {
+		log.Println("Warning: handler.max_concurrent and conversation.ttl changes require a restart, ignoring")
+		next.MaxConcurrent, next.ConversationTTL = cur.MaxConcurrent, cur.ConversationTTL
+	}
+	if next.Provider != cur.Provider || next.CompatBaseURL != cur.CompatBaseURL || next.CompatAPIKey != cur.CompatAPIKey {
+		log.Println("Warning: claude.provider and claude.compat changes require a restart, ignoring")
+		next.Provider, next.CompatBaseURL, next.CompatAPIKey = cur.Provider, cur.CompatBaseURL, cur.CompatAPIKey
+	}
+	if next.StopOnReaction != cur.StopOnReaction {
+		log.Println("Warning: handler.stop_on_reaction changes require a restart, ignoring")
+		next.StopOnReaction = cur.StopOnReaction
+	}
+	if next.ConversationPersistPath != cur.ConversationPersistPath ||
+		next.ConversationFlushInterval != cur.ConversationFlushInterval || next.ConversationFlushThreshold != cur.ConversationFlushThreshold {
+		log.Println("Warning: conversation.persist_path, flush_interval and flush_threshold changes require a restart, ignoring")
+		next.ConversationPersistPath = cur.ConversationPersistPath
+		next.ConversationFlushInterval, next.ConversationFlushThreshold = cur.ConversationFlushInterval, cur.ConversationFlushThreshold
+	}
+	if next.TracingEndpoint != cur.TracingEndpoint {
+		log.Println("Warning: tracing.endpoint changes require a restart, ignoring")
+		next.TracingEndpoint = cur.TracingEndpoint
+	}
+	if next.SettingsDatabasePath != cur.SettingsDatabasePath {
+		log.Println("Warning: settings.database_path changes require a restart, ignoring")
+		next.SettingsDatabasePath = cur.SettingsDatabasePath
+	}
+	if toolsConfigChanged(cur, next) {
+		log.Println("Warning: tool registration changes require a restart, ignoring")
+	}
+
+	next.HomeserverURL = cur.HomeserverURL
+	next.UserID = cur.UserID
+	next.AccessToken = cur.AccessToken
+	next.PickleKey = cur.PickleKey
+	next.CryptoDatabasePath = cur.CryptoDatabasePath
+	next.ShareKeysWith = cur.ShareKeysWith
+	next.BootstrapCrossSigning = cur.BootstrapCrossSigning
+	next.RecoveryKey = cur.RecoveryKey
+	next.CryptoFailOpen = cur.CryptoFailOpen
+	next.WebSearchEnabled = cur.WebSearchEnabled
+	next.ServerTools = cur.ServerTools
+	next.WebSearchAllowedDomains = cur.WebSearchAllowedDomains
+	next.WebSearchBlockedDomains = cur.WebSearchBlockedDomains
+	next.WebSearchMaxUses = cur.WebSearchMaxUses
+	next.DateTimeEnabled = cur.DateTimeEnabled
+	next.Base64Enabled = cur.Base64Enabled
+	next.ChartEnabled = cur.ChartEnabled
+	next.RemindersEnabled = cur.RemindersEnabled
+	next.HistoryEnabled = cur.HistoryEnabled
+	next.RoomPinsEnabled = cur.RoomPinsEnabled
+	next.SandboxDir = cur.SandboxDir
+	next.SandboxPerRoom = cur.SandboxPerRoom
+	next.SandboxReadOnly = cur.SandboxReadOnly
+	next.SandboxEphemeral = cur.SandboxEphemeral
+	next.ToolCacheTTL = cur.ToolCacheTTL
+	next.ToolConcurrency = cur.ToolConcurrency
+	next.ToolOutputFormatters = cur.ToolOutputFormatters
+	next.ShellEnabled = cur.ShellEnabled
+	next.ShellAllowed = cur.ShellAllowed
+	next.MCPServers = cur.MCPServers
+	next.HTTPTools = cur.HTTPTools
+	if next.DisplayName != cur.DisplayName || next.AvatarURL != cur.AvatarURL {
+		log.Println("Warning: matrix.display_name and matrix.avatar_url changes require a restart, ignoring")
+		next.DisplayName, next.AvatarURL = cur.DisplayName, cur.AvatarURL
+	}
+	if !slices.Equal(next.Schedules, cur.Schedules) {
+		log.Println("Warning: schedules changes require a restart, ignoring")
+		next.Schedules = cur.Schedules
+	}
+	if next.MonitoringSyncTimeout != cur.MonitoringSyncTimeout {
+		log.Println("Warning: monitoring.sync_timeout changes require a restart, ignoring")
+		next.MonitoringSyncTimeout = cur.MonitoringSyncTimeout
+	}
+
+	b.conversations.SetMaxThreads(next.ConversationMaxThreads)
+	warnMaxTokens(next)
+	b.config = next
+	log.Println("Configuration reloaded")
+}
+
+// SweepConversations periodically evicts conversations idle for longer than
+// ttl, until ctx is done.
+func (b *Bot) SweepConversations(ctx context.Context, ttl time.Duration) {
+	for b.wait(ctx, max(ttl/2, time.Minute)) {
+		if n := b.conversations.EvictIdle(ttl); n > 0 {
+			log.Printf("Evicted %d idle conversation(s)", n)
+		}
+	}
+}
+
+// FlushConversations writes buffered conversation changes to disk every
+// interval until ctx is done, then flushes once more.
+func (b *Bot) FlushConversations(ctx context.Context, interval time.Duration) {
+	for b.wait(ctx, interval) {
+		b.conversations.Flush()
+	}
+	b.conversations.Flush()
+}
+
+// RegisterHandlers needs the concrete *mautrix.Client for syncer type-assertion.
+func RegisterHandlers(matrixClient *mautrix.Client, b *Bot) {
+	syncer := matrixClient.Syncer.(*mautrix.DefaultSyncer)
+	b.registerHandlers(syncer)
+	syncer.OnSync(func(context.Context, *mautrix.RespSync, string) bool {
+		b.recordSync()
+		return true
 	})
 }
 
 func (b *Bot) handleMessage(ctx context.Context, evt *event.Event) {
-	if evt.Sender == b.config.UserID {
+	cfg := b.cfg()
+	if !b.seen.add(evt.ID, cfg.DedupeSize) {
+		log.Printf("Ignoring %s in %s: already handled", evt.ID, evt.RoomID)
+		return
+	}
+
+	if evt.Sender == cfg.UserID {
 		return
 	}
 
@@ -56,17 +623,16 @@ func (b *Bot) handleMessage(ctx context.Context, evt *event.Event) {
 		return
 	}
 
-	msg := evt.Content.AsMessage()
-	if msg == nil {
+	if !roomAllowed(cfg.AllowedRooms, evt.RoomID) {
 		return
 	}
 
-	if !b.isMentioned(msg) {
+	if cfg.IgnoreBotSenders && looksLikeBot(evt.Sender) {
 		return
 	}
 
-	userText := stripMention(msg.Body, b.config.UserID)
-	if userText == "" {
+	msg := evt.Content.AsMessage()
+	if msg == nil {
 		return
 	}
 
@@ -75,20 +641,400 @@ func (b *Bot) handleMessage(ctx context.Context, evt *event.Event) {
 		threadRootID = msg.RelatesTo.EventID
 	}
 
-	response, err := b.getClaudeResponse(ctx, threadRootID, userText)
+	// With handler.edit_on_correction, editing the message the bot has
+	// just answered is a correction: the edited text is answered and the
+	// bot's reply is edited to match instead of a new one being posted.
+	var correcting trackedReply
+	if replaced := msg.RelatesTo.GetReplaceID(); replaced != "" && cfg.EditOnCorrection && msg.NewContent != nil {
+		if threadID, last, ok := b.lastReplies.answerTo(replaced, evt.Sender); ok {
+			correcting, threadRootID, msg = last, threadID, msg.NewContent
+		}
+	}
+
+	if !b.isMentioned(cfg, msg) {
+		// Someone else spoke in the thread, so the bot's reply is no
+		// longer the latest message there.
+		b.lastReplies.clear(threadRootID)
+		return
+	}
+
+	// A plain reply can root the new thread at the message it answers
+	// instead, keeping the discussion of that message together.
+	if cfg.ThreadRoot == "reply_target" && threadRootID == evt.ID {
+		if target := msg.RelatesTo.GetReplyTo(); target != "" {
+			threadRootID = target
+		}
+	}
+
+	switch msg.MsgType {
+	case event.MsgText, event.MsgEmote:
+	case event.MsgNotice:
+		// Notices are how bots talk; answering them risks bot loops.
+		if !cfg.RespondToNotices {
+			return
+		}
+	default:
+		return
+	}
+
+	msg.RemoveReplyFallback()
+	userText := stripMention(msg.Body, cfg.UserID)
+	if userText == "" {
+		return
+	}
+
+	ctx, span := b.tracer.Start(ctx, "handleMessage", trace.WithAttributes(
+		attribute.String("matrix.room_id", evt.RoomID.String()),
+		attribute.String("matrix.thread_id", threadRootID.String()),
+		attribute.String("matrix.event_id", evt.ID.String()),
+	))
+	defer span.End()
+
+	t := turn{roomID: evt.RoomID, threadRootID: threadRootID, eventID: evt.ID, sender: evt.Sender, conversationID: threadRootID, cfg: cfg}
+	if correcting.reply != "" {
+		// Anything sent rather than edited answers the original message.
+		t.eventID = correcting.question
+	}
+	if cfg.ConversationScope == "room" {
+		// Room and event IDs have different sigils, so they can't collide
+		// as store keys.
+		t.conversationID = id.EventID(evt.RoomID)
+	}
+
+	// Commands that report or change settings answer without calling Claude.
+	if rest, ok := cutCommand(userText, "status"); ok && rest == "" {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.statusReport(cfg))
+		return
+	}
+	if rest, ok := cutCommand(userText, "limits"); ok && rest == "" {
+		reply := "The limits command is only available to admins."
+		if slices.Contains(cfg.Admins, evt.Sender) {
+			reply = b.limitsReport(cfg)
+		}
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, reply)
+		return
+	}
+	if rest, ok := cutCommand(userText, "tools"); ok && rest == "" {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.toolListing(cfg))
+		return
+	}
+	if rest, ok := cutCommand(userText, "pending"); ok && rest == "" {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.pendingToolState(t.conversationID))
+		return
+	}
+	if text, ok := cutCommand(userText, "persona"); ok {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.setPersona(t, text))
+		return
+	}
+	if rest, ok := cutCommand(userText, "model-info"); ok && rest == "" {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.modelInfo(t))
+		return
+	}
+	if name, ok := cutCommand(userText, "model"); ok {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.selectModel(t, name))
+		return
+	}
+	if name, ok := cutCommand(userText, "room-model"); ok {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.selectRoomModel(t, name, slices.Contains(cfg.Admins, evt.Sender)))
+		return
+	}
+	if text, ok := cutCommand(userText, "room-persona"); ok {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, b.setRoomPersona(t, text, slices.Contains(cfg.Admins, evt.Sender)))
+		return
+	}
+	if rest, ok := cutCommand(userText, "stop"); ok && rest == "" {
+		var reply string
+		switch running, stopped := b.running.stop(t.conversationID, evt.Sender, slices.Contains(cfg.Admins, evt.Sender)); {
+		case stopped:
+			reply = stoppedNotice
+		case running:
+			reply = "Only the person who asked, or an admin, can stop this answer."
+		default:
+			reply = "There's nothing running in this thread to stop."
+		}
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, reply)
+		return
+	}
+
+	// The rate limits only cover answers: commands that don't call Claude
+	// stay available, so an admin can still check limits or stop an answer.
+	// Replying to a flooding room would only add to the flood.
+	if !b.roomRate.allow(string(evt.RoomID), b.clock.Now(), cfg.RoomRepliesPerMinute) {
+		log.Printf("Room %s is over ratelimit.per_room_per_minute, dropping %s", evt.RoomID, evt.ID)
+		return
+	}
+	if !b.userRate.allow(string(evt.Sender), b.clock.Now(), cfg.UserRepliesPerMinute) {
+		log.Printf("User %s is over ratelimit.per_user_per_minute, dropping %s", evt.Sender, evt.ID)
+		return
+	}
+
+	if rest, ok := cutCommand(userText, "debug"); ok && rest != "" {
+		if !slices.Contains(cfg.Admins, evt.Sender) {
+			b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, "The debug command is only available to admins.")
+			return
+		}
+		t.debug = &debugCapture{}
+		userText = rest
+	}
+	if rest, ok := cutCommand(userText, "json"); ok && rest != "" {
+		t.jsonMode = true
+		userText = rest
+	}
+	if rest, ok := cutCommand(userText, "nocode"); ok && rest != "" {
+		t.toolChoice = "none"
+		userText = rest
+	}
+	if rest, ok := cutCommand(userText, "search"); ok && rest != "" {
+		if slices.Contains(cfg.DisabledTools, "web_search") {
+			b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, "Web search is disabled on this bot.")
+			return
+		}
+		t.webSearch = true
+		userText = rest
+	}
+	if mode, ok := cutCommand(userText, "retry"); ok {
+		text, temperature, err := b.prepareRetry(t.conversationID, mode)
+		if err != nil {
+			b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, err.Error())
+			return
+		}
+		userText, t.temperature = text, temperature
+	} else if cfg.IncludeSenderName {
+		// A retried message already carries the name from its first run.
+		t.senderName = b.displayName(ctx, evt.Sender)
+	}
+
+	if rule, ok := matchDelegation(cfg.Delegation, userText); ok {
+		b.delegate(ctx, cfg, t, rule.Target, userText)
+		return
+	}
+
+	if limit := cfg.DailyTokenBudget; limit > 0 && b.budget.usedToday(b.clock.Now()) >= limit {
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, budgetNotice)
+		return
+	}
+
+	genCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer b.running.start(t, cancel)()
+	ctx = genCtx
+
+	release, ok := b.acquireSlot(ctx, t, cfg.QueueNoticeDelay)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if rest, ok := cutCommand(userText, "summarize"); ok && rest == "" {
+		summary, err := b.summarizeThread(ctx, t)
+		if errors.Is(err, errNothingToSummarize) {
+			summary = err.Error()
+		} else if err != nil {
+			log.Printf("Summarize failed: %v", err)
+			summary = "Sorry, I couldn't summarize this thread."
+		} else {
+			summary = "📝 Thread summarized; I'll continue from this:\n\n" + summary
+		}
+		b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, summary)
+		return
+	}
+
+	question := userText
+	if quoted := b.quotedContext(ctx, cfg, evt.RoomID, msg); quoted != "" {
+		userText = quoted + "\n\n" + userText
+	}
+
+	// A correction's answer replaces the previous one, so a placeholder
+	// would be left behind.
+	var thinking *thinkingPlaceholder
+	if correcting.reply != "" {
+		thinking = b.startThinking(ctx, t, 0)
+	} else {
+		thinking = b.startThinking(ctx, t, cfg.ThinkingNoticeDelay)
+	}
+
+	var response string
+	var err error
+	if t.jsonMode {
+		response, err = b.getJSONResponse(ctx, t, userText)
+	} else {
+		response, err = b.getClaudeResponse(ctx, t, userText)
+	}
+	placeholderID := thinking.finish()
+	if errors.Is(context.Cause(ctx), errStopped) {
+		// The stop command has already replied; just make sure the
+		// thread isn't left with tool calls that never got results.
+		b.conversations.HealDanglingToolUses(t.conversationID, interruptedToolResult)
+		if placeholderID != "" {
+			b.editReply(context.WithoutCancel(ctx), t.cfg, t.roomID, placeholderID, thinkingStoppedNotice)
+		}
+		return
+	}
 	if err != nil {
 		log.Printf("Claude API error: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "claude request failed")
 		response = "Sorry, I encountered an error generating a response."
 	}
+	// JSON answers go out exactly as Claude gave them, so they stay
+	// parseable.
+	if !t.jsonMode {
+		if cfg.QuoteQuestion {
+			response = quoteQuestion(question) + "\n\n" + response
+		}
+		response = b.decorateReply(cfg, response)
+	}
+
+	answered := trackedReply{question: t.eventID, asker: evt.Sender}
+	if correcting.reply != "" {
+		b.editReplyBody(ctx, t.roomID, correcting.reply, response)
+		b.lastReplies.set(threadRootID, correcting)
+	} else if placeholderID != "" {
+		b.editReplyBody(ctx, t.roomID, placeholderID, response)
+		answered.reply = placeholderID
+		b.lastReplies.set(threadRootID, answered)
+	} else if answered.reply = b.sendReplyBody(ctx, cfg, t.roomID, t.threadRootID, t.eventID, response); answered.reply != "" {
+		b.lastReplies.set(threadRootID, answered)
+	}
+
+	if t.debug != nil {
+		if err := b.sendDebugDump(ctx, t); err != nil {
+			log.Printf("Failed to send debug dump in %s: %v", t.roomID, err)
+		}
+	}
+}
+
+// quotedContext fetches the message the user replied to, if any, and
+// describes it so Claude knows what "this" refers to. Thread fallback
+// replies and the bot's own messages are already in the conversation and
+// are skipped.
+func (b *Bot) quotedContext(ctx context.Context, cfg config.Config, roomID id.RoomID, msg *event.MessageEventContent) string {
+	replyTo := msg.RelatesTo.GetNonFallbackReplyTo()
+	if replyTo == "" {
+		return ""
+	}
+
+	evt, err := b.fetchEvent(ctx, roomID, replyTo)
+	if err != nil {
+		log.Printf("Failed to fetch replied-to event %s: %v", replyTo, err)
+		return ""
+	}
+	if evt.Sender == cfg.UserID {
+		return ""
+	}
+
+	quoted := evt.Content.AsMessage()
+	if quoted == nil || quoted.Body == "" {
+		return ""
+	}
+	quoted.RemoveReplyFallback()
+	return fmt.Sprintf("The user is referring to this message from %s:\n%s", evt.Sender, quoteLines(quoted.Body))
+}
+
+// errCannotDecrypt is returned by fetchEvent for encrypted events when the
+// bot has no crypto helper to decrypt them with.
+var errCannotDecrypt = errors.New("event is encrypted and E2EE is not enabled")
+
+// fetchEvent fetches an event and parses its content, decrypting it first
+// if needed.
+func (b *Bot) fetchEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := b.matrix.GetEvent(ctx, roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if err := evt.Content.ParseRaw(evt.Type); err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	if evt.Type == event.EventEncrypted {
+		// Only a real client has the keys to decrypt with.
+		client, ok := b.matrix.(*mautrix.Client)
+		if !ok || client.Crypto == nil {
+			return nil, errCannotDecrypt
+		}
+		if evt, err = client.Crypto.Decrypt(ctx, evt); err != nil {
+			return nil, fmt.Errorf("decrypt: %w", err)
+		}
+	}
+	return evt, nil
+}
+
+// maxQuotedQuestion bounds the matrix.quote_question snippet, in runes.
+const maxQuotedQuestion = 120
+
+// quoteQuestion returns the question as a one-line "> " quote, shortened to
+// maxQuotedQuestion runes.
+func quoteQuestion(question string) string {
+	question = strings.Join(strings.Fields(question), " ")
+	if runes := []rune(question); len(runes) > maxQuotedQuestion {
+		question = string(runes[:maxQuotedQuestion]) + "…"
+	}
+	return quoteLines(question)
+}
+
+// quoteLines prefixes every line of text with "> ".
+func quoteLines(text string) string {
+	return "> " + strings.ReplaceAll(text, "\n", "\n> ")
+}
+
+// acquireSlot waits for a free generation slot. If none frees up within
+// noticeDelay, the user is told their request is queued. It returns false if
+// ctx is canceled while waiting.
+func (b *Bot) acquireSlot(ctx context.Context, t turn, noticeDelay time.Duration) (release func(), ok bool) {
+	if b.slots == nil {
+		return func() {}, true
+	}
+	release = func() { <-b.slots }
+
+	select {
+	case b.slots <- struct{}{}:
+		return release, true
+	default:
+	}
 
-	b.sendThreadReply(ctx, evt.RoomID, threadRootID, evt.ID, response)
+	fired := make(chan struct{})
+	timer := b.clock.AfterFunc(noticeDelay, func() { close(fired) })
+	defer timer.Stop()
+	var notice <-chan struct{} = fired
+
+	for {
+		select {
+		case b.slots <- struct{}{}:
+			return release, true
+		case <-notice:
+			notice = nil
+			b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, busyNotice)
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
 }
 
 func (b *Bot) handleMemberEvent(ctx context.Context, evt *event.Event) {
-	if evt.GetStateKey() != b.config.UserID.String() {
+	cfg := b.cfg()
+	if evt.GetStateKey() != cfg.UserID.String() {
+		return
+	}
+	switch membership := evt.Content.AsMember().Membership; membership {
+	case event.MembershipInvite:
+	case event.MembershipLeave, event.MembershipBan:
+		b.forgetRoom(evt.RoomID, evt.Sender, membership)
+		return
+	default:
 		return
 	}
-	if evt.Content.AsMember().Membership != event.MembershipInvite {
+	if !roomAllowed(cfg.AllowedRooms, evt.RoomID) {
+		log.Printf("Ignoring invite to %s from %s: room not in allowed_rooms", evt.RoomID, evt.Sender)
+		return
+	}
+	if len(cfg.AllowedInviters) == 0 && len(cfg.AllowedInviteHosts) == 0 {
+		log.Printf("Warning: accepting invite from %s because no autojoin_allowed_inviters or autojoin_allowed_servers are set", evt.Sender)
+	} else if !inviterAllowed(cfg.AllowedInviters, cfg.AllowedInviteHosts, evt.Sender) {
+		log.Printf("Ignoring invite to %s from %s: inviter not trusted", evt.RoomID, evt.Sender)
+		return
+	}
+
+	if !b.joins.add(evt.RoomID) {
+		log.Printf("Ignoring duplicate invite to %s from %s", evt.RoomID, evt.Sender)
 		return
 	}
 
@@ -97,21 +1043,66 @@ func (b *Bot) handleMemberEvent(ctx context.Context, evt *event.Event) {
 	_, err := b.matrix.JoinRoomByID(ctx, evt.RoomID)
 	if err != nil {
 		log.Printf("Failed to join room %s: %v", evt.RoomID, err)
+		b.joins.remove(evt.RoomID)
 		return
 	}
 
 	log.Printf("Joined room %s", evt.RoomID)
 }
 
-func (b *Bot) isMentioned(msg *event.MessageEventContent) bool {
+// forgetRoom clears the bot's state for a room it has left or been kicked
+// or banned from: running answers, conversations and their settings, the
+// room's own settings, and pending reminders. A later invite can then be
+// accepted afresh.
+func (b *Bot) forgetRoom(roomID id.RoomID, sender id.UserID, membership event.Membership) {
+	b.joins.remove(roomID)
+	stopped := b.running.stopRoom(roomID)
+	dropped := b.conversations.DropRoom(roomID)
+	b.settings.clearRoom(roomID)
+	cancelled := 0
+	if b.reminders != nil {
+		cancelled = b.reminders.cancelRoom(roomID)
+	}
+	log.Printf("Membership in %s is now %s (by %s): stopped %d answer(s), dropped %d conversation(s), cancelled %d reminder(s)",
+		roomID, membership, sender, stopped, dropped, cancelled)
+}
+
+// isMentioned reports whether msg is addressed to the bot. An @room
+// broadcast counts only if it also lists the bot in its mentions, so the
+// bot's ID merely appearing in the text doesn't make it answer an
+// announcement, and with matrix.ignore_broadcasts it never counts.
+func (b *Bot) isMentioned(cfg config.Config, msg *event.MessageEventContent) bool {
 	if msg.Mentions != nil {
-		for _, uid := range msg.Mentions.UserIDs {
-			if uid == b.config.UserID {
-				return true
-			}
+		if msg.Mentions.Room && cfg.IgnoreBroadcasts {
+			return false
+		}
+		if slices.Contains(msg.Mentions.UserIDs, cfg.UserID) {
+			return true
+		}
+		if msg.Mentions.Room {
+			return false
 		}
 	}
-	return strings.Contains(msg.Body, b.config.UserID.String())
+	return strings.Contains(msg.Body, cfg.UserID.String())
+}
+
+// roomAllowed reports whether the bot may operate in roomID. An empty
+// allowlist permits every room.
+func roomAllowed(allowed []id.RoomID, roomID id.RoomID) bool {
+	return len(allowed) == 0 || slices.Contains(allowed, roomID)
+}
+
+// inviterAllowed reports whether sender is listed in users or is on one of
+// servers.
+func inviterAllowed(users []id.UserID, servers []string, sender id.UserID) bool {
+	return slices.Contains(users, sender) || slices.Contains(servers, sender.Homeserver())
+}
+
+// looksLikeBot guesses from the localpart whether a user is another bot,
+// e.g. @helperbot:example.com or @bot-github:example.com.
+func looksLikeBot(userID id.UserID) bool {
+	local := strings.ToLower(userID.Localpart())
+	return strings.HasPrefix(local, "bot") || strings.HasSuffix(local, "bot")
 }
 
 func stripMention(body string, userID id.UserID) string {
@@ -119,13 +1110,74 @@ func stripMention(body string, userID id.UserID) string {
 	return strings.TrimSpace(cleaned)
 }
 
-func (b *Bot) sendThreadReply(ctx context.Context, roomID id.RoomID, threadRootID, replyToID id.EventID, text string) {
+// matchDelegation returns the first rule whose keyword appears in text,
+// ignoring case.
+func matchDelegation(rules []config.DelegationRule, text string) (config.DelegationRule, bool) {
+	lower := strings.ToLower(text)
+	for _, rule := range rules {
+		if strings.Contains(lower, strings.ToLower(rule.Keyword)) {
+			return rule, true
+		}
+	}
+	return config.DelegationRule{}, false
+}
+
+// delegate hands the request to another bot by posting it in the thread
+// with a mention of target, instead of answering it.
+func (b *Bot) delegate(ctx context.Context, cfg config.Config, t turn, target id.UserID, text string) {
 	content := &event.MessageEventContent{
-		MsgType: event.MsgText,
-		Body:    text,
+		MsgType:   event.MsgText,
+		Body:      fmt.Sprintf("%s %s", target, text),
+		Mentions:  &event.Mentions{UserIDs: []id.UserID{target}},
+		RelatesTo: b.replyRelation(cfg, t.threadRootID, t.eventID),
 	}
+	if _, err := b.sendMessage(ctx, t.roomID, content); err != nil {
+		log.Printf("Failed to delegate %s to %s: %v", t.eventID, target, err)
+	}
+}
 
-	content.RelatesTo = &event.RelatesTo{
+// sendThreadReply posts text in the thread, decorated and attached to the
+// room as cfg says, and returns the new event's ID, or "" if sending failed.
+func (b *Bot) sendThreadReply(ctx context.Context, cfg config.Config, roomID id.RoomID, threadRootID, replyToID id.EventID, text string) id.EventID {
+	return b.sendReplyBody(ctx, cfg, roomID, threadRootID, replyToID, b.decorateReply(cfg, text))
+}
+
+// sendReplyBody is sendThreadReply without the reply prefix and suffix,
+// attached to the room as cfg says.
+func (b *Bot) sendReplyBody(ctx context.Context, cfg config.Config, roomID id.RoomID, threadRootID, replyToID id.EventID, body string) id.EventID {
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          body,
+		Format:        event.FormatHTML,
+		FormattedBody: formatReply(body),
+	}
+
+	content.RelatesTo = b.replyRelation(cfg, threadRootID, replyToID)
+
+	resp, err := b.sendMessage(ctx, roomID, content)
+	if err != nil {
+		log.Printf("Failed to send reply in %s: %v", roomID, err)
+		return ""
+	}
+	return resp.EventID
+}
+
+// replyRelation returns how a reply to replyToID attaches to the room,
+// following matrix.reply_style: in the thread (the default), as a rich
+// reply, or not at all.
+func (b *Bot) replyRelation(cfg config.Config, threadRootID, replyToID id.EventID) *event.RelatesTo {
+	switch cfg.ReplyStyle {
+	case "reply":
+		return &event.RelatesTo{InReplyTo: &event.InReplyTo{EventID: replyToID}}
+	case "plain":
+		return nil
+	default:
+		return threadRelation(threadRootID, replyToID)
+	}
+}
+
+func threadRelation(threadRootID, replyToID id.EventID) *event.RelatesTo {
+	return &event.RelatesTo{
 		Type:    event.RelThread,
 		EventID: threadRootID,
 		InReplyTo: &event.InReplyTo{
@@ -133,9 +1185,102 @@ func (b *Bot) sendThreadReply(ctx context.Context, roomID id.RoomID, threadRootI
 		},
 		IsFallingBack: true,
 	}
+}
+
+// sendImage uploads an image and posts it as an m.image reply in the turn's
+// thread. When E2EE is enabled the file is encrypted before upload, since
+// the bot may be posting into an encrypted room.
+func (b *Bot) sendImage(ctx context.Context, t turn, name string, data []byte, mimeType string) error {
+	cfg := t.cfg
+	info := &event.FileInfo{MimeType: mimeType, Size: len(data)}
+	if img, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = img.Width, img.Height
+	}
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgImage,
+		Body:     name,
+		FileName: name,
+		Info:     info,
+	}
+
+	if err := b.uploadAttachment(ctx, cfg, content, data, mimeType); err != nil {
+		return err
+	}
+
+	// Large images get a downscaled thumbnail; clients show small ones
+	// as they are.
+	if thumb, thumbInfo, ok := makeThumbnail(data); ok {
+		url, file, err := b.uploadMedia(ctx, cfg, thumb, thumbInfo.MimeType)
+		if err != nil {
+			log.Printf("Failed to upload thumbnail for %s: %v", name, err)
+		} else {
+			info.ThumbnailInfo = thumbInfo
+			info.ThumbnailURL = url
+			info.ThumbnailFile = file
+		}
+	}
 
-	_, err := b.matrix.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+	content.RelatesTo = b.replyRelation(cfg, t.threadRootID, t.eventID)
+	if _, err := b.sendMessage(ctx, t.roomID, content); err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+	return nil
+}
+
+// uploadAttachment uploads data and points content at it, encrypting it
+// first when E2EE is on.
+func (b *Bot) uploadAttachment(ctx context.Context, cfg config.Config, content *event.MessageEventContent, data []byte, mimeType string) error {
+	url, file, err := b.uploadMedia(ctx, cfg, data, mimeType)
 	if err != nil {
-		log.Printf("Failed to send reply in %s: %v", roomID, err)
+		return err
+	}
+	content.URL, content.File = url, file
+	return nil
+}
+
+// uploadMedia uploads data, returning its plain URL or, when E2EE is on,
+// the encrypted file it was uploaded as.
+func (b *Bot) uploadMedia(ctx context.Context, cfg config.Config, data []byte, mimeType string) (id.ContentURIString, *event.EncryptedFileInfo, error) {
+	if cfg.PickleKey != "" {
+		file := attachment.NewEncryptedFile()
+		encrypted := bytes.Clone(data)
+		file.EncryptInPlace(encrypted)
+		resp, err := b.matrix.UploadBytes(ctx, encrypted, "application/octet-stream")
+		if err != nil {
+			return "", nil, fmt.Errorf("upload failed: %w", err)
+		}
+		return "", &event.EncryptedFileInfo{EncryptedFile: *file, URL: resp.ContentURI.CUString()}, nil
+	}
+	resp, err := b.matrix.UploadBytes(ctx, data, mimeType)
+	if err != nil {
+		return "", nil, fmt.Errorf("upload failed: %w", err)
+	}
+	return resp.ContentURI.CUString(), nil, nil
+}
+
+// decorateReply wraps text in the reply prefix and suffix cfg sets.
+func (b *Bot) decorateReply(cfg config.Config, text string) string {
+	return cfg.ReplyPrefix + text + cfg.ReplySuffix
+}
+
+// editReply replaces the text of a message the bot previously sent,
+// decorated as cfg says.
+func (b *Bot) editReply(ctx context.Context, cfg config.Config, roomID id.RoomID, targetID id.EventID, text string) {
+	b.editReplyBody(ctx, roomID, targetID, b.decorateReply(cfg, text))
+}
+
+// editReplyBody is editReply without the reply prefix and suffix.
+func (b *Bot) editReplyBody(ctx context.Context, roomID id.RoomID, targetID id.EventID, body string) {
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          body,
+		Format:        event.FormatHTML,
+		FormattedBody: formatReply(body),
+	}
+	content.SetEdit(targetID)
+
+	_, err := b.sendMessage(ctx, roomID, content)
+	if err != nil {
+		log.Printf("Failed to edit %s in %s: %v", targetID, roomID, err)
 	}
 }
@@ -3,6 +3,10 @@ package bot
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,6 +14,9 @@ import (
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+	"github.com/feline-dis/matrix-claude-bot/internal/tools"
 )
 
 // --- stripMention tests ---
@@ -47,7 +54,7 @@ func TestIsMentioned_ViaUserIDs(t *testing.T) {
 		Body:     "hello",
 		Mentions: &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}},
 	}
-	if !bot.isMentioned(msg) {
+	if !bot.isMentioned(bot.cfg(), msg) {
 		t.Error("expected mention via UserIDs")
 	}
 }
@@ -57,7 +64,7 @@ func TestIsMentioned_ViaBodyText(t *testing.T) {
 	msg := &event.MessageEventContent{
 		Body: "hi @bot:example.com",
 	}
-	if !bot.isMentioned(msg) {
+	if !bot.isMentioned(bot.cfg(), msg) {
 		t.Error("expected mention via body text")
 	}
 }
@@ -67,7 +74,7 @@ func TestIsMentioned_NotMentioned(t *testing.T) {
 	msg := &event.MessageEventContent{
 		Body: "hello",
 	}
-	if bot.isMentioned(msg) {
+	if bot.isMentioned(bot.cfg(), msg) {
 		t.Error("expected no mention")
 	}
 }
@@ -78,7 +85,7 @@ func TestIsMentioned_DifferentUser(t *testing.T) {
 		Body:     "hello",
 		Mentions: &event.Mentions{UserIDs: []id.UserID{"@other:example.com"}},
 	}
-	if bot.isMentioned(msg) {
+	if bot.isMentioned(bot.cfg(), msg) {
 		t.Error("expected no mention for different user")
 	}
 }
@@ -89,11 +96,43 @@ func TestIsMentioned_EmptyMentions(t *testing.T) {
 		Body:     "hello",
 		Mentions: &event.Mentions{},
 	}
-	if bot.isMentioned(msg) {
+	if bot.isMentioned(bot.cfg(), msg) {
 		t.Error("expected no mention with empty Mentions struct")
 	}
 }
 
+func TestIsMentioned_Broadcast(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	explicit := &event.MessageEventContent{
+		Body:     "@room heads up, @bot:example.com please summarize",
+		Mentions: &event.Mentions{Room: true, UserIDs: []id.UserID{"@bot:example.com"}},
+	}
+	if !bot.isMentioned(bot.cfg(), explicit) {
+		t.Error("expected a broadcast that also mentions the bot to count")
+	}
+
+	// The bot's ID in the text of an announcement isn't enough.
+	broadcast := &event.MessageEventContent{
+		Body:     "@room new bot @bot:example.com is live",
+		Mentions: &event.Mentions{Room: true},
+	}
+	if bot.isMentioned(bot.cfg(), broadcast) {
+		t.Error("expected a broadcast without an explicit mention to be ignored")
+	}
+
+	bot.config.IgnoreBroadcasts = true
+	if bot.isMentioned(bot.cfg(), explicit) {
+		t.Error("expected matrix.ignore_broadcasts to ignore broadcasts entirely")
+	}
+	direct := &event.MessageEventContent{
+		Body:     "hello",
+		Mentions: &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}},
+	}
+	if !bot.isMentioned(bot.cfg(), direct) {
+		t.Error("matrix.ignore_broadcasts should not affect ordinary mentions")
+	}
+}
+
 // --- handleMessage tests ---
 
 func TestHandleMessage_IgnoresSelf(t *testing.T) {
@@ -127,6 +166,77 @@ func TestHandleMessage_IgnoresOldMessages(t *testing.T) {
 	}
 }
 
+func TestHandleMessage_IgnoresRedeliveredEvent(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.DedupeSize = 2
+
+	mention := func(eventID id.EventID) {
+		bot.handleMessage(context.Background(), makeMessageEvent("@user:example.com", "!room:example.com", eventID, 2000,
+			"@bot:example.com hello",
+			&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil))
+	}
+	mention("$evt1")
+	mention("$evt1")
+
+	if len(claude.capturedParams) != 1 {
+		t.Errorf("expected 1 Claude call, got %d", len(claude.capturedParams))
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Errorf("expected 1 reply, got %d", len(matrix.sentEvents))
+	}
+
+	// Only the last two events are remembered, so $evt1 is forgotten.
+	mention("$evt2")
+	mention("$evt3")
+	mention("$evt1")
+	if len(claude.capturedParams) != 4 {
+		t.Errorf("expected an event past the dedupe size to be answered again, got %d Claude calls", len(claude.capturedParams))
+	}
+}
+
+func TestHandleMessage_ThreadRoot(t *testing.T) {
+	reply := &event.RelatesTo{InReplyTo: &event.InReplyTo{EventID: "$target"}}
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root", InReplyTo: &event.InReplyTo{EventID: "$target"}, IsFallingBack: true}
+
+	tests := []struct {
+		name       string
+		threadRoot string
+		relatesTo  *event.RelatesTo
+		want       id.EventID
+	}{
+		{"mention mode, plain reply", "mention", reply, "$evt1"},
+		{"reply_target mode, plain reply", "reply_target", reply, "$target"},
+		{"reply_target mode, not a reply", "reply_target", nil, "$evt1"},
+		{"reply_target mode, already threaded", "reply_target", inThread, "$root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matrix := &mockMatrixClient{}
+			claude := &mockClaudeMessenger{}
+			bot := newTestBot(matrix, claude)
+			bot.config.ThreadRoot = tt.threadRoot
+
+			sendMention(bot, "$evt1", "what about this?", tt.relatesTo)
+
+			if len(matrix.sentEvents) != 1 {
+				t.Fatalf("expected 1 reply, got %d", len(matrix.sentEvents))
+			}
+			rel := matrix.sentEvents[0].Content.(*event.MessageEventContent).RelatesTo
+			if rel == nil || rel.Type != event.RelThread || rel.EventID != tt.want {
+				t.Fatalf("expected a reply in the thread rooted at %s, got %+v", tt.want, rel)
+			}
+			if rel.InReplyTo == nil || rel.InReplyTo.EventID != "$evt1" {
+				t.Errorf("expected the reply to answer the mention, got %+v", rel.InReplyTo)
+			}
+			if got := len(bot.conversations.Get(tt.want)); got != 2 {
+				t.Errorf("expected the conversation stored under %s, got %d messages", tt.want, got)
+			}
+		})
+	}
+}
+
 func TestHandleMessage_IgnoresNoMention(t *testing.T) {
 	matrix := &mockMatrixClient{}
 	claude := &mockClaudeMessenger{}
@@ -315,13 +425,54 @@ func TestHandleMemberEvent_JoinError(t *testing.T) {
 	// Should not panic; joinedRooms still has the room because our mock appends before checking func
 }
 
+func TestHandleMemberEvent_BanClearsRoomState(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	invite := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+	bot.handleMemberEvent(context.Background(), invite)
+
+	sendMention(bot, "$root", "hello", nil)
+	bot.conversations.SetPersona("$root", "a pirate")
+	other := makeMessageEvent("@user:example.com", "!other:example.com", "$elsewhere", 2000,
+		"@bot:example.com hello", &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+	bot.handleMessage(context.Background(), other)
+
+	ban := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipBan)
+	bot.handleMemberEvent(context.Background(), ban)
+
+	if len(bot.conversations.Get("$root")) != 0 || bot.conversations.Persona("$root") != "" {
+		t.Error("conversation in the room the bot was banned from should be cleared")
+	}
+	if len(bot.conversations.Get("$elsewhere")) == 0 {
+		t.Error("conversations in other rooms should be kept")
+	}
+
+	// Being invited back joins again rather than being treated as a duplicate.
+	bot.handleMemberEvent(context.Background(), invite)
+	if len(matrix.joinedRooms) != 2 {
+		t.Errorf("expected a fresh join after the ban, got %d join calls", len(matrix.joinedRooms))
+	}
+}
+
+func TestHandleMemberEvent_IgnoresOtherUserLeaving(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	sendMention(bot, "$root", "hello", nil)
+
+	leave := makeMemberEvent("@user:example.com", "!room:example.com", "@user:example.com", event.MembershipLeave)
+	bot.handleMemberEvent(context.Background(), leave)
+
+	if len(bot.conversations.Get("$root")) == 0 {
+		t.Error("another user leaving should not clear the bot's conversations")
+	}
+}
+
 // --- sendThreadReply tests ---
 
 func TestSendThreadReply_CorrectContent(t *testing.T) {
 	matrix := &mockMatrixClient{}
 	bot := newTestBot(matrix, &mockClaudeMessenger{})
 
-	bot.sendThreadReply(context.Background(), "!room:example.com", "$root", "$reply-to", "hello world")
+	bot.sendThreadReply(context.Background(), bot.cfg(), "!room:example.com", "$root", "$reply-to", "hello world")
 
 	if len(matrix.sentEvents) != 1 {
 		t.Fatalf("expected 1 sent event, got %d", len(matrix.sentEvents))
@@ -371,7 +522,224 @@ func TestSendThreadReply_SendError(t *testing.T) {
 	bot := newTestBot(matrix, &mockClaudeMessenger{})
 
 	// Should not panic
-	bot.sendThreadReply(context.Background(), "!room:example.com", "$root", "$reply-to", "hello")
+	bot.sendThreadReply(context.Background(), bot.cfg(), "!room:example.com", "$root", "$reply-to", "hello")
+}
+
+func TestHandleMessage_IncludeSenderName(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		matrix := &mockMatrixClient{displayNames: map[id.UserID]string{"@user:example.com": "Alice"}}
+		claude := &mockClaudeMessenger{}
+		bot := newTestBot(matrix, claude)
+		bot.config.IncludeSenderName = enabled
+
+		sendMention(bot, "$root", "hello", nil)
+		sendMention(bot, "$second", "again", nil)
+
+		text := claude.capturedParams[0].Messages[0].Content[0].OfText.Text
+		if enabled && text != "[Alice]: hello" {
+			t.Errorf("expected sender annotation, got %q", text)
+		}
+		if !enabled && text != "hello" {
+			t.Errorf("expected no sender annotation when disabled, got %q", text)
+		}
+		wantLookups := 0
+		if enabled {
+			wantLookups = 1 // the second message uses the cache
+		}
+		if matrix.displayNameLookups != wantLookups {
+			t.Errorf("enabled=%v: %d profile lookups, want %d", enabled, matrix.displayNameLookups, wantLookups)
+		}
+	}
+}
+
+func TestDisplayName_FallsBackToLocalpart(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	if got := bot.displayName(context.Background(), "@bob:example.com"); got != "bob" {
+		t.Errorf("displayName = %q, want localpart", got)
+	}
+}
+
+func TestHandleMessage_StopCancelsGeneration(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	started := make(chan struct{})
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	done := make(chan struct{})
+	go func() {
+		sendMention(bot, "$root", "write me a novel", nil)
+		close(done)
+	}()
+	<-started
+
+	sendMention(bot, "$stop", "stop", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation was not canceled")
+	}
+
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected only the stop confirmation, got %d events", len(matrix.sentEvents))
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; body != stoppedNotice {
+		t.Errorf("expected stop confirmation, got %q", body)
+	}
+}
+
+func TestHandleMessage_StopByAnotherUser(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			close(started)
+			select {
+			case <-release:
+				return makeClaudeResponse("the novel"), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	done := make(chan struct{})
+	go func() {
+		sendMention(bot, "$root", "write me a novel", nil)
+		close(done)
+	}()
+	<-started
+
+	bot.handleMessage(context.Background(), makeMessageEvent("@bob:example.com", "!room:example.com", "$stop", 2000,
+		"@bot:example.com stop", &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}},
+		&event.RelatesTo{Type: event.RelThread, EventID: "$root"}))
+	close(release)
+	<-done
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected a refusal and the answer, got %d events", len(matrix.sentEvents))
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; !strings.Contains(body, "Only the person who asked") {
+		t.Errorf("expected a refusal, got %q", body)
+	}
+	if body := matrix.sentEvents[1].Content.(*event.MessageEventContent).Body; body != "the novel" {
+		t.Errorf("the answer should not have been stopped, got %q", body)
+	}
+}
+
+func TestHandleMessage_StopWithNothingRunning(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "stop", nil)
+
+	if len(claude.capturedParams) != 0 {
+		t.Error("stop should not reach Claude")
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; !strings.Contains(body, "nothing running") {
+		t.Errorf("unexpected reply: %q", body)
+	}
+}
+
+func TestHandleMessage_DailyTokenBudget(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			resp := makeClaudeResponse("answer")
+			resp.Usage = anthropic.Usage{InputTokens: 60, OutputTokens: 40}
+			return resp, nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.DailyTokenBudget = 150
+	clock := bot.clock.(*fakeClock)
+	clock.Advance(23 * time.Hour) // 23:00 UTC on the first day
+
+	reply := func(n int) string {
+		return matrix.sentEvents[n].Content.(*event.MessageEventContent).Body
+	}
+
+	sendMention(bot, "$one", "first", nil)  // 100 used, under budget
+	sendMention(bot, "$two", "second", nil) // 200 used, over budget
+	sendMention(bot, "$three", "third", nil)
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 Claude calls before the budget ran out, got %d", len(claude.capturedParams))
+	}
+	if reply(2) != budgetNotice {
+		t.Errorf("expected budget notice, got %q", reply(2))
+	}
+
+	clock.Advance(time.Hour) // midnight UTC
+	sendMention(bot, "$four", "fourth", nil)
+	if len(claude.capturedParams) != 3 {
+		t.Error("budget should reset at the day boundary")
+	}
+	if reply(3) != "answer" {
+		t.Errorf("expected a normal answer after reset, got %q", reply(3))
+	}
+}
+
+func TestSendThreadReply_ReplyStyles(t *testing.T) {
+	tests := []struct {
+		style string
+		check func(t *testing.T, rel *event.RelatesTo)
+	}{
+		{"thread", func(t *testing.T, rel *event.RelatesTo) {
+			if rel == nil || rel.Type != event.RelThread || rel.EventID != "$root" || rel.InReplyTo.EventID != "$msg" || !rel.IsFallingBack {
+				t.Errorf("expected thread relation with reply fallback, got %+v", rel)
+			}
+		}},
+		{"reply", func(t *testing.T, rel *event.RelatesTo) {
+			if rel == nil || rel.Type != "" || rel.EventID != "" || rel.InReplyTo == nil || rel.InReplyTo.EventID != "$msg" {
+				t.Errorf("expected a plain rich reply, got %+v", rel)
+			}
+		}},
+		{"plain", func(t *testing.T, rel *event.RelatesTo) {
+			if rel != nil {
+				t.Errorf("expected no relation, got %+v", rel)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.style, func(t *testing.T) {
+			matrix := &mockMatrixClient{}
+			bot := newTestBot(matrix, &mockClaudeMessenger{})
+			bot.config.ReplyStyle = tt.style
+
+			bot.sendThreadReply(context.Background(), bot.cfg(), "!room:example.com", "$root", "$msg", "hi")
+
+			tt.check(t, matrix.sentEvents[0].Content.(*event.MessageEventContent).RelatesTo)
+		})
+	}
+}
+
+func TestSendThreadReply_EscapesHTML(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	text := "Use <script>alert(1)</script> & friends"
+	bot.sendThreadReply(context.Background(), bot.cfg(), "!room:example.com", "$root", "$root", text)
+
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.Body != text {
+		t.Errorf("Body should stay plaintext, got %q", content.Body)
+	}
+	if content.Format != event.FormatHTML {
+		t.Errorf("expected HTML format, got %q", content.Format)
+	}
+	want := "Use &lt;script&gt;alert(1)&lt;/script&gt; &amp; friends"
+	if content.FormattedBody != want {
+		t.Errorf("FormattedBody = %q, want %q", content.FormattedBody, want)
+	}
 }
 
 // --- handleMessage timing edge case ---
@@ -380,9 +748,9 @@ func TestHandleMessage_ExactStartTime(t *testing.T) {
 	matrix := &mockMatrixClient{}
 	claude := &mockClaudeMessenger{}
 	bot := newTestBot(matrix, claude)
-	bot.startTime = time.UnixMilli(2000)
+	start := bot.clock.Now().UnixMilli()
 
-	evt := makeMessageEvent("@user:example.com", "!room:example.com", "$evt1", 2000,
+	evt := makeMessageEvent("@user:example.com", "!room:example.com", "$evt1", start,
 		"@bot:example.com hello",
 		&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
 	bot.handleMessage(context.Background(), evt)
@@ -392,3 +760,1386 @@ func TestHandleMessage_ExactStartTime(t *testing.T) {
 		t.Error("message at exact start time should be processed")
 	}
 }
+
+func TestHandleMessage_OneMillisecondBeforeStart(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	start := bot.clock.Now().UnixMilli()
+
+	evt := makeMessageEvent("@user:example.com", "!room:example.com", "$evt1", start-1,
+		"@bot:example.com hello",
+		&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+	bot.handleMessage(context.Background(), evt)
+
+	if len(claude.capturedParams) != 0 {
+		t.Error("message sent before start should be ignored")
+	}
+}
+
+func TestHandleMessage_CutoffStaysAtStartAsClockAdvances(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	clock := bot.clock.(*fakeClock)
+	start := clock.Now().UnixMilli()
+	clock.Advance(time.Hour)
+
+	// Delivered late (e.g. after a slow initial sync) but sent after startup.
+	evt := makeMessageEvent("@user:example.com", "!room:example.com", "$evt1", start+1,
+		"@bot:example.com hello",
+		&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+	bot.handleMessage(context.Background(), evt)
+
+	if len(claude.capturedParams) != 1 {
+		t.Error("message sent after start should be processed however late it arrives")
+	}
+}
+
+// --- Reload tests ---
+
+func TestReload_UpdatesSystemPrompt(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.SystemPrompt = "Old prompt."
+
+	next := bot.cfg()
+	next.SystemPrompt = "New prompt."
+	bot.Reload(next)
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	params := claude.capturedParams[0]
+	if len(params.System) == 0 || params.System[0].Text != "New prompt." {
+		t.Errorf("expected reloaded system prompt, got %v", params.System)
+	}
+}
+
+func TestReload_IgnoresImmutableFields(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	bot.config.AccessToken = "old-token"
+
+	next := bot.cfg()
+	next.UserID = "@other:example.com"
+	next.AccessToken = "new-token"
+	next.MaxConcurrent = 8
+	next.ConversationTTL = time.Hour
+	next.ChartEnabled = true
+	next.CryptoFailOpen = true
+	next.TracingEndpoint = "localhost:4318"
+	next.ConversationFlushInterval = time.Minute
+	next.Model = "claude-opus-4-20250514"
+	bot.Reload(next)
+
+	cfg := bot.cfg()
+	if cfg.UserID != "@bot:example.com" || cfg.AccessToken != "old-token" {
+		t.Errorf("immutable fields changed: user=%s token=%s", cfg.UserID, cfg.AccessToken)
+	}
+	if cfg.MaxConcurrent != 0 || cfg.ConversationTTL != 0 || cfg.ChartEnabled {
+		t.Errorf("restart-only fields changed: max_concurrent=%d ttl=%s chart=%v", cfg.MaxConcurrent, cfg.ConversationTTL, cfg.ChartEnabled)
+	}
+	if cfg.CryptoFailOpen || cfg.TracingEndpoint != "" || cfg.ConversationFlushInterval != 0 {
+		t.Errorf("restart-only fields changed: fail_open=%v tracing=%q flush_interval=%s", cfg.CryptoFailOpen, cfg.TracingEndpoint, cfg.ConversationFlushInterval)
+	}
+	if cfg.Model != "claude-opus-4-20250514" {
+		t.Errorf("expected model to be reloaded, got %s", cfg.Model)
+	}
+}
+
+func TestToolsConfigChanged_EditedMCPServer(t *testing.T) {
+	old := config.Config{MCPServers: []config.MCPServerConfig{{Name: "files", Command: "mcp-files", Args: []string{"/srv"}}}}
+	next := config.Config{MCPServers: []config.MCPServerConfig{{Name: "files", Command: "mcp-files", Args: []string{"/home"}}}}
+	if !toolsConfigChanged(old, next) {
+		t.Error("an edited MCP server should count as a tool registration change")
+	}
+	if toolsConfigChanged(old, old) {
+		t.Error("identical configs should not count as a change")
+	}
+}
+
+// --- Edit on correction tests ---
+
+func sendMention(bot *Bot, eventID id.EventID, body string, relatesTo *event.RelatesTo) {
+	evt := makeMessageEvent("@user:example.com", "!room:example.com", eventID, 2000,
+		"@bot:example.com "+body,
+		&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, relatesTo)
+	bot.handleMessage(context.Background(), evt)
+}
+
+func TestHandleMessage_RoomRateLimit(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.RoomRepliesPerMinute = 2
+
+	for _, evtID := range []id.EventID{"$evt1", "$evt2", "$evt3"} {
+		sendMention(bot, evtID, "hello", nil)
+	}
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 answered messages, got %d", len(claude.capturedParams))
+	}
+	if len(matrix.sentEvents) != 2 {
+		t.Errorf("the dropped message should get no reply, got %d messages", len(matrix.sentEvents))
+	}
+
+	// Another room has its own allowance.
+	other := makeMessageEvent("@user:example.com", "!other:example.com", "$evt4", 2000,
+		"@bot:example.com hello", &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+	bot.handleMessage(context.Background(), other)
+	if len(claude.capturedParams) != 3 {
+		t.Errorf("a different room should be unaffected, got %d calls", len(claude.capturedParams))
+	}
+
+	// Once the window has passed, the room is answered again.
+	bot.clock.(*fakeClock).Advance(time.Minute)
+	sendMention(bot, "$evt5", "hello", nil)
+	if len(claude.capturedParams) != 4 {
+		t.Errorf("expected the room to be answered after a minute, got %d calls", len(claude.capturedParams))
+	}
+}
+
+func TestHandleMessage_LimitsCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.UserRepliesPerMinute = 2
+	bot.config.Admins = []id.UserID{"@user:example.com"}
+
+	sendMention(bot, "$evt1", "hello", nil)
+	bot.clock.(*fakeClock).Advance(15 * time.Second)
+	sendMention(bot, "$evt2", "hello", nil)
+	sendMention(bot, "$evt3", "hello", nil)
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected the third message over the user limit, got %d calls", len(claude.capturedParams))
+	}
+
+	askLimits := func(sender id.UserID, eventID id.EventID) string {
+		before := len(matrix.sentEvents)
+		bot.handleMessage(context.Background(), makeMessageEvent(sender, "!room:example.com", eventID, 2000,
+			"@bot:example.com limits", &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil))
+		if len(matrix.sentEvents) != before+1 {
+			t.Fatalf("expected one reply to %s, got %d", sender, len(matrix.sentEvents)-before)
+		}
+		return matrix.sentEvents[before].Content.(*event.MessageEventContent).Body
+	}
+
+	if reply := askLimits("@bob:example.com", "$evt4"); !strings.Contains(reply, "only available to admins") {
+		t.Errorf("non-admins should be refused, got %q", reply)
+	}
+
+	// The admin is over the limit, but commands don't count against it,
+	// and neither did bob's.
+	report := askLimits("@user:example.com", "$evt5")
+	for _, want := range []string{
+		"Rooms: no limit.",
+		"Users (2 per minute):\n- @user:example.com: 0 left, next refill in 45s (00:01:01 UTC)",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report should contain %q, got:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "@bob:example.com") {
+		t.Errorf("commands should not use up the sender's answers, got:\n%s", report)
+	}
+}
+
+func TestCheckSync_AlertsOncePerStall(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.MonitoringAdminRoom = "!admin:example.com"
+	clock := bot.clock.(*fakeClock)
+	ctx := context.Background()
+
+	bot.recordSync()
+	clock.Advance(4 * time.Minute)
+	bot.checkSync(ctx, 5*time.Minute)
+	if len(matrix.sentEvents) != 0 {
+		t.Fatalf("no alert expected before the timeout, got %d", len(matrix.sentEvents))
+	}
+
+	// The stall outlasts several checks but is reported once.
+	for range 3 {
+		clock.Advance(2 * time.Minute)
+		bot.checkSync(ctx, 5*time.Minute)
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(matrix.sentEvents))
+	}
+	alert := matrix.sentEvents[0]
+	body := alert.Content.(*event.MessageEventContent).Body
+	if alert.RoomID != "!admin:example.com" || !strings.Contains(body, "has not synced") {
+		t.Errorf("unexpected alert in %s: %q", alert.RoomID, body)
+	}
+
+	// Syncing again is announced, and a later stall alerts anew.
+	bot.recordSync()
+	bot.checkSync(ctx, 5*time.Minute)
+	if len(matrix.sentEvents) != 2 || !strings.Contains(matrix.sentEvents[1].Content.(*event.MessageEventContent).Body, "syncing again") {
+		t.Fatalf("expected a recovery notice, got %d messages", len(matrix.sentEvents))
+	}
+	clock.Advance(5 * time.Minute)
+	bot.checkSync(ctx, 5*time.Minute)
+	if len(matrix.sentEvents) != 3 {
+		t.Errorf("expected a second stall to alert again, got %d messages", len(matrix.sentEvents))
+	}
+}
+
+func TestHandleMessage_Delegation(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.Delegation = []config.DelegationRule{{Keyword: "deploy", Target: "@deploybot:example.com"}}
+
+	sendMention(bot, "$evt1", "please Deploy the staging branch", nil)
+	if len(claude.capturedParams) != 0 {
+		t.Fatalf("a delegated message should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected one delegation message, got %d", len(matrix.sentEvents))
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.Body != "@deploybot:example.com please Deploy the staging branch" {
+		t.Errorf("unexpected delegation body: %q", content.Body)
+	}
+	if content.Mentions == nil || !slices.Equal(content.Mentions.UserIDs, []id.UserID{"@deploybot:example.com"}) {
+		t.Errorf("delegation should mention the target, got %+v", content.Mentions)
+	}
+	if content.RelatesTo == nil || content.RelatesTo.EventID != "$evt1" {
+		t.Error("delegation should be posted in the thread")
+	}
+
+	sendMention(bot, "$evt2", "what is 2+2?", nil)
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("a non-matching message should be answered by Claude, got %d calls", len(claude.capturedParams))
+	}
+}
+
+// sendCorrection edits the user's message target to say body, mentioning
+// the bot.
+func sendCorrection(bot *Bot, eventID, target id.EventID, body string) {
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     "@bot:example.com " + body,
+		Mentions: &event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}},
+	}
+	content.SetEdit(target)
+	bot.handleMessage(context.Background(), &event.Event{
+		Sender:    "@user:example.com",
+		RoomID:    "!room:example.com",
+		ID:        eventID,
+		Timestamp: 2000,
+		Content:   event.Content{Parsed: content},
+	})
+}
+
+func TestHandleMessage_EditOnCorrection(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.EditOnCorrection = true
+
+	sendMention(bot, "$root", "what is 2+2?", nil)
+	sendCorrection(bot, "$edit", "$root", "what is 2*3?")
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected 2 sent events, got %d", len(matrix.sentEvents))
+	}
+	history := claude.capturedParams[1].Messages
+	if got := history[len(history)-1].Content[0].OfText.Text; got != "what is 2*3?" {
+		t.Errorf("expected the edited question to be answered, got %q", got)
+	}
+	edit := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if edit.RelatesTo == nil || edit.RelatesTo.Type != event.RelReplace {
+		t.Fatalf("expected m.replace relation, got %+v", edit.RelatesTo)
+	}
+	if edit.RelatesTo.EventID != "$reply" {
+		t.Errorf("edit should target the previous reply, got %s", edit.RelatesTo.EventID)
+	}
+	if edit.NewContent == nil || edit.NewContent.Body != "mock response" {
+		t.Error("edit should carry the new answer in m.new_content")
+	}
+}
+
+func TestHandleMessage_FollowUpIsNotACorrection(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.EditOnCorrection = true
+
+	sendMention(bot, "$root", "what is 2+2?", nil)
+	sendMention(bot, "$evt2", "and 3+3?", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+
+	second := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if second.RelatesTo == nil || second.RelatesTo.Type != event.RelThread {
+		t.Errorf("expected a fresh thread reply to a new question, got %+v", second.RelatesTo)
+	}
+}
+
+func TestHandleMessage_CorrectionKeepsDebugDump(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.EditOnCorrection = true
+	bot.config.Admins = []id.UserID{"@user:example.com"}
+
+	sendMention(bot, "$root", "what is 2+2?", nil)
+	sendCorrection(bot, "$edit", "$root", "debug what is 2*3?")
+
+	if len(matrix.sentEvents) != 3 {
+		t.Fatalf("expected the answer, its edit and a debug dump, got %d events", len(matrix.sentEvents))
+	}
+	if edit := matrix.sentEvents[1].Content.(*event.MessageEventContent); edit.RelatesTo.GetReplaceID() != "$reply" {
+		t.Errorf("expected the answer to be edited, got %+v", edit.RelatesTo)
+	}
+	if dump := matrix.sentEvents[2].Content.(*event.MessageEventContent); dump.MsgType != event.MsgFile {
+		t.Errorf("expected a debug dump after the edit, got %s", dump.MsgType)
+	}
+}
+
+func TestHandleMessage_NoEditWhenDisabled(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	sendMention(bot, "$root", "what is 2+2?", nil)
+	sendCorrection(bot, "$edit", "$root", "what is 2*3?")
+
+	second := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if second.RelatesTo.GetReplaceID() != "" {
+		t.Errorf("expected a fresh reply, got %+v", second.RelatesTo)
+	}
+}
+
+func TestHandleMessage_NoEditAfterInterveningMessage(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.EditOnCorrection = true
+
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root"}
+	sendMention(bot, "$root", "what is 2+2?", nil)
+	bot.handleMessage(context.Background(), makeMessageEvent("@other:example.com", "!room:example.com", "$chat", 2000, "thanks!", nil, inThread))
+	sendCorrection(bot, "$edit", "$root", "what is 2*3?")
+
+	second := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if second.RelatesTo.GetReplaceID() != "" {
+		t.Errorf("expected a fresh reply, got %+v", second.RelatesTo)
+	}
+}
+
+func TestHandleMessage_QuoteQuestion(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	sendMention(bot, "$evt1", "what is 2+2?", nil)
+	bot.config.QuoteQuestion = true
+	sendMention(bot, "$evt2", "what is\n3+3?", nil)
+	long := strings.Repeat("very ", 30) + "long question"
+	sendMention(bot, "$evt3", long, nil)
+
+	bodies := make([]string, len(matrix.sentEvents))
+	for i, evt := range matrix.sentEvents {
+		bodies[i] = evt.Content.(*event.MessageEventContent).Body
+	}
+	if bodies[0] != "mock response" {
+		t.Errorf("answers should not quote the question by default, got %q", bodies[0])
+	}
+	if bodies[1] != "> what is 3+3?\n\nmock response" {
+		t.Errorf("expected the question quoted on one line, got %q", bodies[1])
+	}
+	want := "> " + strings.Repeat("very ", 24) + "…\n\nmock response"
+	if bodies[2] != want {
+		t.Errorf("expected the long question truncated, got %q", bodies[2])
+	}
+}
+
+func TestSendThreadReply_RetriesWhenRateLimited(t *testing.T) {
+	limited := mautrix.HTTPError{
+		Response: &http.Response{StatusCode: http.StatusTooManyRequests},
+		RespError: &mautrix.RespError{
+			ErrCode:   "M_LIMIT_EXCEEDED",
+			ExtraData: map[string]any{"errcode": "M_LIMIT_EXCEEDED", "retry_after_ms": float64(1500)},
+		},
+	}
+	var mu sync.Mutex
+	attempts := 0
+	matrix := &mockMatrixClient{
+		sendMessageEventFunc: func(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts == 1 {
+				return nil, limited
+			}
+			return &mautrix.RespSendEvent{EventID: "$reply"}, nil
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	clock := bot.clock.(*fakeClock)
+
+	sent := make(chan id.EventID)
+	go func() {
+		sent <- bot.sendThreadReply(context.Background(), bot.cfg(), "!room:example.com", "$thread", "$thread", "answer")
+	}()
+
+	clock.waitForTimer(t)
+	clock.Advance(time.Second)
+	select {
+	case <-sent:
+		t.Fatal("retried before the suggested 1.5s backoff")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clock.Advance(500 * time.Millisecond)
+
+	if eventID := <-sent; eventID != "$reply" {
+		t.Errorf("expected the reply delivered on retry, got %q", eventID)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 send attempts, got %d", attempts)
+	}
+}
+
+func TestHandleMessage_ThinkingPlaceholder(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	var bot *Bot
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			bot.clock.(*fakeClock).Advance(6 * time.Second) // a slow generation
+			return makeClaudeResponse("the answer"), nil
+		},
+	}
+	bot = newTestBot(matrix, claude)
+	bot.config.ThinkingNoticeDelay = 5 * time.Second
+
+	sendMention(bot, "$evt1", "hello", nil)
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected a placeholder and its edit, got %d events", len(matrix.sentEvents))
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; body != thinkingNotice {
+		t.Errorf("expected the placeholder first, got %q", body)
+	}
+	edit := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if edit.RelatesTo == nil || edit.RelatesTo.Type != event.RelReplace || edit.RelatesTo.EventID != "$reply" {
+		t.Fatalf("expected an edit of the placeholder, got %+v", edit.RelatesTo)
+	}
+	if edit.NewContent == nil || edit.NewContent.Body != "the answer" {
+		t.Error("the edit should carry the answer")
+	}
+}
+
+func TestHandleMessage_NoThinkingPlaceholderForFastAnswers(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.ThinkingNoticeDelay = 5 * time.Second
+
+	sendMention(bot, "$evt1", "hello", nil)
+	bot.clock.(*fakeClock).Advance(time.Minute)
+
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected just the answer, got %d events", len(matrix.sentEvents))
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; body != "mock response" {
+		t.Errorf("expected the answer, got %q", body)
+	}
+}
+
+// --- Concurrency limit tests ---
+
+func TestHandleMessage_QueuedNoticeWhenSaturated(t *testing.T) {
+	sent := make(chan struct{}, 2)
+	matrix := &mockMatrixClient{
+		sendMessageEventFunc: func(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error) {
+			sent <- struct{}{}
+			return &mautrix.RespSendEvent{EventID: "$reply"}, nil
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	clock := bot.clock.(*fakeClock)
+	bot.config.QueueNoticeDelay = 10 * time.Second
+	bot.slots = make(chan struct{}, 1)
+	bot.slots <- struct{}{} // saturate
+
+	done := make(chan struct{})
+	go func() {
+		sendMention(bot, "$evt1", "hello", nil)
+		close(done)
+	}()
+
+	clock.waitForTimer(t)
+	clock.Advance(10 * time.Second)
+	<-sent      // the notice
+	<-bot.slots // free the slot
+	<-done
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected notice and answer, got %d events", len(matrix.sentEvents))
+	}
+	notice := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if notice.Body != busyNotice {
+		t.Errorf("expected busy notice first, got %q", notice.Body)
+	}
+	answer := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if answer.Body != "mock response" {
+		t.Errorf("expected answer second, got %q", answer.Body)
+	}
+}
+
+func TestSweepConversations_EvictsOnTheClock(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	clock := bot.clock.(*fakeClock)
+	bot.conversations.now = clock.Now
+	bot.conversations.Append("$old", anthropic.NewUserMessage(anthropic.NewTextBlock("hi")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		bot.SweepConversations(ctx, time.Hour)
+		close(done)
+	}()
+
+	clock.waitForTimer(t)
+	clock.Advance(2 * time.Hour)
+	clock.waitForTimer(t) // rearmed after sweeping
+	if got := bot.conversations.Len(); got != 0 {
+		t.Errorf("expected the idle thread to be swept, %d left", got)
+	}
+	cancel()
+	<-done
+}
+
+func TestHandleMessage_NoQueuedNoticeWhenSlotFree(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.QueueNoticeDelay = 10 * time.Millisecond
+	bot.slots = make(chan struct{}, 1)
+
+	sendMention(bot, "$evt1", "hello", nil)
+
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected only the answer, got %d events", len(matrix.sentEvents))
+	}
+	if len(bot.slots) != 0 {
+		t.Error("slot should be released after the reply")
+	}
+}
+
+// --- Message type tests ---
+
+func makeTypedMention(msgType event.MessageType, body string) *event.Event {
+	evt := makeMessageEvent("@user:example.com", "!room:example.com", "$evt1", 2000,
+		"@bot:example.com "+body,
+		&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+	evt.Content.Parsed.(*event.MessageEventContent).MsgType = msgType
+	return evt
+}
+
+func TestHandleMessage_Emote(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	bot.handleMessage(context.Background(), makeTypedMention(event.MsgEmote, "waves hello"))
+
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected emote to be processed, got %d Claude calls", len(claude.capturedParams))
+	}
+	text := claude.capturedParams[0].Messages[0].Content[0].OfText.Text
+	if text != "waves hello" {
+		t.Errorf("expected mention stripped from emote, got %q", text)
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Errorf("expected a reply, got %d events", len(matrix.sentEvents))
+	}
+}
+
+func TestHandleMessage_IgnoresNonTextTypes(t *testing.T) {
+	for _, msgType := range []event.MessageType{event.MsgNotice, event.MsgImage, event.MsgFile} {
+		t.Run(string(msgType), func(t *testing.T) {
+			claude := &mockClaudeMessenger{}
+			bot := newTestBot(&mockMatrixClient{}, claude)
+
+			bot.handleMessage(context.Background(), makeTypedMention(msgType, "hello"))
+
+			if len(claude.capturedParams) != 0 {
+				t.Errorf("should not respond to %s", msgType)
+			}
+		})
+	}
+}
+
+func TestHandleMessage_NoticeWhenEnabled(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.RespondToNotices = true
+
+	bot.handleMessage(context.Background(), makeTypedMention(event.MsgNotice, "hello"))
+
+	if len(claude.capturedParams) != 1 {
+		t.Error("expected notice to be processed when respond_to_notices is set")
+	}
+}
+
+func TestHandleMessage_IgnoreBotSenders(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.IgnoreBotSenders = true
+
+	for _, sender := range []id.UserID{"@helperbot:example.com", "@bot-github:example.com"} {
+		evt := makeMessageEvent(sender, "!room:example.com", "$evt1", 2000,
+			"@bot:example.com hello",
+			&event.Mentions{UserIDs: []id.UserID{"@bot:example.com"}}, nil)
+		bot.handleMessage(context.Background(), evt)
+	}
+	if len(claude.capturedParams) != 0 {
+		t.Errorf("expected bot senders to be ignored, got %d calls", len(claude.capturedParams))
+	}
+
+	sendMention(bot, "$evt2", "hello", nil)
+	if len(claude.capturedParams) != 1 {
+		t.Error("expected human sender to be processed")
+	}
+}
+
+// --- Retry command tests ---
+
+func TestHandleMessage_RetryCreative(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root"}
+	sendMention(bot, "$root", "write a haiku", nil)
+	sendMention(bot, "$evt2", "retry creative", inThread)
+
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 Claude calls, got %d", len(claude.capturedParams))
+	}
+	retry := claude.capturedParams[1]
+	if !retry.Temperature.Valid() || retry.Temperature.Value != 1.0 {
+		t.Errorf("expected creative temperature 1.0, got %+v", retry.Temperature)
+	}
+	if len(retry.Messages) != 1 || retry.Messages[0].Content[0].OfText.Text != "write a haiku" {
+		t.Errorf("retry should resend only the prior user turn, got %d messages", len(retry.Messages))
+	}
+	if claude.capturedParams[0].Temperature.Valid() {
+		t.Error("normal requests should not set a temperature")
+	}
+}
+
+func TestHandleMessage_RetryPreciseAndDefault(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root"}
+	sendMention(bot, "$root", "question", nil)
+	sendMention(bot, "$evt2", "retry precise", inThread)
+	sendMention(bot, "$evt3", "retry", inThread)
+
+	if got := claude.capturedParams[1].Temperature; !got.Valid() || got.Value != 0.2 {
+		t.Errorf("expected precise temperature 0.2, got %+v", got)
+	}
+	if claude.capturedParams[2].Temperature.Valid() {
+		t.Error("plain retry should use the default temperature")
+	}
+	if n := len(bot.conversations.Get("$root")); n != 2 {
+		t.Errorf("history should hold one user/assistant pair after retries, got %d", n)
+	}
+}
+
+func TestHandleMessage_RetryNothingToRetry(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$evt1", "retry", nil)
+
+	if len(claude.capturedParams) != 0 {
+		t.Error("should not call Claude with nothing to retry")
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if !strings.Contains(content.Body, "nothing to retry") {
+		t.Errorf("unexpected reply: %q", content.Body)
+	}
+}
+
+// --- Allowed rooms tests ---
+
+func TestHandleMessage_DisallowedRoom(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.AllowedRooms = []id.RoomID{"!other:example.com"}
+
+	sendMention(bot, "$evt1", "hello", nil)
+	if len(claude.capturedParams) != 0 {
+		t.Error("should ignore messages in rooms not on the allowlist")
+	}
+
+	bot.config.AllowedRooms = append(bot.config.AllowedRooms, "!room:example.com")
+	sendMention(bot, "$evt2", "hello", nil)
+	if len(claude.capturedParams) != 1 {
+		t.Error("should respond in allowlisted rooms")
+	}
+}
+
+func TestHandleMemberEvent_DisallowedRoom(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.AllowedRooms = []id.RoomID{"!other:example.com"}
+
+	evt := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+	bot.handleMemberEvent(context.Background(), evt)
+
+	if len(matrix.joinedRooms) != 0 {
+		t.Error("should not auto-join rooms outside the allowlist")
+	}
+}
+
+func TestHandleMessage_ModelCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "model claude-opus-4-20250514", nil)
+	if len(claude.capturedParams) != 0 {
+		t.Fatalf("model command should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+	if got := bot.conversations.Model("$root"); got != "claude-opus-4-20250514" {
+		t.Errorf("expected model to be pinned, got %q", got)
+	}
+
+	sendMention(bot, "$evt2", "model default", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	if got := bot.conversations.Model("$root"); got != "" {
+		t.Errorf("expected pin to be cleared, got %q", got)
+	}
+
+	sendMention(bot, "$evt3", "model", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	last := matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent)
+	if !strings.Contains(last.Body, "claude-sonnet-4-20250514") {
+		t.Errorf("expected reply to name the default model, got %q", last.Body)
+	}
+}
+
+func TestHandleMessage_ModelCommandRejectsUnknownModel(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.FallbackModels = []string{"local-llama"}
+
+	for i, text := range []string{"model this as a state machine", "model\nthis as a state machine", "model gpt-4o"} {
+		sendMention(bot, id.EventID(fmt.Sprintf("$evt%d", i)), text, &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+		if got := bot.conversations.Model("$root"); got != "" {
+			t.Fatalf("%q pinned model %q", text, got)
+		}
+		last := matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent)
+		if !strings.Contains(last.Body, "don't know a model") {
+			t.Errorf("%q: expected an unknown-model reply, got %q", text, last.Body)
+		}
+	}
+	if len(claude.capturedParams) != 0 {
+		t.Errorf("model commands should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+
+	sendMention(bot, "$evt9", "model local-llama", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	if got := bot.conversations.Model("$root"); got != "local-llama" {
+		t.Errorf("expected a configured fallback model to be accepted, got %q", got)
+	}
+}
+
+func TestHandleMessage_ModelInfoCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "model-info", nil)
+	if len(claude.capturedParams) != 0 {
+		t.Fatalf("model-info command should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+	reply := matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent)
+	want := "Model: claude-sonnet-4-20250514\nContext window: 200000 tokens\nMax output: 64000 tokens\nTools: yes\nVision: yes"
+	if reply.Body != want {
+		t.Errorf("model-info reply = %q, want %q", reply.Body, want)
+	}
+
+	bot.conversations.SetModel("$root", "local-llama")
+	sendMention(bot, "$evt2", "model-info", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	reply = matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent)
+	if !strings.Contains(reply.Body, "Model: local-llama") || strings.Count(reply.Body, "unknown") != 4 {
+		t.Errorf("expected unknown capabilities for an unrecognized model, got %q", reply.Body)
+	}
+}
+
+func TestMaxTokensFor(t *testing.T) {
+	tests := []struct {
+		model      string
+		configured int64
+		want       int64
+	}{
+		{"claude-3-opus-20240229", 8192, 4096},       // over the limit: clamped
+		{"claude-sonnet-4-5-20250929", 16000, 16000}, // within the limit
+		{"claude-3-5-haiku-20241022", 8192, 8192},    // exactly at the limit
+		{"local-llama", 1_000_000, 1_000_000},        // unknown: left alone
+	}
+	for _, tt := range tests {
+		if got := maxTokensFor(tt.model, tt.configured); got != tt.want {
+			t.Errorf("maxTokensFor(%q, %d) = %d, want %d", tt.model, tt.configured, got, tt.want)
+		}
+	}
+}
+
+func TestGetClaudeResponse_ClampsMaxTokensToModel(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.MaxTokens = 100_000
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bot.conversations.SetModel("$thread2", "claude-3-haiku-20240307")
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread2"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := claude.capturedParams[0].MaxTokens; got != 64_000 {
+		t.Errorf("max_tokens = %d for the default model, want its 64000 limit", got)
+	}
+	if got := claude.capturedParams[1].MaxTokens; got != 4_096 {
+		t.Errorf("max_tokens = %d for a thread's pinned model, want its 4096 limit", got)
+	}
+}
+
+func TestHandleMessage_Summarize(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root"}
+	sendMention(bot, "$root", "first question", nil)
+	sendMention(bot, "$evt2", "second question", inThread)
+
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		return makeClaudeResponse("We discussed two questions."), nil
+	}
+	sendMention(bot, "$evt3", "summarize", inThread)
+
+	history := bot.conversations.Get("$root")
+	if len(history) != 2 {
+		t.Fatalf("expected history compacted to 2 messages, got %d", len(history))
+	}
+	if history[0].Role != anthropic.MessageParamRoleUser || history[1].Role != anthropic.MessageParamRoleAssistant {
+		t.Errorf("expected a user/assistant pair, got %s/%s", history[0].Role, history[1].Role)
+	}
+	if got := history[1].Content[0].OfText.Text; got != "We discussed two questions." {
+		t.Errorf("expected summary in stored history, got %q", got)
+	}
+
+	// The summary request saw the full thread.
+	if got := len(claude.capturedParams[2].Messages); got != 5 {
+		t.Errorf("expected 4 history messages plus the instruction, got %d", got)
+	}
+	reply := matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent)
+	if !strings.Contains(reply.Body, "We discussed two questions.") {
+		t.Errorf("expected summary in reply, got %q", reply.Body)
+	}
+}
+
+func TestHandleMessage_SummarizeEmptyThread(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "summarize", nil)
+
+	if len(claude.capturedParams) != 0 {
+		t.Errorf("expected no API call, got %d", len(claude.capturedParams))
+	}
+	reply := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if reply.Body != errNothingToSummarize.Error() {
+		t.Errorf("unexpected reply: %q", reply.Body)
+	}
+}
+
+func TestHandleMessage_RoomScopeSharesContextAcrossThreads(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.ConversationScope = "room"
+
+	sendMention(bot, "$thread1", "my name is Ada", nil)
+	sendMention(bot, "$thread2", "what is my name?", nil)
+
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 API calls, got %d", len(claude.capturedParams))
+	}
+	// First question, first answer, second question.
+	if got := len(claude.capturedParams[1].Messages); got != 3 {
+		t.Errorf("expected shared room context of 3 messages, got %d", got)
+	}
+}
+
+func TestHandleMessage_ThreadScopeKeepsThreadsSeparate(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.ConversationScope = "thread"
+
+	sendMention(bot, "$thread1", "my name is Ada", nil)
+	sendMention(bot, "$thread2", "what is my name?", nil)
+
+	if got := len(claude.capturedParams[1].Messages); got != 1 {
+		t.Errorf("expected a fresh context of 1 message, got %d", got)
+	}
+}
+
+func TestHandleMessage_EmptyResponseGetsPlaceholder(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return &anthropic.Message{Role: "assistant", StopReason: anthropic.StopReasonMaxTokens}, nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "something", nil)
+
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected 1 sent event, got %d", len(matrix.sentEvents))
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != "(no response generated) (stop reason: max_tokens)" {
+		t.Errorf("unexpected reply: %q", body)
+	}
+}
+
+func TestHandleMessage_EmptyResponseCustomPlaceholder(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return makeClaudeResponse("  "), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.EmptyResponseText = "🤷"
+
+	sendMention(bot, "$root", "something", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != "🤷" {
+		t.Errorf("unexpected reply: %q", body)
+	}
+}
+
+func TestHandleMessage_PendingCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.conversations.Append("$root",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("look it up")),
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("call_1", map[string]any{}, "lookup")),
+	)
+
+	sendMention(bot, "$evt2", "pending", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+
+	if len(claude.capturedParams) != 0 {
+		t.Errorf("pending should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if !strings.Contains(body, "call_1") {
+		t.Errorf("expected reply to list call_1, got %q", body)
+	}
+}
+
+func TestHandleMemberEvent_TrustedInviter(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.AllowedInviters = []id.UserID{"@admin:example.com"}
+
+	evt := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+	bot.handleMemberEvent(context.Background(), evt)
+
+	if len(matrix.joinedRooms) != 1 {
+		t.Fatalf("expected 1 join, got %d", len(matrix.joinedRooms))
+	}
+}
+
+func TestHandleMemberEvent_TrustedInviterServer(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.AllowedInviteHosts = []string{"example.com"}
+
+	evt := makeMemberEvent("@anyone:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+	bot.handleMemberEvent(context.Background(), evt)
+
+	if len(matrix.joinedRooms) != 1 {
+		t.Fatalf("expected 1 join, got %d", len(matrix.joinedRooms))
+	}
+}
+
+func TestHandleMemberEvent_UntrustedInviter(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.AllowedInviters = []id.UserID{"@admin:example.com"}
+	bot.config.AllowedInviteHosts = []string{"trusted.example"}
+
+	evt := makeMemberEvent("@stranger:elsewhere.example", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+	bot.handleMemberEvent(context.Background(), evt)
+
+	if len(matrix.joinedRooms) != 0 {
+		t.Error("should not auto-join on an untrusted invite")
+	}
+}
+
+func TestHandleMessage_RefusalGetsFriendlyMessage(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return &anthropic.Message{Role: "assistant", StopReason: anthropic.StopReasonRefusal}, nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "something dubious", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != refusalMessage {
+		t.Errorf("expected refusal message, got %q", body)
+	}
+	if strings.Contains(body, "error") {
+		t.Errorf("refusal should not be reported as an internal error: %q", body)
+	}
+}
+
+func TestHandleMessage_PauseTurnContinues(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			if len(params.Messages) == 1 {
+				resp := makeClaudeResponse("Searching the web...")
+				resp.StopReason = anthropic.StopReasonPauseTurn
+				return resp, nil
+			}
+			return makeClaudeResponse("Here's the answer."), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "research this", nil)
+
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected the paused turn to be resent, got %d calls", len(claude.capturedParams))
+	}
+	resent := claude.capturedParams[1].Messages
+	if last := resent[len(resent)-1]; last.Role != anthropic.MessageParamRoleAssistant {
+		t.Errorf("resent conversation should end with the paused assistant turn, got %s", last.Role)
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != "Searching the web...\n\nHere's the answer." {
+		t.Errorf("expected partial and final text, got %q", body)
+	}
+}
+
+func TestHandleMessage_PauseTurnKeepsPartialText(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			resp := makeClaudeResponse("Here's what I found so far.")
+			resp.StopReason = anthropic.StopReasonPauseTurn
+			return resp, nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.MaxToolIterations = 1
+
+	sendMention(bot, "$root", "research this", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if !strings.HasPrefix(body, "Here's what I found so far.") || !strings.HasSuffix(body, pausedNotice) {
+		t.Errorf("expected partial text followed by pause notice, got %q", body)
+	}
+}
+
+func TestSendThreadReply_PrefixAndSuffix(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.ReplyPrefix = "🤖 "
+	bot.config.ReplySuffix = "\n— generated by AI"
+
+	sendMention(bot, "$root", "hello", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != "🤖 mock response\n— generated by AI" {
+		t.Errorf("expected wrapped body, got %q", body)
+	}
+}
+
+func TestSendThreadReply_NoPrefixByDefault(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	sendMention(bot, "$root", "hello", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != "mock response" {
+		t.Errorf("expected unchanged body, got %q", body)
+	}
+}
+
+func TestHandleMessage_JSONModeRetriesInvalidJSON(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	replies := []string{"Sure! Here it is: {\"answer\": 4}", `{"answer": 4}`}
+	claude := &mockClaudeMessenger{}
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		return makeClaudeResponse(replies[len(claude.capturedParams)-1]), nil
+	}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "json what is 2+2?", nil)
+
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected a retry after invalid JSON, got %d calls", len(claude.capturedParams))
+	}
+	if !strings.Contains(claude.capturedParams[0].System[0].Text, "valid JSON") {
+		t.Error("expected JSON instructions in the system prompt")
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != `{"answer": 4}` {
+		t.Errorf("expected the valid JSON reply, got %q", body)
+	}
+}
+
+func TestHandleMessage_JSONModeValidFirstTime(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return makeClaudeResponse(`[1, 2, 3]`), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "json list three numbers", nil)
+
+	if len(claude.capturedParams) != 1 {
+		t.Errorf("expected no retry, got %d calls", len(claude.capturedParams))
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != `[1, 2, 3]` {
+		t.Errorf("expected JSON returned as-is, got %q", body)
+	}
+}
+
+func TestHandleMessage_JSONModeSkipsReplyDecoration(t *testing.T) {
+	matrix := &mockMatrixClient{displayNames: map[id.UserID]string{"@user:example.com": "Alice"}}
+	replies := []string{"not json", `{"answer": 4}`}
+	claude := &mockClaudeMessenger{}
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		return makeClaudeResponse(replies[len(claude.capturedParams)-1]), nil
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.ReplyPrefix = "🤖 "
+	bot.config.ReplySuffix = "\n-- bot"
+	bot.config.QuoteQuestion = true
+	bot.config.IncludeSenderName = true
+
+	sendMention(bot, "$root", "json what is 2+2?", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if body != `{"answer": 4}` {
+		t.Errorf("expected the bare JSON reply, got %q", body)
+	}
+	retry := claude.capturedParams[1].Messages
+	correction := retry[len(retry)-1].Content[0].OfText.Text
+	if strings.HasPrefix(correction, "[Alice]") {
+		t.Errorf("expected the correction without the sender's name, got %q", correction)
+	}
+}
+
+func TestHandleMessage_StatusCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.latencies.record(100 * time.Millisecond)
+	bot.latencies.record(300 * time.Millisecond)
+	bot.clock.(*fakeClock).Advance(90 * time.Minute)
+
+	sendMention(bot, "$root", "status", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if !strings.HasPrefix(body, "Up 1h30m0s on ") {
+		t.Errorf("expected uptime from the clock, got %q", body)
+	}
+	if !strings.Contains(body, "p50 100ms, p95 300ms") {
+		t.Errorf("expected latency percentiles in status, got %q", body)
+	}
+}
+
+func TestHandleMessage_StatusCommandShowsMCPServers(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.SetMCPStatus([]tools.MCPServerStatus{
+		{Name: "files", Connected: true, ToolCount: 3},
+		{Name: "search", Err: fmt.Errorf("connection refused")},
+	})
+
+	sendMention(bot, "$root", "status", nil)
+
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	if !strings.Contains(body, "- files: 3 tool(s)") || !strings.Contains(body, "- search: unavailable: connection refused") {
+		t.Errorf("expected MCP server health in status, got %q", body)
+	}
+}
+
+func TestHandleMessage_ToolsCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.tools.Register(&fakeTool{name: "datetime", description: "Get the current date and time.\nAccepts a timezone."})
+	bot.tools.Register(&fakeTool{name: "github_search_issues", description: "Search issues in a repository"})
+	bot.tools.Register(&fakeTool{name: "hidden", description: "Disabled tool"})
+	bot.tools.AddServerTool(anthropic.ToolUnionParam{OfWebSearchTool20250305: &anthropic.WebSearchTool20250305Param{}})
+	bot.config.DisabledTools = []string{"hidden"}
+	bot.SetMCPStatus([]tools.MCPServerStatus{{Name: "github", Connected: true, ToolCount: 1}})
+
+	sendMention(bot, "$root", "tools", nil)
+
+	if len(claude.capturedParams) != 0 {
+		t.Errorf("tools command should not call Claude, got %d calls", len(claude.capturedParams))
+	}
+	body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body
+	want := strings.Join([]string{
+		"3 tool(s) available:",
+		"- datetime: Get the current date and time.",
+		"- github_search_issues (MCP: github): Search issues in a repository",
+		"- web_search (runs on Anthropic's side)",
+	}, "\n")
+	if body != want {
+		t.Errorf("tool listing =\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestToolListing_Bounded(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	for i := range maxListedTools + 5 {
+		bot.tools.Register(&fakeTool{name: fmt.Sprintf("tool_%03d", i), description: strings.Repeat("d", 500)})
+	}
+
+	listing := bot.toolListing(bot.cfg())
+	if !strings.HasSuffix(listing, "…and 5 more.") {
+		t.Errorf("expected overflow note, got tail %q", listing[len(listing)-40:])
+	}
+	if strings.Contains(listing, strings.Repeat("d", maxToolDescriptionLength+1)) {
+		t.Error("long description was not shortened")
+	}
+}
+
+func TestHandleMessage_PersonaCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.SystemPrompt = "Be concise."
+	inThread := &event.RelatesTo{Type: event.RelThread, EventID: "$root"}
+
+	sendMention(bot, "$root", "persona You are a SQL expert.", nil)
+	sendMention(bot, "$evt2", "how do I join two tables?", inThread)
+
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected 1 API call, got %d", len(claude.capturedParams))
+	}
+	if got := claude.capturedParams[0].System[0].Text; got != "You are a SQL expert.\n\nBe concise." {
+		t.Errorf("expected persona merged with the global prompt, got %q", got)
+	}
+
+	sendMention(bot, "$evt3", "persona clear", inThread)
+	sendMention(bot, "$evt4", "and a left join?", inThread)
+
+	if got := claude.capturedParams[1].System[0].Text; got != "Be concise." {
+		t.Errorf("expected default prompt after clearing, got %q", got)
+	}
+}
+
+func TestHandleMessage_IncludesRepliedToMessage(t *testing.T) {
+	matrix := &mockMatrixClient{
+		getEventFunc: func(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+			if eventID != "$quoted" {
+				t.Errorf("fetched wrong event: %s", eventID)
+			}
+			return &event.Event{
+				Sender:  "@alice:example.com",
+				Type:    event.EventMessage,
+				ID:      eventID,
+				Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "The earth is flat."}},
+			}, nil
+		},
+	}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$evt", "is this right?", &event.RelatesTo{InReplyTo: &event.InReplyTo{EventID: "$quoted"}})
+
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected 1 API call, got %d", len(claude.capturedParams))
+	}
+	prompt := claude.capturedParams[0].Messages[0].Content[0].OfText.Text
+	want := "The user is referring to this message from @alice:example.com:\n> The earth is flat.\n\nis this right?"
+	if prompt != want {
+		t.Errorf("unexpected prompt:\n%q\nwant:\n%q", prompt, want)
+	}
+}
+
+func TestHandleMessage_ThreadFallbackReplyNotFetched(t *testing.T) {
+	matrix := &mockMatrixClient{
+		getEventFunc: func(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+			t.Errorf("should not fetch thread fallback reply %s", eventID)
+			return nil, fmt.Errorf("unexpected")
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	sendMention(bot, "$evt", "follow-up", &event.RelatesTo{
+		Type: event.RelThread, EventID: "$root",
+		InReplyTo: &event.InReplyTo{EventID: "$reply"}, IsFallingBack: true,
+	})
+}
+
+func TestHandleMemberEvent_DeduplicatesConcurrentInvites(t *testing.T) {
+	release := make(chan struct{})
+	matrix := &mockMatrixClient{
+		joinRoomByIDFunc: func(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinRoom, error) {
+			<-release
+			return &mautrix.RespJoinRoom{RoomID: roomID}, nil
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	evt := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bot.handleMemberEvent(context.Background(), evt)
+		}()
+	}
+	// Let one join start before releasing it, so the invites overlap.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if len(matrix.joinedRooms) != 1 {
+		t.Errorf("expected 1 join call, got %d", len(matrix.joinedRooms))
+	}
+}
+
+func TestHandleMemberEvent_RetriesAfterFailedJoin(t *testing.T) {
+	fail := true
+	matrix := &mockMatrixClient{
+		joinRoomByIDFunc: func(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinRoom, error) {
+			if fail {
+				return nil, fmt.Errorf("server error")
+			}
+			return &mautrix.RespJoinRoom{RoomID: roomID}, nil
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	evt := makeMemberEvent("@admin:example.com", "!room:example.com", "@bot:example.com", event.MembershipInvite)
+
+	bot.handleMemberEvent(context.Background(), evt)
+	fail = false
+	bot.handleMemberEvent(context.Background(), evt)
+
+	if len(matrix.joinedRooms) != 2 {
+		t.Errorf("expected a retry after the failed join, got %d join calls", len(matrix.joinedRooms))
+	}
+}
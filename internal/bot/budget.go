@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+const budgetNotice = "🪫 I've used up today's token budget. I'll be able to answer again after midnight UTC."
+
+// tokenBudget counts the Claude tokens used on the current UTC day. The
+// zero value is ready to use.
+type tokenBudget struct {
+	mu   sync.Mutex
+	day  string
+	used int64
+}
+
+// rollover resets the count when now is on a new day. Callers hold mu.
+func (t *tokenBudget) rollover(now time.Time) {
+	if day := now.UTC().Format(time.DateOnly); day != t.day {
+		t.day, t.used = day, 0
+	}
+}
+
+// add records tokens used at now.
+func (t *tokenBudget) add(now time.Time, tokens int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover(now)
+	t.used += tokens
+}
+
+// usedToday returns the tokens used so far on now's day.
+func (t *tokenBudget) usedToday(now time.Time) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rollover(now)
+	return t.used
+}
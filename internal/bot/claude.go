@@ -2,31 +2,77 @@ package bot
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+	"github.com/feline-dis/matrix-claude-bot/internal/tools"
 )
 
 type ConversationStore struct {
-	mu    sync.RWMutex
-	convs map[id.EventID][]anthropic.MessageParam
+	mu         sync.RWMutex
+	convs      map[id.EventID][]anthropic.MessageParam
+	models     map[id.EventID]string
+	personas   map[id.EventID]string
+	rooms      map[id.EventID]id.RoomID
+	lastAccess map[id.EventID]time.Time
+	now        func() time.Time
+	// maxThreads caps how many threads are held; 0 means no limit.
+	maxThreads int
+	// onDrop, if set, is told about every thread the store forgets.
+	onDrop func(threadID id.EventID)
+
+	// path is where the store is persisted; empty keeps it in memory only.
+	path string
+	// buffered defers writes to path until Flush, or until flushAfter
+	// (when positive) changes are pending.
+	buffered   bool
+	flushAfter int
+	pending    int
+	// unsaved is a snapshot encoded under mu and waiting to be written
+	// once mu is released, and saveSeq numbers the snapshots.
+	unsaved []byte
+	saveSeq uint64
+
+	// fileMu serializes writes to path; written is the saveSeq of the
+	// snapshot last written, so an older one never replaces a newer one.
+	fileMu  sync.Mutex
+	written uint64
 }
 
 func NewConversationStore() *ConversationStore {
 	return &ConversationStore{
-		convs: make(map[id.EventID][]anthropic.MessageParam),
+		convs:      make(map[id.EventID][]anthropic.MessageParam),
+		models:     make(map[id.EventID]string),
+		personas:   make(map[id.EventID]string),
+		rooms:      make(map[id.EventID]id.RoomID),
+		lastAccess: make(map[id.EventID]time.Time),
+		now:        time.Now,
 	}
 }
 
 func (s *ConversationStore) Get(threadID id.EventID) []anthropic.MessageParam {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	history := s.convs[threadID]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.convs[threadID]
+	if ok {
+		s.lastAccess[threadID] = s.now()
+	}
 	copied := make([]anthropic.MessageParam, len(history))
 	copy(copied, history)
 	return copied
@@ -34,8 +80,346 @@ func (s *ConversationStore) Get(threadID id.EventID) []anthropic.MessageParam {
 
 func (s *ConversationStore) Append(threadID id.EventID, msgs ...anthropic.MessageParam) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	defer s.unlockAndSave()
 	s.convs[threadID] = append(s.convs[threadID], msgs...)
+	s.touchLocked(threadID)
+	s.persistLocked()
+}
+
+// RewindLastUserTurn removes the most recent user text message and
+// everything after it, returning that message's text so it can be asked
+// again. Tool results, which are also user-role messages, are skipped.
+func (s *ConversationStore) RewindLastUserTurn(threadID id.EventID) (string, bool) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+
+	history := s.convs[threadID]
+	for i := len(history) - 1; i >= 0; i-- {
+		msg := history[i]
+		if msg.Role != anthropic.MessageParamRoleUser {
+			continue
+		}
+		for _, block := range msg.Content {
+			if block.OfText != nil {
+				s.convs[threadID] = history[:i:i]
+				s.lastAccess[threadID] = s.now()
+				s.persistLocked()
+				return block.OfText.Text, true
+			}
+		}
+	}
+	return "", false
+}
+
+// DropOldestTurns removes the older half of a thread's turns, each a user
+// message and everything answering it, and returns how many messages went.
+// Cutting only at the start of a turn keeps every tool_use with its
+// tool_result. The latest turn is always kept, so a single-turn thread is
+// left alone.
+func (s *ConversationStore) DropOldestTurns(threadID id.EventID) int {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+
+	history := s.convs[threadID]
+	var starts []int
+	for i, msg := range history {
+		if startsTurn(msg) {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) < 2 {
+		return 0
+	}
+	cut := starts[len(starts)/2]
+	s.convs[threadID] = slices.Clone(history[cut:])
+	s.touchLocked(threadID)
+	s.persistLocked()
+	return cut
+}
+
+// startsTurn reports whether msg is a user message rather than the tool
+// results of an earlier turn.
+func startsTurn(msg anthropic.MessageParam) bool {
+	if msg.Role != anthropic.MessageParamRoleUser {
+		return false
+	}
+	for _, block := range msg.Content {
+		if block.OfToolResult != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate returns the IDs of tool_use blocks in a thread that have no
+// tool_result in the message right after them, as left behind when a tool
+// loop fails partway. The API rejects a history containing any.
+func (s *ConversationStore) Validate(threadID id.EventID) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []string
+	for _, dangling := range danglingToolUses(s.convs[threadID]) {
+		ids = append(ids, dangling...)
+	}
+	return ids
+}
+
+// HealDanglingToolUses gives every dangling tool_use in a thread an error
+// tool_result with the given text, so the history is valid again. It
+// returns the IDs it repaired.
+func (s *ConversationStore) HealDanglingToolUses(threadID id.EventID, result string) []string {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+
+	history := s.convs[threadID]
+	dangling := danglingToolUses(history)
+	if len(dangling) == 0 {
+		return nil
+	}
+
+	healed := make([]anthropic.MessageParam, 0, len(history)+1)
+	var ids []string
+	for i, msg := range history {
+		if i > 0 && len(dangling[i-1]) > 0 && msg.Role == anthropic.MessageParamRoleUser {
+			// Results have to lead the user message that follows the call.
+			msg.Content = append(toolErrorResults(dangling[i-1], result), msg.Content...)
+			ids = append(ids, dangling[i-1]...)
+			delete(dangling, i-1)
+		}
+		healed = append(healed, msg)
+		if len(dangling[i]) > 0 && (i == len(history)-1 || history[i+1].Role != anthropic.MessageParamRoleUser) {
+			healed = append(healed, anthropic.NewUserMessage(toolErrorResults(dangling[i], result)...))
+			ids = append(ids, dangling[i]...)
+			delete(dangling, i)
+		}
+	}
+
+	s.convs[threadID] = healed
+	s.persistLocked()
+	return ids
+}
+
+// danglingToolUses maps the index of each assistant message to the IDs of
+// its tool_use blocks that the following message doesn't answer.
+func danglingToolUses(history []anthropic.MessageParam) map[int][]string {
+	dangling := make(map[int][]string)
+	for i, msg := range history {
+		if msg.Role != anthropic.MessageParamRoleAssistant {
+			continue
+		}
+		answered := make(map[string]bool)
+		if i+1 < len(history) && history[i+1].Role == anthropic.MessageParamRoleUser {
+			for _, block := range history[i+1].Content {
+				if block.OfToolResult != nil {
+					answered[block.OfToolResult.ToolUseID] = true
+				}
+			}
+		}
+		for _, block := range msg.Content {
+			if block.OfToolUse != nil && !answered[block.OfToolUse.ID] {
+				dangling[i] = append(dangling[i], block.OfToolUse.ID)
+			}
+		}
+	}
+	return dangling
+}
+
+// mergeConsecutiveRoles joins runs of messages with the same role into one
+// message, which the API requires (e.g. tool results followed by a new user
+// message). Blocks keep their order, so tool results still lead the merged
+// user message. The input is left unchanged.
+func mergeConsecutiveRoles(history []anthropic.MessageParam) []anthropic.MessageParam {
+	merged := make([]anthropic.MessageParam, 0, len(history))
+	for _, msg := range history {
+		if n := len(merged); n > 0 && merged[n-1].Role == msg.Role {
+			prev := &merged[n-1]
+			prev.Content = append(slices.Clip(prev.Content), msg.Content...)
+			continue
+		}
+		merged = append(merged, msg)
+	}
+	return merged
+}
+
+func toolErrorResults(ids []string, result string) []anthropic.ContentBlockParamUnion {
+	blocks := make([]anthropic.ContentBlockParamUnion, len(ids))
+	for i, toolUseID := range ids {
+		blocks[i] = anthropic.NewToolResultBlock(toolUseID, result, true)
+	}
+	return blocks
+}
+
+// Replace swaps a thread's entire history for msgs.
+func (s *ConversationStore) Replace(threadID id.EventID, msgs ...anthropic.MessageParam) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	s.convs[threadID] = msgs
+	s.touchLocked(threadID)
+	s.persistLocked()
+}
+
+// EvictIdle drops every thread that hasn't been read or written within ttl
+// and returns how many were removed.
+func (s *ConversationStore) EvictIdle(ttl time.Duration) int {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+
+	cutoff := s.now().Add(-ttl)
+	evicted := 0
+	for threadID, last := range s.lastAccess {
+		if last.Before(cutoff) {
+			s.dropLocked(threadID)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		s.persistLocked()
+	}
+	return evicted
+}
+
+// SetMaxThreads caps how many threads the store holds: once a new thread
+// takes it over the cap, the least recently used threads are evicted. Zero
+// removes the cap.
+func (s *ConversationStore) SetMaxThreads(n int) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	s.maxThreads = n
+	if s.evictOverCapLocked("") > 0 {
+		s.persistLocked()
+	}
+}
+
+// touchLocked marks a thread as just used, evicting others if that puts the
+// store over its thread cap. Callers must hold s.mu.
+func (s *ConversationStore) touchLocked(threadID id.EventID) {
+	s.lastAccess[threadID] = s.now()
+	s.evictOverCapLocked(threadID)
+}
+
+// evictOverCapLocked drops the least recently used threads other than keep
+// until the store is within maxThreads, and returns how many it dropped.
+// Callers must hold s.mu.
+func (s *ConversationStore) evictOverCapLocked(keep id.EventID) int {
+	if s.maxThreads <= 0 {
+		return 0
+	}
+	evicted := 0
+	for len(s.lastAccess) > s.maxThreads {
+		var oldest id.EventID
+		var oldestAt time.Time
+		for threadID, last := range s.lastAccess {
+			if threadID != keep && (oldest == "" || last.Before(oldestAt)) {
+				oldest, oldestAt = threadID, last
+			}
+		}
+		if oldest == "" {
+			break
+		}
+		s.dropLocked(oldest)
+		evicted++
+	}
+	return evicted
+}
+
+// OnDrop registers fn to be called with each thread the store forgets,
+// whether evicted or dropped with its room. It runs with the store locked,
+// so it must not call back into the store.
+func (s *ConversationStore) OnDrop(fn func(threadID id.EventID)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDrop = fn
+}
+
+// dropLocked forgets everything about a thread. Callers must hold s.mu.
+func (s *ConversationStore) dropLocked(threadID id.EventID) {
+	delete(s.convs, threadID)
+	delete(s.models, threadID)
+	delete(s.personas, threadID)
+	delete(s.rooms, threadID)
+	delete(s.lastAccess, threadID)
+	if s.onDrop != nil {
+		s.onDrop(threadID)
+	}
+}
+
+// SetRoom records which room a held thread is in, so DropRoom can find it.
+func (s *ConversationStore) SetRoom(threadID id.EventID, roomID id.RoomID) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	if _, ok := s.lastAccess[threadID]; !ok || s.rooms[threadID] == roomID {
+		return
+	}
+	s.rooms[threadID] = roomID
+	s.persistLocked()
+}
+
+// DropRoom forgets every thread recorded in roomID and returns how many
+// there were.
+func (s *ConversationStore) DropRoom(roomID id.RoomID) int {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	dropped := 0
+	for threadID, room := range s.rooms {
+		if room == roomID {
+			s.dropLocked(threadID)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		s.persistLocked()
+	}
+	return dropped
+}
+
+// Len returns how many conversations the store holds.
+func (s *ConversationStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.convs)
+}
+
+// Model returns the model pinned for a thread, or "" if it uses the default.
+func (s *ConversationStore) Model(threadID id.EventID) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.models[threadID]
+}
+
+// SetModel pins the model used for subsequent requests in a thread. An empty
+// model returns the thread to the configured default.
+func (s *ConversationStore) SetModel(threadID id.EventID, model string) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	if model == "" {
+		delete(s.models, threadID)
+	} else {
+		s.models[threadID] = model
+	}
+	s.touchLocked(threadID)
+	s.persistLocked()
+}
+
+// Persona returns the thread's system-prompt override, or "" if it has none.
+func (s *ConversationStore) Persona(threadID id.EventID) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.personas[threadID]
+}
+
+// SetPersona sets the system-prompt override for a thread. An empty persona
+// removes it.
+func (s *ConversationStore) SetPersona(threadID id.EventID, persona string) {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	if persona == "" {
+		delete(s.personas, threadID)
+	} else {
+		s.personas[threadID] = persona
+	}
+	s.touchLocked(threadID)
+	s.persistLocked()
 }
 
 func extractText(content []anthropic.ContentBlockUnion) string {
@@ -48,25 +432,138 @@ func extractText(content []anthropic.ContentBlockUnion) string {
 	return strings.Join(parts, "\n")
 }
 
+// interruptedToolResult answers tool calls whose results were lost when an
+// earlier request failed partway through the tool loop.
+const interruptedToolResult = "tool call was interrupted before it returned a result"
+
+const defaultEmptyResponseText = "(no response generated)"
+
+const (
+	refusalMessage = "Sorry, I can't help with that request. Feel free to rephrase it or ask something else."
+	pausedNotice   = "I had to pause partway through this one. Mention me again to have me continue."
+)
+
+// stripTaggedSections removes <tag>...</tag> sections for each of tags, such
+// as reasoning a model wrote out as plain text. An unclosed tag hides the
+// rest of the text. Only the reply is affected; history keeps the original.
+func stripTaggedSections(text string, tags []string) string {
+	for _, tag := range tags {
+		openTag, closeTag := regexp.QuoteMeta("<"+tag+">"), regexp.QuoteMeta("</"+tag+">")
+		re := regexp.MustCompile(`(?s)` + openTag + `.*?(?:` + closeTag + `|\z)\s*`)
+		text = re.ReplaceAllString(text, "")
+	}
+	return strings.TrimSpace(text)
+}
+
+// emptyResponseText returns the configured claude.empty_response_text, or
+// the default when none is set.
+func emptyResponseText(configured string) string {
+	if configured == "" {
+		return defaultEmptyResponseText
+	}
+	return configured
+}
+
+// finalText returns the text of Claude's last response. Refusals and paused
+// turns get a plain explanation instead of whatever partial text came back.
+// A response with no text at all (e.g. max_tokens hit before any output)
+// would send an empty message, so placeholder is used instead, noting any
+// unusual stop reason. With sources set, web pages the text cites are
+// listed after it.
+func finalText(resp *anthropic.Message, placeholder string, sources bool) string {
+	text := extractText(resp.Content)
+	switch resp.StopReason {
+	case anthropic.StopReasonRefusal:
+		return refusalMessage
+	case anthropic.StopReasonPauseTurn:
+		if strings.TrimSpace(text) == "" {
+			return pausedNotice
+		}
+		return text + "\n\n" + pausedNotice
+	}
+
+	if strings.TrimSpace(text) != "" {
+		if sources {
+			text += citationSources(resp.Content)
+		}
+		return text
+	}
+	placeholder = emptyResponseText(placeholder)
+	switch resp.StopReason {
+	case "", anthropic.StopReasonEndTurn, anthropic.StopReasonToolUse:
+		return placeholder
+	default:
+		return fmt.Sprintf("%s (stop reason: %s)", placeholder, resp.StopReason)
+	}
+}
+
+// citationSources formats the web pages cited by text blocks as a numbered
+// "Sources:" footer, in order of first citation. It returns "" when nothing
+// was cited.
+func citationSources(content []anthropic.ContentBlockUnion) string {
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, block := range content {
+		if block.Type != "text" {
+			continue
+		}
+		for _, c := range block.Citations {
+			if c.URL == "" || seen[c.URL] {
+				continue
+			}
+			seen[c.URL] = true
+			if b.Len() == 0 {
+				b.WriteString("\n\nSources:")
+			}
+			if c.Title == "" {
+				fmt.Fprintf(&b, "\n%d. %s", len(seen), c.URL)
+			} else {
+				fmt.Fprintf(&b, "\n%d. %s — %s", len(seen), c.Title, c.URL)
+			}
+		}
+	}
+	return b.String()
+}
+
 // toolCapabilitiesPrompt generates a system prompt section describing the
 // tools currently available, built from the Registry so it stays in sync
 // with what is actually registered.
-func (b *Bot) toolCapabilitiesPrompt() string {
+func (b *Bot) toolCapabilitiesPrompt(cfg config.Config) string {
 	if b.tools == nil || b.tools.IsEmpty() {
 		return ""
 	}
 
+	disabled := cfg.DisabledTools
 	var parts []string
 
-	if b.tools.HasServerTools() {
-		parts = append(parts, "- Web search: you can search the web for current information")
+	for _, d := range b.tools.ServerDefinitions() {
+		name := toolName(d)
+		if slices.Contains(disabled, name) {
+			continue
+		}
+		switch name {
+		case "web_search":
+			parts = append(parts, "- Web search: you can search the web for current information")
+		case "web_fetch":
+			parts = append(parts, "- Web fetch: you can fetch the contents of a URL")
+		case "code_execution":
+			parts = append(parts, "- Code execution: you can run code in a sandboxed environment")
+		default:
+			parts = append(parts, fmt.Sprintf("- %s", name))
+		}
 	}
 
 	localNames := b.tools.LocalToolNames()
+	canWrite := slices.Contains(localNames, "fs_write") && !slices.Contains(disabled, "fs_write")
 	for _, name := range localNames {
+		if slices.Contains(disabled, name) {
+			continue
+		}
 		switch {
-		case strings.HasPrefix(name, "fs_"):
+		case strings.HasPrefix(name, "fs_") && canWrite:
 			parts = append(parts, "- Filesystem: you can read, write, and list files in a sandboxed directory")
+		case strings.HasPrefix(name, "fs_"):
+			parts = append(parts, "- Filesystem: you can read and list files in a sandboxed directory, which is read-only")
 		default:
 			parts = append(parts, fmt.Sprintf("- %s", name))
 		}
@@ -89,72 +586,439 @@ func (b *Bot) toolCapabilitiesPrompt() string {
 	return "\n\nYou have access to the following tools:\n" + strings.Join(unique, "\n")
 }
 
-func (b *Bot) getClaudeResponse(ctx context.Context, threadID id.EventID, userText string) (string, error) {
+const defaultClarificationPrompt = "If a request is ambiguous in a way that would change which tools you use or how, ask one short clarifying question and stop, without calling any tools. The user will answer in the thread. If the request is clear enough, go ahead."
+
+// clarificationPrompt returns the system prompt section that encourages
+// Claude to ask before starting a tool chain on an ambiguous request. A
+// reply that is only a question ends the turn like any text answer.
+func clarificationPrompt(custom string) string {
+	if custom != "" {
+		return "\n\n" + custom
+	}
+	return "\n\n" + defaultClarificationPrompt
+}
+
+// languagePrompt returns the system prompt section asking Claude to answer
+// in the room's configured language, or "" if it has none. Room keys are
+// lowercased by the config loader.
+func languagePrompt(languages map[id.RoomID]string, roomID id.RoomID) string {
+	language := languages[id.RoomID(strings.ToLower(string(roomID)))]
+	if language == "" {
+		return ""
+	}
+	return fmt.Sprintf("\n\nThis room's language is %s: write your answers in %s.", language, language)
+}
+
+const maxSchemaHintLength = 2000
+
+// schemaHint restates a tool's input schema after Claude sent it input that
+// didn't decode, so the model can correct the call instead of guessing.
+func (b *Bot) schemaHint(name string) string {
+	def, ok := b.tools.Definition(name)
+	if !ok || def.GetInputSchema() == nil {
+		return ""
+	}
+	schema, err := json.Marshal(def.GetInputSchema())
+	if err != nil || len(schema) > maxSchemaHintLength {
+		return ""
+	}
+	return fmt.Sprintf("\n\nThe input must match this JSON schema for %s: %s", name, schema)
+}
+
+// toolName returns the name Claude uses to refer to a tool definition.
+func toolName(d anthropic.ToolUnionParam) string {
+	switch {
+	case d.OfTool != nil:
+		return d.OfTool.Name
+	case d.OfWebSearchTool20250305 != nil:
+		return "web_search"
+	case d.OfWebFetchTool20250910 != nil:
+		return "web_fetch"
+	case d.OfCodeExecutionTool20250825 != nil:
+		return "code_execution"
+	default:
+		return "(unknown)"
+	}
+}
+
+// enabledToolDefinitions returns the registry's tool definitions minus any
+// the deployment has disabled.
+func (b *Bot) enabledToolDefinitions(disabled []string) []anthropic.ToolUnionParam {
+	var defs []anthropic.ToolUnionParam
+	for _, d := range b.tools.Definitions() {
+		if !slices.Contains(disabled, toolName(d)) {
+			defs = append(defs, d)
+		}
+	}
+	return defs
+}
+
+// turnToolDefinitions returns the tool definitions to send for t: the
+// enabled registry tools, plus web search when the turn asked for it and the
+// deployment doesn't already offer it.
+func (b *Bot) turnToolDefinitions(cfg config.Config, t turn) []anthropic.ToolUnionParam {
+	var defs []anthropic.ToolUnionParam
+	if b.tools != nil {
+		defs = b.enabledToolDefinitions(cfg.DisabledTools)
+	}
+	if t.webSearch && !slices.ContainsFunc(defs, func(d anthropic.ToolUnionParam) bool { return d.OfWebSearchTool20250305 != nil }) {
+		if def, err := tools.NewServerTool("web_search", cfg); err == nil {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+// toolChoiceParam maps a tools.tool_choice setting to the API parameter:
+// "auto", "any", "none", or the name of a specific tool to force.
+func toolChoiceParam(choice string) anthropic.ToolChoiceUnionParam {
+	switch choice {
+	case "auto":
+		return anthropic.ToolChoiceUnionParam{OfAuto: &anthropic.ToolChoiceAutoParam{}}
+	case "any":
+		return anthropic.ToolChoiceUnionParam{OfAny: &anthropic.ToolChoiceAnyParam{}}
+	case "none":
+		return anthropic.ToolChoiceUnionParam{OfNone: &anthropic.ToolChoiceNoneParam{}}
+	default:
+		return anthropic.ToolChoiceUnionParam{OfTool: &anthropic.ToolChoiceToolParam{Name: choice}}
+	}
+}
+
+// maxActivityValueLen bounds how much of each tool input value is echoed
+// into activity messages.
+const maxActivityValueLen = 40
+
+// summarizeToolInput renders a short, redacted view of a tool's input for
+// activity messages: only short string fields are shown, in key order.
+func summarizeToolInput(input json.RawMessage) string {
+	var fields map[string]any
+	if err := json.Unmarshal(input, &fields); err != nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		v, ok := fields[k].(string)
+		if !ok || v == "" {
+			continue
+		}
+		if len(v) > maxActivityValueLen {
+			v = "…"
+		}
+		parts = append(parts, fmt.Sprintf("%s: %s", k, v))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// postToolActivity tells the thread which tool the bot is about to run.
+func (b *Bot) postToolActivity(ctx context.Context, t turn, name string, input json.RawMessage) {
+	text := fmt.Sprintf("🔧 running %s", name)
+	if summary := summarizeToolInput(input); summary != "" {
+		text += " (" + summary + ")"
+	}
+	b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, text+"…")
+}
+
+// maxEchoLength caps how much of a tool result is echoed into the thread;
+// Claude still gets all of it.
+const maxEchoLength = 2000
+
+// echoToolResult posts a tool's result in the turn's thread as a code
+// block, truncated to maxEchoLength, so people see the raw data alongside
+// Claude's reading of it.
+func (b *Bot) echoToolResult(ctx context.Context, t turn, name, result string) {
+	result = strings.TrimSpace(result)
+	if result == "" {
+		return
+	}
+	var more string
+	if runes := []rune(result); len(runes) > maxEchoLength {
+		result = string(runes[:maxEchoLength])
+		more = fmt.Sprintf("\n… (%d more characters)", len(runes)-maxEchoLength)
+	}
+	text := fmt.Sprintf("📄 %s result:\n```\n%s\n```%s", name, result, more)
+	b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, text)
+}
+
+// maxNarrationLength caps a narration message, which should be one line.
+const maxNarrationLength = 200
+
+// narration returns the first line of the text Claude sent alongside its
+// tool calls, which usually says what it is about to do, or "" if none.
+func narration(resp *anthropic.Message) string {
+	for line := range strings.Lines(extractText(resp.Content)) {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if runes := []rune(line); len(runes) > maxNarrationLength {
+			line = string(runes[:maxNarrationLength]) + "…"
+		}
+		return line
+	}
+	return ""
+}
+
+// progressEditInterval is the minimum time between edits of a tool's
+// progress message, so chatty tools don't flood the room with edits.
+const progressEditInterval = 2 * time.Second
+
+// progressReporter returns a reporter that shows a tool's progress in the
+// turn's thread: the first update posts a message and later ones edit it.
+func (b *Bot) progressReporter(ctx context.Context, t turn, name string) tools.ProgressReporter {
+	var mu sync.Mutex
+	var msgID id.EventID
+	var last time.Time
+	return func(message string, progress, total float64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := b.clock.Now()
+		if msgID != "" && now.Sub(last) < progressEditInterval {
+			return
+		}
+		last = now
+
+		text := "⏳ " + name
+		if message != "" {
+			text += ": " + message
+		}
+		if total > 0 {
+			text += fmt.Sprintf(" (%.0f%%)", 100*progress/total)
+		}
+
+		if msgID == "" {
+			msgID = b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, text)
+		} else {
+			b.editReply(ctx, t.cfg, t.roomID, msgID, text)
+		}
+	}
+}
+
+// isModelNotFound reports whether err is the API rejecting the requested model.
+func isModelNotFound(err error) bool {
+	var apiErr *anthropic.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// isPromptTooLong reports whether err is the API rejecting a request for
+// exceeding the model's context window.
+func isPromptTooLong(err error) bool {
+	var apiErr *anthropic.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(apiErr.RawJSON(), "prompt is too long")
+}
+
+// sendWithFallback calls Claude, moving on to the configured fallback models
+// if the requested model is not found. A fallback that works is pinned for
+// the thread so later requests go straight to it.
+func (b *Bot) sendWithFallback(ctx context.Context, threadID id.EventID, fallbacks []string, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	candidates := []string{string(params.Model)}
+	for _, m := range fallbacks {
+		if m != candidates[0] {
+			candidates = append(candidates, m)
+		}
+	}
+
+	for i, model := range candidates {
+		params.Model = anthropic.Model(model)
+		resp, err := b.claude.NewMessage(ctx, params)
+		if err == nil {
+			b.budget.add(b.clock.Now(), resp.Usage.InputTokens+resp.Usage.OutputTokens)
+			if i > 0 {
+				b.conversations.SetModel(threadID, model)
+			}
+			return resp, nil
+		}
+		if !isModelNotFound(err) || i == len(candidates)-1 {
+			return nil, err
+		}
+		log.Printf("Model %s unavailable, falling back to %s", model, candidates[i+1])
+	}
+	return nil, fmt.Errorf("no models to try")
+}
+
+func (b *Bot) getClaudeResponse(ctx context.Context, t turn, userText string) (string, error) {
+	convID := t.conversationID
+	if healed := b.conversations.HealDanglingToolUses(convID, interruptedToolResult); len(healed) > 0 {
+		log.Printf("Repaired %d tool call(s) left without results in %s", len(healed), convID)
+	}
+	if t.senderName != "" {
+		userText = "[" + t.senderName + "]: " + userText
+	}
 	userMsg := anthropic.NewUserMessage(anthropic.NewTextBlock(userText))
-	b.conversations.Append(threadID, userMsg)
+	b.conversations.Append(convID, userMsg)
+	b.conversations.SetRoom(convID, t.roomID)
 
-	maxIterations := b.config.MaxToolIterations
+	cfg := t.cfg
+	maxIterations := cfg.MaxToolIterations
 	if maxIterations <= 0 {
 		maxIterations = 1
 	}
 
-	toolTimeout := b.config.ToolTimeout
+	toolTimeout := cfg.ToolTimeout
 	if toolTimeout <= 0 {
 		toolTimeout = 30 * time.Second
 	}
 
 	hasTools := b.tools != nil && !b.tools.IsEmpty()
+	// schemaHinted records tools whose schema has already been repeated
+	// this turn, so a model that keeps failing isn't sent it again.
+	schemaHinted := make(map[string]bool)
+
+	toolChoice := cfg.ToolChoice
+	if t.toolChoice != "" {
+		toolChoice = t.toolChoice
+	}
+
+	var roomContext string
+	if cfg.IncludeRoomContext {
+		roomContext = b.roomContext(ctx, t.roomID)
+	}
+
+	// trimmed records that the history has already been cut down once
+	// after the API found it too long.
+	trimmed := false
+
+	// paused holds text from responses that stopped with pause_turn, which
+	// would otherwise be lost from the reply once Claude continues.
+	var paused []string
+	reply := func(resp *anthropic.Message) string {
+		text := strings.Join(append(paused, finalText(resp, cfg.EmptyResponseText, !t.jsonMode)), "\n\n")
+		if len(cfg.StripTags) == 0 {
+			return text
+		}
+		if text = stripTaggedSections(text, cfg.StripTags); text == "" {
+			return emptyResponseText(cfg.EmptyResponseText)
+		}
+		return text
+	}
 
 	for i := 0; i < maxIterations; i++ {
+		model := b.modelFor(t)
+
+		iterCtx, span := b.tracer.Start(ctx, "claude.iteration", trace.WithAttributes(
+			attribute.Int("claude.iteration", i),
+			attribute.String("claude.model", model),
+		))
+
 		params := anthropic.MessageNewParams{
-			Model:     anthropic.Model(b.config.Model),
-			Messages:  b.conversations.Get(threadID),
-			MaxTokens: b.config.MaxTokens,
+			Model:     anthropic.Model(model),
+			Messages:  mergeConsecutiveRoles(b.conversations.Get(convID)),
+			MaxTokens: maxTokensFor(model, cfg.MaxTokens),
+		}
+		if t.temperature != nil {
+			params.Temperature = anthropic.Float(*t.temperature)
+		} else if cfg.Temperature != nil {
+			params.Temperature = anthropic.Float(*cfg.Temperature)
+		}
+		if cfg.TopP != nil {
+			params.TopP = anthropic.Float(*cfg.TopP)
+		}
+		if cfg.TopK != nil {
+			params.TopK = anthropic.Int(*cfg.TopK)
 		}
 
-		systemPrompt := b.config.SystemPrompt + b.toolCapabilitiesPrompt()
+		systemPrompt := cfg.SystemPrompt
+		if persona := b.personaFor(t); persona != "" {
+			systemPrompt = strings.TrimSpace(persona + "\n\n" + systemPrompt)
+		}
+		if roomContext != "" {
+			systemPrompt = strings.TrimSpace(roomContext + "\n\n" + systemPrompt)
+		}
+		systemPrompt += b.toolCapabilitiesPrompt(cfg)
+		if hasTools && cfg.AskClarification {
+			systemPrompt += clarificationPrompt(cfg.ClarificationPrompt)
+		}
+		systemPrompt += languagePrompt(cfg.RoomLanguage, t.roomID)
+		if t.jsonMode {
+			systemPrompt += jsonModePrompt
+		}
 		if systemPrompt != "" {
 			params.System = []anthropic.TextBlockParam{
 				{Text: systemPrompt},
 			}
 		}
 
-		if hasTools {
-			defs := b.tools.Definitions()
+		if hasTools || t.webSearch {
+			defs := b.turnToolDefinitions(cfg, t)
 			params.Tools = defs
 			if i == 0 {
 				names := make([]string, len(defs))
 				for j, d := range defs {
-					if d.OfTool != nil {
-						names[j] = d.OfTool.Name
-					} else if d.OfWebSearchTool20250305 != nil {
-						names[j] = "web_search"
-					} else {
-						names[j] = "(unknown)"
-					}
+					names[j] = toolName(d)
 				}
 				log.Printf("Sending %d tool(s) to Claude: %v", len(defs), names)
 			}
+
+			// Forcing a tool only applies to the first request; after that
+			// Claude must be free to answer or the loop would never end.
+			if toolChoice != "" && len(defs) > 0 && (i == 0 || toolChoice == "none" || toolChoice == "auto") {
+				params.ToolChoice = toolChoiceParam(toolChoice)
+			}
 		}
 
-		resp, err := b.claude.NewMessage(ctx, params)
+		start := b.clock.Now()
+		resp, err := b.sendWithFallback(iterCtx, convID, cfg.FallbackModels, params)
+		t.debug.record(params, resp, err)
+		// The history outgrew the context window: drop its oldest half and
+		// try once more rather than failing the thread for good.
+		if isPromptTooLong(err) && !trimmed {
+			trimmed = true
+			if n := b.conversations.DropOldestTurns(convID); n > 0 {
+				log.Printf("Prompt too long for thread %s, dropped its %d oldest messages and retrying", convID, n)
+				params.Messages = mergeConsecutiveRoles(b.conversations.Get(convID))
+				resp, err = b.sendWithFallback(iterCtx, convID, cfg.FallbackModels, params)
+				t.debug.record(params, resp, err)
+			}
+		}
 		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "claude API call failed")
+			span.End()
 			return "", fmt.Errorf("claude API call failed: %w", err)
 		}
+		b.latencies.record(b.clock.Now().Sub(start))
+		span.SetAttributes(attribute.String("claude.stop_reason", string(resp.StopReason)))
 
-		b.conversations.Append(threadID, resp.ToParam())
+		b.conversations.Append(convID, resp.ToParam())
+
+		// A long server tool run can pause the turn; sending the
+		// conversation back as-is lets Claude carry on from there. On the
+		// last iteration the partial answer goes out with pausedNotice.
+		if resp.StopReason == anthropic.StopReasonPauseTurn && i < maxIterations-1 {
+			if text := extractText(resp.Content); strings.TrimSpace(text) != "" {
+				paused = append(paused, text)
+			}
+			span.End()
+			continue
+		}
 
 		if resp.StopReason != anthropic.StopReasonToolUse {
-			return extractText(resp.Content), nil
+			span.End()
+			return reply(resp), nil
 		}
 
 		// No local tools to execute -- shouldn't happen, but guard against
 		// infinite loops if only server tools are registered.
 		if !hasTools {
-			return extractText(resp.Content), nil
+			span.End()
+			return reply(resp), nil
+		}
+
+		if cfg.NarrateTools {
+			if text := narration(resp); text != "" {
+				b.sendThreadReply(iterCtx, t.cfg, t.roomID, t.threadRootID, t.eventID, "💭 "+text)
+			}
 		}
 
 		var toolResults []anthropic.ContentBlockParamUnion
+		executed := 0
 		for _, block := range resp.Content {
 			if block.Type != "tool_use" {
 				continue
@@ -162,25 +1026,71 @@ func (b *Bot) getClaudeResponse(ctx context.Context, threadID id.EventID, userTe
 			if !b.tools.HasLocalTool(block.Name) {
 				continue
 			}
+			if cfg.ToolCallsPerTurn > 0 && executed >= cfg.ToolCallsPerTurn {
+				log.Printf("Skipping call to %s: over the limit of %d tool calls per turn", block.Name, cfg.ToolCallsPerTurn)
+				toolResults = append(toolResults, anthropic.NewToolResultBlock(block.ID,
+					fmt.Sprintf("too many tool calls: at most %d run per turn, so this one was skipped; request fewer at once", cfg.ToolCallsPerTurn), true))
+				continue
+			}
+			if slices.Contains(cfg.DisabledTools, block.Name) {
+				log.Printf("Refusing call to disabled tool %s", block.Name)
+				toolResults = append(toolResults, anthropic.NewToolResultBlock(block.ID, fmt.Sprintf("tool %s is disabled in this deployment", block.Name), true))
+				continue
+			}
+
+			executed++
+
+			if cfg.ShowToolActivity {
+				b.postToolActivity(iterCtx, t, block.Name, block.Input)
+			}
 
-			toolCtx, cancel := context.WithTimeout(ctx, toolTimeout)
+			toolCtx, cancel := context.WithTimeout(iterCtx, toolTimeout)
+			toolCtx = withTurn(toolCtx, t)
+			toolCtx = tools.WithRoomID(toolCtx, string(t.roomID))
+			if b.sandboxes != nil {
+				toolCtx = tools.WithEphemeralSandbox(toolCtx, b.sandboxes, string(t.conversationID))
+			}
+			toolCtx = tools.WithImageSender(toolCtx, func(ctx context.Context, name string, data []byte, mimeType string) error {
+				return b.sendImage(ctx, t, name, data, mimeType)
+			})
+			toolCtx = tools.WithProgressReporter(toolCtx, b.progressReporter(iterCtx, t, block.Name))
+			toolCtx, toolSpan := b.tracer.Start(toolCtx, "tool.execute", trace.WithAttributes(
+				attribute.String("tool.name", block.Name),
+			))
 			result, isError, err := b.tools.Execute(toolCtx, block.Name, block.Input)
 			cancel()
 
+			outcome := "ok"
 			if err != nil {
 				log.Printf("Tool execution error (%s): %v", block.Name, err)
 				result = "internal error executing tool"
 				isError = true
+				outcome = "failed"
+				toolSpan.RecordError(err)
+				toolSpan.SetStatus(codes.Error, "tool execution failed")
+			} else if isError {
+				outcome = "error"
+				if cfg.ToolSchemaHints && !schemaHinted[block.Name] && tools.IsInvalidInput(result) {
+					schemaHinted[block.Name] = true
+					result += b.schemaHint(block.Name)
+				}
+			}
+			toolSpan.SetAttributes(attribute.String("tool.outcome", outcome))
+			toolSpan.End()
+
+			if cfg.EchoToolResults && !isError {
+				b.echoToolResult(iterCtx, t, block.Name, result)
 			}
 
 			toolResults = append(toolResults, anthropic.NewToolResultBlock(block.ID, result, isError))
 		}
 
+		span.End()
 		if len(toolResults) == 0 {
-			return extractText(resp.Content), nil
+			return reply(resp), nil
 		}
 
-		b.conversations.Append(threadID, anthropic.NewUserMessage(toolResults...))
+		b.conversations.Append(convID, anthropic.NewUserMessage(toolResults...))
 	}
 
 	return "reached maximum tool use iterations", nil
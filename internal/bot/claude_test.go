@@ -1,15 +1,30 @@
 package bot
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/tools"
 )
 
 func TestConversationStore_EmptyGet(t *testing.T) {
@@ -91,7 +106,7 @@ func TestGetClaudeResponse_Success(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	threadID := id.EventID("$thread1")
 
-	resp, err := bot.getClaudeResponse(context.Background(), threadID, "hello")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, threadID), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -117,7 +132,7 @@ func TestGetClaudeResponse_MultipleTextBlocks(t *testing.T) {
 	}
 	bot := newTestBot(matrix, claude)
 
-	resp, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -136,7 +151,7 @@ func TestGetClaudeResponse_APIError(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	threadID := id.EventID("$thread1")
 
-	resp, err := bot.getClaudeResponse(context.Background(), threadID, "hello")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, threadID), "hello")
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -156,12 +171,12 @@ func TestGetClaudeResponse_ConversationHistory(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	threadID := id.EventID("$thread1")
 
-	_, err := bot.getClaudeResponse(context.Background(), threadID, "first")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, threadID), "first")
 	if err != nil {
 		t.Fatalf("first call failed: %v", err)
 	}
 
-	_, err = bot.getClaudeResponse(context.Background(), threadID, "second")
+	_, err = bot.getClaudeResponse(context.Background(), turnFor(bot, threadID), "second")
 	if err != nil {
 		t.Fatalf("second call failed: %v", err)
 	}
@@ -182,7 +197,7 @@ func TestGetClaudeResponse_WithSystemPrompt(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	bot.config.SystemPrompt = "You are a helpful bot."
 
-	_, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -204,7 +219,7 @@ func TestGetClaudeResponse_WithSystemPromptAndTools(t *testing.T) {
 	bot.config.SystemPrompt = "You are a helpful bot."
 	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
 
-	_, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -227,7 +242,7 @@ func TestGetClaudeResponse_NoSystemPrompt(t *testing.T) {
 	claude := &mockClaudeMessenger{}
 	bot := newTestBot(matrix, claude)
 
-	_, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -244,7 +259,7 @@ func TestGetClaudeResponse_NoSystemPromptWithTools(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
 
-	_, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -258,6 +273,135 @@ func TestGetClaudeResponse_NoSystemPromptWithTools(t *testing.T) {
 	}
 }
 
+func TestGetClaudeResponse_RoomLanguage(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.SystemPrompt = "Be concise."
+	bot.config.RoomLanguage = map[id.RoomID]string{"!room:example.com": "German"}
+
+	other := turnFor(bot, "$thread2")
+	other.roomID = "!other:example.com"
+	for _, tr := range []turn{turnFor(bot, "$thread1"), other} {
+		if _, err := bot.getClaudeResponse(context.Background(), tr, "hello"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if got := claude.capturedParams[0].System[0].Text; !strings.Contains(got, "write your answers in German") {
+		t.Errorf("expected a German instruction for the configured room, got %q", got)
+	}
+	if got := claude.capturedParams[1].System[0].Text; got != "Be concise." {
+		t.Errorf("other rooms should get the plain system prompt, got %q", got)
+	}
+}
+
+func TestGetClaudeResponse_RoomContext(t *testing.T) {
+	matrix := &mockMatrixClient{stateEvents: map[event.Type]any{
+		event.StateRoomName: event.RoomNameEventContent{Name: "Infra On-Call"},
+		event.StateTopic:    event.TopicEventContent{Topic: "Pages, incidents and postmortems"},
+	}}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.SystemPrompt = "Be concise."
+
+	ask := func() string {
+		t.Helper()
+		if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return claude.capturedParams[len(claude.capturedParams)-1].System[0].Text
+	}
+
+	if got := ask(); got != "Be concise." {
+		t.Errorf("room context should be off by default, got %q", got)
+	}
+
+	bot.config.IncludeRoomContext = true
+	want := "You are chatting in the Matrix room \"Infra On-Call\".\nThe room's topic is: Pages, incidents and postmortems\n\nBe concise."
+	if got := ask(); got != want {
+		t.Errorf("system prompt = %q, want %q", got, want)
+	}
+
+	// The state is cached rather than fetched for every message.
+	matrix.stateEvents = nil
+	if got := ask(); got != want {
+		t.Errorf("expected the cached room context, got %q", got)
+	}
+}
+
+func TestGetClaudeResponse_ClarificationPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		ask      bool
+		custom   string
+		withTool bool
+		want     string
+	}{
+		{"default", true, "", true, defaultClarificationPrompt},
+		{"custom", true, "Ask first if unsure.", true, "Ask first if unsure."},
+		{"disabled", false, "", true, ""},
+		{"no tools", true, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claude := &mockClaudeMessenger{}
+			bot := newTestBot(&mockMatrixClient{}, claude)
+			bot.config.AskClarification = tt.ask
+			bot.config.ClarificationPrompt = tt.custom
+			if tt.withTool {
+				bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
+			}
+
+			if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var system string
+			if params := claude.capturedParams[0]; len(params.System) > 0 {
+				system = params.System[0].Text
+			}
+			if tt.want == "" {
+				if strings.Contains(system, defaultClarificationPrompt) {
+					t.Errorf("system prompt should not ask for clarification, got %q", system)
+				}
+			} else if !strings.HasSuffix(system, "\n\n"+tt.want) {
+				t.Errorf("system prompt = %q, want it to end with %q", system, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetClaudeResponse_ClarifyingQuestionSkipsTools(t *testing.T) {
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return makeClaudeResponse("Which repository do you mean?"), nil
+		},
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.AskClarification = true
+	tool := &countingTool{name: "search"}
+	bot.tools.Register(tool)
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "find the bug")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "Which repository do you mean?" {
+		t.Errorf("expected the clarifying question, got %q", resp)
+	}
+	if len(claude.capturedParams) != 1 || tool.calls != 0 {
+		t.Errorf("expected one API call and no tool runs, got %d calls and %d runs", len(claude.capturedParams), tool.calls)
+	}
+
+	// The user's answer continues the same conversation.
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "the bot repo"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := len(claude.capturedParams[1].Messages); got != 3 {
+		t.Errorf("follow-up should carry the question and answer, got %d messages", got)
+	}
+}
+
 // --- Tool use loop tests ---
 
 func TestGetClaudeResponse_ToolUseLoop(t *testing.T) {
@@ -275,7 +419,7 @@ func TestGetClaudeResponse_ToolUseLoop(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	bot.tools.Register(&fakeTool{name: "echo", result: "echoed: hi"})
 
-	resp, err := bot.getClaudeResponse(context.Background(), "$thread1", "test tool use")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "test tool use")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -299,7 +443,7 @@ func TestGetClaudeResponse_NoToolsPreservesExistingBehavior(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	// tools registry is empty (no tools registered)
 
-	resp, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -320,7 +464,7 @@ func TestGetClaudeResponse_ToolsIncludedInAPICall(t *testing.T) {
 	bot := newTestBot(matrix, claude)
 	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
 
-	_, err := bot.getClaudeResponse(context.Background(), "$thread1", "hello")
+	_, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -341,7 +485,7 @@ func TestGetClaudeResponse_MaxIterationsReached(t *testing.T) {
 	bot.config.MaxToolIterations = 3
 	bot.tools.Register(&fakeTool{name: "echo", result: "ok"})
 
-	resp, err := bot.getClaudeResponse(context.Background(), "$thread1", "loop forever")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "loop forever")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -370,7 +514,7 @@ func TestGetClaudeResponse_ToolExecutionError(t *testing.T) {
 	// Register a tool that returns isError=true
 	bot.tools.Register(&fakeTool{name: "failing", result: "something went wrong"})
 
-	resp, err := bot.getClaudeResponse(context.Background(), "$thread1", "test error")
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "test error")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -379,6 +523,181 @@ func TestGetClaudeResponse_ToolExecutionError(t *testing.T) {
 	}
 }
 
+// strictTool rejects every input as malformed.
+type strictTool struct{}
+
+func (strictTool) Name() string { return "strict" }
+func (strictTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name: "strict",
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{"path": map[string]any{"type": "string"}},
+				Required:   []string{"path"},
+			},
+		},
+	}
+}
+func (strictTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	return tools.InvalidInput(errors.New("cannot unmarshal number into path")), true, nil
+}
+
+func lastToolResultText(params anthropic.MessageNewParams) string {
+	msg := params.Messages[len(params.Messages)-1]
+	return msg.Content[0].OfToolResult.Content[0].OfText.Text
+}
+
+func TestGetClaudeResponse_SchemaHintOnInvalidInput(t *testing.T) {
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount <= 2 {
+				return makeToolUseResponse(fmt.Sprintf("tool_%d", callCount), "strict", json.RawMessage(`{"path":1}`)), nil
+			}
+			return makeClaudeResponse("gave up"), nil
+		},
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.ToolSchemaHints = true
+	bot.tools.Register(strictTool{})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "read it"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	first := lastToolResultText(claude.capturedParams[1])
+	if !strings.HasPrefix(first, "invalid input: ") || !strings.Contains(first, `"required":["path"]`) {
+		t.Errorf("first input error should carry the schema, got %q", first)
+	}
+	if second := lastToolResultText(claude.capturedParams[2]); strings.Contains(second, "schema") {
+		t.Errorf("schema should only be repeated once per turn, got %q", second)
+	}
+}
+
+func TestGetClaudeResponse_NoSchemaHintByDefault(t *testing.T) {
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount == 1 {
+				return makeToolUseResponse("tool_1", "strict", json.RawMessage(`{}`)), nil
+			}
+			return makeClaudeResponse("ok"), nil
+		},
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.tools.Register(strictTool{})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "read it"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := lastToolResultText(claude.capturedParams[1]); strings.Contains(got, "schema") {
+		t.Errorf("expected the plain error without schema hints enabled, got %q", got)
+	}
+}
+
+func TestStripTaggedSections(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"single", "<thinking>they want a number</thinking>\nThe answer is 4.", "The answer is 4."},
+		{"several tags", "<scratch>a</scratch>Yes.<thinking>b\nc</thinking> Done.", "Yes.Done."},
+		{"unclosed", "Sure. <thinking>cut off mid-thought", "Sure."},
+		{"untouched", "Use <b>bold</b> here.", "Use <b>bold</b> here."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripTaggedSections(tt.in, []string{"thinking", "scratch"}); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetClaudeResponse_StripTags(t *testing.T) {
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			var msg anthropic.Message
+			err := json.Unmarshal([]byte(`{"role":"assistant","content":[{"type":"text","text":"<thinking>2+2 is 4</thinking>It's 4."}]}`), &msg)
+			return &msg, err
+		},
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.StripTags = []string{"thinking"}
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "what is 2+2?")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "It's 4." {
+		t.Errorf("expected tagged section stripped from the reply, got %q", resp)
+	}
+	history := bot.conversations.Get("$thread1")
+	if got := history[len(history)-1].Content[0].OfText.Text; !strings.Contains(got, "<thinking>") {
+		t.Errorf("history should keep the original text, got %q", got)
+	}
+}
+
+func TestGetClaudeResponse_StripTagsLeavesNothing(t *testing.T) {
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			var msg anthropic.Message
+			err := json.Unmarshal([]byte(`{"role":"assistant","content":[{"type":"text","text":"<thinking>just musing</thinking>"}]}`), &msg)
+			return &msg, err
+		},
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.config.StripTags = []string{"thinking"}
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hmm?")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != defaultEmptyResponseText {
+		t.Errorf("expected the default empty-response text, got %q", resp)
+	}
+
+	bot.config.EmptyResponseText = "🤐"
+	if resp, _ := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread2"), "hmm?"); resp != "🤐" {
+		t.Errorf("expected the configured empty-response text, got %q", resp)
+	}
+}
+
+func TestGetClaudeResponse_MergesConsecutiveRoles(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.conversations.Append("$thread1",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("list files")),
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("tu_1", map[string]any{}, "fs_list")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("tu_1", "a.txt", false)),
+		anthropic.NewUserMessage(anthropic.NewTextBlock("never mind")),
+	)
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "what about b.txt?"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs := claude.capturedParams[0].Messages
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].Role == msgs[i-1].Role {
+			t.Fatalf("messages %d and %d both have role %s", i-1, i, msgs[i].Role)
+		}
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 alternating messages, got %d", len(msgs))
+	}
+	last := msgs[2].Content
+	if len(last) != 3 || last[0].OfToolResult == nil || last[1].OfText.Text != "never mind" || last[2].OfText.Text != "what about b.txt?" {
+		t.Errorf("merged user message should keep block order with the tool result first, got %+v", last)
+	}
+
+	stored := bot.conversations.Get("$thread1")
+	if len(stored[2].Content) != 1 || len(stored[3].Content) != 1 || len(stored[4].Content) != 1 {
+		t.Errorf("stored messages should not be merged, got %+v", stored[2:5])
+	}
+}
+
 func TestExtractText(t *testing.T) {
 	blocks := []anthropic.ContentBlockUnion{
 		{Type: "thinking", Thinking: "hmm"},
@@ -403,7 +722,7 @@ func TestExtractText_Empty(t *testing.T) {
 
 func TestToolCapabilitiesPrompt_NoTools(t *testing.T) {
 	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
-	if got := bot.toolCapabilitiesPrompt(); got != "" {
+	if got := bot.toolCapabilitiesPrompt(bot.cfg()); got != "" {
 		t.Errorf("expected empty string for no tools, got %q", got)
 	}
 }
@@ -411,7 +730,7 @@ func TestToolCapabilitiesPrompt_NoTools(t *testing.T) {
 func TestToolCapabilitiesPrompt_NilRegistry(t *testing.T) {
 	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
 	bot.tools = nil
-	if got := bot.toolCapabilitiesPrompt(); got != "" {
+	if got := bot.toolCapabilitiesPrompt(bot.cfg()); got != "" {
 		t.Errorf("expected empty string for nil registry, got %q", got)
 	}
 }
@@ -422,19 +741,31 @@ func TestToolCapabilitiesPrompt_WebSearch(t *testing.T) {
 		OfWebSearchTool20250305: &anthropic.WebSearchTool20250305Param{},
 	})
 
-	got := bot.toolCapabilitiesPrompt()
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
 	if !strings.Contains(got, "Web search") {
 		t.Errorf("expected web search capability, got %q", got)
 	}
 }
 
+func TestToolCapabilitiesPrompt_CodeExecution(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	bot.tools.AddServerTool(anthropic.ToolUnionParam{
+		OfCodeExecutionTool20250825: &anthropic.CodeExecutionTool20250825Param{},
+	})
+
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
+	if !strings.Contains(got, "Code execution") || strings.Contains(got, "Web search") {
+		t.Errorf("expected only code execution capability, got %q", got)
+	}
+}
+
 func TestToolCapabilitiesPrompt_Filesystem(t *testing.T) {
 	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
 	bot.tools.Register(&fakeTool{name: "fs_read", result: "ok"})
 	bot.tools.Register(&fakeTool{name: "fs_write", result: "ok"})
 	bot.tools.Register(&fakeTool{name: "fs_list", result: "ok"})
 
-	got := bot.toolCapabilitiesPrompt()
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
 	if !strings.Contains(got, "Filesystem") {
 		t.Errorf("expected filesystem capability, got %q", got)
 	}
@@ -444,11 +775,22 @@ func TestToolCapabilitiesPrompt_Filesystem(t *testing.T) {
 	}
 }
 
+func TestToolCapabilitiesPrompt_ReadOnlyFilesystem(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	bot.tools.Register(&fakeTool{name: "fs_read", result: "ok"})
+	bot.tools.Register(&fakeTool{name: "fs_list", result: "ok"})
+
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
+	if !strings.Contains(got, "read-only") || strings.Contains(got, "write") {
+		t.Errorf("expected a read-only filesystem capability, got %q", got)
+	}
+}
+
 func TestToolCapabilitiesPrompt_CustomTool(t *testing.T) {
 	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
 	bot.tools.Register(&fakeTool{name: "weather_lookup", result: "ok"})
 
-	got := bot.toolCapabilitiesPrompt()
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
 	if !strings.Contains(got, "weather_lookup") {
 		t.Errorf("expected custom tool name in output, got %q", got)
 	}
@@ -462,7 +804,7 @@ func TestToolCapabilitiesPrompt_AllTypes(t *testing.T) {
 	bot.tools.Register(&fakeTool{name: "fs_read", result: "ok"})
 	bot.tools.Register(&fakeTool{name: "custom_tool", result: "ok"})
 
-	got := bot.toolCapabilitiesPrompt()
+	got := bot.toolCapabilitiesPrompt(bot.cfg())
 	if !strings.Contains(got, "Web search") {
 		t.Errorf("expected web search capability, got %q", got)
 	}
@@ -473,3 +815,1187 @@ func TestToolCapabilitiesPrompt_AllTypes(t *testing.T) {
 		t.Errorf("expected custom tool name, got %q", got)
 	}
 }
+
+// --- Tool activity tests ---
+
+func TestGetClaudeResponse_ShowToolActivity(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount <= 2 {
+				return makeToolUseResponse(fmt.Sprintf("tool_%d", callCount), "fs_read", json.RawMessage(`{"path":"notes.txt"}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.ShowToolActivity = true
+	bot.tools.Register(&fakeTool{name: "fs_read", result: "contents"})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "read my notes"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected 2 activity messages, got %d", len(matrix.sentEvents))
+	}
+	for _, sent := range matrix.sentEvents {
+		content := sent.Content.(*event.MessageEventContent)
+		if !strings.Contains(content.Body, "fs_read") || !strings.Contains(content.Body, "notes.txt") {
+			t.Errorf("unexpected activity message: %q", content.Body)
+		}
+		if content.RelatesTo == nil || content.RelatesTo.EventID != "$thread1" {
+			t.Error("activity message should be posted in the thread")
+		}
+	}
+}
+
+func TestGetClaudeResponse_EchoesToolResults(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			switch callCount {
+			case 1:
+				return makeToolUseResponse("tool_1", "web_fetch", json.RawMessage(`{"url":"https://example.com"}`)), nil
+			case 2:
+				return makeToolUseResponse("tool_2", "big_fetch", json.RawMessage(`{}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.EchoToolResults = true
+	bot.tools.Register(&fakeTool{name: "web_fetch", result: "<h1>Example Domain</h1>"})
+	long := strings.Repeat("x", maxEchoLength+50)
+	bot.tools.Register(&fakeTool{name: "big_fetch", result: long})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "fetch it"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected one echo per tool call, got %d messages", len(matrix.sentEvents))
+	}
+	first := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if !strings.Contains(first.Body, "web_fetch") || !strings.Contains(first.Body, "<h1>Example Domain</h1>") {
+		t.Errorf("unexpected echo: %q", first.Body)
+	}
+	if !strings.Contains(first.FormattedBody, "<pre><code>&lt;h1&gt;Example Domain&lt;/h1&gt;</code></pre>") {
+		t.Errorf("expected the result as an escaped code block, got %q", first.FormattedBody)
+	}
+	if first.RelatesTo == nil || first.RelatesTo.EventID != "$thread1" {
+		t.Error("echo should be posted in the thread")
+	}
+	second := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if strings.Contains(second.Body, long) || !strings.Contains(second.Body, "(50 more characters)") {
+		t.Errorf("expected a truncated echo, got %d bytes", len(second.Body))
+	}
+
+	// Claude still gets the whole result.
+	last := claude.capturedParams[len(claude.capturedParams)-1].Messages
+	if got := last[len(last)-1].Content[0].OfToolResult.Content[0].OfText.Text; got != long {
+		t.Errorf("expected Claude to get the full result, got %d bytes", len(got))
+	}
+}
+
+func TestGetClaudeResponse_NarratesEachIteration(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			switch callCount {
+			case 1:
+				resp := makeToolUseResponse("tool_1", "fs_list", json.RawMessage(`{}`))
+				resp.Content = append([]anthropic.ContentBlockUnion{{Type: "text", Text: "First I'll list the sandbox.\nThen read what's there."}}, resp.Content...)
+				return resp, nil
+			case 2:
+				resp := makeToolUseResponse("tool_2", "fs_read", json.RawMessage(`{"path":"notes.txt"}`))
+				resp.Content = append([]anthropic.ContentBlockUnion{{Type: "text", Text: "\nNow reading notes.txt."}}, resp.Content...)
+				return resp, nil
+			case 3:
+				// No accompanying text, so nothing to narrate.
+				return makeToolUseResponse("tool_3", "fs_read", json.RawMessage(`{"path":"todo.txt"}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.NarrateTools = true
+	bot.tools.Register(&fakeTool{name: "fs_list", result: "notes.txt"})
+	bot.tools.Register(&fakeTool{name: "fs_read", result: "contents"})
+
+	got, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "summarize my notes")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got != "done" {
+		t.Errorf("narration should not be repeated in the reply, got %q", got)
+	}
+
+	want := []string{"💭 First I'll list the sandbox.", "💭 Now reading notes.txt."}
+	if len(matrix.sentEvents) != len(want) {
+		t.Fatalf("expected %d narration messages, got %d", len(want), len(matrix.sentEvents))
+	}
+	for i, sent := range matrix.sentEvents {
+		content := sent.Content.(*event.MessageEventContent)
+		if content.Body != want[i] {
+			t.Errorf("narration %d = %q, want %q", i, content.Body, want[i])
+		}
+		if content.RelatesTo == nil || content.RelatesTo.EventID != "$thread1" {
+			t.Error("narration should be posted in the thread")
+		}
+	}
+}
+
+func TestProgressReporter_PostsThenEdits(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	clock := bot.clock.(*fakeClock)
+	report := bot.progressReporter(context.Background(), turnFor(bot, "$thread1"), "fetch_build")
+
+	report("downloading", 1, 4)
+	report("still downloading", 2, 4) // within the edit interval, dropped
+	clock.Advance(progressEditInterval)
+	report("unpacking", 3, 4)
+
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected a post and one edit, got %d events", len(matrix.sentEvents))
+	}
+	first := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if first.Body != "⏳ fetch_build: downloading (25%)" || first.RelatesTo.EventID != "$thread1" {
+		t.Errorf("unexpected progress message: %q", first.Body)
+	}
+	edit := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if edit.NewContent == nil || edit.NewContent.Body != "⏳ fetch_build: unpacking (75%)" {
+		t.Errorf("expected an edit to 75%%, got %+v", edit.NewContent)
+	}
+	if edit.RelatesTo.GetReplaceID() != "$reply" {
+		t.Errorf("edit should replace the progress message, got %+v", edit.RelatesTo)
+	}
+}
+
+func TestGetClaudeResponse_ToolActivityDisabledByDefault(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount == 1 {
+				return makeToolUseResponse("tool_1", "echo", json.RawMessage(`{}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.tools.Register(&fakeTool{name: "echo", result: "ok"})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hi"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(matrix.sentEvents) != 0 {
+		t.Errorf("expected no activity messages, got %d", len(matrix.sentEvents))
+	}
+}
+
+func TestSummarizeToolInput_RedactsLongValues(t *testing.T) {
+	input := json.RawMessage(`{"path":"a.txt","content":"` + strings.Repeat("x", 100) + `","n":3}`)
+	got := summarizeToolInput(input)
+	if got != "content: …, path: a.txt" {
+		t.Errorf("unexpected summary: %q", got)
+	}
+}
+
+// --- Model fallback tests ---
+
+func TestGetClaudeResponse_FallbackModel(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			if params.Model == "claude-retired" {
+				return nil, makeAPIError(http.StatusNotFound)
+			}
+			return makeClaudeResponse("from fallback"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.Model = "claude-retired"
+	bot.config.FallbackModels = []string{"claude-sonnet-4-20250514"}
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "from fallback" {
+		t.Errorf("expected fallback response, got %q", resp)
+	}
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 API calls, got %d", len(claude.capturedParams))
+	}
+	if claude.capturedParams[1].Model != "claude-sonnet-4-20250514" {
+		t.Errorf("second call should use fallback model, got %s", claude.capturedParams[1].Model)
+	}
+
+	// The working model is remembered for the thread.
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "again"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(claude.capturedParams) != 3 || claude.capturedParams[2].Model != "claude-sonnet-4-20250514" {
+		t.Errorf("follow-up should go straight to the fallback model")
+	}
+}
+
+func TestGetClaudeResponse_FallbackNotUsedForOtherErrors(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return nil, makeAPIError(http.StatusInternalServerError)
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.FallbackModels = []string{"claude-haiku"}
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(claude.capturedParams) != 1 {
+		t.Errorf("expected no fallback attempt, got %d calls", len(claude.capturedParams))
+	}
+}
+
+func TestGetClaudeResponse_PromptTooLongTrimsAndRetries(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	tooLong := makeAPIError(http.StatusBadRequest)
+	if err := tooLong.UnmarshalJSON([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long: 210000 tokens > 200000 maximum"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			if len(params.Messages) > 3 {
+				return nil, tooLong
+			}
+			return makeClaudeResponse("fits now"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	for _, q := range []string{"one", "two", "three"} {
+		bot.conversations.Append("$thread1",
+			anthropic.NewUserMessage(anthropic.NewTextBlock(q)),
+			anthropic.NewAssistantMessage(anthropic.NewTextBlock("answer "+q)))
+	}
+
+	got, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "four")
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	if got != "fits now" {
+		t.Errorf("reply = %q", got)
+	}
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected one retry, got %d calls", len(claude.capturedParams))
+	}
+	retried := claude.capturedParams[1].Messages
+	if len(retried) != 3 || retried[0].Content[0].OfText.Text != "three" {
+		t.Errorf("expected the two oldest turns dropped, retried with %d messages starting %+v", len(retried), retried[0])
+	}
+}
+
+func TestGetClaudeResponse_PromptTooLongRetriesOnce(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	tooLong := makeAPIError(http.StatusBadRequest)
+	if err := tooLong.UnmarshalJSON([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"prompt is too long"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			return nil, tooLong
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.conversations.Append("$thread1",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("one")),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("answer")))
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "two"); err == nil {
+		t.Fatal("expected an error when the trimmed history is still too long")
+	}
+	if len(claude.capturedParams) != 2 {
+		t.Errorf("expected exactly one retry, got %d calls", len(claude.capturedParams))
+	}
+}
+
+// --- Disabled tool tests ---
+
+func TestGetClaudeResponse_DisabledToolExcluded(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.DisabledTools = []string{"fs_write"}
+	bot.tools.Register(&fakeTool{name: "fs_read", result: "ok"})
+	bot.tools.Register(&fakeTool{name: "fs_write", result: "ok"})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	defs := claude.capturedParams[0].Tools
+	if len(defs) != 1 || toolName(defs[0]) != "fs_read" {
+		names := make([]string, len(defs))
+		for i, d := range defs {
+			names[i] = toolName(d)
+		}
+		t.Errorf("expected only fs_read to be sent, got %v", names)
+	}
+}
+
+func TestGetClaudeResponse_DisabledToolCallDenied(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount == 1 {
+				return makeToolUseResponse("tool_1", "fs_write", json.RawMessage(`{"path":"x","content":"y"}`)), nil
+			}
+			return makeClaudeResponse("ok"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.DisabledTools = []string{"fs_write"}
+	tool := &countingTool{name: "fs_write"}
+	bot.tools.Register(tool)
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "write"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tool.calls != 0 {
+		t.Errorf("disabled tool should not be executed, got %d calls", tool.calls)
+	}
+
+	msgs := bot.conversations.Get("$thread1")
+	result := msgs[2].Content[0].OfToolResult
+	if result == nil {
+		t.Fatal("expected a tool_result block")
+	}
+	if !result.IsError.Value || !strings.Contains(result.Content[0].OfText.Text, "disabled") {
+		t.Errorf("expected denial result, got %+v", result)
+	}
+}
+
+// --- Tool choice tests ---
+
+func TestGetClaudeResponse_ToolChoiceFromConfig(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.ToolChoice = "any"
+	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claude.capturedParams[0].ToolChoice.OfAny == nil {
+		t.Errorf("expected tool_choice any, got %+v", claude.capturedParams[0].ToolChoice)
+	}
+}
+
+func TestGetClaudeResponse_ToolChoiceSpecificToolOnlyFirstIteration(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	callCount := 0
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			callCount++
+			if callCount == 1 {
+				return makeToolUseResponse("tool_1", "my_tool", json.RawMessage(`{}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.ToolChoice = "my_tool"
+	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := claude.capturedParams[0].ToolChoice.OfTool
+	if first == nil || first.Name != "my_tool" {
+		t.Errorf("expected first call to force my_tool, got %+v", claude.capturedParams[0].ToolChoice)
+	}
+	if second := claude.capturedParams[1].ToolChoice; second.OfTool != nil {
+		t.Error("forced tool choice should not be repeated after the first call")
+	}
+}
+
+func TestHandleMessage_NocodeCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.config.ToolChoice = "auto"
+	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
+
+	sendMention(bot, "$evt1", "nocode what is 2+2?", nil)
+
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected 1 Claude call, got %d", len(claude.capturedParams))
+	}
+	params := claude.capturedParams[0]
+	if params.ToolChoice.OfNone == nil {
+		t.Errorf("expected tool_choice none, got %+v", params.ToolChoice)
+	}
+	text := params.Messages[0].Content[0].OfText.Text
+	if text != "what is 2+2?" {
+		t.Errorf("command word should be stripped, got %q", text)
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.Body != "mock response" {
+		t.Errorf("expected normal text answer, got %q", content.Body)
+	}
+}
+
+func TestHandleMessage_SearchCommand(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	bot.tools.Register(&fakeTool{name: "my_tool", result: "ok"})
+
+	hasWebSearch := func(params anthropic.MessageNewParams) bool {
+		return slices.ContainsFunc(params.Tools, func(d anthropic.ToolUnionParam) bool { return d.OfWebSearchTool20250305 != nil })
+	}
+
+	sendMention(bot, "$evt1", "search who won the match last night?", nil)
+	sendMention(bot, "$evt2", "what is 2+2?", nil)
+
+	if len(claude.capturedParams) != 2 {
+		t.Fatalf("expected 2 Claude calls, got %d", len(claude.capturedParams))
+	}
+	searched := claude.capturedParams[0]
+	if !hasWebSearch(searched) {
+		t.Errorf("search command should offer web search, got tools %+v", searched.Tools)
+	}
+	if len(searched.Tools) != 2 {
+		t.Errorf("local tools should still be offered alongside web search, got %d tools", len(searched.Tools))
+	}
+	if text := searched.Messages[0].Content[0].OfText.Text; text != "who won the match last night?" {
+		t.Errorf("command word should be stripped, got %q", text)
+	}
+	if hasWebSearch(claude.capturedParams[1]) {
+		t.Error("a normal question should not get web search")
+	}
+}
+
+func TestGetClaudeResponse_EphemeralSandbox(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			last := params.Messages[len(params.Messages)-1]
+			if len(params.Messages) == 1 && last.Content[0].OfText.Text == "write a note" {
+				return makeToolUseResponse("tool_1", "fs_write", json.RawMessage(`{"path":"note.txt","content":"hi"}`)), nil
+			}
+			return makeClaudeResponse("done"), nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	clock := bot.clock.(*fakeClock)
+	bot.conversations.now = clock.Now
+	parent := t.TempDir()
+	for _, tool := range tools.NewFilesystemTools(parent, false, false) {
+		bot.tools.Register(tool)
+	}
+	bot.UseEphemeralSandboxes(tools.NewEphemeralSandboxes(parent))
+
+	sandboxes := func() []string {
+		entries, err := os.ReadDir(parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	// A thread that never touches a file gets no directory.
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$chat"), "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sandboxes(); len(got) != 0 {
+		t.Fatalf("expected no sandbox before filesystem use, got %v", got)
+	}
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$idle"), "write a note"); err != nil {
+		t.Fatal(err)
+	}
+	idle := sandboxes()
+	if len(idle) != 1 {
+		t.Fatalf("expected 1 sandbox after fs_write, got %v", idle)
+	}
+	if data, err := os.ReadFile(filepath.Join(parent, idle[0], "note.txt")); err != nil || string(data) != "hi" {
+		t.Fatalf("expected note.txt in the thread's sandbox, got %q, %v", data, err)
+	}
+
+	clock.Advance(time.Hour)
+	other := turnFor(bot, "$other")
+	other.roomID = "!other:example.com"
+	if _, err := bot.getClaudeResponse(context.Background(), other, "write a note"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sandboxes(); len(got) != 2 {
+		t.Fatalf("each thread should get its own sandbox, got %v", got)
+	}
+
+	// Eviction deletes the idle thread's sandbox and leaves the other.
+	bot.conversations.EvictIdle(30 * time.Minute)
+	if got := sandboxes(); len(got) != 1 || got[0] == idle[0] {
+		t.Fatalf("expected only the idle thread's sandbox removed, got %v", got)
+	}
+
+	// So does dropping a room's threads.
+	bot.conversations.DropRoom("!other:example.com")
+	if got := sandboxes(); len(got) != 0 {
+		t.Errorf("expected every sandbox removed, got %v", got)
+	}
+}
+
+func TestConversationStore_EvictIdle(t *testing.T) {
+	store := NewConversationStore()
+	now := time.Unix(1_000_000, 0)
+	store.now = func() time.Time { return now }
+
+	store.Append("$idle", anthropic.NewUserMessage(anthropic.NewTextBlock("old")))
+	store.SetModel("$idle", "claude-haiku")
+	store.Append("$active", anthropic.NewUserMessage(anthropic.NewTextBlock("old")))
+
+	now = now.Add(50 * time.Minute)
+	store.Get("$active") // reading counts as activity
+
+	now = now.Add(20 * time.Minute)
+	if n := store.EvictIdle(time.Hour); n != 1 {
+		t.Fatalf("expected 1 eviction, got %d", n)
+	}
+	if len(store.Get("$idle")) != 0 || store.Model("$idle") != "" {
+		t.Error("idle thread should have been evicted")
+	}
+	if len(store.Get("$active")) != 1 {
+		t.Error("active thread should survive")
+	}
+}
+
+func TestConversationStore_MaxThreadsEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewConversationStore()
+	now := time.Unix(1_000_000, 0)
+	store.now = func() time.Time { return now }
+	store.SetMaxThreads(3)
+
+	for _, threadID := range []id.EventID{"$a", "$b", "$c"} {
+		store.Append(threadID, anthropic.NewUserMessage(anthropic.NewTextBlock("hi")))
+		now = now.Add(time.Minute)
+	}
+	store.Get("$a") // reading counts as use, so $b is now the oldest
+	now = now.Add(time.Minute)
+
+	store.Append("$d", anthropic.NewUserMessage(anthropic.NewTextBlock("hi")))
+	if store.Len() != 3 {
+		t.Fatalf("expected the store to stay at 3 threads, got %d", store.Len())
+	}
+	if len(store.Get("$b")) != 0 {
+		t.Error("least recently used thread should have been evicted")
+	}
+	for _, threadID := range []id.EventID{"$a", "$c", "$d"} {
+		if len(store.Get(threadID)) != 1 {
+			t.Errorf("thread %s should remain", threadID)
+		}
+	}
+
+	// Lowering the cap trims the store right away.
+	store.SetMaxThreads(1)
+	if store.Len() != 1 {
+		t.Errorf("expected 1 thread after lowering the cap, got %d", store.Len())
+	}
+}
+
+// --- Sampling parameter tests ---
+
+func TestGetClaudeResponse_TemperatureFromConfig(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	temp := 0.3
+	bot.config.Temperature = &temp
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := claude.capturedParams[0].Temperature; !got.Valid() || got.Value != 0.3 {
+		t.Errorf("expected temperature 0.3, got %+v", got)
+	}
+}
+
+func TestGetClaudeResponse_TemperatureOmittedWhenUnset(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claude.capturedParams[0].Temperature.Valid() {
+		t.Error("temperature should be omitted when not configured")
+	}
+}
+
+func TestGetClaudeResponse_TopPAndTopK(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claude.capturedParams[0].TopP.Valid() || claude.capturedParams[0].TopK.Valid() {
+		t.Error("top_p and top_k should be omitted when not configured")
+	}
+
+	topP, topK := 0.8, int64(20)
+	bot.config.TopP = &topP
+	bot.config.TopK = &topK
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread2"), "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	params := claude.capturedParams[1]
+	if !params.TopP.Valid() || params.TopP.Value != 0.8 {
+		t.Errorf("expected top_p 0.8, got %+v", params.TopP)
+	}
+	if !params.TopK.Valid() || params.TopK.Value != 20 {
+		t.Errorf("expected top_k 20, got %+v", params.TopK)
+	}
+}
+
+func TestPersistentConversationStore_RestoresModelOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+
+	first := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	store, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first.conversations = store
+	sendMention(first, "$root", "model claude-opus-4-20250514", nil)
+	sendMention(first, "$evt2", "hello", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+
+	// Simulate a restart: a new bot loading the same file.
+	claude := &mockClaudeMessenger{}
+	second := newTestBot(&mockMatrixClient{}, claude)
+	second.conversations, err = NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+
+	if got := second.conversations.Model("$root"); got != "claude-opus-4-20250514" {
+		t.Errorf("expected restored model override, got %q", got)
+	}
+	if got := len(second.conversations.Get("$root")); got != 2 {
+		t.Errorf("expected 2 restored messages, got %d", got)
+	}
+
+	sendMention(second, "$evt3", "again", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected 1 API call, got %d", len(claude.capturedParams))
+	}
+	if got := claude.capturedParams[0].Model; got != "claude-opus-4-20250514" {
+		t.Errorf("expected restored model to be used, got %q", got)
+	}
+	if got := len(claude.capturedParams[0].Messages); got != 3 {
+		t.Errorf("expected restored history plus the new message, got %d messages", got)
+	}
+}
+
+func TestPersistentConversationStore_MissingFile(t *testing.T) {
+	store, err := NewPersistentConversationStore(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := store.Get("$root"); len(got) != 0 {
+		t.Errorf("expected empty store, got %d messages", len(got))
+	}
+}
+
+func TestConversationStore_ExportImportRoundTrip(t *testing.T) {
+	src := NewConversationStore()
+	src.Append("$a",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("first question")),
+		anthropic.NewAssistantMessage(
+			anthropic.NewTextBlock("let me look"),
+			anthropic.NewToolUseBlock("call_1", map[string]any{"q": "go"}, "search"),
+		),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("call_1", "found it", false)),
+	)
+	src.SetModel("$a", "claude-opus-4-20250514")
+	src.SetRoom("$a", "!one:example.com")
+	src.Append("$b", anthropic.NewUserMessage(anthropic.NewTextBlock("second question")))
+	src.SetPersona("$b", "You are terse.")
+	src.SetRoom("$b", "!two:example.com")
+
+	var first bytes.Buffer
+	if err := src.Export(&first); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	dst := NewConversationStore()
+	dst.Append("$other", anthropic.NewUserMessage(anthropic.NewTextBlock("kept")))
+	n, err := dst.Import(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 imported threads, got %d", n)
+	}
+
+	a := dst.Get("$a")
+	if len(a) != 3 {
+		t.Fatalf("expected 3 messages in $a, got %d", len(a))
+	}
+	if got := a[0].Content[0].OfText.Text; got != "first question" {
+		t.Errorf("unexpected first message in $a: %q", got)
+	}
+	if use := a[1].Content[1].OfToolUse; use == nil || use.ID != "call_1" || use.Name != "search" {
+		t.Errorf("expected tool_use call_1 to survive, got %+v", a[1].Content[1])
+	}
+	if result := a[2].Content[0].OfToolResult; result == nil || result.ToolUseID != "call_1" {
+		t.Errorf("expected tool_result for call_1 to survive, got %+v", a[2].Content[0])
+	}
+	b := dst.Get("$b")
+	if len(b) != 1 || b[0].Content[0].OfText.Text != "second question" {
+		t.Errorf("expected $b to hold only its own message, got %+v", b)
+	}
+	if got := dst.Model("$a"); got != "claude-opus-4-20250514" {
+		t.Errorf("expected model override on $a, got %q", got)
+	}
+	if got := dst.Model("$b"); got != "" {
+		t.Errorf("expected no model override on $b, got %q", got)
+	}
+	if got := dst.Persona("$b"); got != "You are terse." {
+		t.Errorf("expected persona on $b, got %q", got)
+	}
+	if got := dst.DropRoom("!two:example.com"); got != 1 {
+		t.Errorf("expected $b's room to survive, dropped %d threads", got)
+	}
+	if got := len(dst.Get("$other")); got != 1 {
+		t.Errorf("expected existing thread to be kept, got %d messages", got)
+	}
+
+	again := NewConversationStore()
+	if _, err := again.Import(bytes.NewReader(first.Bytes())); err != nil {
+		t.Fatalf("second import: %v", err)
+	}
+	var second bytes.Buffer
+	if err := again.Export(&second); err != nil {
+		t.Fatalf("second export: %v", err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("expected the export to survive a round trip unchanged:\n%s\nvs\n%s", first.String(), second.String())
+	}
+}
+
+func TestConversationStore_ImportRejectsUnknownVersion(t *testing.T) {
+	store := NewConversationStore()
+	if _, err := store.Import(strings.NewReader(`{"version": 99, "threads": {}}`)); err == nil {
+		t.Error("expected an error for an unknown export version")
+	}
+}
+
+func TestGetClaudeResponse_TracesToolFlow(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	claude := &mockClaudeMessenger{}
+	callCount := 0
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		callCount++
+		if callCount == 1 {
+			return makeToolUseResponse("call_1", "lookup", json.RawMessage(`{}`)), nil
+		}
+		return makeClaudeResponse("done"), nil
+	}
+
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, claude)
+	bot.tools.Register(&fakeTool{name: "lookup", result: "found"})
+	bot.tracer = provider.Tracer("test")
+
+	sendMention(bot, "$root", "look something up", nil)
+
+	spans := recorder.Ended()
+	byName := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byName[s.Name()] = append(byName[s.Name()], s)
+	}
+	if len(byName["handleMessage"]) != 1 || len(byName["claude.iteration"]) != 2 || len(byName["tool.execute"]) != 1 {
+		t.Fatalf("unexpected spans: %d handleMessage, %d claude.iteration, %d tool.execute",
+			len(byName["handleMessage"]), len(byName["claude.iteration"]), len(byName["tool.execute"]))
+	}
+
+	root := byName["handleMessage"][0]
+	for _, iter := range byName["claude.iteration"] {
+		if iter.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("claude.iteration should be a child of handleMessage")
+		}
+	}
+	tool := byName["tool.execute"][0]
+	if tool.Parent().SpanID() != byName["claude.iteration"][0].SpanContext().SpanID() {
+		t.Errorf("tool.execute should be a child of the first claude.iteration")
+	}
+
+	attrs := make(map[attribute.Key]string)
+	for _, kv := range append(root.Attributes(), tool.Attributes()...) {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs["matrix.room_id"] != "!room:example.com" || attrs["matrix.thread_id"] != "$root" {
+		t.Errorf("missing room/thread attributes: %v", attrs)
+	}
+	if attrs["tool.name"] != "lookup" || attrs["tool.outcome"] != "ok" {
+		t.Errorf("missing tool attributes: %v", attrs)
+	}
+}
+
+func danglingToolUseMessage(toolID string) anthropic.MessageParam {
+	return anthropic.NewAssistantMessage(anthropic.NewToolUseBlock(toolID, map[string]any{}, "lookup"))
+}
+
+func TestConversationStore_Validate(t *testing.T) {
+	store := NewConversationStore()
+	store.Append("$thread",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("look it up")),
+		danglingToolUseMessage("call_1"),
+	)
+
+	if got := store.Validate("$thread"); len(got) != 1 || got[0] != "call_1" {
+		t.Fatalf("expected dangling call_1, got %v", got)
+	}
+
+	store.Append("$thread", anthropic.NewUserMessage(anthropic.NewToolResultBlock("call_1", "ok", false)))
+	if got := store.Validate("$thread"); len(got) != 0 {
+		t.Errorf("expected no dangling tool uses once answered, got %v", got)
+	}
+}
+
+func TestConversationStore_HealDanglingToolUsesMidHistory(t *testing.T) {
+	store := NewConversationStore()
+	store.Append("$thread",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("look it up")),
+		danglingToolUseMessage("call_1"),
+		anthropic.NewUserMessage(anthropic.NewTextBlock("hello?")),
+	)
+
+	if healed := store.HealDanglingToolUses("$thread", "interrupted"); len(healed) != 1 {
+		t.Fatalf("expected 1 healed call, got %v", healed)
+	}
+	history := store.Get("$thread")
+	if len(history) != 3 {
+		t.Fatalf("expected results merged into the next user message, got %d messages", len(history))
+	}
+	first := history[2].Content[0].OfToolResult
+	if first == nil || first.ToolUseID != "call_1" {
+		t.Errorf("expected tool_result to lead the following user message, got %+v", history[2].Content[0])
+	}
+	if len(store.Validate("$thread")) != 0 {
+		t.Error("expected history to be valid after healing")
+	}
+}
+
+func TestGetClaudeResponse_HealsDanglingToolUse(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		if len(danglingToolUses(params.Messages)) > 0 {
+			return nil, makeAPIError(http.StatusBadRequest)
+		}
+		return makeClaudeResponse("recovered"), nil
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.conversations.Append("$thread",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("look it up")),
+		danglingToolUseMessage("call_1"),
+	)
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread"), "try again")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "recovered" {
+		t.Errorf("expected 'recovered', got %q", resp)
+	}
+
+	result := claude.capturedParams[0].Messages[2].Content[0].OfToolResult
+	if result == nil || result.ToolUseID != "call_1" || !result.IsError.Value {
+		t.Errorf("expected synthetic error tool_result for call_1, got %+v", result)
+	}
+}
+
+func TestGetClaudeResponse_AppendsCitationSources(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		return &anthropic.Message{
+			Role: "assistant",
+			Content: []anthropic.ContentBlockUnion{
+				{Type: "text", Text: "Go 1.25 was released in August.", Citations: []anthropic.TextCitationUnion{
+					{Type: "web_search_result_location", URL: "https://go.dev/blog/go1.25", Title: "Go 1.25 is released"},
+				}},
+				{Type: "text", Text: "It includes a new GC.", Citations: []anthropic.TextCitationUnion{
+					{Type: "web_search_result_location", URL: "https://go.dev/doc/go1.25"},
+					{Type: "web_search_result_location", URL: "https://go.dev/blog/go1.25", Title: "Go 1.25 is released"},
+				}},
+			},
+			StopReason: anthropic.StopReasonEndTurn,
+		}, nil
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread"), "what's new in go?")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := "Go 1.25 was released in August.\nIt includes a new GC." +
+		"\n\nSources:\n1. Go 1.25 is released — https://go.dev/blog/go1.25\n2. https://go.dev/doc/go1.25"
+	if resp != want {
+		t.Errorf("unexpected response:\n%s\nwant:\n%s", resp, want)
+	}
+}
+
+func TestCitationSources_NoCitations(t *testing.T) {
+	if got := citationSources([]anthropic.ContentBlockUnion{{Type: "text", Text: "plain"}}); got != "" {
+		t.Errorf("expected no footer, got %q", got)
+	}
+}
+
+func TestGetClaudeResponse_CapsToolCallsPerTurn(t *testing.T) {
+	tool := &countingTool{name: "lookup"}
+	claude := &mockClaudeMessenger{}
+	callCount := 0
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		callCount++
+		if callCount > 1 {
+			return makeClaudeResponse("done"), nil
+		}
+		resp := &anthropic.Message{Role: "assistant", StopReason: anthropic.StopReasonToolUse}
+		for i := range 5 {
+			resp.Content = append(resp.Content, anthropic.ContentBlockUnion{
+				Type: "tool_use", ID: fmt.Sprintf("call_%d", i), Name: "lookup", Input: json.RawMessage(`{}`),
+			})
+		}
+		return resp, nil
+	}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.tools.Register(tool)
+	bot.config.ToolCallsPerTurn = 2
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread"), "fan out"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tool.calls != 2 {
+		t.Errorf("expected 2 executed calls, got %d", tool.calls)
+	}
+	results := claude.capturedParams[1].Messages[2].Content
+	if len(results) != 5 {
+		t.Fatalf("expected a result for every call, got %d", len(results))
+	}
+	for _, r := range results[2:] {
+		if !r.OfToolResult.IsError.Value {
+			t.Errorf("expected skipped call %s to be an error result", r.OfToolResult.ToolUseID)
+		}
+	}
+}
+
+func TestGetClaudeResponse_SendsSandboxImage(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 3)))
+	os.WriteFile(filepath.Join(dir, "chart.png"), buf.Bytes(), 0o644)
+
+	claude := &mockClaudeMessenger{}
+	callCount := 0
+	claude.newMessageFunc = func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+		callCount++
+		if callCount == 1 {
+			return makeToolUseResponse("call_1", "fs_send_image", json.RawMessage(`{"path":"chart.png"}`)), nil
+		}
+		return makeClaudeResponse("Here's the chart."), nil
+	}
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, claude)
+	for _, tool := range tools.NewFilesystemTools(dir, false, false) {
+		bot.tools.Register(tool)
+	}
+
+	if _, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread"), "draw a chart"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(matrix.uploads) != 1 || matrix.uploads[0].ContentType != "image/png" {
+		t.Fatalf("expected one image/png upload, got %+v", matrix.uploads)
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected 1 sent event, got %d", len(matrix.sentEvents))
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.MsgType != event.MsgImage {
+		t.Errorf("expected m.image, got %s", content.MsgType)
+	}
+	if content.URL != "mxc://example.com/image" {
+		t.Errorf("unexpected URL: %s", content.URL)
+	}
+	if content.Info == nil || content.Info.MimeType != "image/png" || content.Info.Width != 4 || content.Info.Height != 3 {
+		t.Errorf("unexpected image info: %+v", content.Info)
+	}
+	if content.Info.ThumbnailInfo != nil || content.Info.ThumbnailURL != "" {
+		t.Errorf("expected no thumbnail for a small image, got %+v", content.Info)
+	}
+	if content.RelatesTo == nil || content.RelatesTo.EventID != "$thread" {
+		t.Errorf("expected image in the thread, got %+v", content.RelatesTo)
+	}
+}
+
+func TestSendImage_ThumbnailsLargeImages(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1600, 400)))
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+
+	if err := bot.sendImage(context.Background(), turnFor(bot, "$thread"), "wide.png", buf.Bytes(), "image/png"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(matrix.uploads) != 2 {
+		t.Fatalf("expected the image and its thumbnail to be uploaded, got %d uploads", len(matrix.uploads))
+	}
+	thumb, _, err := image.DecodeConfig(bytes.NewReader(matrix.uploads[1].Data))
+	if err != nil || thumb.Width != 800 || thumb.Height != 200 {
+		t.Errorf("expected an 800x200 thumbnail, got %+v (%v)", thumb, err)
+	}
+	info := matrix.sentEvents[0].Content.(*event.MessageEventContent).Info
+	if info.Width != 1600 || info.ThumbnailInfo == nil || info.ThumbnailInfo.Width != 800 || info.ThumbnailInfo.Height != 200 {
+		t.Errorf("unexpected image info: %+v", info)
+	}
+	if info.ThumbnailURL == "" || info.ThumbnailInfo.Size != len(matrix.uploads[1].Data) {
+		t.Errorf("expected the thumbnail upload to be attached, got %+v", info)
+	}
+}
+
+func TestSendImage_EncryptsWhenE2EEEnabled(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.PickleKey = "secret"
+
+	if err := bot.sendImage(context.Background(), turnFor(bot, "$thread"), "a.png", []byte("fake png"), "image/png"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if matrix.uploads[0].ContentType != "application/octet-stream" || string(matrix.uploads[0].Data) == "fake png" {
+		t.Error("expected the upload to be encrypted")
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.File == nil || content.URL != "" {
+		t.Errorf("expected encrypted file info instead of a plain URL, got %+v", content)
+	}
+}
+
+func TestPersistentConversationStore_BufferedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	store, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.BufferWrites(0)
+
+	store.Append("$thread", anthropic.NewUserMessage(anthropic.NewTextBlock("hello")))
+	if got := len(store.Get("$thread")); got != 1 {
+		t.Fatalf("buffered append should be visible via Get, got %d messages", got)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing on disk before flush, stat err: %v", err)
+	}
+
+	store.Flush()
+	reloaded, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if got := len(reloaded.Get("$thread")); got != 1 {
+		t.Errorf("expected flushed append on disk, got %d messages", got)
+	}
+}
+
+func TestPersistentConversationStore_FlushesAtThreshold(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	store, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.BufferWrites(2)
+
+	store.Append("$thread", anthropic.NewUserMessage(anthropic.NewTextBlock("one")))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("expected first change to stay buffered")
+	}
+	store.Append("$thread", anthropic.NewAssistantMessage(anthropic.NewTextBlock("two")))
+
+	reloaded, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if got := len(reloaded.Get("$thread")); got != 2 {
+		t.Errorf("expected both changes flushed at the threshold, got %d messages", got)
+	}
+}
+
+func TestPersistentConversationStore_ConcurrentWritesKeepLatest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	store, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Append(id.EventID(fmt.Sprintf("$thread%d", i)), anthropic.NewUserMessage(anthropic.NewTextBlock("hello")))
+		}()
+	}
+	wg.Wait()
+
+	reloaded, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if got := reloaded.Len(); got != 20 {
+		t.Errorf("expected the last write to hold all 20 threads, got %d", got)
+	}
+
+	// A snapshot older than the one on disk is never written over it.
+	store.writeFile([]byte("{}"), 1)
+	if reloaded, _ := NewPersistentConversationStore(path); reloaded.Len() != 20 {
+		t.Errorf("a stale snapshot replaced the file")
+	}
+}
+
+func TestPersistentConversationStore_RestoresPersona(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.json")
+	store, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.SetPersona("$thread", "You are a pirate.")
+
+	reloaded, err := NewPersistentConversationStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if got := reloaded.Persona("$thread"); got != "You are a pirate." {
+		t.Errorf("expected restored persona, got %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the bot's source of time. The bot reads the time and waits only
+// through its Clock, as does the ConversationStore NewBot gives it, so tests
+// can pin the time and fire timers deterministically.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the part of *time.Timer the bot uses.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// wait sleeps for d on the bot's clock, reporting false if ctx is done
+// first.
+func (b *Bot) wait(ctx context.Context, d time.Duration) bool {
+	done := make(chan struct{})
+	timer := b.clock.AfterFunc(d, func() { close(done) })
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	}
+}
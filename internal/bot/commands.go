@@ -0,0 +1,441 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+// retryTemperatures maps "retry" modes to the sampling temperature used.
+var retryTemperatures = map[string]float64{
+	"creative": 1.0,
+	"precise":  0.2,
+}
+
+// modelAllowed reports whether name can be pinned with "model": a single
+// word naming a model in the built-in table, the configured model, or one
+// of the fallback models. The last two cover providers whose model names
+// the table doesn't know.
+func (b *Bot) modelAllowed(cfg config.Config, name string) bool {
+	if strings.ContainsFunc(name, unicode.IsSpace) {
+		return false
+	}
+	if _, ok := lookupModel(name); ok {
+		return true
+	}
+	return name == cfg.Model || slices.Contains(cfg.FallbackModels, name)
+}
+
+// cutCommand reports whether text starts with the given command word
+// (case-insensitive), followed by whitespace or nothing, and returns the
+// remaining text after it.
+func cutCommand(text, command string) (string, bool) {
+	word, rest := text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		word, rest = text[:i], text[i:]
+	}
+	if !strings.EqualFold(word, command) {
+		return text, false
+	}
+	return strings.TrimSpace(rest), true
+}
+
+// prepareRetry handles "retry [creative|precise]": it rewinds the thread to
+// before its last user message and returns that message's text along with
+// the temperature for the chosen mode (nil for the default).
+func (b *Bot) prepareRetry(threadID id.EventID, mode string) (string, *float64, error) {
+	var temperature *float64
+	if mode != "" {
+		temp, ok := retryTemperatures[strings.ToLower(mode)]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown retry mode %q; use creative or precise.", mode)
+		}
+		temperature = &temp
+	}
+
+	text, ok := b.conversations.RewindLastUserTurn(threadID)
+	if !ok {
+		return "", nil, errors.New("There's nothing to retry in this thread yet.")
+	}
+	return text, temperature, nil
+}
+
+// modelFor returns the model t's conversation uses: the thread's own pin,
+// else its room's, else claude.model.
+func (b *Bot) modelFor(t turn) string {
+	if model := b.conversations.Model(t.conversationID); model != "" {
+		return model
+	}
+	if model := b.settings.get(t.roomID, settingModel); model != "" {
+		return model
+	}
+	return t.cfg.Model
+}
+
+// personaFor returns the persona t's conversation uses: the thread's own,
+// else its room's, or "" for none.
+func (b *Bot) personaFor(t turn) string {
+	if persona := b.conversations.Persona(t.conversationID); persona != "" {
+		return persona
+	}
+	return b.settings.get(t.roomID, settingPersona)
+}
+
+// roomDefaultModel describes the model a thread without its own pin uses.
+func (b *Bot) roomDefaultModel(t turn) string {
+	if model := b.settings.get(t.roomID, settingModel); model != "" {
+		return "the room's model, " + model
+	}
+	return "the default model, " + t.cfg.Model
+}
+
+// selectModel handles "model [name|default]": with a name it pins that model
+// for the thread, with "default" it clears the pin, and on its own it reports
+// the model the thread is using.
+func (b *Bot) selectModel(t turn, name string) string {
+	switch {
+	case name == "":
+		if model := b.conversations.Model(t.conversationID); model != "" {
+			return fmt.Sprintf("This thread uses %s.", model)
+		}
+		return fmt.Sprintf("This thread uses %s.", b.roomDefaultModel(t))
+	case strings.EqualFold(name, "default"):
+		b.conversations.SetModel(t.conversationID, "")
+		return fmt.Sprintf("This thread is back on %s.", b.roomDefaultModel(t))
+	case !b.modelAllowed(t.cfg, name):
+		return unknownModelReply(name, t.cfg.Model)
+	default:
+		b.conversations.SetModel(t.conversationID, name)
+		return fmt.Sprintf("This thread now uses %s.", name)
+	}
+}
+
+// selectRoomModel handles "room-model [name|default]": like "model", but for
+// every thread in the room that hasn't pinned its own. The choice is kept
+// across restarts when a settings database is in use. Anyone may ask which
+// model the room uses, but only an admin may change it.
+func (b *Bot) selectRoomModel(t turn, name string, admin bool) string {
+	switch {
+	case name == "":
+		if model := b.settings.get(t.roomID, settingModel); model != "" {
+			return fmt.Sprintf("This room uses %s.", model)
+		}
+		return fmt.Sprintf("This room uses the default model, %s.", t.cfg.Model)
+	case !admin:
+		return "Only admins can change this room's model."
+	case strings.EqualFold(name, "default"):
+		b.settings.set(t.roomID, settingModel, "")
+		return fmt.Sprintf("This room is back on the default model, %s.", t.cfg.Model)
+	case !b.modelAllowed(t.cfg, name):
+		return unknownModelReply(name, t.cfg.Model)
+	default:
+		b.settings.set(t.roomID, settingModel, name)
+		return fmt.Sprintf("This room now uses %s.", name)
+	}
+}
+
+func unknownModelReply(name, example string) string {
+	return fmt.Sprintf("I don't know a model called %q. Use a Claude model name such as %s, or \"default\".", name, example)
+}
+
+const (
+	summarizeInstruction = "Summarize our conversation so far. Keep every fact, decision, and open question needed to continue it, and leave out pleasantries. Reply with the summary only."
+	summaryRequest       = "Summarize our conversation so far."
+)
+
+var errNothingToSummarize = errors.New("There's nothing to summarize in this thread yet.")
+
+// summarizeThread handles "summarize": it asks Claude to condense the thread
+// and replaces the stored history with a single request/summary pair, so
+// later turns carry the summary instead of the full transcript.
+func (b *Bot) summarizeThread(ctx context.Context, t turn) (string, error) {
+	threadID := t.conversationID
+	history := b.conversations.Get(threadID)
+	if len(history) == 0 {
+		return "", errNothingToSummarize
+	}
+
+	cfg := t.cfg
+	model := b.modelFor(t)
+
+	params := anthropic.MessageNewParams{
+		Model:     anthropic.Model(model),
+		Messages:  mergeConsecutiveRoles(append(history, anthropic.NewUserMessage(anthropic.NewTextBlock(summarizeInstruction)))),
+		MaxTokens: maxTokensFor(model, cfg.MaxTokens),
+	}
+	if cfg.SystemPrompt != "" {
+		params.System = []anthropic.TextBlockParam{{Text: cfg.SystemPrompt}}
+	}
+	// Earlier tool_use blocks need their definitions present, but the
+	// summary itself must not call anything.
+	if b.tools != nil && !b.tools.IsEmpty() {
+		if defs := b.enabledToolDefinitions(cfg.DisabledTools); len(defs) > 0 {
+			params.Tools = defs
+			params.ToolChoice = toolChoiceParam("none")
+		}
+	}
+
+	resp, err := b.sendWithFallback(ctx, threadID, cfg.FallbackModels, params)
+	if err != nil {
+		return "", fmt.Errorf("claude API call failed: %w", err)
+	}
+	summary := extractText(resp.Content)
+	if summary == "" {
+		return "", errors.New("claude returned an empty summary")
+	}
+
+	b.conversations.Replace(threadID,
+		anthropic.NewUserMessage(anthropic.NewTextBlock(summaryRequest)),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock(summary)),
+	)
+	return summary, nil
+}
+
+// pendingToolState handles "pending": it reports tool calls in the thread
+// that never got a result, which the next message will mark as failed.
+func (b *Bot) pendingToolState(threadID id.EventID) string {
+	ids := b.conversations.Validate(threadID)
+	if len(ids) == 0 {
+		return "No tool calls are pending in this thread."
+	}
+	return fmt.Sprintf("%d tool call(s) never got a result: %s. They'll be marked as failed when you send the next message.",
+		len(ids), strings.Join(ids, ", "))
+}
+
+const jsonModePrompt = "\n\nReply with a single valid JSON value and nothing else: no prose, no explanation, and no markdown code fences."
+
+// getJSONResponse handles "json <query>": it asks for the answer as JSON and,
+// if the reply doesn't parse, tells Claude what was wrong and asks once more.
+func (b *Bot) getJSONResponse(ctx context.Context, t turn, userText string) (string, error) {
+	response, err := b.getClaudeResponse(ctx, t, userText)
+	if err != nil {
+		return "", err
+	}
+	if json.Valid([]byte(response)) {
+		return response, nil
+	}
+
+	log.Printf("Reply in %s was not valid JSON, retrying", t.conversationID)
+	syntaxErr := json.Unmarshal([]byte(response), new(any))
+	correction := fmt.Sprintf("That reply was not valid JSON (%v). Reply again with only the JSON value.", syntaxErr)
+	// The correction comes from the bot, not the sender.
+	retry := t
+	retry.senderName = ""
+	response, err = b.getClaudeResponse(ctx, retry, correction)
+	if err != nil {
+		return "", err
+	}
+	if !json.Valid([]byte(response)) {
+		return "", errors.New("claude did not return valid JSON after a retry")
+	}
+	return response, nil
+}
+
+// statusReport handles "status": uptime, the default model, how many
+// conversations are held, recent Claude latency, and MCP server health.
+func (b *Bot) statusReport(cfg config.Config) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Up %s on %s with %d active conversation(s).",
+		b.clock.Now().Sub(b.startTime).Round(time.Second), cfg.Model, b.conversations.Len())
+
+	if p, n := b.latencies.percentiles(50, 95); n > 0 {
+		fmt.Fprintf(&sb, "\nClaude latency over the last %d request(s): p50 %s, p95 %s.",
+			n, p[0].Round(time.Millisecond), p[1].Round(time.Millisecond))
+	} else {
+		sb.WriteString("\nNo Claude requests yet.")
+	}
+
+	if limit := cfg.DailyTokenBudget; limit > 0 {
+		fmt.Fprintf(&sb, "\nTokens used today: %d of %d.", b.budget.usedToday(b.clock.Now()), limit)
+	}
+
+	if len(b.mcpStatus) > 0 {
+		sb.WriteString("\nMCP servers:")
+		for _, s := range b.mcpStatus {
+			switch {
+			case s.Err == nil:
+				fmt.Fprintf(&sb, "\n- %s: %d tool(s)", s.Name, s.ToolCount)
+			case s.Connected:
+				fmt.Fprintf(&sb, "\n- %s: %d tool(s), partial: %v", s.Name, s.ToolCount, s.Err)
+			default:
+				fmt.Fprintf(&sb, "\n- %s: unavailable: %v", s.Name, s.Err)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// maxListedLimits bounds each section of the limits report.
+const maxListedLimits = 10
+
+// limitsReport handles "limits": the rooms and users closest to their
+// ratelimit.per_*_per_minute caps, with how many answers each has left this
+// minute and when the next one frees up.
+func (b *Bot) limitsReport(cfg config.Config) string {
+	now := b.clock.Now()
+	var sb strings.Builder
+	writeLimitSection(&sb, "Rooms", b.roomRate.states(now, cfg.RoomRepliesPerMinute), cfg.RoomRepliesPerMinute, now)
+	sb.WriteString("\n")
+	writeLimitSection(&sb, "Users", b.userRate.states(now, cfg.UserRepliesPerMinute), cfg.UserRepliesPerMinute, now)
+	return sb.String()
+}
+
+func writeLimitSection(sb *strings.Builder, title string, states []rateLimitState, limit int, now time.Time) {
+	switch {
+	case limit <= 0:
+		fmt.Fprintf(sb, "%s: no limit.", title)
+		return
+	case len(states) == 0:
+		fmt.Fprintf(sb, "%s (%d per minute): none answered in the last minute.", title, limit)
+		return
+	}
+	fmt.Fprintf(sb, "%s (%d per minute):", title, limit)
+	for _, st := range states[:min(len(states), maxListedLimits)] {
+		fmt.Fprintf(sb, "\n- %s: %d left, next refill in %s (%s UTC)",
+			st.key, st.remaining, st.refill.Sub(now).Round(time.Second), st.refill.UTC().Format(time.TimeOnly))
+	}
+	if extra := len(states) - maxListedLimits; extra > 0 {
+		fmt.Fprintf(sb, "\n- …and %d more", extra)
+	}
+}
+
+const (
+	maxListedTools           = 50
+	maxToolDescriptionLength = 100
+)
+
+// toolListing handles "tools": every tool Claude can call, sorted by name,
+// with the first line of its description. MCP tools note which server
+// provides them; server tools run on Anthropic's side.
+func (b *Bot) toolListing(cfg config.Config) string {
+	if b.tools == nil || b.tools.IsEmpty() {
+		return "No tools are available."
+	}
+	disabled := cfg.DisabledTools
+
+	descriptions := make(map[string]string)
+	for _, d := range b.tools.Definitions() {
+		if desc := d.GetDescription(); desc != nil {
+			descriptions[toolName(d)] = *desc
+		}
+	}
+
+	var lines []string
+	for _, name := range b.tools.LocalToolNames() {
+		if slices.Contains(disabled, name) {
+			continue
+		}
+		line := "- " + name
+		if server := b.mcpServerFor(name); server != "" {
+			line += fmt.Sprintf(" (MCP: %s)", server)
+		}
+		if desc := shortDescription(descriptions[name]); desc != "" {
+			line += ": " + desc
+		}
+		lines = append(lines, line)
+	}
+	var serverNames []string
+	for _, d := range b.tools.ServerDefinitions() {
+		if name := toolName(d); !slices.Contains(disabled, name) {
+			serverNames = append(serverNames, name)
+		}
+	}
+	slices.Sort(serverNames)
+	for _, name := range serverNames {
+		lines = append(lines, fmt.Sprintf("- %s (runs on Anthropic's side)", name))
+	}
+
+	if len(lines) == 0 {
+		return "No tools are available."
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d tool(s) available:", len(lines))
+	for _, line := range lines[:min(len(lines), maxListedTools)] {
+		sb.WriteString("\n" + line)
+	}
+	if extra := len(lines) - maxListedTools; extra > 0 {
+		fmt.Fprintf(&sb, "\n…and %d more.", extra)
+	}
+	return sb.String()
+}
+
+// mcpServerFor returns the MCP server whose prefix a local tool name has,
+// or "" for built-in tools.
+func (b *Bot) mcpServerFor(toolName string) string {
+	var server string
+	for _, s := range b.mcpStatus {
+		if strings.HasPrefix(toolName, s.Name+"_") && len(s.Name) > len(server) {
+			server = s.Name
+		}
+	}
+	return server
+}
+
+// shortDescription trims a tool description to its first line, bounded so
+// one verbose tool can't crowd out the rest of the listing.
+func shortDescription(desc string) string {
+	desc, _, _ = strings.Cut(strings.TrimSpace(desc), "\n")
+	if runes := []rune(desc); len(runes) > maxToolDescriptionLength {
+		desc = string(runes[:maxToolDescriptionLength]) + "…"
+	}
+	return desc
+}
+
+// setPersona handles "persona [text|clear]": with text it becomes the
+// thread's system-prompt override, "clear" removes it, and on its own it
+// shows the current one.
+func (b *Bot) setPersona(t turn, text string) string {
+	threadID := t.conversationID
+	switch {
+	case text == "":
+		if persona := b.conversations.Persona(threadID); persona != "" {
+			return "This thread's persona: " + persona
+		}
+		if persona := b.settings.get(t.roomID, settingPersona); persona != "" {
+			return "This thread uses the room's persona: " + persona
+		}
+		return "This thread has no persona; it uses the default system prompt."
+	case strings.EqualFold(text, "clear"):
+		b.conversations.SetPersona(threadID, "")
+		if b.settings.get(t.roomID, settingPersona) != "" {
+			return "Persona cleared; this thread is back to the room's persona."
+		}
+		return "Persona cleared; this thread is back to the default system prompt."
+	default:
+		b.conversations.SetPersona(threadID, text)
+		return "Got it, I'll use that persona for the rest of this thread."
+	}
+}
+
+// setRoomPersona handles "room-persona [text|clear]": like "persona", but
+// for every thread in the room without a persona of its own. It is kept
+// across restarts when a settings database is in use. Anyone may see the
+// room's persona, but only an admin may change it.
+func (b *Bot) setRoomPersona(t turn, text string, admin bool) string {
+	switch {
+	case text == "":
+		if persona := b.settings.get(t.roomID, settingPersona); persona != "" {
+			return "This room's persona: " + persona
+		}
+		return "This room has no persona; it uses the default system prompt."
+	case !admin:
+		return "Only admins can change this room's persona."
+	case strings.EqualFold(text, "clear"):
+		b.settings.set(t.roomID, settingPersona, "")
+		return "Room persona cleared; threads here are back to the default system prompt."
+	default:
+		b.settings.set(t.roomID, settingPersona, text)
+		return "Got it, threads in this room will use that persona unless they set their own."
+	}
+}
@@ -0,0 +1,280 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// compatAdapter is a ClaudeMessenger backed by an OpenAI-compatible chat
+// completions endpoint (e.g. a local model server), for development and
+// offline testing. It translates text and custom tool use; server tools,
+// images, and thinking blocks have no equivalent and are dropped.
+type compatAdapter struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewCompatAdapter creates a ClaudeMessenger that sends requests to the
+// chat completions API under baseURL (e.g. "http://localhost:11434/v1").
+// apiKey is sent as a bearer token when set.
+func NewCompatAdapter(baseURL, apiKey string) ClaudeMessenger {
+	return &compatAdapter{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{},
+	}
+}
+
+type compatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []compatMessage `json:"messages"`
+	MaxTokens   int64           `json:"max_tokens,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"`
+	TopP        *float64        `json:"top_p,omitempty"`
+	Tools       []compatTool    `json:"tools,omitempty"`
+	ToolChoice  any             `json:"tool_choice,omitempty"`
+}
+
+type compatMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []compatToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type compatToolCall struct {
+	ID       string             `json:"id"`
+	Type     string             `json:"type"`
+	Function compatFunctionCall `json:"function"`
+}
+
+type compatFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type compatTool struct {
+	Type     string         `json:"type"`
+	Function compatFunction `json:"function"`
+}
+
+type compatFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type compatResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      compatMessage `json:"message"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+const maxCompatErrorBody = 512
+
+func (a *compatAdapter) NewMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	reqBody, err := compatRequestFrom(params)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.apiKey)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxCompatErrorBody))
+		return nil, fmt.Errorf("compat endpoint returned %s: %s", resp.Status, bytes.TrimSpace(snippet))
+	}
+
+	var out compatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return out.toMessage()
+}
+
+// compatRequestFrom translates Anthropic request params into a chat
+// completions request.
+func compatRequestFrom(params anthropic.MessageNewParams) (compatRequest, error) {
+	req := compatRequest{
+		Model:     string(params.Model),
+		MaxTokens: params.MaxTokens,
+	}
+	if params.Temperature.Valid() {
+		req.Temperature = &params.Temperature.Value
+	}
+	if params.TopP.Valid() {
+		req.TopP = &params.TopP.Value
+	}
+
+	var system []string
+	for _, block := range params.System {
+		system = append(system, block.Text)
+	}
+	if len(system) > 0 {
+		req.Messages = append(req.Messages, compatMessage{Role: "system", Content: strings.Join(system, "\n\n")})
+	}
+
+	for _, msg := range params.Messages {
+		converted, err := compatMessagesFrom(msg)
+		if err != nil {
+			return compatRequest{}, err
+		}
+		req.Messages = append(req.Messages, converted...)
+	}
+
+	for _, tool := range params.Tools {
+		if tool.OfTool == nil {
+			continue
+		}
+		schema, err := json.Marshal(tool.OfTool.InputSchema)
+		if err != nil {
+			return compatRequest{}, fmt.Errorf("encoding schema for %s: %w", tool.OfTool.Name, err)
+		}
+		req.Tools = append(req.Tools, compatTool{
+			Type: "function",
+			Function: compatFunction{
+				Name:        tool.OfTool.Name,
+				Description: tool.OfTool.Description.Value,
+				Parameters:  schema,
+			},
+		})
+	}
+
+	if len(req.Tools) > 0 {
+		switch choice := params.ToolChoice; {
+		case choice.OfNone != nil:
+			req.ToolChoice = "none"
+		case choice.OfAny != nil:
+			req.ToolChoice = "required"
+		case choice.OfTool != nil:
+			req.ToolChoice = map[string]any{"type": "function", "function": map[string]string{"name": choice.OfTool.Name}}
+		}
+	}
+	return req, nil
+}
+
+// compatMessagesFrom converts one Anthropic message. Tool results become
+// separate "tool" messages, which must come before any text the user sent
+// alongside them.
+func compatMessagesFrom(msg anthropic.MessageParam) ([]compatMessage, error) {
+	var out []compatMessage
+	var text []string
+	var calls []compatToolCall
+
+	for _, block := range msg.Content {
+		switch {
+		case block.OfText != nil:
+			text = append(text, block.OfText.Text)
+		case block.OfToolUse != nil:
+			args, err := json.Marshal(block.OfToolUse.Input)
+			if err != nil {
+				return nil, fmt.Errorf("encoding input for %s: %w", block.OfToolUse.Name, err)
+			}
+			calls = append(calls, compatToolCall{
+				ID:       block.OfToolUse.ID,
+				Type:     "function",
+				Function: compatFunctionCall{Name: block.OfToolUse.Name, Arguments: string(args)},
+			})
+		case block.OfToolResult != nil:
+			var parts []string
+			for _, c := range block.OfToolResult.Content {
+				if c.OfText != nil {
+					parts = append(parts, c.OfText.Text)
+				}
+			}
+			content := strings.Join(parts, "\n")
+			if block.OfToolResult.IsError.Value {
+				content = "error: " + content
+			}
+			out = append(out, compatMessage{Role: "tool", ToolCallID: block.OfToolResult.ToolUseID, Content: content})
+		}
+	}
+
+	if len(text) > 0 || len(calls) > 0 {
+		out = append(out, compatMessage{Role: string(msg.Role), Content: strings.Join(text, "\n"), ToolCalls: calls})
+	}
+	return out, nil
+}
+
+// toMessage builds the equivalent Anthropic response. It goes through JSON
+// so the result behaves like one decoded from the real API (ToParam relies
+// on the raw JSON of each block).
+func (r compatResponse) toMessage() (*anthropic.Message, error) {
+	if len(r.Choices) == 0 {
+		return nil, fmt.Errorf("compat endpoint returned no choices")
+	}
+	choice := r.Choices[0]
+
+	content := []map[string]any{}
+	if choice.Message.Content != "" {
+		content = append(content, map[string]any{"type": "text", "text": choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		input := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		content = append(content, map[string]any{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": input})
+	}
+
+	stopReason := anthropic.StopReasonEndTurn
+	switch {
+	case len(choice.Message.ToolCalls) > 0 || choice.FinishReason == "tool_calls":
+		stopReason = anthropic.StopReasonToolUse
+	case choice.FinishReason == "length":
+		stopReason = anthropic.StopReasonMaxTokens
+	}
+
+	raw, err := json.Marshal(map[string]any{
+		"id":          r.ID,
+		"type":        "message",
+		"role":        "assistant",
+		"model":       r.Model,
+		"content":     content,
+		"stop_reason": stopReason,
+		"usage": map[string]int64{
+			"input_tokens":  r.Usage.PromptTokens,
+			"output_tokens": r.Usage.CompletionTokens,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var msg anthropic.Message
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return nil, fmt.Errorf("converting response: %w", err)
+	}
+	return &msg, nil
+}
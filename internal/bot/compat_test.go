@@ -0,0 +1,133 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// fakeCompatServer serves chat completions, answering each request with the
+// next response in turn and recording the decoded requests.
+func fakeCompatServer(t *testing.T, responses ...string) (*httptest.Server, *[]compatRequest) {
+	t.Helper()
+	var requests []compatRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer local-key" {
+			t.Errorf("Authorization = %q", got)
+		}
+		var req compatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		requests = append(requests, req)
+		if len(requests) > len(responses) {
+			http.Error(w, "no more responses", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[len(requests)-1]))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestCompatAdapter_TextRoundTrip(t *testing.T) {
+	srv, requests := fakeCompatServer(t, `{
+		"id": "chatcmpl-1", "model": "llama3",
+		"choices": [{"message": {"role": "assistant", "content": "Hello there!"}, "finish_reason": "stop"}],
+		"usage": {"prompt_tokens": 12, "completion_tokens": 3}
+	}`)
+	adapter := NewCompatAdapter(srv.URL+"/v1/", "local-key")
+
+	msg, err := adapter.NewMessage(context.Background(), anthropic.MessageNewParams{
+		Model:       "llama3",
+		MaxTokens:   256,
+		Temperature: anthropic.Float(0.5),
+		System:      []anthropic.TextBlockParam{{Text: "Be brief."}},
+		Messages:    []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))},
+	})
+	if err != nil {
+		t.Fatalf("NewMessage: %v", err)
+	}
+
+	req := (*requests)[0]
+	if req.Model != "llama3" || req.MaxTokens != 256 || req.Temperature == nil || *req.Temperature != 0.5 {
+		t.Errorf("unexpected request settings: %+v", req)
+	}
+	want := []compatMessage{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "hi"}}
+	if len(req.Messages) != 2 || req.Messages[0].Role != want[0].Role || req.Messages[0].Content != want[0].Content ||
+		req.Messages[1].Role != want[1].Role || req.Messages[1].Content != want[1].Content {
+		t.Errorf("messages = %+v, want %+v", req.Messages, want)
+	}
+
+	if extractText(msg.Content) != "Hello there!" || msg.StopReason != anthropic.StopReasonEndTurn {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if msg.Usage.InputTokens != 12 || msg.Usage.OutputTokens != 3 {
+		t.Errorf("usage = %+v", msg.Usage)
+	}
+	if p := msg.ToParam(); p.Content[0].OfText == nil || p.Content[0].OfText.Text != "Hello there!" {
+		t.Errorf("ToParam lost the text: %+v", p)
+	}
+}
+
+func TestCompatAdapter_ToolUseRoundTrip(t *testing.T) {
+	srv, requests := fakeCompatServer(t,
+		`{"id": "1", "model": "llama3", "choices": [{"message": {"role": "assistant", "content": "",
+			"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "echo", "arguments": "{\"text\":\"hi\"}"}}]},
+			"finish_reason": "tool_calls"}]}`,
+		`{"id": "2", "model": "llama3", "choices": [{"message": {"role": "assistant", "content": "It said hi."}, "finish_reason": "stop"}]}`,
+	)
+	claude := NewCompatAdapter(srv.URL+"/v1", "local-key")
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	bot.claude = claude
+	bot.tools.Register(&fakeTool{name: "echo", description: "Echo text", result: "echoed: hi"})
+
+	resp, err := bot.getClaudeResponse(context.Background(), turnFor(bot, "$thread1"), "use echo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp != "It said hi." {
+		t.Errorf("response = %q", resp)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(*requests))
+	}
+	first := (*requests)[0]
+	if len(first.Tools) != 1 || first.Tools[0].Function.Name != "echo" || first.Tools[0].Function.Description != "Echo text" ||
+		!strings.Contains(string(first.Tools[0].Function.Parameters), `"type":"object"`) {
+		t.Errorf("tools = %+v", first.Tools)
+	}
+
+	second := (*requests)[1].Messages
+	call, result := second[len(second)-2], second[len(second)-1]
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" ||
+		call.ToolCalls[0].Function.Arguments != `{"text":"hi"}` {
+		t.Errorf("assistant tool call = %+v", call)
+	}
+	if result.Role != "tool" || result.ToolCallID != "call_1" || result.Content != "echoed: hi" {
+		t.Errorf("tool result = %+v", result)
+	}
+}
+
+func TestCompatAdapter_HTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not loaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	_, err := NewCompatAdapter(srv.URL, "").NewMessage(context.Background(), anthropic.MessageNewParams{Model: "x"})
+	if err == nil || !strings.Contains(err.Error(), "503") || !strings.Contains(err.Error(), "model not loaded") {
+		t.Errorf("expected status and body in error, got %v", err)
+	}
+}
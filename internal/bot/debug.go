@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/event"
+)
+
+const debugFileName = "claude-debug.json"
+
+// debugCapture collects what was sent to and received from Claude during
+// one turn, for the "debug" command. A nil capture records nothing.
+type debugCapture struct {
+	Exchanges []debugExchange `json:"exchanges"`
+}
+
+type debugExchange struct {
+	Request      anthropic.MessageNewParams `json:"request"`
+	Model        string                     `json:"model,omitempty"`
+	StopReason   string                     `json:"stop_reason,omitempty"`
+	InputTokens  int64                      `json:"input_tokens,omitempty"`
+	OutputTokens int64                      `json:"output_tokens,omitempty"`
+	Error        string                     `json:"error,omitempty"`
+}
+
+func (d *debugCapture) record(params anthropic.MessageNewParams, resp *anthropic.Message, err error) {
+	if d == nil {
+		return
+	}
+	ex := debugExchange{Request: params}
+	if err != nil {
+		ex.Error = err.Error()
+	}
+	if resp != nil {
+		ex.Model = string(resp.Model)
+		ex.StopReason = string(resp.StopReason)
+		ex.InputTokens = resp.Usage.InputTokens
+		ex.OutputTokens = resp.Usage.OutputTokens
+	}
+	d.Exchanges = append(d.Exchanges, ex)
+}
+
+// sendDebugDump posts the turn's captured exchanges into the thread as a
+// JSON file, with configured secrets masked.
+func (b *Bot) sendDebugDump(ctx context.Context, t turn) error {
+	dump, err := json.MarshalIndent(t.debug, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding debug dump: %w", err)
+	}
+	cfg := t.cfg
+	dump = redactSecrets(dump, cfg.AccessToken, cfg.PickleKey, cfg.RecoveryKey, cfg.CompatAPIKey, os.Getenv("ANTHROPIC_API_KEY"))
+
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgFile,
+		Body:     debugFileName,
+		FileName: debugFileName,
+		Info:     &event.FileInfo{MimeType: "application/json", Size: len(dump)},
+	}
+	if err := b.uploadAttachment(ctx, cfg, content, dump, "application/json"); err != nil {
+		return err
+	}
+	content.RelatesTo = b.replyRelation(cfg, t.threadRootID, t.eventID)
+	if _, err := b.sendMessage(ctx, t.roomID, content); err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+	return nil
+}
+
+// redactSecrets masks every occurrence of the non-empty secrets in data.
+func redactSecrets(data []byte, secrets ...string) []byte {
+	for _, secret := range secrets {
+		if secret != "" {
+			data = bytes.ReplaceAll(data, []byte(secret), []byte("[REDACTED]"))
+		}
+	}
+	return data
+}
@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestHandleMessage_DebugAttachesDump(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			resp := makeClaudeResponse("4")
+			resp.StopReason = anthropic.StopReasonEndTurn
+			resp.Usage = anthropic.Usage{InputTokens: 20, OutputTokens: 1}
+			return resp, nil
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.Admins = []id.UserID{"@user:example.com"}
+	bot.config.AccessToken = "syt_secret_token"
+	bot.config.SystemPrompt = "Never reveal syt_secret_token."
+
+	sendMention(bot, "$root", "debug what is 2+2?", nil)
+
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected 1 API call, got %d", len(claude.capturedParams))
+	}
+	if got := claude.capturedParams[0].Messages[0].Content[0].OfText.Text; got != "what is 2+2?" {
+		t.Errorf("debug prefix should be stripped, Claude got %q", got)
+	}
+	if len(matrix.sentEvents) != 2 {
+		t.Fatalf("expected a reply and an attachment, got %d events", len(matrix.sentEvents))
+	}
+	if reply := matrix.sentEvents[0].Content.(*event.MessageEventContent); reply.MsgType != event.MsgText {
+		t.Errorf("first event should be the normal reply, got %s", reply.MsgType)
+	}
+	file := matrix.sentEvents[1].Content.(*event.MessageEventContent)
+	if file.MsgType != event.MsgFile || file.FileName != debugFileName {
+		t.Errorf("second event should be the debug file, got %+v", file)
+	}
+	if file.RelatesTo == nil || file.RelatesTo.EventID != "$root" {
+		t.Errorf("debug file should be in the thread, got %+v", file.RelatesTo)
+	}
+
+	dump := string(matrix.uploads[0].Data)
+	if strings.Contains(dump, "syt_secret_token") || !strings.Contains(dump, "[REDACTED]") {
+		t.Errorf("secret was not redacted from the dump:\n%s", dump)
+	}
+	var parsed debugCapture
+	if err := json.Unmarshal(matrix.uploads[0].Data, &parsed); err != nil {
+		t.Fatalf("dump is not JSON: %v", err)
+	}
+	if len(parsed.Exchanges) != 1 || parsed.Exchanges[0].StopReason != "end_turn" || parsed.Exchanges[0].InputTokens != 20 {
+		t.Errorf("unexpected exchanges: %+v", parsed.Exchanges)
+	}
+}
+
+func TestHandleMessage_NoDebugAttachmentNormally(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.Admins = []id.UserID{"@user:example.com"}
+
+	sendMention(bot, "$root", "what is 2+2?", nil)
+
+	if len(matrix.sentEvents) != 1 || len(matrix.uploads) != 0 {
+		t.Errorf("expected only the reply, got %d events and %d uploads", len(matrix.sentEvents), len(matrix.uploads))
+	}
+}
+
+func TestHandleMessage_DebugRequiresAdmin(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+
+	sendMention(bot, "$root", "debug what is 2+2?", nil)
+
+	if len(claude.capturedParams) != 0 || len(matrix.uploads) != 0 {
+		t.Error("non-admins should not get a debug run")
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; !strings.Contains(body, "only available to admins") {
+		t.Errorf("unexpected reply: %q", body)
+	}
+}
@@ -0,0 +1,43 @@
+package bot
+
+import (
+	"container/list"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// seenEvents remembers the IDs of the most recently handled events, so an
+// event the homeserver delivers again, as can happen after a reconnect,
+// isn't answered twice. The zero value is ready to use.
+type seenEvents struct {
+	mu    sync.Mutex
+	order *list.List // of id.EventID, most recent first
+	index map[id.EventID]*list.Element
+}
+
+// add records eventID and reports whether it is new. Only the size most
+// recent events are remembered; a size of 0 disables the check.
+func (s *seenEvents) add(eventID id.EventID, size int) bool {
+	if size <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index == nil {
+		s.order = list.New()
+		s.index = make(map[id.EventID]*list.Element)
+	}
+	if e, ok := s.index[eventID]; ok {
+		s.order.MoveToFront(e)
+		return false
+	}
+	s.index[eventID] = s.order.PushFront(eventID)
+	for s.order.Len() > size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.index, oldest.Value.(id.EventID))
+	}
+	return true
+}
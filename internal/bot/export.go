@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// exportVersion is the format version Export writes and Import accepts.
+const exportVersion = 1
+
+// conversationExport is the file Export writes: every thread, keyed by the
+// event ID of its root (or the room ID for room-scoped conversations), in
+// the same form the persistent store keeps on disk.
+type conversationExport struct {
+	Version int                            `json:"version"`
+	Threads map[id.EventID]persistedThread `json:"threads"`
+}
+
+// Export writes every conversation, with its model, persona and room, to w
+// as indented JSON. Thread IDs are written in sorted order, so exporting the
+// same state twice gives the same bytes.
+func (s *ConversationStore) Export(w io.Writer) error {
+	s.mu.RLock()
+	data, err := json.MarshalIndent(conversationExport{
+		Version: exportVersion,
+		Threads: s.snapshotLocked(),
+	}, "", "  ")
+	s.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("encoding conversations: %w", err)
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Import reads conversations written by Export from r and adds them to the
+// store, replacing any thread with the same ID, and returns how many it
+// read. Threads already in the store and not in the export are kept.
+func (s *ConversationStore) Import(r io.Reader) (int, error) {
+	var export conversationExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return 0, fmt.Errorf("parsing conversation export: %w", err)
+	}
+	if export.Version != exportVersion {
+		return 0, fmt.Errorf("unsupported conversation export version %d, want %d", export.Version, exportVersion)
+	}
+
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	s.restoreLocked(export.Threads)
+	s.evictOverCapLocked("")
+	s.persistLocked()
+	return len(export.Threads), nil
+}
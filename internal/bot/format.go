@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"html"
+	"strings"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// formatReply renders a plaintext reply as Matrix HTML. Everything is
+// escaped, so a "<" or "&" in Claude's answer can't be read as markup;
+// fenced code blocks become <pre><code> so their whitespace survives.
+func formatReply(text string) string {
+	var sb strings.Builder
+	var prose, code []string
+	inCode := false
+	lang := ""
+
+	flushProse := func() {
+		if len(prose) > 0 {
+			sb.WriteString(event.TextToHTML(strings.Join(prose, "\n")))
+			prose = nil
+		}
+	}
+	flushCode := func() {
+		sb.WriteString("<pre><code")
+		if lang != "" {
+			sb.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+		}
+		sb.WriteString(">")
+		sb.WriteString(html.EscapeString(strings.Join(code, "\n")))
+		sb.WriteString("</code></pre>")
+		code = nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		fence, isFence := strings.CutPrefix(strings.TrimSpace(line), "```")
+		switch {
+		case isFence && !inCode:
+			flushProse()
+			inCode, lang = true, fenceLanguage(fence)
+		case isFence && inCode:
+			flushCode()
+			inCode = false
+		case inCode:
+			code = append(code, line)
+		default:
+			prose = append(prose, line)
+		}
+	}
+	if inCode {
+		flushCode()
+	}
+	flushProse()
+	return sb.String()
+}
+
+// fenceLanguage returns the language named by a code fence's info string:
+// its first word, as in CommonMark, so "```python title=x" is "python".
+func fenceLanguage(info string) string {
+	if fields := strings.Fields(info); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package bot
+
+import "testing"
+
+func TestFormatReply(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello", "hello"},
+		{"escapes markup", "a <b> & c", "a &lt;b&gt; &amp; c"},
+		{"newlines", "one\ntwo", "one<br/>two"},
+		{
+			"fenced code",
+			"Try:\n```go\nif a < b && ok {\n\treturn\n}\n```\nDone.",
+			"Try:<pre><code class=\"language-go\">if a &lt; b &amp;&amp; ok {\n\treturn\n}</code></pre>Done.",
+		},
+		{"untagged fence", "```\nls -l\n```", "<pre><code>ls -l</code></pre>"},
+		{"info string", "```python title=\"x.py\"\nprint(1)\n```", "<pre><code class=\"language-python\">print(1)</code></pre>"},
+		{"unclosed fence", "```\n<x>", "<pre><code>&lt;x&gt;</code></pre>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatReply(tt.in); got != tt.want {
+				t.Errorf("formatReply(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package bot
+
+import (
+	"context"
+	"log"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+// eventFeature is one event subscription. Features whose enabled func
+// returns false for the startup config aren't attached to the syncer at all.
+type eventFeature struct {
+	name      string
+	eventType event.Type
+	enabled   func(cfg config.Config) bool
+	handle    func(ctx context.Context, evt *event.Event)
+}
+
+func always(config.Config) bool { return true }
+
+// eventFeatures lists every event subscription the bot knows about. New
+// features that need another event type add an entry here.
+func (b *Bot) eventFeatures() []eventFeature {
+	return []eventFeature{
+		{
+			name:      "messages",
+			eventType: event.EventMessage,
+			enabled:   always,
+			handle: func(ctx context.Context, evt *event.Event) {
+				go b.handleMessage(ctx, evt)
+			},
+		},
+		{
+			name:      "invites",
+			eventType: event.StateMember,
+			enabled:   always,
+			handle:    b.handleMemberEvent,
+		},
+		{
+			name:      "stop reactions",
+			eventType: event.EventReaction,
+			enabled:   func(cfg config.Config) bool { return cfg.StopOnReaction },
+			handle:    b.handleReaction,
+		},
+	}
+}
+
+// registerHandlers attaches the enabled features' handlers to syncer and
+// returns the names of those it attached.
+func (b *Bot) registerHandlers(syncer EventSyncer) []string {
+	cfg := b.cfg()
+	var names []string
+	for _, f := range b.eventFeatures() {
+		if !f.enabled(cfg) {
+			continue
+		}
+		syncer.OnEventType(f.eventType, f.handle)
+		names = append(names, f.name)
+	}
+	log.Printf("Handling events for: %v", names)
+	return names
+}
+
+// stopReactions are the reaction keys that stop a generation when placed on
+// the message it is answering.
+var stopReactions = map[string]bool{"⏹️": true, "⏹": true, "🛑": true}
+
+// handleReaction stops the answer to a message when its sender reacts to
+// that message with a stop emoji, like the "stop" command. Reactions from
+// anyone else are ignored, so other room members can't cut an answer short.
+func (b *Bot) handleReaction(ctx context.Context, evt *event.Event) {
+	cfg := b.cfg()
+	if evt.Sender == cfg.UserID || !roomAllowed(cfg.AllowedRooms, evt.RoomID) {
+		return
+	}
+	reaction := evt.Content.AsReaction()
+	if reaction == nil || !stopReactions[reaction.RelatesTo.Key] {
+		return
+	}
+
+	t, ok := b.running.stopTriggeredBy(reaction.RelatesTo.EventID, evt.Sender)
+	if !ok {
+		return
+	}
+	log.Printf("Stopped generation in %s after a reaction from %s", t.conversationID, evt.Sender)
+	b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, stoppedNotice)
+}
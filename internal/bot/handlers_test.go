@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// recordingSyncer captures the event types handlers are registered for.
+type recordingSyncer struct {
+	handlers map[event.Type]mautrix.EventHandler
+}
+
+func (s *recordingSyncer) OnEventType(eventType event.Type, callback mautrix.EventHandler) {
+	if s.handlers == nil {
+		s.handlers = make(map[event.Type]mautrix.EventHandler)
+	}
+	s.handlers[eventType] = callback
+}
+
+func TestRegisterHandlers_ReactionsDisabled(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	syncer := &recordingSyncer{}
+
+	names := bot.registerHandlers(syncer)
+
+	if _, ok := syncer.handlers[event.EventReaction]; ok {
+		t.Error("no reaction handler should be registered when stop_on_reaction is off")
+	}
+	if _, ok := syncer.handlers[event.EventMessage]; !ok {
+		t.Error("message handler should always be registered")
+	}
+	if _, ok := syncer.handlers[event.StateMember]; !ok {
+		t.Error("member handler should always be registered")
+	}
+	if slices.Contains(names, "stop reactions") {
+		t.Errorf("registered features = %v", names)
+	}
+}
+
+func TestRegisterHandlers_ReactionsEnabled(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	bot.config.StopOnReaction = true
+	syncer := &recordingSyncer{}
+
+	bot.registerHandlers(syncer)
+
+	if _, ok := syncer.handlers[event.EventReaction]; !ok {
+		t.Error("expected a reaction handler with stop_on_reaction on")
+	}
+}
+
+func makeReactionEvent(sender id.UserID, target id.EventID, key string) *event.Event {
+	return &event.Event{
+		Sender: sender,
+		Type:   event.EventReaction,
+		RoomID: "!room:example.com",
+		ID:     "$reaction",
+		Content: event.Content{Parsed: &event.ReactionEventContent{
+			RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: target, Key: key},
+		}},
+	}
+}
+
+func TestHandleReaction_StopsGeneration(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	started := make(chan struct{})
+	claude := &mockClaudeMessenger{
+		newMessageFunc: func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	bot := newTestBot(matrix, claude)
+	bot.config.StopOnReaction = true
+
+	done := make(chan struct{})
+	go func() {
+		sendMention(bot, "$root", "write me a novel", nil)
+		close(done)
+	}()
+	<-started
+
+	// Reactions on other messages, with other keys, or from anyone but
+	// the requester are ignored.
+	bot.handleReaction(context.Background(), makeReactionEvent("@user:example.com", "$other", "🛑"))
+	bot.handleReaction(context.Background(), makeReactionEvent("@someone-else:example.com", "$root", "🛑"))
+	bot.handleReaction(context.Background(), makeReactionEvent("@user:example.com", "$root", "👍"))
+	if len(matrix.sentEvents) != 0 {
+		t.Fatalf("expected the generation to keep running, got %d events", len(matrix.sentEvents))
+	}
+	bot.handleReaction(context.Background(), makeReactionEvent("@user:example.com", "$root", "🛑"))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("generation was not canceled")
+	}
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("expected only the stop confirmation, got %d events", len(matrix.sentEvents))
+	}
+	if body := matrix.sentEvents[0].Content.(*event.MessageEventContent).Body; body != stoppedNotice {
+		t.Errorf("expected stop confirmation, got %q", body)
+	}
+}
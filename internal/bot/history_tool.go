@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/tools"
+)
+
+const (
+	defaultHistoryMessages = 20
+	maxHistoryMessages     = 100
+	// maxHistoryMessageChars and maxHistoryChars bound the tool's output so
+	// a long thread can't flood the context it's being asked about.
+	maxHistoryMessageChars = 500
+	maxHistoryChars        = 8000
+)
+
+// conversationHistoryTool lets Claude look back over the stored history of
+// the conversation it is answering in, for questions like "what did I ask
+// you earlier?".
+type conversationHistoryTool struct {
+	conversations *ConversationStore
+}
+
+type conversationHistoryInput struct {
+	Last int `json:"last"`
+}
+
+func (t *conversationHistoryTool) Name() string { return "conversation_history" }
+
+func (t *conversationHistoryTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "conversation_history",
+			Description: anthropic.String("Return the most recent messages of this conversation as stored by the bot, oldest first, with long messages shortened. Use for questions about what was said earlier in the conversation."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"last": map[string]any{
+						"type":        "integer",
+						"description": fmt.Sprintf("How many of the most recent messages to return (default %d, max %d)", defaultHistoryMessages, maxHistoryMessages),
+					},
+				},
+			},
+		},
+	}
+}
+
+func (t *conversationHistoryTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params conversationHistoryInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return tools.InvalidInput(err), true, nil
+	}
+	if params.Last <= 0 {
+		params.Last = defaultHistoryMessages
+	}
+	params.Last = min(params.Last, maxHistoryMessages)
+
+	tr, ok := turnFrom(ctx)
+	if !ok {
+		return "conversation history is only available from a chat message", true, nil
+	}
+
+	history := t.conversations.Get(tr.conversationID)
+	if len(history) == 0 {
+		return "This conversation has no stored history.", false, nil
+	}
+
+	var lines []string
+	for _, msg := range history {
+		if line := summarizeMessage(msg); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	omitted := max(len(lines)-params.Last, 0)
+	lines = lines[omitted:]
+
+	// Drop the oldest lines until the rest fits.
+	size := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		size += len(lines[i]) + 1
+		if size > maxHistoryChars {
+			omitted += i + 1
+			lines = lines[i+1:]
+			break
+		}
+	}
+
+	var sb strings.Builder
+	if omitted > 0 {
+		fmt.Fprintf(&sb, "(%d earlier message(s) omitted)\n", omitted)
+	}
+	sb.WriteString(strings.Join(lines, "\n"))
+	return sb.String(), false, nil
+}
+
+// summarizeMessage renders one stored message as a "role: ..." entry,
+// naming tool calls instead of including their inputs and results.
+func summarizeMessage(msg anthropic.MessageParam) string {
+	var parts []string
+	for _, block := range msg.Content {
+		switch {
+		case block.OfText != nil:
+			parts = append(parts, block.OfText.Text)
+		case block.OfToolUse != nil:
+			parts = append(parts, fmt.Sprintf("[called %s]", block.OfToolUse.Name))
+		case block.OfToolResult != nil:
+			parts = append(parts, "[tool result]")
+		case block.OfImage != nil:
+			parts = append(parts, "[image]")
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	text := strings.Join(parts, " ")
+	if runes := []rune(text); len(runes) > maxHistoryMessageChars {
+		text = string(runes[:maxHistoryMessageChars]) + "…"
+	}
+	return fmt.Sprintf("%s: %s", msg.Role, text)
+}
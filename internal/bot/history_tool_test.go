@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestConversationHistoryTool_ReturnsTurns(t *testing.T) {
+	store := NewConversationStore()
+	store.Append("$thread",
+		anthropic.NewUserMessage(anthropic.NewTextBlock("what is 2+2?")),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("4")),
+		anthropic.NewUserMessage(anthropic.NewTextBlock("list the files")),
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("tu_1", map[string]any{"path": "."}, "fs_list")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("tu_1", "a.txt", false)),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock("There is a.txt.")),
+	)
+	store.Append("$other", anthropic.NewUserMessage(anthropic.NewTextBlock("unrelated")))
+	tool := &conversationHistoryTool{conversations: store}
+
+	result, isErr, err := tool.Execute(withTurn(context.Background(), testTurn("$thread")), json.RawMessage(`{}`))
+	if err != nil || isErr {
+		t.Fatalf("Execute = %q, %v, %v", result, isErr, err)
+	}
+	want := strings.Join([]string{
+		"user: what is 2+2?",
+		"assistant: 4",
+		"user: list the files",
+		"assistant: [called fs_list]",
+		"user: [tool result]",
+		"assistant: There is a.txt.",
+	}, "\n")
+	if result != want {
+		t.Errorf("result =\n%s\nwant\n%s", result, want)
+	}
+}
+
+func TestConversationHistoryTool_Bounded(t *testing.T) {
+	store := NewConversationStore()
+	long := strings.Repeat("x", 2000)
+	for range 30 {
+		store.Append("$thread",
+			anthropic.NewUserMessage(anthropic.NewTextBlock(long)),
+			anthropic.NewAssistantMessage(anthropic.NewTextBlock("ok")),
+		)
+	}
+	tool := &conversationHistoryTool{conversations: store}
+	ctx := withTurn(context.Background(), testTurn("$thread"))
+
+	result, _, _ := tool.Execute(ctx, json.RawMessage(`{"last":4}`))
+	if !strings.HasPrefix(result, "(56 earlier message(s) omitted)\n") {
+		t.Errorf("result should note omitted messages, got prefix %q", result[:40])
+	}
+	if strings.Contains(result, strings.Repeat("x", maxHistoryMessageChars+1)) {
+		t.Error("long message was not shortened")
+	}
+
+	result, _, _ = tool.Execute(ctx, json.RawMessage(`{"last":100}`))
+	if len(result) > maxHistoryChars+100 {
+		t.Errorf("result is %d bytes, want at most about %d", len(result), maxHistoryChars)
+	}
+}
+
+func TestConversationHistoryTool_RequiresTurn(t *testing.T) {
+	tool := &conversationHistoryTool{conversations: NewConversationStore()}
+	_, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{}`))
+	if !isErr {
+		t.Error("expected an error result without a turn in the context")
+	}
+}
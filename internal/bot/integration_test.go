@@ -10,6 +10,7 @@ import (
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace/noop"
 	"maunium.net/go/mautrix"
 
 	"github.com/feline-dis/matrix-claude-bot/internal/config"
@@ -106,13 +107,17 @@ func TestIntegration_FullFlow(t *testing.T) {
 		config:        cfg,
 		conversations: NewConversationStore(),
 		tools:         tools.NewRegistry(),
+		clock:         realClock{},
 		startTime:     time.Now(),
+		lastReplies:   newReplyTracker(),
+		latencies:     newLatencyTracker(latencyWindow),
+		tracer:        noop.NewTracerProvider().Tracer(""),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	resp, err := bot.getClaudeResponse(ctx, "$integration-test", "Say hello in exactly one word.")
+	resp, err := bot.getClaudeResponse(ctx, turnFor(bot, "$integration-test"), "Say hello in exactly one word.")
 	if err != nil {
 		t.Fatalf("getClaudeResponse failed: %v", err)
 	}
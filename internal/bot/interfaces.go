@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -13,6 +14,24 @@ import (
 type MatrixClient interface {
 	JoinRoomByID(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinRoom, error)
 	SendMessageEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error)
+	UploadBytes(ctx context.Context, data []byte, contentType string) (*mautrix.RespMediaUpload, error)
+	GetEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error)
+	StateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error
+	GetDisplayName(ctx context.Context, userID id.UserID) (*mautrix.RespUserDisplayName, error)
+}
+
+// ProfileClient is the part of *mautrix.Client that SyncProfile uses to
+// keep the bot's own profile up to date.
+type ProfileClient interface {
+	GetProfile(ctx context.Context, userID id.UserID) (*mautrix.RespUserProfile, error)
+	SetDisplayName(ctx context.Context, displayName string) error
+	SetAvatarURL(ctx context.Context, url id.ContentURI) error
+}
+
+// EventSyncer is the part of mautrix.DefaultSyncer that handlers are
+// registered on.
+type EventSyncer interface {
+	OnEventType(eventType event.Type, callback mautrix.EventHandler)
 }
 
 // ClaudeMessenger abstracts the Claude message-creation capability.
@@ -29,7 +48,12 @@ func (a *claudeAdapter) NewMessage(ctx context.Context, params anthropic.Message
 	return a.client.Messages.New(ctx, params)
 }
 
-// NewClaudeAdapter creates a ClaudeMessenger backed by the Anthropic SDK client.
-func NewClaudeAdapter() ClaudeMessenger {
-	return &claudeAdapter{client: anthropic.NewClient()}
+// NewClaudeAdapter creates a ClaudeMessenger backed by the Anthropic SDK
+// client, with any extra request options (e.g. a different base URL).
+//
+// Requests are bound to the caller's context: cancelling it (the stop
+// command, a stop reaction, or shutdown) closes the connection, which ends
+// generation and billing on Anthropic's side rather than leaving it to run.
+func NewClaudeAdapter(opts ...option.RequestOption) ClaudeMessenger {
+	return &claudeAdapter{client: anthropic.NewClient(opts...)}
 }
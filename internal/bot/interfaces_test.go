@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+func TestClaudeAdapter_CancelClosesRequest(t *testing.T) {
+	started := make(chan struct{})
+	closed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client hanging up once the body has
+		// been read.
+		io.Copy(io.Discard, r.Body)
+		close(started)
+		// Stand in for a long generation: hold the request open until the
+		// client goes away.
+		<-r.Context().Done()
+		close(closed)
+	}))
+	defer server.Close()
+
+	claude := NewClaudeAdapter(option.WithBaseURL(server.URL), option.WithAPIKey("test"), option.WithMaxRetries(0))
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := claude.NewMessage(ctx, anthropic.MessageNewParams{
+			Model:     "claude-sonnet-4-20250514",
+			MaxTokens: 1024,
+			Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))},
+		})
+		errc <- err
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected a cancellation error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NewMessage did not return after its context was cancelled")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request to the API was left open after cancellation")
+	}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencyWindow is how many recent Claude requests status percentiles cover.
+const latencyWindow = 100
+
+// latencyTracker keeps the durations of the last size requests in a ring
+// buffer.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	size    int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, 0, size), size: size}
+}
+
+func (l *latencyTracker) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < l.size {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % l.size
+}
+
+// percentiles returns the nearest-rank value for each percentile p (0-100)
+// and how many samples they were computed from.
+func (l *latencyTracker) percentiles(ps ...float64) ([]time.Duration, int) {
+	l.mu.Lock()
+	sorted := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return nil, 0
+	}
+	slices.Sort(sorted)
+
+	out := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		out[i] = sorted[min(max(rank, 0), len(sorted)-1)]
+	}
+	return out, len(sorted)
+}
@@ -0,0 +1,42 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyTracker_Percentiles(t *testing.T) {
+	l := newLatencyTracker(100)
+	for i := 1; i <= 100; i++ {
+		l.record(time.Duration(i) * time.Millisecond)
+	}
+
+	p, n := l.percentiles(50, 95)
+	if n != 100 {
+		t.Fatalf("expected 100 samples, got %d", n)
+	}
+	if p[0] != 50*time.Millisecond || p[1] != 95*time.Millisecond {
+		t.Errorf("expected p50=50ms p95=95ms, got p50=%s p95=%s", p[0], p[1])
+	}
+}
+
+func TestLatencyTracker_KeepsOnlyRecentSamples(t *testing.T) {
+	l := newLatencyTracker(4)
+	for _, ms := range []int{1000, 1000, 1000, 1000, 10, 20, 30, 40} {
+		l.record(time.Duration(ms) * time.Millisecond)
+	}
+
+	p, n := l.percentiles(50, 100)
+	if n != 4 {
+		t.Fatalf("expected window of 4 samples, got %d", n)
+	}
+	if p[0] != 20*time.Millisecond || p[1] != 40*time.Millisecond {
+		t.Errorf("expected old samples to be overwritten, got p50=%s max=%s", p[0], p[1])
+	}
+}
+
+func TestLatencyTracker_Empty(t *testing.T) {
+	if _, n := newLatencyTracker(10).percentiles(50); n != 0 {
+		t.Errorf("expected no samples, got %d", n)
+	}
+}
@@ -0,0 +1,85 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+// modelCapabilities describes what the "model-info" command reports for a
+// family of models.
+type modelCapabilities struct {
+	prefix        string
+	contextWindow int
+	maxOutput     int
+	tools         bool
+	vision        bool
+}
+
+// knownModels is matched by longest prefix, so dated and aliased names like
+// "claude-sonnet-4-5-20250929" and "claude-sonnet-4-5" share an entry.
+var knownModels = []modelCapabilities{
+	{prefix: "claude-opus-4-5", contextWindow: 200_000, maxOutput: 64_000, tools: true, vision: true},
+	{prefix: "claude-opus-4-1", contextWindow: 200_000, maxOutput: 32_000, tools: true, vision: true},
+	{prefix: "claude-opus-4", contextWindow: 200_000, maxOutput: 32_000, tools: true, vision: true},
+	{prefix: "claude-sonnet-4-5", contextWindow: 200_000, maxOutput: 64_000, tools: true, vision: true},
+	{prefix: "claude-sonnet-4", contextWindow: 200_000, maxOutput: 64_000, tools: true, vision: true},
+	{prefix: "claude-haiku-4-5", contextWindow: 200_000, maxOutput: 64_000, tools: true, vision: true},
+	{prefix: "claude-3-7-sonnet", contextWindow: 200_000, maxOutput: 64_000, tools: true, vision: true},
+	{prefix: "claude-3-5-sonnet", contextWindow: 200_000, maxOutput: 8_192, tools: true, vision: true},
+	{prefix: "claude-3-5-haiku", contextWindow: 200_000, maxOutput: 8_192, tools: true, vision: true},
+	{prefix: "claude-3-opus", contextWindow: 200_000, maxOutput: 4_096, tools: true, vision: true},
+	{prefix: "claude-3-haiku", contextWindow: 200_000, maxOutput: 4_096, tools: true, vision: true},
+}
+
+// lookupModel returns the capabilities of the known model family with the
+// longest prefix of model.
+func lookupModel(model string) (modelCapabilities, bool) {
+	var best modelCapabilities
+	found := false
+	for _, m := range knownModels {
+		if strings.HasPrefix(model, m.prefix) && len(m.prefix) > len(best.prefix) {
+			best, found = m, true
+		}
+	}
+	return best, found
+}
+
+// maxTokensFor caps configured at model's output limit, since the API
+// rejects every request asking for more. Unknown models are left alone.
+func maxTokensFor(model string, configured int64) int64 {
+	if caps, ok := lookupModel(model); ok && configured > int64(caps.maxOutput) {
+		return int64(caps.maxOutput)
+	}
+	return configured
+}
+
+// warnMaxTokens logs when claude.max_tokens is above the default model's
+// output limit and will be clamped.
+func warnMaxTokens(cfg config.Config) {
+	if capped := maxTokensFor(cfg.Model, cfg.MaxTokens); capped != cfg.MaxTokens {
+		log.Printf("Warning: claude.max_tokens %d is above %s's output limit, using %d", cfg.MaxTokens, cfg.Model, capped)
+	}
+}
+
+// modelInfo handles "model-info": the thread's model with its context
+// window, output limit, and tool and vision support.
+func (b *Bot) modelInfo(t turn) string {
+	model := b.modelFor(t)
+
+	caps, ok := lookupModel(model)
+	if !ok {
+		return fmt.Sprintf("Model: %s\nContext window: unknown\nMax output: unknown\nTools: unknown\nVision: unknown", model)
+	}
+	return fmt.Sprintf("Model: %s\nContext window: %d tokens\nMax output: %d tokens\nTools: %s\nVision: %s",
+		model, caps.contextWindow, caps.maxOutput, yesNo(caps.tools), yesNo(caps.vision))
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
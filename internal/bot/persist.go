@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/id"
+)
+
+// persistedThread is the on-disk form of a single conversation.
+type persistedThread struct {
+	History    []anthropic.MessageParam `json:"history,omitempty"`
+	Model      string                   `json:"model,omitempty"`
+	Persona    string                   `json:"persona,omitempty"`
+	Room       id.RoomID                `json:"room,omitempty"`
+	LastAccess time.Time                `json:"last_access"`
+}
+
+// NewPersistentConversationStore returns a store that is loaded from path and
+// rewritten there after every change. A missing file starts an empty store.
+func NewPersistentConversationStore(path string) (*ConversationStore, error) {
+	s := NewConversationStore()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var threads map[id.EventID]persistedThread
+	if err := json.Unmarshal(data, &threads); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	s.restoreLocked(threads)
+	return s, nil
+}
+
+// restoreLocked loads threads into the store, replacing any thread with the
+// same ID. Callers must hold s.mu, or own s exclusively.
+func (s *ConversationStore) restoreLocked(threads map[id.EventID]persistedThread) {
+	for threadID, thread := range threads {
+		delete(s.convs, threadID)
+		delete(s.models, threadID)
+		delete(s.personas, threadID)
+		delete(s.rooms, threadID)
+		if len(thread.History) > 0 {
+			s.convs[threadID] = thread.History
+		}
+		if thread.Model != "" {
+			s.models[threadID] = thread.Model
+		}
+		if thread.Persona != "" {
+			s.personas[threadID] = thread.Persona
+		}
+		if thread.Room != "" {
+			s.rooms[threadID] = thread.Room
+		}
+		s.lastAccess[threadID] = thread.LastAccess
+	}
+}
+
+// snapshotLocked returns every thread in its on-disk form. Callers must hold
+// s.mu.
+func (s *ConversationStore) snapshotLocked() map[id.EventID]persistedThread {
+	threads := make(map[id.EventID]persistedThread, len(s.lastAccess))
+	for threadID, last := range s.lastAccess {
+		threads[threadID] = persistedThread{
+			History:    s.convs[threadID],
+			Model:      s.models[threadID],
+			Persona:    s.personas[threadID],
+			Room:       s.rooms[threadID],
+			LastAccess: last,
+		}
+	}
+	return threads
+}
+
+// BufferWrites makes a persistent store write to disk only when Flush is
+// called or, if maxPending is positive, once that many changes have
+// accumulated, instead of on every change. Reads are unaffected since memory
+// stays authoritative, but a crash loses any changes not yet flushed.
+func (s *ConversationStore) BufferWrites(maxPending int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buffered = true
+	s.flushAfter = maxPending
+}
+
+// Flush writes any buffered changes to disk.
+func (s *ConversationStore) Flush() {
+	s.mu.Lock()
+	defer s.unlockAndSave()
+	if s.pending > 0 {
+		s.saveLocked()
+	}
+}
+
+// persistLocked records a change, saving it now or buffering it per
+// BufferWrites. Callers must hold s.mu and release it with unlockAndSave.
+func (s *ConversationStore) persistLocked() {
+	if s.path == "" {
+		return
+	}
+	s.pending++
+	if !s.buffered || (s.flushAfter > 0 && s.pending >= s.flushAfter) {
+		s.saveLocked()
+	}
+}
+
+// saveLocked encodes every conversation for unlockAndSave to write to disk
+// when the store is persistent. Callers must hold s.mu and release it with
+// unlockAndSave.
+func (s *ConversationStore) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	s.pending = 0
+
+	data, err := json.Marshal(s.snapshotLocked())
+	if err != nil {
+		log.Printf("Failed to encode conversations: %v", err)
+		return
+	}
+	s.saveSeq++
+	s.unsaved = data
+}
+
+// unlockAndSave releases s.mu and then writes out the snapshot saveLocked
+// encoded, if any, so the store isn't locked while the disk is busy.
+func (s *ConversationStore) unlockAndSave() {
+	data, seq := s.unsaved, s.saveSeq
+	s.unsaved = nil
+	s.mu.Unlock()
+	if data != nil {
+		s.writeFile(data, seq)
+	}
+}
+
+// writeFile replaces the file at s.path with snapshot seq, unless a newer
+// snapshot has already been written. The file is replaced atomically so a
+// crash mid-write can't corrupt it.
+func (s *ConversationStore) writeFile(data []byte, seq uint64) {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if seq <= s.written {
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("Failed to save conversations: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("Failed to save conversations: %v", err)
+		return
+	}
+	s.written = seq
+}
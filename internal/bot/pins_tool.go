@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	maxRoomPins        = 20
+	maxRoomPinLength   = 1000
+	roomPinsNoneResult = "This room has no pinned messages."
+)
+
+// roomPinsTool lets Claude read the pinned messages of the room it is
+// answering in, which often hold rules or other onboarding information.
+type roomPinsTool struct {
+	bot *Bot
+}
+
+func (t *roomPinsTool) Name() string { return "room_pins" }
+
+func (t *roomPinsTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "room_pins",
+			Description: anthropic.String(fmt.Sprintf("Return the text of this Matrix room's pinned messages (newest %d at most). Use for questions about the room's rules, links, or other information the room keeps pinned.", maxRoomPins)),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{},
+			},
+		},
+	}
+}
+
+func (t *roomPinsTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	tr, ok := turnFrom(ctx)
+	if !ok {
+		return "room pins are only available from a chat message", true, nil
+	}
+
+	var pins event.PinnedEventsEventContent
+	err := t.bot.matrix.StateEvent(ctx, tr.roomID, event.StatePinnedEvents, "", &pins)
+	if errors.Is(err, mautrix.MNotFound) {
+		return roomPinsNoneResult, false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("fetching pinned events: %w", err)
+	}
+	if len(pins.Pinned) == 0 {
+		return roomPinsNoneResult, false, nil
+	}
+
+	// Clients append new pins, so the newest are at the end.
+	pinned := pins.Pinned
+	omitted := max(len(pinned)-maxRoomPins, 0)
+	pinned = pinned[omitted:]
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d pinned message(s)", len(pins.Pinned))
+	if omitted > 0 {
+		fmt.Fprintf(&sb, ", showing the newest %d", len(pinned))
+	}
+	sb.WriteString(":")
+	for _, eventID := range pinned {
+		evt, err := t.bot.fetchEvent(ctx, tr.roomID, eventID)
+		if err != nil {
+			log.Printf("Failed to fetch pinned event %s: %v", eventID, err)
+			fmt.Fprintf(&sb, "\n\n[%s could not be read]", eventID)
+			continue
+		}
+		msg := evt.Content.AsMessage()
+		if msg == nil || msg.Body == "" {
+			fmt.Fprintf(&sb, "\n\n[%s has no text]", eventID)
+			continue
+		}
+		body := msg.Body
+		if runes := []rune(body); len(runes) > maxRoomPinLength {
+			body = string(runes[:maxRoomPinLength]) + "…"
+		}
+		fmt.Fprintf(&sb, "\n\nFrom %s:\n%s", evt.Sender, body)
+	}
+	return sb.String(), false, nil
+}
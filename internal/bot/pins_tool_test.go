@@ -0,0 +1,88 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+func pinnedMessage(sender id.UserID, eventID id.EventID, body string) *event.Event {
+	return &event.Event{
+		Sender:  sender,
+		Type:    event.EventMessage,
+		ID:      eventID,
+		RoomID:  "!room:example.com",
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: body}},
+	}
+}
+
+func TestRoomPinsTool_ReturnsPinnedText(t *testing.T) {
+	matrix := &mockMatrixClient{
+		stateEvents: map[event.Type]any{
+			event.StatePinnedEvents: event.PinnedEventsEventContent{Pinned: []id.EventID{"$rules", "$gone", "$faq"}},
+		},
+		getEventFunc: func(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+			switch eventID {
+			case "$rules":
+				return pinnedMessage("@mod:example.com", eventID, "1. Be kind\n2. No spam"), nil
+			case "$faq":
+				return pinnedMessage("@mod:example.com", eventID, "FAQ: see the wiki"), nil
+			}
+			return nil, fmt.Errorf("not found")
+		},
+	}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	tool := &roomPinsTool{bot: bot}
+
+	result, isErr, err := tool.Execute(withTurn(context.Background(), testTurn("$thread")), nil)
+	if err != nil || isErr {
+		t.Fatalf("Execute = %q, %v, %v", result, isErr, err)
+	}
+	for _, want := range []string{"3 pinned message(s):", "From @mod:example.com:\n1. Be kind\n2. No spam", "[$gone could not be read]", "FAQ: see the wiki"} {
+		if !strings.Contains(result, want) {
+			t.Errorf("result missing %q:\n%s", want, result)
+		}
+	}
+	if strings.Index(result, "Be kind") > strings.Index(result, "FAQ") {
+		t.Error("pins should keep their pinned order")
+	}
+}
+
+func TestRoomPinsTool_NoPins(t *testing.T) {
+	bot := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	tool := &roomPinsTool{bot: bot}
+
+	result, isErr, err := tool.Execute(withTurn(context.Background(), testTurn("$thread")), nil)
+	if err != nil || isErr || result != roomPinsNoneResult {
+		t.Errorf("Execute = %q, %v, %v", result, isErr, err)
+	}
+}
+
+func TestRoomPinsTool_BoundsPins(t *testing.T) {
+	var pinned []id.EventID
+	for i := range maxRoomPins + 5 {
+		pinned = append(pinned, id.EventID(fmt.Sprintf("$pin%d", i)))
+	}
+	matrix := &mockMatrixClient{
+		stateEvents: map[event.Type]any{event.StatePinnedEvents: event.PinnedEventsEventContent{Pinned: pinned}},
+		getEventFunc: func(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+			return pinnedMessage("@mod:example.com", eventID, "pin "+string(eventID)+" "+strings.Repeat("x", 2000)), nil
+		},
+	}
+	tool := &roomPinsTool{bot: newTestBot(matrix, &mockClaudeMessenger{})}
+
+	result, _, _ := tool.Execute(withTurn(context.Background(), testTurn("$thread")), nil)
+	if !strings.HasPrefix(result, fmt.Sprintf("%d pinned message(s), showing the newest %d:", maxRoomPins+5, maxRoomPins)) {
+		t.Errorf("unexpected header: %q", result[:60])
+	}
+	if strings.Contains(result, "pin $pin4 ") || !strings.Contains(result, "pin $pin5 ") {
+		t.Error("expected only the newest pins")
+	}
+	if strings.Contains(result, strings.Repeat("x", maxRoomPinLength)) {
+		t.Error("long pins should be shortened")
+	}
+}
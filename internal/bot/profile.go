@@ -0,0 +1,47 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+// SyncProfile sets the bot's display name and avatar to matrix.display_name
+// and matrix.avatar_url, skipping whichever is unset or already matches the
+// current profile.
+func SyncProfile(ctx context.Context, client ProfileClient, cfg config.Config) error {
+	if cfg.DisplayName == "" && cfg.AvatarURL.IsEmpty() {
+		return nil
+	}
+
+	// A profile that can't be read is treated as empty, so both are set.
+	var currentName string
+	var currentAvatar id.ContentURI
+	if profile, err := client.GetProfile(ctx, cfg.UserID); err != nil {
+		log.Printf("Could not read own profile, setting it anyway: %v", err)
+	} else {
+		currentName, currentAvatar = profile.DisplayName, profile.AvatarURL
+	}
+
+	var errs []error
+	if cfg.DisplayName != "" && cfg.DisplayName != currentName {
+		if err := client.SetDisplayName(ctx, cfg.DisplayName); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set display name: %w", err))
+		} else {
+			log.Printf("Display name set to %q", cfg.DisplayName)
+		}
+	}
+	if !cfg.AvatarURL.IsEmpty() && cfg.AvatarURL != currentAvatar {
+		if err := client.SetAvatarURL(ctx, cfg.AvatarURL); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set avatar: %w", err))
+		} else {
+			log.Printf("Avatar set to %s", cfg.AvatarURL)
+		}
+	}
+	return errors.Join(errs...)
+}
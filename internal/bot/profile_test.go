@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+type mockProfileClient struct {
+	profile    *mautrix.RespUserProfile
+	profileErr error
+	names      []string
+	avatars    []id.ContentURI
+}
+
+func (m *mockProfileClient) GetProfile(ctx context.Context, userID id.UserID) (*mautrix.RespUserProfile, error) {
+	return m.profile, m.profileErr
+}
+
+func (m *mockProfileClient) SetDisplayName(ctx context.Context, displayName string) error {
+	m.names = append(m.names, displayName)
+	return nil
+}
+
+func (m *mockProfileClient) SetAvatarURL(ctx context.Context, url id.ContentURI) error {
+	m.avatars = append(m.avatars, url)
+	return nil
+}
+
+func TestSyncProfile(t *testing.T) {
+	avatar := id.ContentURI{Homeserver: "example.com", FileID: "avatar"}
+	cfg := config.Config{UserID: "@bot:example.com", DisplayName: "Claude", AvatarURL: avatar}
+
+	// A differing name is updated; a matching avatar is left alone.
+	client := &mockProfileClient{profile: &mautrix.RespUserProfile{DisplayName: "bot", AvatarURL: avatar}}
+	if err := SyncProfile(context.Background(), client, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.names) != 1 || client.names[0] != "Claude" {
+		t.Errorf("expected the display name set to Claude, got %v", client.names)
+	}
+	if len(client.avatars) != 0 {
+		t.Errorf("expected the matching avatar skipped, got %v", client.avatars)
+	}
+
+	// Nothing is set when the profile already matches.
+	client = &mockProfileClient{profile: &mautrix.RespUserProfile{DisplayName: "Claude", AvatarURL: avatar}}
+	if err := SyncProfile(context.Background(), client, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.names) != 0 || len(client.avatars) != 0 {
+		t.Errorf("expected no updates, got names %v, avatars %v", client.names, client.avatars)
+	}
+
+	// An unreadable profile gets both set.
+	client = &mockProfileClient{profileErr: errors.New("M_NOT_FOUND")}
+	if err := SyncProfile(context.Background(), client, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.names) != 1 || len(client.avatars) != 1 {
+		t.Errorf("expected both set, got names %v, avatars %v", client.names, client.avatars)
+	}
+
+	// Unset options make it a no-op.
+	client = &mockProfileClient{profileErr: errors.New("should not be called")}
+	if err := SyncProfile(context.Background(), client, config.Config{UserID: "@bot:example.com"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.names) != 0 || len(client.avatars) != 0 {
+		t.Errorf("expected no updates without config, got names %v, avatars %v", client.names, client.avatars)
+	}
+}
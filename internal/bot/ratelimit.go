@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rateWindow is the span the ratelimit.per_*_per_minute limits count over.
+const rateWindow = time.Minute
+
+// rateLimiter counts the messages answered for each key, a room or a user,
+// in the last minute. The zero value is ready to use.
+type rateLimiter struct {
+	mu      sync.Mutex
+	answers map[string][]time.Time
+}
+
+// allow reports whether key may be answered at now under limit per minute,
+// recording the answer if so. A limit of 0 allows everything.
+func (r *rateLimiter) allow(key string, now time.Time, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recent := r.pruneLocked(key, now)
+	if len(recent) >= limit {
+		return false
+	}
+	if r.answers == nil {
+		r.answers = make(map[string][]time.Time)
+	}
+	r.answers[key] = append(recent, now)
+	return true
+}
+
+// pruneLocked drops key's answers that have left the window and returns
+// the rest. Callers must hold r.mu.
+func (r *rateLimiter) pruneLocked(key string, now time.Time) []time.Time {
+	recent := r.answers[key]
+	for len(recent) > 0 && now.Sub(recent[0]) >= rateWindow {
+		recent = recent[1:]
+	}
+	if len(recent) == 0 {
+		delete(r.answers, key)
+		return nil
+	}
+	r.answers[key] = recent
+	return recent
+}
+
+// rateLimitState is how much of its limit one key has left.
+type rateLimitState struct {
+	key       string
+	remaining int
+	// refill is when the oldest counted answer leaves the window, freeing
+	// a slot.
+	refill time.Time
+}
+
+// states returns the standing under limit of every key answered within the
+// window, most limited first.
+func (r *rateLimiter) states(now time.Time, limit int) []rateLimitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var states []rateLimitState
+	for key := range r.answers {
+		recent := r.pruneLocked(key, now)
+		if len(recent) == 0 {
+			continue
+		}
+		states = append(states, rateLimitState{
+			key:       key,
+			remaining: max(limit-len(recent), 0),
+			refill:    recent[0].Add(rateWindow),
+		})
+	}
+	slices.SortFunc(states, func(a, b rateLimitState) int {
+		return cmp.Or(
+			cmp.Compare(a.remaining, b.remaining),
+			a.refill.Compare(b.refill),
+			cmp.Compare(a.key, b.key),
+		)
+	})
+	return states
+}
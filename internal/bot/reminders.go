@@ -0,0 +1,264 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/tools"
+)
+
+const maxReminderDelay = 30 * 24 * time.Hour
+
+// Reminder is a message the bot will post in a room at a later time,
+// mentioning the user who asked for it.
+type Reminder struct {
+	ID      string    `json:"id"`
+	RoomID  id.RoomID `json:"room_id"`
+	UserID  id.UserID `json:"user_id"`
+	Message string    `json:"message"`
+	Due     time.Time `json:"due"`
+}
+
+// reminderScheduler keeps a timer per pending reminder and calls fire when
+// one is due. Pending reminders are saved to path, if set, so they survive
+// restarts.
+type reminderScheduler struct {
+	mu      sync.Mutex
+	pending map[string]Reminder
+	timers  map[string]Timer
+	seq     int
+	stopped bool
+
+	path  string
+	clock Clock
+	fire  func(Reminder)
+}
+
+func newReminderScheduler(path string, clock Clock, fire func(Reminder)) *reminderScheduler {
+	return &reminderScheduler{
+		pending: make(map[string]Reminder),
+		timers:  make(map[string]Timer),
+		path:    path,
+		clock:   clock,
+		fire:    fire,
+	}
+}
+
+// load schedules the reminders saved at s.path. Any that came due while the
+// bot was down fire right away.
+func (s *reminderScheduler) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var reminders []Reminder
+	if err := json.Unmarshal(data, &reminders); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range reminders {
+		s.pending[r.ID] = r
+		s.armLocked(r)
+	}
+	return nil
+}
+
+// schedule adds a reminder, filling in its ID, and returns it.
+func (s *reminderScheduler) schedule(r Reminder) Reminder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	r.ID = strconv.FormatInt(s.clock.Now().UnixNano(), 36) + "-" + strconv.Itoa(s.seq)
+	s.pending[r.ID] = r
+	s.armLocked(r)
+	s.saveLocked()
+	return r
+}
+
+func (s *reminderScheduler) armLocked(r Reminder) {
+	if s.stopped {
+		return
+	}
+	s.timers[r.ID] = s.clock.AfterFunc(max(r.Due.Sub(s.clock.Now()), 0), func() {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.pending, r.ID)
+		delete(s.timers, r.ID)
+		s.saveLocked()
+		s.mu.Unlock()
+
+		s.fire(r)
+	})
+}
+
+// cancelRoom drops every pending reminder for roomID and returns how many
+// there were.
+func (s *reminderScheduler) cancelRoom(roomID id.RoomID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cancelled := 0
+	for reminderID, r := range s.pending {
+		if r.RoomID != roomID {
+			continue
+		}
+		if t, ok := s.timers[reminderID]; ok {
+			t.Stop()
+			delete(s.timers, reminderID)
+		}
+		delete(s.pending, reminderID)
+		cancelled++
+	}
+	if cancelled > 0 {
+		s.saveLocked()
+	}
+	return cancelled
+}
+
+// stop cancels every timer. Persisted reminders are kept and rescheduled on
+// the next start.
+func (s *reminderScheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for id, t := range s.timers {
+		t.Stop()
+		delete(s.timers, id)
+	}
+}
+
+func (s *reminderScheduler) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	reminders := make([]Reminder, 0, len(s.pending))
+	for _, r := range s.pending {
+		reminders = append(reminders, r)
+	}
+	data, err := json.Marshal(reminders)
+	if err != nil {
+		log.Printf("Failed to encode reminders: %v", err)
+		return
+	}
+	if err := os.WriteFile(s.path, data, 0o600); err != nil {
+		log.Printf("Failed to save reminders: %v", err)
+	}
+}
+
+// postReminder sends a due reminder to its room, mentioning the requester.
+func (b *Bot) postReminder(r Reminder) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgText,
+		Body:     fmt.Sprintf("%s ⏰ Reminder: %s", r.UserID, r.Message),
+		Mentions: &event.Mentions{UserIDs: []id.UserID{r.UserID}},
+	}
+	if _, err := b.sendMessage(ctx, r.RoomID, content); err != nil {
+		log.Printf("Failed to post reminder %s in %s: %v", r.ID, r.RoomID, err)
+	}
+}
+
+type turnKey struct{}
+
+// withTurn attaches the turn being answered to a tool call's context, for
+// tools that act on the room or user that asked.
+func withTurn(ctx context.Context, t turn) context.Context {
+	return context.WithValue(ctx, turnKey{}, t)
+}
+
+func turnFrom(ctx context.Context) (turn, bool) {
+	t, ok := ctx.Value(turnKey{}).(turn)
+	return t, ok
+}
+
+// --- set_reminder ---
+
+type setReminderTool struct {
+	scheduler *reminderScheduler
+}
+
+type setReminderInput struct {
+	Delay   string `json:"delay"`
+	Message string `json:"message"`
+}
+
+func (t *setReminderTool) Name() string { return "set_reminder" }
+
+func (t *setReminderTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "set_reminder",
+			Description: anthropic.String("Schedule a reminder that the bot posts in this room later, mentioning the user who asked. Use when someone asks to be reminded of something."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"delay": map[string]any{
+						"type":        "string",
+						"description": "How long from now, as a duration like \"90m\" or \"2h30m\" (max 720h)",
+					},
+					"message": map[string]any{
+						"type":        "string",
+						"description": "What to remind them about, e.g. \"deploy the release\"",
+					},
+				},
+				Required: []string{"delay", "message"},
+			},
+		},
+	}
+}
+
+func (t *setReminderTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params setReminderInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return tools.InvalidInput(err), true, nil
+	}
+
+	delay, err := time.ParseDuration(params.Delay)
+	if err != nil {
+		return fmt.Sprintf("invalid delay %q: use a duration like 90m or 2h30m", params.Delay), true, nil
+	}
+	if delay <= 0 || delay > maxReminderDelay {
+		return "delay must be between 1s and 720h", true, nil
+	}
+	if params.Message == "" {
+		return "message is empty", true, nil
+	}
+
+	tr, ok := turnFrom(ctx)
+	if !ok {
+		return "reminders can only be set from a chat message", true, nil
+	}
+
+	r := t.scheduler.schedule(Reminder{
+		RoomID:  tr.roomID,
+		UserID:  tr.sender,
+		Message: params.Message,
+		Due:     t.scheduler.clock.Now().Add(delay),
+	})
+	return fmt.Sprintf("reminder set for %s (in %s)", r.Due.UTC().Format(time.RFC3339), delay), false, nil
+}
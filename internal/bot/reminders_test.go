@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+var reminderEpoch = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func reminderCtx() context.Context {
+	t := testTurn("$thread")
+	t.sender = "@alice:example.com"
+	return withTurn(context.Background(), t)
+}
+
+func TestSetReminder_Schedules(t *testing.T) {
+	clock := newFakeClock(reminderEpoch)
+	s := newReminderScheduler("", clock, func(Reminder) {})
+	tool := &setReminderTool{scheduler: s}
+
+	result, isErr, err := tool.Execute(reminderCtx(), json.RawMessage(`{"delay":"2h","message":"deploy"}`))
+	if err != nil || isErr {
+		t.Fatalf("Execute = %q, %v, %v", result, isErr, err)
+	}
+	if !strings.Contains(result, "2025-06-01T14:00:00Z") {
+		t.Errorf("result = %q, want due time", result)
+	}
+	if len(clock.timers) != 1 || !clock.timers[0].due.Equal(reminderEpoch.Add(2*time.Hour)) {
+		t.Fatalf("timers = %+v, want one due in 2h", clock.timers)
+	}
+	if len(s.pending) != 1 {
+		t.Fatalf("pending = %d, want 1", len(s.pending))
+	}
+	for _, r := range s.pending {
+		if r.RoomID != "!room:example.com" || r.UserID != "@alice:example.com" || r.Message != "deploy" {
+			t.Errorf("reminder = %+v", r)
+		}
+	}
+}
+
+func TestSetReminder_RejectsBadDelay(t *testing.T) {
+	clock := newFakeClock(reminderEpoch)
+	s := newReminderScheduler("", clock, func(Reminder) {})
+	tool := &setReminderTool{scheduler: s}
+
+	for _, delay := range []string{"soon", "-1h", "1000h"} {
+		input, _ := json.Marshal(setReminderInput{Delay: delay, Message: "x"})
+		if _, isErr, _ := tool.Execute(reminderCtx(), input); !isErr {
+			t.Errorf("delay %q: expected error result", delay)
+		}
+	}
+	if len(clock.timers) != 0 {
+		t.Errorf("scheduled %d timers, want 0", len(clock.timers))
+	}
+}
+
+func TestReminder_FiresIntoRoom(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	clock := newFakeClock(reminderEpoch)
+	s := newReminderScheduler("", clock, bot.postReminder)
+	tool := &setReminderTool{scheduler: s}
+
+	if _, isErr, _ := tool.Execute(reminderCtx(), json.RawMessage(`{"delay":"10m","message":"stand-up"}`)); isErr {
+		t.Fatal("unexpected error result")
+	}
+	clock.Advance(9 * time.Minute)
+	if len(matrix.sentEvents) != 0 {
+		t.Fatal("reminder fired early")
+	}
+	clock.Advance(time.Minute)
+
+	if len(matrix.sentEvents) != 1 {
+		t.Fatalf("sent %d events, want 1", len(matrix.sentEvents))
+	}
+	sent := matrix.sentEvents[0]
+	content := sent.Content.(*event.MessageEventContent)
+	if sent.RoomID != "!room:example.com" {
+		t.Errorf("room = %s", sent.RoomID)
+	}
+	if !strings.Contains(content.Body, "@alice:example.com") || !strings.Contains(content.Body, "stand-up") {
+		t.Errorf("body = %q", content.Body)
+	}
+	if content.Mentions == nil || len(content.Mentions.UserIDs) != 1 || content.Mentions.UserIDs[0] != "@alice:example.com" {
+		t.Errorf("mentions = %+v", content.Mentions)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending = %d after firing, want 0", len(s.pending))
+	}
+}
+
+func TestReminder_StopCancelsTimers(t *testing.T) {
+	var fired []Reminder
+	clock := newFakeClock(reminderEpoch)
+	s := newReminderScheduler("", clock, func(r Reminder) { fired = append(fired, r) })
+	s.schedule(Reminder{RoomID: "!room:example.com", UserID: "@alice:example.com", Message: "x", Due: reminderEpoch.Add(time.Hour)})
+
+	s.stop()
+	clock.Advance(2 * time.Hour)
+
+	if !clock.timers[0].stopped {
+		t.Error("timer not stopped")
+	}
+	// A timer that was already firing when stop ran must not post.
+	clock.timers[0].fn()
+	if len(fired) != 0 {
+		t.Errorf("fired %d reminders after stop", len(fired))
+	}
+}
+
+func TestReminder_PersistsAcrossRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reminders.json")
+	s := newReminderScheduler(path, newFakeClock(reminderEpoch), func(Reminder) {})
+	s.schedule(Reminder{RoomID: "!room:example.com", UserID: id.UserID("@alice:example.com"), Message: "x", Due: reminderEpoch.Add(time.Hour)})
+	s.stop()
+
+	clock := newFakeClock(reminderEpoch.Add(30 * time.Minute))
+	var fired []Reminder
+	restored := newReminderScheduler(path, clock, func(r Reminder) { fired = append(fired, r) })
+	if err := restored.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(restored.pending) != 1 {
+		t.Fatalf("restored %d reminders, want 1", len(restored.pending))
+	}
+	clock.Advance(30 * time.Minute)
+	if len(fired) != 1 {
+		t.Errorf("fired %d reminders after restart, want 1", len(fired))
+	}
+}
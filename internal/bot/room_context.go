@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// roomContextTTL is how long a room's name and topic are reused before its
+// state is fetched again, so renames show up without a restart.
+const roomContextTTL = 10 * time.Minute
+
+// roomContextCache holds recently built room context prompts. The zero value
+// is ready to use.
+type roomContextCache struct {
+	mu      sync.Mutex
+	entries map[id.RoomID]cachedRoomContext
+}
+
+type cachedRoomContext struct {
+	prompt  string
+	fetched time.Time
+}
+
+func (c *roomContextCache) get(roomID id.RoomID, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[roomID]
+	if !ok || now.Sub(e.fetched) >= roomContextTTL {
+		return "", false
+	}
+	return e.prompt, true
+}
+
+func (c *roomContextCache) set(roomID id.RoomID, prompt string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[id.RoomID]cachedRoomContext)
+	}
+	c.entries[roomID] = cachedRoomContext{prompt: prompt, fetched: now}
+}
+
+// roomContext returns a system prompt section naming the room and giving
+// its topic, for matrix.include_room_context, or "" if the room has
+// neither. A failed fetch is logged and not cached, so it is retried on the
+// next message.
+func (b *Bot) roomContext(ctx context.Context, roomID id.RoomID) string {
+	now := b.clock.Now()
+	if prompt, ok := b.roomContexts.get(roomID, now); ok {
+		return prompt
+	}
+
+	var name event.RoomNameEventContent
+	if err := b.matrix.StateEvent(ctx, roomID, event.StateRoomName, "", &name); err != nil && !errors.Is(err, mautrix.MNotFound) {
+		log.Printf("Failed to fetch name of %s: %v", roomID, err)
+		return ""
+	}
+	var topic event.TopicEventContent
+	if err := b.matrix.StateEvent(ctx, roomID, event.StateTopic, "", &topic); err != nil && !errors.Is(err, mautrix.MNotFound) {
+		log.Printf("Failed to fetch topic of %s: %v", roomID, err)
+		return ""
+	}
+
+	var lines []string
+	if n := strings.TrimSpace(name.Name); n != "" {
+		lines = append(lines, fmt.Sprintf("You are chatting in the Matrix room %q.", n))
+	}
+	if t := strings.TrimSpace(topic.Topic); t != "" {
+		lines = append(lines, "The room's topic is: "+t)
+	}
+	prompt := strings.Join(lines, "\n")
+	b.roomContexts.set(roomID, prompt, now)
+	return prompt
+}
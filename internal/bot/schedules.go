@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+	"github.com/feline-dis/matrix-claude-bot/internal/cron"
+)
+
+// scheduledPromptTimeout bounds one scheduled prompt, from asking Claude to
+// posting the answer.
+const scheduledPromptTimeout = 5 * time.Minute
+
+// promptScheduler keeps a timer per configured schedule, armed for its next
+// match, and calls fire each time one comes due.
+type promptScheduler struct {
+	mu      sync.Mutex
+	timers  []Timer
+	stopped bool
+
+	clock Clock
+	fire  func(config.ScheduleConfig)
+}
+
+func newPromptScheduler(schedules []config.ScheduleConfig, clock Clock, fire func(config.ScheduleConfig)) *promptScheduler {
+	s := &promptScheduler{timers: make([]Timer, len(schedules)), clock: clock, fire: fire}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sc := range schedules {
+		spec, err := cron.Parse(sc.Cron)
+		if err != nil {
+			log.Printf("Skipping schedule %d: %v", i, err)
+			continue
+		}
+		loc, err := time.LoadLocation(sc.Timezone)
+		if err != nil {
+			log.Printf("Skipping schedule %d: %v", i, err)
+			continue
+		}
+		s.armLocked(i, sc, spec, s.clock.Now().In(loc))
+	}
+	return s
+}
+
+// armLocked sets schedule i's timer for its first match after from.
+// Callers must hold s.mu.
+func (s *promptScheduler) armLocked(i int, sc config.ScheduleConfig, spec cron.Schedule, from time.Time) {
+	if s.stopped {
+		return
+	}
+	next := spec.Next(from)
+	if next.IsZero() {
+		log.Printf("Schedule %q never matches, not scheduling it", sc.Cron)
+		return
+	}
+	s.timers[i] = s.clock.AfterFunc(max(next.Sub(s.clock.Now()), 0), func() {
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			return
+		}
+		// Rearm from whichever is later, so a late timer doesn't fire
+		// again for each match it missed.
+		s.armLocked(i, sc, spec, later(next, s.clock.Now().In(next.Location())))
+		s.mu.Unlock()
+
+		s.fire(sc)
+	})
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// stop cancels every timer.
+func (s *promptScheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, t := range s.timers {
+		if t != nil {
+			t.Stop()
+		}
+	}
+}
+
+// runScheduledPrompt asks Claude a scheduled prompt and posts the answer in
+// the schedule's room. The prompt and answer are stored as the new thread's
+// history, so replies to the post carry on from it.
+func (b *Bot) runScheduledPrompt(sc config.ScheduleConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), scheduledPromptTimeout)
+	defer cancel()
+
+	cfg := b.cfg()
+	if limit := cfg.DailyTokenBudget; limit > 0 && b.budget.usedToday(b.clock.Now()) >= limit {
+		log.Printf("Skipping scheduled prompt for %s: daily token budget used up", sc.Room)
+		return
+	}
+
+	prompt := anthropic.NewUserMessage(anthropic.NewTextBlock(sc.Prompt))
+	params := anthropic.MessageNewParams{
+		Model:     anthropic.Model(cfg.Model),
+		Messages:  []anthropic.MessageParam{prompt},
+		MaxTokens: maxTokensFor(cfg.Model, cfg.MaxTokens),
+	}
+	if cfg.SystemPrompt != "" {
+		params.System = []anthropic.TextBlockParam{{Text: cfg.SystemPrompt}}
+	}
+	// There's no thread yet to pin a fallback model to, so only the
+	// default model is tried.
+	resp, err := b.sendWithFallback(ctx, "", nil, params)
+	if err != nil {
+		log.Printf("Scheduled prompt for %s failed: %v", sc.Room, err)
+		return
+	}
+	answer := extractText(resp.Content)
+	if answer == "" {
+		log.Printf("Scheduled prompt for %s got an empty answer", sc.Room)
+		return
+	}
+
+	body := b.decorateReply(cfg, answer)
+	content := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          body,
+		Format:        event.FormatHTML,
+		FormattedBody: formatReply(body),
+	}
+	sent, err := b.sendMessage(ctx, sc.Room, content)
+	if err != nil {
+		log.Printf("Failed to post scheduled prompt in %s: %v", sc.Room, err)
+		return
+	}
+
+	convID := sent.EventID
+	if cfg.ConversationScope == "room" {
+		convID = id.EventID(sc.Room)
+	}
+	b.conversations.Append(convID, prompt, anthropic.NewAssistantMessage(anthropic.NewTextBlock(answer)))
+	b.conversations.SetRoom(convID, sc.Room)
+}
@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+func TestPromptScheduler_PostsOnSchedule(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(matrix, claude)
+	clock := newFakeClock(time.Date(2025, 6, 2, 8, 0, 0, 0, time.UTC)) // a Monday
+	bot.clock = clock
+	standup := config.ScheduleConfig{
+		Cron:     "30 9 * * 1-5",
+		Room:     "!team:example.com",
+		Prompt:   "Post today's standup questions.",
+		Timezone: "UTC",
+	}
+	s := newPromptScheduler([]config.ScheduleConfig{standup}, clock, bot.runScheduledPrompt)
+	defer s.stop()
+
+	clock.Advance(89 * time.Minute)
+	if len(claude.capturedParams) != 0 {
+		t.Fatalf("fired %d time(s) before 09:30", len(claude.capturedParams))
+	}
+
+	clock.Advance(time.Minute)
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("expected the prompt sent at 09:30, got %d calls", len(claude.capturedParams))
+	}
+	if got := claude.capturedParams[0].Messages[0].Content[0].OfText.Text; got != standup.Prompt {
+		t.Errorf("expected the configured prompt, got %q", got)
+	}
+	if len(matrix.sentEvents) != 1 || matrix.sentEvents[0].RoomID != standup.Room {
+		t.Fatalf("expected the answer posted in %s, got %+v", standup.Room, matrix.sentEvents)
+	}
+	content := matrix.sentEvents[0].Content.(*event.MessageEventContent)
+	if content.Body != "mock response" || content.RelatesTo != nil {
+		t.Errorf("expected a top-level post of the answer, got %+v", content)
+	}
+	// Replies to the post continue from the prompt and answer.
+	if history := bot.conversations.Get("$reply"); len(history) != 2 {
+		t.Errorf("expected the post's thread to hold the prompt and answer, got %d messages", len(history))
+	}
+
+	// Next fires on Tuesday, not again on Monday.
+	clock.Advance(23*time.Hour + 59*time.Minute)
+	if len(claude.capturedParams) != 1 {
+		t.Fatalf("fired again before the next day, got %d calls", len(claude.capturedParams))
+	}
+	clock.Advance(time.Minute)
+	if len(claude.capturedParams) != 2 {
+		t.Errorf("expected the prompt sent again on Tuesday at 09:30, got %d calls", len(claude.capturedParams))
+	}
+
+	// Once stopped, nothing more fires.
+	s.stop()
+	clock.Advance(24 * time.Hour)
+	if len(claude.capturedParams) != 2 {
+		t.Errorf("fired after stop, got %d calls", len(claude.capturedParams))
+	}
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// maxSendRetries is how many times a rate-limited send is retried
+	// before the message is given up on.
+	maxSendRetries = 3
+	// defaultSendBackoff is the wait when the homeserver rate-limits
+	// without saying for how long.
+	defaultSendBackoff = 2 * time.Second
+	// maxSendBackoff caps the wait before one retry, whatever the
+	// homeserver asks for.
+	maxSendBackoff = 30 * time.Second
+)
+
+// sendMessage sends an m.room.message event. When the homeserver answers
+// M_LIMIT_EXCEEDED it waits for the retry_after_ms it suggests and tries
+// again, up to maxSendRetries times.
+func (b *Bot) sendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent) (*mautrix.RespSendEvent, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := b.matrix.SendMessageEvent(ctx, roomID, event.EventMessage, content)
+		backoff, limited := rateLimitBackoff(err)
+		if !limited || attempt == maxSendRetries {
+			return resp, err
+		}
+		log.Printf("Rate limited sending to %s, retrying in %s", roomID, backoff)
+		if !b.wait(ctx, backoff) {
+			return nil, err
+		}
+	}
+}
+
+// rateLimitBackoff reports whether err is an M_LIMIT_EXCEEDED response and
+// how long to wait before retrying.
+func rateLimitBackoff(err error) (time.Duration, bool) {
+	var httpErr mautrix.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RespError == nil || httpErr.RespError.ErrCode != mautrix.MLimitExceeded.ErrCode {
+		return 0, false
+	}
+	backoff := defaultSendBackoff
+	if ms, ok := httpErr.RespError.ExtraData["retry_after_ms"].(float64); ok && ms >= 0 {
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	return min(backoff, maxSendBackoff), true
+}
@@ -0,0 +1,166 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// Names of the per-room overrides kept in roomSettings.
+const (
+	settingModel   = "model"
+	settingPersona = "persona"
+)
+
+// SettingsStore is durable storage for the per-room overrides people set
+// from chat, such as a room's model or persona, keyed by room and setting
+// name. Setting a value to "" deletes it.
+type SettingsStore interface {
+	Load(ctx context.Context) (map[id.RoomID]map[string]string, error)
+	Set(ctx context.Context, roomID id.RoomID, name, value string) error
+}
+
+// sqlSettings keeps settings in a table of a SQLite database.
+type sqlSettings struct {
+	db *sql.DB
+}
+
+// NewSQLSettingsStore returns a SettingsStore backed by db, creating its
+// table if needed.
+func NewSQLSettingsStore(ctx context.Context, db *sql.DB) (SettingsStore, error) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS bot_room_settings (
+		room_id TEXT NOT NULL,
+		name    TEXT NOT NULL,
+		value   TEXT NOT NULL,
+		PRIMARY KEY (room_id, name)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("creating settings table: %w", err)
+	}
+	return &sqlSettings{db: db}, nil
+}
+
+func (s *sqlSettings) Load(ctx context.Context) (map[id.RoomID]map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT room_id, name, value FROM bot_room_settings`)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[id.RoomID]map[string]string)
+	for rows.Next() {
+		var roomID id.RoomID
+		var name, value string
+		if err := rows.Scan(&roomID, &name, &value); err != nil {
+			return nil, fmt.Errorf("loading settings: %w", err)
+		}
+		if out[roomID] == nil {
+			out[roomID] = make(map[string]string)
+		}
+		out[roomID][name] = value
+	}
+	return out, rows.Err()
+}
+
+func (s *sqlSettings) Set(ctx context.Context, roomID id.RoomID, name, value string) error {
+	var err error
+	if value == "" {
+		_, err = s.db.ExecContext(ctx, `DELETE FROM bot_room_settings WHERE room_id = ? AND name = ?`, roomID, name)
+	} else {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO bot_room_settings (room_id, name, value) VALUES (?, ?, ?)
+			ON CONFLICT (room_id, name) DO UPDATE SET value = excluded.value`, roomID, name, value)
+	}
+	if err != nil {
+		return fmt.Errorf("saving setting %s for %s: %w", name, roomID, err)
+	}
+	return nil
+}
+
+// roomSettings holds each room's overrides in memory and, once use has
+// given it a SettingsStore, writes every change through to it. Without a
+// store, settings last only as long as the process. The zero value is
+// ready to use.
+type roomSettings struct {
+	mu     sync.RWMutex
+	values map[id.RoomID]map[string]string
+	store  SettingsStore
+
+	// writeMu keeps writes to store in the order they were made. They
+	// happen outside mu, so reads never wait on the database.
+	writeMu sync.Mutex
+}
+
+// use loads the settings held in store, replacing those in memory, and
+// writes changes through to it from now on.
+func (r *roomSettings) use(ctx context.Context, store SettingsStore) error {
+	loaded, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = loaded
+	r.store = store
+	return nil
+}
+
+// get returns a room's value for the named setting, or "" if it has none.
+func (r *roomSettings) get(roomID id.RoomID, name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.values[roomID][name]
+}
+
+// set changes a room's value for the named setting; "" deletes it.
+// Failures to save are logged; the value in memory still applies.
+func (r *roomSettings) set(roomID id.RoomID, name, value string) {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+
+	r.mu.Lock()
+	if value == "" {
+		delete(r.values[roomID], name)
+		if len(r.values[roomID]) == 0 {
+			delete(r.values, roomID)
+		}
+	} else {
+		if r.values == nil {
+			r.values = make(map[id.RoomID]map[string]string)
+		}
+		if r.values[roomID] == nil {
+			r.values[roomID] = make(map[string]string)
+		}
+		r.values[roomID][name] = value
+	}
+	store := r.store
+	r.mu.Unlock()
+
+	if store == nil {
+		return
+	}
+	if err := store.Set(context.Background(), roomID, name, value); err != nil {
+		log.Printf("Failed to save %s setting for %s: %v", name, roomID, err)
+	}
+}
+
+// clearRoom deletes every setting of roomID.
+func (r *roomSettings) clearRoom(roomID id.RoomID) {
+	r.mu.RLock()
+	names := slices.Collect(maps.Keys(r.values[roomID]))
+	r.mu.RUnlock()
+	for _, name := range names {
+		r.set(roomID, name, "")
+	}
+}
+
+// UseSettings loads room settings from store and keeps them there from now
+// on. Until it is called, room settings are kept in memory only.
+func (b *Bot) UseSettings(ctx context.Context, store SettingsStore) error {
+	return b.settings.use(ctx, store)
+}
@@ -0,0 +1,142 @@
+package bot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	_ "modernc.org/sqlite"
+)
+
+func openTestSettingsDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLSettingsStore_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSQLSettingsStore(ctx, openTestSettingsDB(t))
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+
+	for _, set := range []struct{ room, name, value string }{
+		{"!a:example.com", settingModel, "claude-opus-4-20250514"},
+		{"!a:example.com", settingPersona, "a pirate"},
+		{"!a:example.com", settingPersona, "a SQL expert"}, // overwrites
+		{"!b:example.com", settingModel, "claude-haiku-4-5"},
+		{"!b:example.com", settingModel, ""}, // deletes
+	} {
+		if err := store.Set(ctx, id.RoomID(set.room), set.name, set.value); err != nil {
+			t.Fatalf("Set(%s, %s): %v", set.room, set.name, err)
+		}
+	}
+
+	got, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(got) != 1 || got["!a:example.com"][settingModel] != "claude-opus-4-20250514" || got["!a:example.com"][settingPersona] != "a SQL expert" {
+		t.Errorf("unexpected settings: %v", got)
+	}
+}
+
+func TestRoomSettings_SurviveRestart(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSettingsDB(t)
+	const room = id.RoomID("!room:example.com")
+
+	first := newTestBot(&mockMatrixClient{}, &mockClaudeMessenger{})
+	first.config.Admins = []id.UserID{"@user:example.com"}
+	store, err := NewSQLSettingsStore(ctx, db)
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	if err := first.UseSettings(ctx, store); err != nil {
+		t.Fatalf("UseSettings: %v", err)
+	}
+	sendMention(first, "$root", "room-model claude-opus-4-20250514", nil)
+	sendMention(first, "$persona", "room-persona a pirate", nil)
+
+	// A fresh bot on the same database, as after a restart.
+	matrix := &mockMatrixClient{}
+	claude := &mockClaudeMessenger{}
+	second := newTestBot(matrix, claude)
+	store, err = NewSQLSettingsStore(ctx, db)
+	if err != nil {
+		t.Fatalf("reopening store: %v", err)
+	}
+	if err := second.UseSettings(ctx, store); err != nil {
+		t.Fatalf("UseSettings: %v", err)
+	}
+	sendMention(second, "$question", "hello", nil)
+
+	params := claude.capturedParams[0]
+	if params.Model != "claude-opus-4-20250514" {
+		t.Errorf("model = %q after restart", params.Model)
+	}
+	if !strings.HasPrefix(params.System[0].Text, "a pirate") {
+		t.Errorf("expected the room persona in the system prompt, got %q", params.System[0].Text)
+	}
+
+	// Leaving the room forgets its settings, in the database too.
+	second.forgetRoom(room, "@admin:example.com", event.MembershipLeave)
+	if loaded, _ := store.Load(ctx); len(loaded) != 0 {
+		t.Errorf("settings of a left room should be deleted, got %v", loaded)
+	}
+}
+
+func TestHandleMessage_ThreadModelOverridesRoomModel(t *testing.T) {
+	claude := &mockClaudeMessenger{}
+	bot := newTestBot(&mockMatrixClient{}, claude)
+	bot.settings.set("!room:example.com", settingModel, "claude-haiku-4-5")
+
+	sendMention(bot, "$root", "hello", nil)
+	bot.conversations.SetModel("$root", "claude-opus-4-20250514")
+	sendMention(bot, "$reply", "again", &event.RelatesTo{Type: event.RelThread, EventID: "$root"})
+	sendMention(bot, "$other", "hi", nil)
+
+	want := []anthropic.Model{"claude-haiku-4-5", "claude-opus-4-20250514", "claude-haiku-4-5"}
+	for i, params := range claude.capturedParams {
+		if params.Model != want[i] {
+			t.Errorf("request %d used %q, want %q", i, params.Model, want[i])
+		}
+	}
+}
+
+func TestHandleMessage_RoomSettingsNeedAdmin(t *testing.T) {
+	matrix := &mockMatrixClient{}
+	bot := newTestBot(matrix, &mockClaudeMessenger{})
+	bot.config.Admins = []id.UserID{"@admin:example.com"}
+	bot.settings.set("!room:example.com", settingModel, "claude-haiku-4-5")
+
+	replies := make([]string, 0, 3)
+	for i, body := range []string{"room-model claude-opus-4-20250514", "room-persona a pirate", "room-model"} {
+		sendMention(bot, id.EventID(fmt.Sprintf("$evt%d", i)), body, nil)
+		replies = append(replies, matrix.sentEvents[len(matrix.sentEvents)-1].Content.(*event.MessageEventContent).Body)
+	}
+
+	if !strings.Contains(replies[0], "Only admins") || !strings.Contains(replies[1], "Only admins") {
+		t.Errorf("a non-admin's changes should be refused, got %q", replies[:2])
+	}
+	if got := bot.settings.get("!room:example.com", settingModel); got != "claude-haiku-4-5" {
+		t.Errorf("room model = %q, want it unchanged", got)
+	}
+	if got := bot.settings.get("!room:example.com", settingPersona); got != "" {
+		t.Errorf("room persona = %q, want none", got)
+	}
+	if replies[2] != "This room uses claude-haiku-4-5." {
+		t.Errorf("anyone should be able to ask for the room model, got %q", replies[2])
+	}
+}
@@ -3,9 +3,15 @@ package bot
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
 	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"go.opentelemetry.io/otel/trace/noop"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -17,8 +23,19 @@ import (
 type mockMatrixClient struct {
 	joinRoomByIDFunc     func(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinRoom, error)
 	sendMessageEventFunc func(ctx context.Context, roomID id.RoomID, eventType event.Type, contentJSON interface{}, extra ...mautrix.ReqSendEvent) (*mautrix.RespSendEvent, error)
+	getEventFunc         func(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error)
+	displayNames         map[id.UserID]string
+	stateEvents          map[event.Type]any
+	displayNameLookups   int
 	sentEvents           []sentEvent
+	joinMu               sync.Mutex
 	joinedRooms          []id.RoomID
+	uploads              []upload
+}
+
+type upload struct {
+	Data        []byte
+	ContentType string
 }
 
 type sentEvent struct {
@@ -28,7 +45,9 @@ type sentEvent struct {
 }
 
 func (m *mockMatrixClient) JoinRoomByID(ctx context.Context, roomID id.RoomID) (*mautrix.RespJoinRoom, error) {
+	m.joinMu.Lock()
 	m.joinedRooms = append(m.joinedRooms, roomID)
+	m.joinMu.Unlock()
 	if m.joinRoomByIDFunc != nil {
 		return m.joinRoomByIDFunc(ctx, roomID)
 	}
@@ -43,6 +62,41 @@ func (m *mockMatrixClient) SendMessageEvent(ctx context.Context, roomID id.RoomI
 	return &mautrix.RespSendEvent{EventID: "$reply"}, nil
 }
 
+func (m *mockMatrixClient) UploadBytes(ctx context.Context, data []byte, contentType string) (*mautrix.RespMediaUpload, error) {
+	m.uploads = append(m.uploads, upload{Data: data, ContentType: contentType})
+	return &mautrix.RespMediaUpload{ContentURI: id.ContentURI{Homeserver: "example.com", FileID: "image"}}, nil
+}
+
+func (m *mockMatrixClient) GetDisplayName(ctx context.Context, userID id.UserID) (*mautrix.RespUserDisplayName, error) {
+	m.displayNameLookups++
+	name, ok := m.displayNames[userID]
+	if !ok {
+		return nil, fmt.Errorf("no profile for %s", userID)
+	}
+	return &mautrix.RespUserDisplayName{DisplayName: name}, nil
+}
+
+func (m *mockMatrixClient) GetEvent(ctx context.Context, roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	if m.getEventFunc != nil {
+		return m.getEventFunc(ctx, roomID, eventID)
+	}
+	return nil, fmt.Errorf("event %s not found", eventID)
+}
+
+// StateEvent round-trips the stored content through JSON like a real
+// response would, and reports M_NOT_FOUND for state that isn't set.
+func (m *mockMatrixClient) StateEvent(ctx context.Context, roomID id.RoomID, eventType event.Type, stateKey string, outContent interface{}) error {
+	content, ok := m.stateEvents[eventType]
+	if !ok {
+		return mautrix.MNotFound
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, outContent)
+}
+
 type mockClaudeMessenger struct {
 	newMessageFunc func(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error)
 	capturedParams []anthropic.MessageNewParams
@@ -67,7 +121,86 @@ func makeClaudeResponse(texts ...string) *anthropic.Message {
 	}
 }
 
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	due     time.Time
+	fn      func()
+	stopped bool
+	fired   bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, due: c.now.Add(d), fn: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward and runs every timer that came due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	for _, t := range c.timers {
+		if !t.stopped && !t.fired && !t.due.After(c.now) {
+			t.fired = true
+			due = append(due, t.fn)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, fn := range due {
+		fn()
+	}
+}
+
+// waitForTimer blocks until another goroutine has a timer armed that
+// hasn't fired or been stopped, so a test can Advance past it.
+func (c *fakeClock) waitForTimer(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		for _, timer := range c.timers {
+			if !timer.stopped && !timer.fired {
+				c.mu.Unlock()
+				return
+			}
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for a timer")
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
 func newTestBot(matrix *mockMatrixClient, claude *mockClaudeMessenger) *Bot {
+	clock := newFakeClock(time.UnixMilli(1000))
 	return &Bot{
 		matrix: matrix,
 		claude: claude,
@@ -80,10 +213,28 @@ func newTestBot(matrix *mockMatrixClient, claude *mockClaudeMessenger) *Bot {
 		},
 		conversations: NewConversationStore(),
 		tools:         tools.NewRegistry(),
-		startTime:     time.UnixMilli(1000),
+		clock:         clock,
+		startTime:     clock.Now(),
+		lastReplies:   newReplyTracker(),
+		latencies:     newLatencyTracker(latencyWindow),
+		tracer:        noop.NewTracerProvider().Tracer(""),
 	}
 }
 
+// testTurn builds a turn for a message in the default test room that is the
+// root of its own thread.
+func testTurn(threadID id.EventID) turn {
+	return turn{roomID: "!room:example.com", threadRootID: threadID, eventID: threadID, conversationID: threadID}
+}
+
+// turnFor is testTurn carrying b's current configuration, as the turns
+// handleMessage builds do.
+func turnFor(b *Bot, threadID id.EventID) turn {
+	t := testTurn(threadID)
+	t.cfg = b.cfg()
+	return t
+}
+
 func makeToolUseResponse(toolID, toolName string, input json.RawMessage) *anthropic.Message {
 	return &anthropic.Message{
 		Role: "assistant",
@@ -125,21 +276,54 @@ func makeMemberEvent(sender id.UserID, roomID id.RoomID, stateKey string, member
 
 // fakeTool implements tools.Tool for testing within the bot package.
 type fakeTool struct {
-	name   string
-	result string
+	name        string
+	description string
+	result      string
 }
 
 func (t *fakeTool) Name() string { return t.name }
 func (t *fakeTool) Definition() anthropic.ToolUnionParam {
-	return anthropic.ToolUnionParam{
-		OfTool: &anthropic.ToolParam{
-			Name: t.name,
-			InputSchema: anthropic.ToolInputSchemaParam{
-				Properties: map[string]any{},
-			},
+	param := &anthropic.ToolParam{
+		Name: t.name,
+		InputSchema: anthropic.ToolInputSchemaParam{
+			Properties: map[string]any{},
 		},
 	}
+	if t.description != "" {
+		param.Description = anthropic.String(t.description)
+	}
+	return anthropic.ToolUnionParam{OfTool: param}
 }
 func (t *fakeTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
 	return t.result, false, nil
 }
+
+// makeAPIError builds an Anthropic API error with the given HTTP status.
+func makeAPIError(status int) *anthropic.Error {
+	req := httptest.NewRequest(http.MethodPost, "https://api.anthropic.com/v1/messages", nil)
+	return &anthropic.Error{
+		StatusCode: status,
+		Request:    req,
+		Response:   &http.Response{StatusCode: status, Request: req},
+	}
+}
+
+// countingTool records how many times it has been executed.
+type countingTool struct {
+	name  string
+	calls int
+}
+
+func (t *countingTool) Name() string { return t.name }
+func (t *countingTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        t.name,
+			InputSchema: anthropic.ToolInputSchemaParam{Properties: map[string]any{}},
+		},
+	}
+}
+func (t *countingTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	t.calls++
+	return "ok", false, nil
+}
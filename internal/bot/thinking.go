@@ -0,0 +1,56 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	thinkingNotice = "🤔 thinking…"
+	// thinkingStoppedNotice replaces the placeholder of a stopped
+	// generation; the stop itself is confirmed separately.
+	thinkingStoppedNotice = "🤔 Stopped before answering."
+)
+
+// thinkingPlaceholder posts thinkingNotice in a turn's thread if the answer
+// takes longer than handler.thinking_notice_seconds, so the answer can later
+// be edited into it.
+type thinkingPlaceholder struct {
+	mu      sync.Mutex
+	timer   Timer
+	done    bool
+	eventID id.EventID
+}
+
+// startThinking arms the placeholder for t. With a zero delay nothing is
+// ever posted.
+func (b *Bot) startThinking(ctx context.Context, t turn, delay time.Duration) *thinkingPlaceholder {
+	p := &thinkingPlaceholder{}
+	if delay <= 0 {
+		return p
+	}
+	p.timer = b.clock.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if !p.done {
+			p.eventID = b.sendThreadReply(ctx, t.cfg, t.roomID, t.threadRootID, t.eventID, thinkingNotice)
+		}
+	})
+	return p
+}
+
+// finish disarms the placeholder and returns its event ID, or "" if it was
+// never posted. A post already under way is waited for, so the answer can't
+// land before it.
+func (p *thinkingPlaceholder) finish() id.EventID {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	return p.eventID
+}
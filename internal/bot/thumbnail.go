@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	"maunium.net/go/mautrix/event"
+)
+
+// Bounds on the thumbnail sendImage attaches to an image, and the largest
+// image it will decode to make one, so a small file can't expand into a
+// huge bitmap.
+const (
+	maxThumbnailWidth  = 800
+	maxThumbnailHeight = 600
+	maxThumbnailSource = 40_000_000 // pixels
+)
+
+// makeThumbnail returns a copy of the image in data scaled down to fit
+// within maxThumbnailWidth x maxThumbnailHeight, with the info to attach it
+// by. It reports false if the image already fits, is too large to decode,
+// or can't be decoded at all. Images that may have transparency are
+// thumbnailed as PNG and the rest as JPEG.
+func makeThumbnail(data []byte) ([]byte, *event.FileInfo, bool) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, nil, false
+	}
+	if cfg.Width <= maxThumbnailWidth && cfg.Height <= maxThumbnailHeight {
+		return nil, nil, false
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSource {
+		return nil, nil, false
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, false
+	}
+
+	width, height := maxThumbnailWidth, cfg.Height*maxThumbnailWidth/cfg.Width
+	if height > maxThumbnailHeight {
+		width, height = cfg.Width*maxThumbnailHeight/cfg.Height, maxThumbnailHeight
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+	var buf bytes.Buffer
+	mimeType := "image/jpeg"
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+	} else {
+		mimeType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, nil, false
+	}
+	return buf.Bytes(), &event.FileInfo{
+		MimeType: mimeType,
+		Width:    dst.Bounds().Dx(),
+		Height:   dst.Bounds().Dy(),
+		Size:     buf.Len(),
+	}, true
+}
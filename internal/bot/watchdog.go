@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// syncWatch tracks when the last /sync response arrived, for the
+// monitoring.sync_timeout watchdog. The zero value is ready to use.
+type syncWatch struct {
+	mu      sync.Mutex
+	last    time.Time
+	alerted bool
+}
+
+// recordSync notes a successful sync. It runs on the syncer's goroutine, so
+// it only records the time; the watchdog reports recoveries.
+func (b *Bot) recordSync() {
+	b.syncWatch.mu.Lock()
+	defer b.syncWatch.mu.Unlock()
+	b.syncWatch.last = b.clock.Now()
+}
+
+// WatchSync checks every so often until ctx is done whether a sync has
+// arrived within timeout, alerting monitoring.admin_room when one hasn't.
+func (b *Bot) WatchSync(ctx context.Context, timeout time.Duration) {
+	for b.wait(ctx, max(timeout/4, time.Second)) {
+		b.checkSync(ctx, timeout)
+	}
+}
+
+// checkSync alerts once when the last sync is older than timeout, counting
+// from startup if there hasn't been one, and posts a recovery notice once
+// syncs resume.
+func (b *Bot) checkSync(ctx context.Context, timeout time.Duration) {
+	now := b.clock.Now()
+	b.syncWatch.mu.Lock()
+	last := b.syncWatch.last
+	if last.IsZero() {
+		last = b.startTime
+	}
+	stalled := now.Sub(last) >= timeout
+	changed := stalled != b.syncWatch.alerted
+	b.syncWatch.alerted = stalled
+	b.syncWatch.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	var text string
+	if stalled {
+		text = fmt.Sprintf("⚠️ %s has not synced with the homeserver for %s (last sync %s).",
+			b.cfg().UserID, now.Sub(last).Round(time.Second), last.UTC().Format(time.RFC3339))
+	} else {
+		text = fmt.Sprintf("✅ %s is syncing again.", b.cfg().UserID)
+	}
+	log.Println(text)
+	b.alertAdminRoom(ctx, text)
+}
+
+// alertAdminRoom posts text as a notice in monitoring.admin_room, if set.
+func (b *Bot) alertAdminRoom(ctx context.Context, text string) {
+	roomID := b.cfg().MonitoringAdminRoom
+	if roomID == "" {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    text,
+	}
+	if _, err := b.sendMessage(ctx, roomID, content); err != nil {
+		log.Printf("Failed to send alert to %s: %v", roomID, err)
+	}
+}
@@ -1,28 +1,192 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/cron"
 )
 
 type Config struct {
 	HomeserverURL      string
 	UserID             id.UserID
 	AccessToken        string
+	AllowedRooms       []id.RoomID
+	AllowedInviters    []id.UserID
+	AllowedInviteHosts []string
+	Admins             []id.UserID
+	ReplyPrefix        string
+	ReplySuffix        string
+	ReplyStyle         string // "thread", "reply", or "plain"
 	Model              string
+	FallbackModels     []string
 	MaxTokens          int64
+	DailyTokenBudget   int64    // 0 means unlimited
+	Temperature        *float64 // nil leaves the API default
+	TopP               *float64 // nil leaves the API default
+	TopK               *int64   // nil leaves the API default
 	SystemPrompt       string
+	IncludeSenderName  bool
+	AskClarification   bool
+	EmptyResponseText  string
+	StripTags          []string // <tag>...</tag> sections hidden from replies
 	WebSearchEnabled   bool
+	ServerTools        []string // includes web_search when WebSearchEnabled
+	DateTimeEnabled    bool
+	RemindersEnabled   bool
+	HistoryEnabled     bool
+	RoomPinsEnabled    bool
 	SandboxDir         string
+	SandboxPerRoom     bool
+	SandboxReadOnly    bool
+	ShellEnabled       bool
+	ShellAllowed       []string
 	MaxToolIterations  int
+	ToolCallsPerTurn   int // 0 means no limit
 	ToolTimeout        time.Duration
+	ToolCacheTTL       time.Duration // 0 disables the read-tool result cache
+	ToolSchemaHints    bool
+	ShowToolActivity   bool
+	NarrateTools       bool
+	DisabledTools      []string
+	ToolChoice         string
 	MCPServers         []MCPServerConfig
+	ConversationTTL    time.Duration
+	ConversationScope  string // "thread" or "room"
+	EditOnCorrection   bool
+	RespondToNotices   bool
+	IgnoreBotSenders   bool
+	StopOnReaction     bool
+	Delegation         []DelegationRule
+	MaxConcurrent      int
+	QueueNoticeDelay   time.Duration
 	PickleKey          string
 	CryptoDatabasePath string
+
+	BootstrapCrossSigning bool
+	RecoveryKey           string
+	ShareKeysWith         string // "trusted", "all", or "none"
+	// CryptoFailOpen keeps the bot running without E2EE if crypto setup fails.
+	CryptoFailOpen bool
+
+	// ConversationPersistPath, when set, keeps conversations across restarts.
+	ConversationPersistPath string
+	// ConversationFlushInterval, when set, buffers writes to
+	// ConversationPersistPath and flushes them on this interval or once
+	// ConversationFlushThreshold changes are pending.
+	ConversationFlushInterval  time.Duration
+	ConversationFlushThreshold int
+	// ConversationMaxThreads, when positive, caps how many conversations
+	// are held; the least recently used are evicted past it.
+	ConversationMaxThreads int
+
+	// TracingEndpoint is the OTLP/HTTP collector URL; empty disables tracing.
+	TracingEndpoint string
+
+	// WebSearch* constrain the web_search server tool. At most one of the
+	// domain lists may be set; a zero MaxUses leaves the API default.
+	WebSearchAllowedDomains []string
+	WebSearchBlockedDomains []string
+	WebSearchMaxUses        int64
+
+	// Provider selects the model backend: "anthropic", or "compat" for an
+	// OpenAI-compatible chat completions endpoint at CompatBaseURL.
+	Provider      string
+	CompatBaseURL string
+	CompatAPIKey  string
+
+	// ClarificationPrompt replaces the built-in instruction used when
+	// AskClarification is set.
+	ClarificationPrompt string
+
+	// RoomLanguage maps rooms to the language Claude should answer in
+	// there. Keys are lowercased room IDs.
+	RoomLanguage map[id.RoomID]string
+
+	// IncludeRoomContext puts the room's name and topic at the start of
+	// the system prompt.
+	IncludeRoomContext bool
+
+	// ToolConcurrency limits how many calls of a tool run at once, by
+	// lowercased tool name.
+	ToolConcurrency map[string]int
+
+	// ToolOutputFormatters post-process tool results, as specs for
+	// tools.ParseOutputFormatter keyed by lowercased tool name.
+	ToolOutputFormatters map[string]string
+
+	// HTTPTools are tools defined entirely in config that forward
+	// Claude's input to a URL.
+	HTTPTools []HTTPToolConfig
+
+	// RoomRepliesPerMinute caps how many messages the bot answers in one
+	// room per minute; 0 means unlimited.
+	RoomRepliesPerMinute int
+	// UserRepliesPerMinute is the same cap per sender, across rooms.
+	UserRepliesPerMinute int
+
+	// ThinkingNoticeDelay is how long a generation may run before a
+	// placeholder is posted for the answer to replace; 0 disables it.
+	ThinkingNoticeDelay time.Duration
+
+	// QuoteQuestion starts each answer with a short quote of the question
+	// it answers.
+	QuoteQuestion bool
+
+	// MonitoringAdminRoom receives an alert when syncing stalls for
+	// MonitoringSyncTimeout; a zero timeout disables the watchdog.
+	MonitoringAdminRoom   id.RoomID
+	MonitoringSyncTimeout time.Duration
+
+	// SandboxEphemeral gives each thread its own temporary subdirectory
+	// of SandboxDir, deleted when the thread is dropped.
+	SandboxEphemeral bool
+
+	// IgnoreBroadcasts makes the bot ignore @room messages even when they
+	// mention it explicitly.
+	IgnoreBroadcasts bool
+
+	// Base64Enabled registers the base64_encode and base64_decode tools.
+	Base64Enabled bool
+
+	// Schedules are prompts the bot answers in a room on a cron schedule.
+	Schedules []ScheduleConfig
+
+	// DisplayName and AvatarURL are set on the bot's profile at startup
+	// when they differ from it.
+	DisplayName string
+	AvatarURL   id.ContentURI
+
+	// EchoToolResults posts each successful local tool result in the
+	// thread as well as giving it to Claude.
+	EchoToolResults bool
+
+	// DedupeSize is how many recent event IDs are remembered so events
+	// delivered twice are answered once; 0 disables the check.
+	DedupeSize int
+
+	// ThreadRoot picks the root of the thread started for a mention sent
+	// as a plain reply: "mention" (the mention itself) or "reply_target"
+	// (the message it replies to).
+	ThreadRoot string
+
+	// ChartEnabled registers the render_chart tool.
+	ChartEnabled bool
+
+	// SettingsDatabasePath is the SQLite database room settings are saved
+	// in. When empty they are saved in the crypto database if E2EE is on,
+	// and kept in memory otherwise.
+	SettingsDatabasePath string
 }
 
 type MCPServerConfig struct {
@@ -32,6 +196,43 @@ type MCPServerConfig struct {
 	Env       map[string]string `mapstructure:"env"`
 	URL       string            `mapstructure:"url"`
 	Transport string            `mapstructure:"transport"` // "stdio", "sse", or "streamable"
+
+	// AllowedTools, when set, limits which of the server's tools are
+	// registered; BlockedTools are left out either way. Both list the
+	// server's own tool names, without the server prefix.
+	AllowedTools []string `mapstructure:"allowed_tools"`
+	BlockedTools []string `mapstructure:"blocked_tools"`
+}
+
+// HTTPToolConfig defines a tool backed by an HTTP endpoint. InputSchema is a
+// JSON Schema object given as a JSON string, since viper would lowercase the
+// property names of a YAML map.
+type HTTPToolConfig struct {
+	Name        string `mapstructure:"name"`
+	Description string `mapstructure:"description"`
+	URL         string `mapstructure:"url"`
+	Method      string `mapstructure:"method"` // GET, POST (default), PUT, or PATCH
+	InputSchema string `mapstructure:"input_schema"`
+}
+
+// toolNamePattern is what the Anthropic API accepts as a tool name.
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// DelegationRule hands messages containing Keyword to another bot in the
+// room, Target, instead of answering them.
+type DelegationRule struct {
+	Keyword string    `mapstructure:"keyword"`
+	Target  id.UserID `mapstructure:"target"`
+}
+
+// ScheduleConfig is a prompt sent to Claude whenever Cron matches, with the
+// answer posted in Room. Cron is read in Timezone, or the server's local
+// time if that's empty.
+type ScheduleConfig struct {
+	Cron     string    `mapstructure:"cron"`
+	Room     id.RoomID `mapstructure:"room"`
+	Prompt   string    `mapstructure:"prompt"`
+	Timezone string    `mapstructure:"timezone"`
 }
 
 // LoadConfig reads configuration from viper and returns a validated Config.
@@ -42,31 +243,413 @@ func LoadConfig() (Config, error) {
 	accessToken := viper.GetString("matrix.access_token")
 	apiKey := viper.GetString("anthropic.api_key")
 
-	if homeserverURL == "" || userID == "" || accessToken == "" || apiKey == "" {
+	provider := viper.GetString("claude.provider")
+	switch provider {
+	case "":
+		provider = "anthropic"
+	case "anthropic", "compat":
+	default:
+		return Config{}, fmt.Errorf("claude.provider must be anthropic or compat, got %q", provider)
+	}
+
+	if homeserverURL == "" || userID == "" || accessToken == "" || (apiKey == "" && provider == "anthropic") {
 		return Config{}, fmt.Errorf("required config: matrix.homeserver_url, matrix.user_id, matrix.access_token, anthropic.api_key")
 	}
+	if provider == "compat" && viper.GetString("claude.compat.base_url") == "" {
+		return Config{}, fmt.Errorf("claude.provider compat requires claude.compat.base_url")
+	}
 
 	// The Anthropic SDK reads the API key from the environment.
 	os.Setenv("ANTHROPIC_API_KEY", apiKey)
 
+	var temperature *float64
+	if viper.IsSet("claude.temperature") {
+		t := viper.GetFloat64("claude.temperature")
+		if t < 0 || t > 1 {
+			return Config{}, fmt.Errorf("claude.temperature must be between 0 and 1, got %v", t)
+		}
+		temperature = &t
+	}
+
+	var topP *float64
+	if viper.IsSet("claude.top_p") {
+		p := viper.GetFloat64("claude.top_p")
+		if p <= 0 || p > 1 {
+			return Config{}, fmt.Errorf("claude.top_p must be greater than 0 and at most 1, got %v", p)
+		}
+		topP = &p
+	}
+
+	var topK *int64
+	if viper.IsSet("claude.top_k") {
+		k := viper.GetInt64("claude.top_k")
+		if k < 1 {
+			return Config{}, fmt.Errorf("claude.top_k must be at least 1, got %d", k)
+		}
+		topK = &k
+	}
+
+	if temperature != nil && topP != nil {
+		log.Println("Warning: both claude.temperature and claude.top_p are set; Anthropic recommends adjusting only one")
+	}
+
+	maxThreads := viper.GetInt("conversation.max_threads")
+	if maxThreads < 0 {
+		return Config{}, fmt.Errorf("conversation.max_threads must not be negative, got %d", maxThreads)
+	}
+
+	conversationScope := viper.GetString("conversation.scope")
+	switch conversationScope {
+	case "":
+		conversationScope = "thread"
+	case "thread", "room":
+	default:
+		return Config{}, fmt.Errorf("conversation.scope must be thread or room, got %q", conversationScope)
+	}
+
+	replyStyle := viper.GetString("matrix.reply_style")
+	switch replyStyle {
+	case "":
+		replyStyle = "thread"
+	case "thread", "reply", "plain":
+	default:
+		return Config{}, fmt.Errorf("matrix.reply_style must be thread, reply, or plain, got %q", replyStyle)
+	}
+
+	threadRoot := viper.GetString("matrix.thread_root")
+	switch threadRoot {
+	case "":
+		threadRoot = "mention"
+	case "mention", "reply_target":
+	default:
+		return Config{}, fmt.Errorf("matrix.thread_root must be mention or reply_target, got %q", threadRoot)
+	}
+
+	shareKeysWith := viper.GetString("crypto.share_keys_with")
+	switch shareKeysWith {
+	case "", "trusted", "all", "none":
+	default:
+		return Config{}, fmt.Errorf("crypto.share_keys_with must be trusted, all, or none, got %q", shareKeysWith)
+	}
+
+	webSearchEnabled := viper.GetBool("tools.web_search_enabled")
+	serverTools := viper.GetStringSlice("tools.server_tools")
+	if webSearchEnabled && !slices.Contains(serverTools, "web_search") {
+		serverTools = append(serverTools, "web_search")
+	}
+
+	webSearchAllowed := viper.GetStringSlice("tools.web_search.allowed_domains")
+	webSearchBlocked := viper.GetStringSlice("tools.web_search.blocked_domains")
+	if len(webSearchAllowed) > 0 && len(webSearchBlocked) > 0 {
+		return Config{}, fmt.Errorf("tools.web_search.allowed_domains and tools.web_search.blocked_domains cannot both be set")
+	}
+	webSearchMaxUses := viper.GetInt64("tools.web_search.max_uses")
+	if webSearchMaxUses < 0 {
+		return Config{}, fmt.Errorf("tools.web_search.max_uses must not be negative, got %d", webSearchMaxUses)
+	}
+
 	timeoutSec := viper.GetInt("tools.timeout_seconds")
 
+	shellEnabled := viper.GetBool("tools.shell_enabled")
+	shellAllowed := viper.GetStringSlice("tools.shell_allowed_commands")
+	if shellEnabled {
+		if viper.GetString("tools.sandbox_dir") == "" {
+			return Config{}, fmt.Errorf("tools.shell_enabled requires tools.sandbox_dir")
+		}
+		if len(shellAllowed) == 0 {
+			return Config{}, fmt.Errorf("tools.shell_enabled requires tools.shell_allowed_commands")
+		}
+		// Allowed commands could still write files, so a read-only
+		// sandbox can't offer a shell.
+		if viper.GetBool("tools.sandbox_readonly") {
+			return Config{}, fmt.Errorf("tools.shell_enabled cannot be combined with tools.sandbox_readonly")
+		}
+	}
+
+	sandboxEphemeral := viper.GetBool("tools.sandbox_ephemeral")
+	if sandboxEphemeral {
+		if viper.GetString("tools.sandbox_dir") == "" {
+			return Config{}, fmt.Errorf("tools.sandbox_ephemeral requires tools.sandbox_dir")
+		}
+		// Each thread starts with an empty directory of its own, so
+		// neither sharing one per room nor a read-only one makes sense.
+		if viper.GetBool("tools.sandbox_per_room") || viper.GetBool("tools.sandbox_readonly") {
+			return Config{}, fmt.Errorf("tools.sandbox_ephemeral cannot be combined with tools.sandbox_per_room or tools.sandbox_readonly")
+		}
+	}
+
+	var allowedRooms []id.RoomID
+	for _, room := range viper.GetStringSlice("matrix.allowed_rooms") {
+		allowedRooms = append(allowedRooms, id.RoomID(room))
+	}
+
+	var allowedInviters []id.UserID
+	for _, user := range viper.GetStringSlice("matrix.autojoin_allowed_inviters") {
+		allowedInviters = append(allowedInviters, id.UserID(user))
+	}
+
+	var admins []id.UserID
+	for _, user := range viper.GetStringSlice("matrix.admins") {
+		admins = append(admins, id.UserID(user))
+	}
+
+	// Viper lowercases map keys read from files, so room IDs are always
+	// stored lowercased and looked up the same way; IDs differing only in
+	// case don't occur in practice.
+	roomLanguage := make(map[id.RoomID]string)
+	for room, language := range viper.GetStringMapString("matrix.room_language") {
+		if !strings.HasPrefix(room, "!") {
+			return Config{}, fmt.Errorf("matrix.room_language keys must be room IDs, got %q", room)
+		}
+		if language = strings.TrimSpace(language); language != "" {
+			roomLanguage[id.RoomID(strings.ToLower(room))] = language
+		}
+	}
+
+	// Keys are lowercased like matrix.room_language's; the registry
+	// matches tool names case-insensitively.
+	var concurrency map[string]int
+	if err := viper.UnmarshalKey("tools.concurrency", &concurrency); err != nil {
+		return Config{}, fmt.Errorf("tools.concurrency: %w", err)
+	}
+	toolConcurrency := make(map[string]int, len(concurrency))
+	for name, limit := range concurrency {
+		if limit <= 0 {
+			return Config{}, fmt.Errorf("tools.concurrency.%s must be a positive number, got %d", name, limit)
+		}
+		toolConcurrency[strings.ToLower(name)] = limit
+	}
+
+	// Keys are lowercased like tools.concurrency's; the specs themselves
+	// are parsed when the registry is set up.
+	toolOutputFormatters := make(map[string]string)
+	for name, spec := range viper.GetStringMapString("tools.output_formatters") {
+		if strings.TrimSpace(spec) == "" {
+			return Config{}, fmt.Errorf("tools.output_formatters.%s must not be empty", name)
+		}
+		toolOutputFormatters[strings.ToLower(name)] = spec
+	}
+
 	var mcpServers []MCPServerConfig
 	viper.UnmarshalKey("tools.mcp_servers", &mcpServers)
 
+	roomRepliesPerMinute := viper.GetInt("ratelimit.per_room_per_minute")
+	if roomRepliesPerMinute < 0 {
+		return Config{}, fmt.Errorf("ratelimit.per_room_per_minute must not be negative, got %d", roomRepliesPerMinute)
+	}
+
+	userRepliesPerMinute := viper.GetInt("ratelimit.per_user_per_minute")
+	if userRepliesPerMinute < 0 {
+		return Config{}, fmt.Errorf("ratelimit.per_user_per_minute must not be negative, got %d", userRepliesPerMinute)
+	}
+
+	thinkingNoticeSec := viper.GetInt("handler.thinking_notice_seconds")
+	if thinkingNoticeSec < 0 {
+		return Config{}, fmt.Errorf("handler.thinking_notice_seconds must not be negative, got %d", thinkingNoticeSec)
+	}
+
+	dedupeSize := viper.GetInt("handler.dedupe_size")
+	if dedupeSize < 0 {
+		return Config{}, fmt.Errorf("handler.dedupe_size must not be negative, got %d", dedupeSize)
+	}
+
+	adminRoom := viper.GetString("monitoring.admin_room")
+	if adminRoom != "" && !strings.HasPrefix(adminRoom, "!") {
+		return Config{}, fmt.Errorf("monitoring.admin_room must be a room ID, got %q", adminRoom)
+	}
+	syncTimeout := viper.GetDuration("monitoring.sync_timeout")
+	if syncTimeout < 0 {
+		return Config{}, fmt.Errorf("monitoring.sync_timeout must not be negative, got %s", syncTimeout)
+	}
+
+	var httpTools []HTTPToolConfig
+	if err := viper.UnmarshalKey("tools.http_tools", &httpTools); err != nil {
+		return Config{}, fmt.Errorf("tools.http_tools: %w", err)
+	}
+	seenHTTPTools := make(map[string]bool)
+	for i := range httpTools {
+		tool := &httpTools[i]
+		if !toolNamePattern.MatchString(tool.Name) {
+			return Config{}, fmt.Errorf("tools.http_tools[%d].name must be 1-64 letters, digits, _ or -, got %q", i, tool.Name)
+		}
+		if seenHTTPTools[tool.Name] {
+			return Config{}, fmt.Errorf("tools.http_tools[%d].name %q is used twice", i, tool.Name)
+		}
+		seenHTTPTools[tool.Name] = true
+		if u, err := url.Parse(tool.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("tools.http_tools[%d].url must be an http or https URL, got %q", i, tool.URL)
+		}
+		tool.Method = strings.ToUpper(tool.Method)
+		switch tool.Method {
+		case "":
+			tool.Method = "POST"
+		case "GET", "POST", "PUT", "PATCH":
+		default:
+			return Config{}, fmt.Errorf("tools.http_tools[%d].method must be GET, POST, PUT, or PATCH, got %q", i, tool.Method)
+		}
+		if tool.InputSchema != "" {
+			var schema map[string]any
+			if err := json.Unmarshal([]byte(tool.InputSchema), &schema); err != nil {
+				return Config{}, fmt.Errorf("tools.http_tools[%d].input_schema must be a JSON object: %w", i, err)
+			}
+		}
+	}
+
+	var delegation []DelegationRule
+	if err := viper.UnmarshalKey("delegation", &delegation); err != nil {
+		return Config{}, fmt.Errorf("delegation: %w", err)
+	}
+	for i, rule := range delegation {
+		if strings.TrimSpace(rule.Keyword) == "" {
+			return Config{}, fmt.Errorf("delegation[%d].keyword must not be empty", i)
+		}
+		if _, _, err := rule.Target.Parse(); err != nil {
+			return Config{}, fmt.Errorf("delegation[%d].target must be a Matrix user ID, got %q", i, rule.Target)
+		}
+	}
+
+	var avatarURL id.ContentURI
+	if raw := viper.GetString("matrix.avatar_url"); raw != "" {
+		parsed, err := id.ParseContentURI(raw)
+		if err != nil || parsed.IsEmpty() {
+			return Config{}, fmt.Errorf("matrix.avatar_url must be an mxc:// URI, got %q", raw)
+		}
+		avatarURL = parsed
+	}
+
+	var schedules []ScheduleConfig
+	if err := viper.UnmarshalKey("schedules", &schedules); err != nil {
+		return Config{}, fmt.Errorf("schedules: %w", err)
+	}
+	for i, sched := range schedules {
+		if _, err := cron.Parse(sched.Cron); err != nil {
+			return Config{}, fmt.Errorf("schedules[%d].cron: %w", i, err)
+		}
+		if !strings.HasPrefix(string(sched.Room), "!") {
+			return Config{}, fmt.Errorf("schedules[%d].room must be a room ID, got %q", i, sched.Room)
+		}
+		if strings.TrimSpace(sched.Prompt) == "" {
+			return Config{}, fmt.Errorf("schedules[%d].prompt must not be empty", i)
+		}
+		if _, err := time.LoadLocation(sched.Timezone); err != nil {
+			return Config{}, fmt.Errorf("schedules[%d].timezone must be an IANA timezone name, got %q", i, sched.Timezone)
+		}
+	}
+
 	return Config{
 		HomeserverURL:      homeserverURL,
 		UserID:             id.UserID(userID),
 		AccessToken:        accessToken,
+		AllowedRooms:       allowedRooms,
+		AllowedInviters:    allowedInviters,
+		AllowedInviteHosts: viper.GetStringSlice("matrix.autojoin_allowed_servers"),
+		Admins:             admins,
+		ReplyPrefix:        viper.GetString("matrix.reply_prefix"),
+		ReplySuffix:        viper.GetString("matrix.reply_suffix"),
+		ReplyStyle:         replyStyle,
+		RoomLanguage:       roomLanguage,
 		Model:              viper.GetString("claude.model"),
+		FallbackModels:     viper.GetStringSlice("claude.fallback_models"),
 		MaxTokens:          viper.GetInt64("claude.max_tokens"),
+		DailyTokenBudget:   viper.GetInt64("claude.daily_token_budget"),
+		Temperature:        temperature,
+		TopP:               topP,
+		TopK:               topK,
 		SystemPrompt:       viper.GetString("claude.system_prompt"),
-		WebSearchEnabled:   viper.GetBool("tools.web_search_enabled"),
+		IncludeSenderName:  viper.GetBool("claude.include_sender_name"),
+		AskClarification:   viper.GetBool("claude.ask_clarification"),
+		EmptyResponseText:  viper.GetString("claude.empty_response_text"),
+		StripTags:          viper.GetStringSlice("claude.strip_tags"),
+		WebSearchEnabled:   webSearchEnabled,
+		ServerTools:        serverTools,
+		DateTimeEnabled:    viper.GetBool("tools.datetime_enabled"),
+		RemindersEnabled:   viper.GetBool("tools.reminders_enabled"),
+		HistoryEnabled:     viper.GetBool("tools.history_enabled"),
+		RoomPinsEnabled:    viper.GetBool("tools.room_pins_enabled"),
 		SandboxDir:         viper.GetString("tools.sandbox_dir"),
+		SandboxPerRoom:     viper.GetBool("tools.sandbox_per_room"),
+		SandboxReadOnly:    viper.GetBool("tools.sandbox_readonly"),
+		ShellEnabled:       shellEnabled,
+		ShellAllowed:       shellAllowed,
 		MaxToolIterations:  viper.GetInt("tools.max_iterations"),
+		ToolCallsPerTurn:   viper.GetInt("tools.max_calls_per_turn"),
 		ToolTimeout:        time.Duration(timeoutSec) * time.Second,
+		ToolCacheTTL:       viper.GetDuration("tools.cache_ttl"),
+		ToolSchemaHints:    viper.GetBool("tools.schema_hints"),
+		ShowToolActivity:   viper.GetBool("tools.show_activity"),
+		NarrateTools:       viper.GetBool("tools.narrate"),
+		DisabledTools:      viper.GetStringSlice("tools.disabled"),
+		ToolChoice:         viper.GetString("tools.tool_choice"),
 		MCPServers:         mcpServers,
+		ConversationTTL:    viper.GetDuration("conversation.ttl"),
+		ConversationScope:  conversationScope,
+		EditOnCorrection:   viper.GetBool("handler.edit_on_correction"),
+		RespondToNotices:   viper.GetBool("handler.respond_to_notices"),
+		IgnoreBotSenders:   viper.GetBool("handler.ignore_bot_senders"),
+		StopOnReaction:     viper.GetBool("handler.stop_on_reaction"),
+		Delegation:         delegation,
+		MaxConcurrent:      viper.GetInt("handler.max_concurrent"),
+		QueueNoticeDelay:   time.Duration(viper.GetInt("handler.queue_notice_seconds")) * time.Second,
 		PickleKey:          viper.GetString("crypto.pickle_key"),
 		CryptoDatabasePath: viper.GetString("crypto.database_path"),
+
+		BootstrapCrossSigning: viper.GetBool("crypto.bootstrap_cross_signing"),
+		RecoveryKey:           viper.GetString("crypto.recovery_key"),
+		ShareKeysWith:         shareKeysWith,
+		CryptoFailOpen:        viper.GetBool("crypto.fail_open"),
+
+		ConversationPersistPath:    viper.GetString("conversation.persist_path"),
+		ConversationFlushInterval:  viper.GetDuration("conversation.flush_interval"),
+		ConversationFlushThreshold: viper.GetInt("conversation.flush_threshold"),
+		ConversationMaxThreads:     maxThreads,
+
+		TracingEndpoint: viper.GetString("tracing.endpoint"),
+
+		WebSearchAllowedDomains: webSearchAllowed,
+		WebSearchBlockedDomains: webSearchBlocked,
+		WebSearchMaxUses:        webSearchMaxUses,
+
+		Provider:      provider,
+		CompatBaseURL: viper.GetString("claude.compat.base_url"),
+		CompatAPIKey:  viper.GetString("claude.compat.api_key"),
+
+		ClarificationPrompt: viper.GetString("claude.clarification_prompt"),
+
+		IncludeRoomContext: viper.GetBool("matrix.include_room_context"),
+
+		ToolConcurrency:      toolConcurrency,
+		ToolOutputFormatters: toolOutputFormatters,
+
+		HTTPTools: httpTools,
+
+		RoomRepliesPerMinute: roomRepliesPerMinute,
+		UserRepliesPerMinute: userRepliesPerMinute,
+		ThinkingNoticeDelay:  time.Duration(thinkingNoticeSec) * time.Second,
+
+		QuoteQuestion: viper.GetBool("matrix.quote_question"),
+
+		MonitoringAdminRoom:   id.RoomID(adminRoom),
+		MonitoringSyncTimeout: syncTimeout,
+
+		SandboxEphemeral: sandboxEphemeral,
+
+		IgnoreBroadcasts: viper.GetBool("matrix.ignore_broadcasts"),
+
+		Base64Enabled: viper.GetBool("tools.base64_enabled"),
+
+		Schedules: schedules,
+
+		DisplayName: viper.GetString("matrix.display_name"),
+		AvatarURL:   avatarURL,
+
+		EchoToolResults: viper.GetBool("tools.echo_results"),
+
+		DedupeSize: dedupeSize,
+
+		ThreadRoot: threadRoot,
+
+		ChartEnabled: viper.GetBool("tools.chart_enabled"),
+
+		SettingsDatabasePath: viper.GetString("settings.database_path"),
 	}, nil
 }
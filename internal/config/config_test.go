@@ -2,6 +2,8 @@ package config
 
 import (
 	"os"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -139,3 +141,338 @@ func TestLoadConfig_CryptoDefaults(t *testing.T) {
 		t.Errorf("expected default database path, got %q", cfg.CryptoDatabasePath)
 	}
 }
+
+func TestLoadConfig_Temperature(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("claude.temperature", 0.7)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Temperature == nil || *cfg.Temperature != 0.7 {
+		t.Errorf("expected temperature 0.7, got %v", cfg.Temperature)
+	}
+}
+
+func TestLoadConfig_TemperatureUnset(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Temperature != nil {
+		t.Errorf("expected nil temperature when unset, got %v", *cfg.Temperature)
+	}
+}
+
+func TestLoadConfig_TemperatureOutOfRange(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("claude.temperature", 1.5)
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for temperature above 1")
+	}
+}
+
+func TestLoadConfig_TopPAndTopK(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("claude.top_p", 0.9)
+	viper.Set("claude.top_k", 40)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TopP == nil || *cfg.TopP != 0.9 {
+		t.Errorf("expected top_p 0.9, got %v", cfg.TopP)
+	}
+	if cfg.TopK == nil || *cfg.TopK != 40 {
+		t.Errorf("expected top_k 40, got %v", cfg.TopK)
+	}
+}
+
+func TestLoadConfig_TopPAndTopKOutOfRange(t *testing.T) {
+	for key, value := range map[string]any{"claude.top_p": 1.2, "claude.top_k": 0} {
+		t.Run(key, func(t *testing.T) {
+			setupConfigTest(t)
+			setRequiredViperKeys()
+			viper.Set(key, value)
+
+			if _, err := LoadConfig(); err == nil {
+				t.Fatalf("expected error for %s=%v", key, value)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_InvalidShareKeysWith(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("crypto.share_keys_with", "everyone")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for unknown crypto.share_keys_with")
+	}
+}
+
+func TestLoadConfig_InvalidConversationScope(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("conversation.scope", "server")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for unknown conversation.scope")
+	}
+}
+
+func TestLoadConfig_ShellRequiresAllowlist(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.sandbox_dir", t.TempDir())
+	viper.Set("tools.shell_enabled", true)
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error when shell is enabled without allowed commands")
+	}
+}
+
+func TestLoadConfig_ShellRejectsReadOnlySandbox(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.sandbox_dir", t.TempDir())
+	viper.Set("tools.sandbox_readonly", true)
+	viper.Set("tools.shell_enabled", true)
+	viper.Set("tools.shell_allowed_commands", []string{"ls"})
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error when shell is enabled with a read-only sandbox")
+	}
+}
+
+func TestLoadConfig_Delegation(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("delegation", []map[string]any{{"keyword": "deploy", "target": "@deploybot:example.com"}})
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []DelegationRule{{Keyword: "deploy", Target: "@deploybot:example.com"}}
+	if !slices.Equal(cfg.Delegation, want) {
+		t.Errorf("Delegation = %+v, want %+v", cfg.Delegation, want)
+	}
+
+	viper.Set("delegation", []map[string]any{{"keyword": "deploy", "target": "deploybot"}})
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for a target that isn't a user ID")
+	}
+}
+
+func TestLoadConfig_MaxThreadsMustNotBeNegative(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("conversation.max_threads", -1)
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for negative conversation.max_threads")
+	}
+}
+
+func TestLoadConfig_RoomLanguage(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("matrix.room_language", map[string]string{"!AbC:example.com": "German"})
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.RoomLanguage["!abc:example.com"]; got != "German" {
+		t.Errorf("RoomLanguage = %v, want German under the lowercased room ID", cfg.RoomLanguage)
+	}
+
+	viper.Set("matrix.room_language", map[string]string{"#alias:example.com": "German"})
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for a key that isn't a room ID")
+	}
+}
+
+func TestLoadConfig_ServerToolsIncludeWebSearchFlag(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.server_tools", []string{"code_execution"})
+	viper.Set("tools.web_search_enabled", true)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(cfg.ServerTools, []string{"code_execution", "web_search"}) {
+		t.Errorf("ServerTools = %v", cfg.ServerTools)
+	}
+}
+
+func TestLoadConfig_WebSearchDomainListsExclusive(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.web_search.allowed_domains", []string{"go.dev"})
+	viper.Set("tools.web_search.blocked_domains", []string{"example.com"})
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error when both domain lists are set")
+	}
+}
+
+func TestLoadConfig_ReplyStyle(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReplyStyle != "thread" {
+		t.Errorf("ReplyStyle = %q, want thread by default", cfg.ReplyStyle)
+	}
+
+	viper.Set("matrix.reply_style", "sideways")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for invalid reply style")
+	}
+}
+
+func TestLoadConfig_ThreadRoot(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ThreadRoot != "mention" {
+		t.Errorf("ThreadRoot = %q, want mention by default", cfg.ThreadRoot)
+	}
+
+	viper.Set("matrix.thread_root", "reply_target")
+	if cfg, err = LoadConfig(); err != nil || cfg.ThreadRoot != "reply_target" {
+		t.Errorf("ThreadRoot = %q, %v; want reply_target", cfg.ThreadRoot, err)
+	}
+
+	viper.Set("matrix.thread_root", "parent")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for invalid thread root")
+	}
+}
+
+func TestLoadConfig_CompatProvider(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("anthropic.api_key", "")
+	viper.Set("claude.provider", "compat")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error without claude.compat.base_url")
+	}
+
+	viper.Set("claude.compat.base_url", "http://localhost:11434/v1")
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("compat provider should not need anthropic.api_key: %v", err)
+	}
+	if cfg.Provider != "compat" || cfg.CompatBaseURL != "http://localhost:11434/v1" {
+		t.Errorf("unexpected provider config: %q %q", cfg.Provider, cfg.CompatBaseURL)
+	}
+
+	viper.Set("claude.provider", "openai")
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for unknown provider")
+	}
+}
+
+func TestLoadConfig_ToolConcurrency(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.concurrency", map[string]any{"GitHub_Search": 2})
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.ToolConcurrency["github_search"]; got != 2 {
+		t.Errorf("ToolConcurrency = %v, want 2 under the lowercased name", cfg.ToolConcurrency)
+	}
+
+	viper.Set("tools.concurrency", map[string]any{"github_search": 0})
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected error for a non-positive limit")
+	}
+}
+
+func TestLoadConfig_HTTPTools(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("tools.http_tools", []map[string]any{{
+		"name":         "weather",
+		"url":          "https://weather.example.com/now",
+		"method":       "get",
+		"input_schema": `{"type":"object","properties":{"cityName":{"type":"string"}}}`,
+	}})
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.HTTPTools) != 1 || cfg.HTTPTools[0].Method != "GET" || !strings.Contains(cfg.HTTPTools[0].InputSchema, "cityName") {
+		t.Errorf("HTTPTools = %+v", cfg.HTTPTools)
+	}
+
+	for name, tool := range map[string]map[string]any{
+		"bad name":   {"name": "get weather", "url": "https://example.com"},
+		"bad url":    {"name": "weather", "url": "ftp://example.com"},
+		"bad method": {"name": "weather", "url": "https://example.com", "method": "DELETE"},
+		"bad schema": {"name": "weather", "url": "https://example.com", "input_schema": "{"},
+	} {
+		viper.Set("tools.http_tools", []map[string]any{tool})
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadConfig_Schedules(t *testing.T) {
+	setupConfigTest(t)
+	setRequiredViperKeys()
+	viper.Set("schedules", []map[string]any{{
+		"cron":     "30 9 * * 1-5",
+		"room":     "!team:example.com",
+		"prompt":   "Post today's standup questions.",
+		"timezone": "Europe/Berlin",
+	}})
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Schedules) != 1 || cfg.Schedules[0].Room != "!team:example.com" || cfg.Schedules[0].Timezone != "Europe/Berlin" {
+		t.Errorf("Schedules = %+v", cfg.Schedules)
+	}
+
+	for name, sched := range map[string]map[string]any{
+		"bad cron":     {"cron": "every morning", "room": "!team:example.com", "prompt": "hi"},
+		"bad room":     {"cron": "@daily", "room": "#team:example.com", "prompt": "hi"},
+		"no prompt":    {"cron": "@daily", "room": "!team:example.com"},
+		"bad timezone": {"cron": "@daily", "room": "!team:example.com", "prompt": "hi", "timezone": "Mars/Olympus"},
+	} {
+		viper.Set("schedules", []map[string]any{sched})
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
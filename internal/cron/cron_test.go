@@ -0,0 +1,68 @@
+package cron
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// Wednesday.
+	from := time.Date(2025, 3, 12, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 3, 12, 9, 31, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 3, 13, 9, 0, 0, 0, time.UTC)},
+		{"45 9 * * *", time.Date(2025, 3, 12, 9, 45, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2025, 3, 12, 9, 40, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)},
+		{"0 8 1,15 * *", time.Date(2025, 3, 15, 8, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either matching is enough.
+		{"0 8 1 * 5", time.Date(2025, 3, 14, 8, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 3, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.spec, err)
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Next(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestNext_Location(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	s, _ := Parse("0 9 * * *")
+	from := time.Date(2025, 3, 12, 10, 0, 0, 0, tokyo)
+	want := time.Date(2025, 3, 13, 9, 0, 0, 0, tokyo)
+	if got := s.Next(from); !got.Equal(want) {
+		t.Errorf("expected 09:00 Tokyo time, got %v", got)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct{ spec, want string }{
+		{"* * * *", "must have 5 fields"},
+		{"60 * * * *", "minute must be between 0 and 59"},
+		{"* * 0 * *", "day of month must be between 1 and 31"},
+		{"*/0 * * * *", "step must be a positive number"},
+		{"5-1 * * * *", "runs backwards"},
+		{"@sometimes", "must have 5 fields"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want it to mention %q", tt.spec, err, tt.want)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package crypto
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"slices"
 
 	"go.mau.fi/util/dbutil"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/cryptohelper"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
 
 	_ "modernc.org/sqlite"
 
@@ -34,14 +39,126 @@ func Setup(ctx context.Context, client *mautrix.Client, cfg config.Config) (*cry
 		return nil, fmt.Errorf("failed to initialize crypto helper: %w", err)
 	}
 
+	applyKeySharing(helper.Machine(), cfg.ShareKeysWith)
+
+	if err := bootstrapCrossSigning(ctx, helper.Machine(), cfg); err != nil {
+		log.Printf("Warning: cross-signing bootstrap failed, device stays unverified: %v", err)
+	}
+
 	client.Crypto = helper
 	log.Println("E2EE support enabled")
 	return helper, nil
 }
 
-func openDatabase(path string) (*dbutil.Database, error) {
+// SetupWithFallback runs Setup, but when cfg.CryptoFailOpen is set a failure
+// is logged and the bot carries on without E2EE: it returns a nil helper and
+// no error, leaving encrypted rooms unreadable while plaintext rooms work.
+func SetupWithFallback(ctx context.Context, client *mautrix.Client, cfg config.Config) (*cryptohelper.CryptoHelper, error) {
+	helper, err := Setup(ctx, client, cfg)
+	if err == nil || !cfg.CryptoFailOpen {
+		return helper, err
+	}
+	client.Crypto = nil
+	log.Printf("WARNING: E2EE setup failed, continuing WITHOUT encryption because crypto.fail_open is set: %v", err)
+	log.Println("WARNING: messages in encrypted rooms will be ignored until the crypto database is fixed and the bot restarted")
+	return nil, nil
+}
+
+// keyShareRejectAll is sent in reply to every key request under the "none"
+// sharing policy.
+var keyShareRejectAll = crypto.KeyShareRejection{
+	Code:   event.RoomKeyWithheldUnauthorized,
+	Reason: "This device does not share keys",
+}
+
+// applyKeySharing sets which devices the bot answers room key requests from:
+//
+//   - "trusted" (default): mautrix's policy; the bot's own cross-signed
+//     devices, and other users' devices the session was originally sent to.
+//   - "all": also the bot's unverified devices, and other users' devices
+//     that weren't original recipients (e.g. a new login) as long as the
+//     session is the bot's own and the user shares the room.
+//   - "none": never share.
+func applyKeySharing(mach *crypto.OlmMachine, policy string) {
+	switch policy {
+	case "none":
+		mach.AllowKeyShare = func(ctx context.Context, device *id.Device, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
+			return &keyShareRejectAll
+		}
+	case "all":
+		defaultAllow := mach.AllowKeyShare
+		mach.ShareKeysMinTrust = id.TrustStateUnset
+		mach.AllowKeyShare = func(ctx context.Context, device *id.Device, info event.RequestedKeyInfo) *crypto.KeyShareRejection {
+			rejection := defaultAllow(ctx, device, info)
+			if rejection == nil || device.UserID == mach.Client.UserID {
+				return rejection
+			}
+			if device.Trust == id.TrustStateBlacklisted {
+				return &crypto.KeyShareRejectBlacklisted
+			}
+			igs, err := mach.CryptoStore.GetGroupSession(ctx, info.RoomID, info.SessionID)
+			if err != nil || igs == nil || igs.SenderKey != mach.OwnIdentity().IdentityKey {
+				return &crypto.KeyShareRejectUnavailable
+			}
+			rooms, err := mach.StateStore.FindSharedRooms(ctx, device.UserID)
+			if err != nil || !slices.Contains(rooms, info.RoomID) {
+				return &crypto.KeyShareRejectOtherUser
+			}
+			return nil
+		}
+	default:
+		mach.ShareKeysMinTrust = id.TrustStateCrossSignedTOFU
+	}
+	log.Printf("Sharing room keys with: %s", cmp.Or(policy, "trusted"))
+}
+
+// crossSigner is the subset of *crypto.OlmMachine used to bootstrap
+// cross-signing.
+type crossSigner interface {
+	GetOwnCrossSigningPublicKeys(ctx context.Context) *crypto.CrossSigningPublicKeysCache
+	VerifyWithRecoveryKey(ctx context.Context, recoveryKey string) error
+	GenerateAndVerifyWithRecoveryKey(ctx context.Context) (string, error)
+}
+
+// bootstrapCrossSigning self-signs the bot's device when
+// crypto.bootstrap_cross_signing is set. With a recovery key it loads the
+// existing cross-signing keys from secret storage; without one it generates
+// new keys on first run and logs the recovery key.
+func bootstrapCrossSigning(ctx context.Context, signer crossSigner, cfg config.Config) error {
+	if !cfg.BootstrapCrossSigning {
+		return nil
+	}
+
+	if cfg.RecoveryKey != "" {
+		if err := signer.VerifyWithRecoveryKey(ctx, cfg.RecoveryKey); err != nil {
+			return fmt.Errorf("failed to verify with recovery key: %w", err)
+		}
+		log.Println("Device verified via cross-signing")
+		return nil
+	}
+
+	if signer.GetOwnCrossSigningPublicKeys(ctx) != nil {
+		log.Println("Warning: cross-signing keys already exist; set crypto.recovery_key to verify this device")
+		return nil
+	}
+
+	recoveryKey, err := signer.GenerateAndVerifyWithRecoveryKey(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Generated cross-signing keys. Save this recovery key and set it as crypto.recovery_key: %s", recoveryKey)
+	return nil
+}
+
+// OpenDB opens the SQLite database at path with the settings the crypto
+// store uses. The bot keeps its persistent settings in the same file.
+func OpenDB(path string) (*sql.DB, error) {
 	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)", path)
-	rawDB, err := sql.Open("sqlite", dsn)
+	return sql.Open("sqlite", dsn)
+}
+
+func openDatabase(path string) (*dbutil.Database, error) {
+	rawDB, err := OpenDB(path)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+type fakeSigner struct {
+	existing      *crypto.CrossSigningPublicKeysCache
+	verifiedWith  string
+	generated     bool
+	generateError error
+}
+
+func (f *fakeSigner) GetOwnCrossSigningPublicKeys(ctx context.Context) *crypto.CrossSigningPublicKeysCache {
+	return f.existing
+}
+
+func (f *fakeSigner) VerifyWithRecoveryKey(ctx context.Context, recoveryKey string) error {
+	f.verifiedWith = recoveryKey
+	return nil
+}
+
+func (f *fakeSigner) GenerateAndVerifyWithRecoveryKey(ctx context.Context) (string, error) {
+	f.generated = true
+	return "EsTc abcd", f.generateError
+}
+
+func TestBootstrapCrossSigning_Disabled(t *testing.T) {
+	signer := &fakeSigner{}
+	if err := bootstrapCrossSigning(context.Background(), signer, config.Config{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if signer.generated || signer.verifiedWith != "" {
+		t.Error("bootstrap should not run when disabled")
+	}
+}
+
+func TestBootstrapCrossSigning_GeneratesOnFirstRun(t *testing.T) {
+	signer := &fakeSigner{}
+	cfg := config.Config{BootstrapCrossSigning: true}
+	if err := bootstrapCrossSigning(context.Background(), signer, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !signer.generated {
+		t.Error("expected new cross-signing keys to be generated")
+	}
+}
+
+func TestBootstrapCrossSigning_UsesRecoveryKey(t *testing.T) {
+	signer := &fakeSigner{existing: &crypto.CrossSigningPublicKeysCache{}}
+	cfg := config.Config{BootstrapCrossSigning: true, RecoveryKey: "EsTc abcd"}
+	if err := bootstrapCrossSigning(context.Background(), signer, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if signer.verifiedWith != "EsTc abcd" {
+		t.Errorf("expected verification with configured recovery key, got %q", signer.verifiedWith)
+	}
+	if signer.generated {
+		t.Error("should not generate new keys when a recovery key is configured")
+	}
+}
+
+func TestBootstrapCrossSigning_ExistingKeysWithoutRecoveryKey(t *testing.T) {
+	signer := &fakeSigner{existing: &crypto.CrossSigningPublicKeysCache{}}
+	cfg := config.Config{BootstrapCrossSigning: true}
+	if err := bootstrapCrossSigning(context.Background(), signer, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if signer.generated {
+		t.Error("should not overwrite existing cross-signing keys")
+	}
+}
+
+func TestBootstrapCrossSigning_GenerateError(t *testing.T) {
+	signer := &fakeSigner{generateError: fmt.Errorf("upload rejected")}
+	cfg := config.Config{BootstrapCrossSigning: true}
+	if err := bootstrapCrossSigning(context.Background(), signer, cfg); err == nil {
+		t.Fatal("expected error to be returned")
+	}
+}
+
+func newTestMachine() *crypto.OlmMachine {
+	client := &mautrix.Client{UserID: "@bot:example.com", DeviceID: "BOTDEVICE"}
+	return crypto.NewOlmMachine(client, nil, crypto.NewMemoryStore(nil), nil)
+}
+
+func TestApplyKeySharing_Trusted(t *testing.T) {
+	mach := newTestMachine()
+	applyKeySharing(mach, "trusted")
+	if mach.ShareKeysMinTrust != id.TrustStateCrossSignedTOFU {
+		t.Errorf("expected cross-signed minimum trust, got %s", mach.ShareKeysMinTrust)
+	}
+}
+
+func TestApplyKeySharing_All(t *testing.T) {
+	mach := newTestMachine()
+	applyKeySharing(mach, "all")
+	if mach.ShareKeysMinTrust != id.TrustStateUnset {
+		t.Errorf("expected no minimum trust, got %s", mach.ShareKeysMinTrust)
+	}
+
+	// Sessions the bot doesn't have are still refused.
+	device := &id.Device{UserID: "@alice:example.com", DeviceID: "NEWPHONE"}
+	info := event.RequestedKeyInfo{RoomID: "!room:example.com", SessionID: "unknown"}
+	if mach.AllowKeyShare(context.Background(), device, info) == nil {
+		t.Error("expected request for an unknown session to be rejected")
+	}
+}
+
+func TestApplyKeySharing_None(t *testing.T) {
+	mach := newTestMachine()
+	applyKeySharing(mach, "none")
+
+	device := &id.Device{UserID: "@bot:example.com", DeviceID: "OTHERDEVICE", Trust: id.TrustStateVerified}
+	rejection := mach.AllowKeyShare(context.Background(), device, event.RequestedKeyInfo{})
+	if rejection == nil || rejection.Code != event.RoomKeyWithheldUnauthorized {
+		t.Errorf("expected every request to be rejected, got %+v", rejection)
+	}
+}
+
+func brokenCryptoConfig(t *testing.T) config.Config {
+	return config.Config{
+		PickleKey:          "pickle",
+		CryptoDatabasePath: filepath.Join(t.TempDir(), "missing", "crypto.db"),
+	}
+}
+
+func TestSetupWithFallback_FailClosed(t *testing.T) {
+	client, _ := mautrix.NewClient("https://matrix.example.com", "@bot:example.com", "token")
+
+	helper, err := SetupWithFallback(context.Background(), client, brokenCryptoConfig(t))
+	if err == nil || helper != nil {
+		t.Fatalf("expected setup error by default, got helper %v, err %v", helper, err)
+	}
+}
+
+func TestSetupWithFallback_FailOpen(t *testing.T) {
+	client, _ := mautrix.NewClient("https://matrix.example.com", "@bot:example.com", "token")
+	cfg := brokenCryptoConfig(t)
+	cfg.CryptoFailOpen = true
+
+	helper, err := SetupWithFallback(context.Background(), client, cfg)
+	if err != nil {
+		t.Fatalf("expected fail-open to swallow the error, got %v", err)
+	}
+	if helper != nil || client.Crypto != nil {
+		t.Errorf("expected no crypto helper, got %v / %v", helper, client.Crypto)
+	}
+}
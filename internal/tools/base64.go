@@ -0,0 +1,121 @@
+package tools
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// maxBase64Input caps the content either tool accepts.
+const maxBase64Input = 256 << 10 // 256 KB
+
+// NewBase64Tools returns the base64_encode and base64_decode tools.
+func NewBase64Tools() []Tool {
+	return []Tool{&base64EncodeTool{}, &base64DecodeTool{}}
+}
+
+type base64Input struct {
+	Content string `json:"content"`
+}
+
+// --- base64_encode ---
+
+type base64EncodeTool struct{}
+
+func (t *base64EncodeTool) Name() string { return "base64_encode" }
+
+func (t *base64EncodeTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "base64_encode",
+			Description: anthropic.String("Encode text as standard base64 (with padding). Input is capped at 256KB."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"content": map[string]any{
+						"type":        "string",
+						"description": "Text to encode",
+					},
+				},
+				Required: []string{"content"},
+			},
+		},
+	}
+}
+
+func (t *base64EncodeTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params base64Input
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+	if len(params.Content) > maxBase64Input {
+		return fmt.Sprintf("content too large: %d bytes (max %d)", len(params.Content), maxBase64Input), true, nil
+	}
+	return base64.StdEncoding.EncodeToString([]byte(params.Content)), false, nil
+}
+
+// --- base64_decode ---
+
+type base64DecodeTool struct{}
+
+func (t *base64DecodeTool) Name() string { return "base64_decode" }
+
+func (t *base64DecodeTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "base64_decode",
+			Description: anthropic.String("Decode base64 (standard or URL-safe, padding optional, line breaks ignored) back to text. The decoded data must be UTF-8 text. Input is capped at 256KB."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"content": map[string]any{
+						"type":        "string",
+						"description": "Base64 to decode",
+					},
+				},
+				Required: []string{"content"},
+			},
+		},
+	}
+}
+
+func (t *base64DecodeTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params base64Input
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+	if len(params.Content) > maxBase64Input {
+		return fmt.Sprintf("content too large: %d bytes (max %d)", len(params.Content), maxBase64Input), true, nil
+	}
+
+	data, err := decodeBase64(params.Content)
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			return fmt.Sprintf("invalid base64 at byte %d (ignoring whitespace)", int64(corrupt)), true, nil
+		}
+		return "invalid base64: " + err.Error(), true, nil
+	}
+	if !utf8.Valid(data) {
+		return fmt.Sprintf("decoded data is %d bytes of binary, not text, so it can't be returned", len(data)), true, nil
+	}
+	return string(data), false, nil
+}
+
+// decodeBase64 decodes s in whichever alphabet it uses, with or without
+// padding, after dropping whitespace such as line wrapping.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	enc := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.URLEncoding
+	}
+	if !strings.HasSuffix(s, "=") {
+		enc = enc.WithPadding(base64.NoPadding)
+	}
+	return enc.DecodeString(s)
+}
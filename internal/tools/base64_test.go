@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func runBase64Tool(t *testing.T, tool Tool, content string) (string, bool) {
+	t.Helper()
+	input, _ := json.Marshal(base64Input{Content: content})
+	result, isErr, err := tool.Execute(context.Background(), input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return result, isErr
+}
+
+func TestBase64_RoundTrip(t *testing.T) {
+	tools := NewBase64Tools()
+	encode, decode := tools[0], tools[1]
+
+	for _, text := range []string{"", "hello, world", "héllo ✓\nsecond line", "a?b>c"} {
+		encoded, isErr := runBase64Tool(t, encode, text)
+		if isErr {
+			t.Fatalf("encode %q failed: %s", text, encoded)
+		}
+		decoded, isErr := runBase64Tool(t, decode, encoded)
+		if isErr || decoded != text {
+			t.Errorf("round trip of %q gave %q (error %v)", text, decoded, isErr)
+		}
+	}
+
+	if got, _ := runBase64Tool(t, encode, "hi?"); got != "aGk/" {
+		t.Errorf("expected standard alphabet, got %q", got)
+	}
+	// URL-safe, unpadded, and wrapped input all decode.
+	for _, encoded := range []string{"aGk_", "aGk", "aGVs\nbG8=\n"} {
+		if got, isErr := runBase64Tool(t, decode, encoded); isErr {
+			t.Errorf("decode %q failed: %s", encoded, got)
+		}
+	}
+}
+
+func TestBase64_InvalidInput(t *testing.T) {
+	decode := NewBase64Tools()[1]
+
+	result, isErr := runBase64Tool(t, decode, "aGVs*G8=")
+	if !isErr || !strings.Contains(result, "invalid base64 at byte 4") {
+		t.Errorf("expected the bad byte to be reported, got %q (error %v)", result, isErr)
+	}
+
+	// Valid base64 of bytes that aren't text.
+	result, isErr = runBase64Tool(t, decode, "/w==")
+	if !isErr || !strings.Contains(result, "binary") {
+		t.Errorf("expected binary data to be refused, got %q (error %v)", result, isErr)
+	}
+}
+
+func TestBase64_SizeCap(t *testing.T) {
+	big := strings.Repeat("a", maxBase64Input+1)
+	for _, tool := range NewBase64Tools() {
+		result, isErr := runBase64Tool(t, tool, big)
+		if !isErr || !strings.Contains(result, "content too large") {
+			t.Errorf("%s: expected size cap error, got %q", tool.Name(), result)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tools
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Cacheable is implemented by read-only tools whose results may be reused
+// for an identical call made shortly afterwards.
+type Cacheable interface {
+	Cacheable() bool
+}
+
+func isCacheable(t Tool) bool {
+	c, ok := t.(Cacheable)
+	return ok && c.Cacheable()
+}
+
+// resultCache holds recent results of cacheable tools, keyed by tool name,
+// calling room, ephemeral sandbox, and input. Any other tool call may change what those reads
+// would return, so it empties the cache.
+type resultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[[sha256.Size]byte]cachedResult
+}
+
+type cachedResult struct {
+	result  string
+	expires time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, now: time.Now, entries: make(map[[sha256.Size]byte]cachedResult)}
+}
+
+func cacheKey(ctx context.Context, name string, input json.RawMessage) [sha256.Size]byte {
+	roomID, _ := ctx.Value(roomIDKey{}).(string)
+	// Threads in one room each have their own ephemeral sandbox, so the
+	// same read can see different files.
+	sandbox, _ := ctx.Value(ephemeralSandboxKey{}).(ephemeralSandbox)
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(roomID))
+	h.Write([]byte{0})
+	h.Write([]byte(sandbox.conversationID))
+	h.Write([]byte{0})
+	h.Write(input)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func (c *resultCache) get(key [sha256.Size]byte) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.expires) {
+		return "", false
+	}
+	return e.result, true
+}
+
+func (c *resultCache) put(key [sha256.Size]byte, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedResult{result: result, expires: now.Add(c.ttl)}
+}
+
+func (c *resultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
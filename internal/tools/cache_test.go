@@ -0,0 +1,122 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCachedFSRegistry(t *testing.T) (*Registry, string) {
+	t.Helper()
+	dir := t.TempDir()
+	reg := NewRegistry()
+	for _, tool := range NewFilesystemTools(dir, false, false) {
+		reg.Register(tool)
+	}
+	reg.EnableResultCache(time.Minute)
+	return reg, dir
+}
+
+func TestResultCache_RepeatedReadHitsCache(t *testing.T) {
+	reg, dir := newCachedFSRegistry(t)
+	path := filepath.Join(dir, "notes.txt")
+	os.WriteFile(path, []byte("v1"), 0o644)
+	ctx := context.Background()
+	read := json.RawMessage(`{"path":"notes.txt"}`)
+
+	if result, _, _ := reg.Execute(ctx, "fs_read", read); result != "v1" {
+		t.Fatalf("first read = %q", result)
+	}
+	// Changed behind the cache's back, so only a cache hit returns v1.
+	os.WriteFile(path, []byte("v2"), 0o644)
+	if result, _, _ := reg.Execute(ctx, "fs_read", read); result != "v1" {
+		t.Errorf("repeated read = %q, want cached v1", result)
+	}
+}
+
+func TestResultCache_WriteIsNotCachedAndInvalidatesReads(t *testing.T) {
+	reg, dir := newCachedFSRegistry(t)
+	ctx := context.Background()
+	read := json.RawMessage(`{"path":"notes.txt"}`)
+
+	reg.Execute(ctx, "fs_write", json.RawMessage(`{"path":"notes.txt","content":"v1"}`))
+	if result, _, _ := reg.Execute(ctx, "fs_read", read); result != "v1" {
+		t.Fatalf("read after first write = %q", result)
+	}
+
+	reg.Execute(ctx, "fs_write", json.RawMessage(`{"path":"notes.txt","content":"v2"}`))
+	if result, _, _ := reg.Execute(ctx, "fs_read", read); result != "v2" {
+		t.Errorf("read after second write = %q, want v2", result)
+	}
+
+	// Repeating an identical write must run it again, not replay a result.
+	os.Remove(filepath.Join(dir, "notes.txt"))
+	reg.Execute(ctx, "fs_write", json.RawMessage(`{"path":"notes.txt","content":"v2"}`))
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("repeated write was not executed: %v", err)
+	}
+}
+
+func TestResultCache_ExpiresAndIsPerRoom(t *testing.T) {
+	dir := t.TempDir()
+	reg := NewRegistry()
+	reg.Register(&fsReadTool{sandboxDir: dir, perRoom: true})
+	reg.EnableResultCache(time.Minute)
+	now := time.Unix(0, 0)
+	reg.cache.now = func() time.Time { return now }
+
+	roomA := WithRoomID(context.Background(), "!a:example.com")
+	roomB := WithRoomID(context.Background(), "!b:example.com")
+	read := json.RawMessage(`{"path":"f"}`)
+	writeRoomFile := func(room, content string) {
+		roomDir := filepath.Join(dir, url.PathEscape(room))
+		os.MkdirAll(roomDir, 0o755)
+		os.WriteFile(filepath.Join(roomDir, "f"), []byte(content), 0o644)
+	}
+	writeRoomFile("!a:example.com", "A1")
+	writeRoomFile("!b:example.com", "B1")
+
+	reg.Execute(roomA, "fs_read", read)
+	if result, _, _ := reg.Execute(roomB, "fs_read", read); result != "B1" {
+		t.Errorf("room B got %q, want its own file", result)
+	}
+
+	writeRoomFile("!a:example.com", "A2")
+	now = now.Add(time.Minute)
+	if result, _, _ := reg.Execute(roomA, "fs_read", read); result != "A2" {
+		t.Errorf("read after TTL = %q, want fresh A2", result)
+	}
+}
+
+func TestResultCache_IsPerEphemeralSandbox(t *testing.T) {
+	sandboxes := NewEphemeralSandboxes(t.TempDir())
+	defer sandboxes.RemoveAll()
+	reg := NewRegistry()
+	for _, tool := range NewFilesystemTools(t.TempDir(), false, false) {
+		reg.Register(tool)
+	}
+	reg.EnableResultCache(time.Minute)
+
+	room := WithRoomID(context.Background(), "!a:example.com")
+	threadA := WithEphemeralSandbox(room, sandboxes, "$a")
+	threadB := WithEphemeralSandbox(room, sandboxes, "$b")
+	for thread, content := range map[string]string{"$a": "secret A", "$b": "B"} {
+		dir, err := sandboxes.Dir(thread)
+		if err != nil {
+			t.Fatalf("sandbox for %s: %v", thread, err)
+		}
+		os.WriteFile(filepath.Join(dir, "notes.txt"), []byte(content), 0o644)
+	}
+
+	read := json.RawMessage(`{"path":"notes.txt"}`)
+	if result, _, _ := reg.Execute(threadA, "fs_read", read); result != "secret A" {
+		t.Fatalf("thread A read = %q", result)
+	}
+	if result, _, _ := reg.Execute(threadB, "fs_read", read); result != "B" {
+		t.Errorf("thread B read = %q, want its own file, not thread A's cached one", result)
+	}
+}
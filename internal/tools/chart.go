@@ -0,0 +1,233 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/wcharczuk/go-chart/v2"
+)
+
+// Bounds on a render_chart spec, so one call can't ask for an unreadable
+// or very expensive image, and the size of the image it draws.
+const (
+	maxChartPoints     = 100
+	maxChartSeries     = 8
+	maxChartTitleLen   = 200
+	maxChartLabelLen   = 40
+	chartWidth         = 1024
+	chartHeight        = 576
+	chartImageFileName = "chart.png"
+)
+
+// NewChartTool returns the render_chart tool, which draws a bar or line
+// chart and posts it into the chat as a PNG.
+func NewChartTool() Tool {
+	return &chartTool{}
+}
+
+type chartSeries struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+}
+
+type chartInput struct {
+	Type   string        `json:"type"`
+	Title  string        `json:"title"`
+	Labels []string      `json:"labels"`
+	Series []chartSeries `json:"series"`
+}
+
+type chartTool struct{}
+
+func (t *chartTool) Name() string { return "render_chart" }
+
+func (t *chartTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name: "render_chart",
+			Description: anthropic.String(fmt.Sprintf(
+				"Draw a bar or line chart and post it into the chat as an image. Use it when a chart makes numbers easier to read. "+
+					"Bar charts take exactly one series; line charts take up to %d. Each series has one value per label, with at most %d labels.",
+				maxChartSeries, maxChartPoints)),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"type": map[string]any{
+						"type":        "string",
+						"enum":        []string{"bar", "line"},
+						"description": "Chart type",
+					},
+					"title": map[string]any{
+						"type":        "string",
+						"description": "Optional chart title",
+					},
+					"labels": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": "Category or x-axis labels, in order",
+					},
+					"series": map[string]any{
+						"type": "array",
+						"items": map[string]any{
+							"type": "object",
+							"properties": map[string]any{
+								"name": map[string]any{
+									"type":        "string",
+									"description": "Series name, shown in the legend of line charts with several series",
+								},
+								"values": map[string]any{
+									"type":        "array",
+									"items":       map[string]any{"type": "number"},
+									"description": "One value per label",
+								},
+							},
+							"required": []string{"values"},
+						},
+						"description": "Data series to plot",
+					},
+				},
+				Required: []string{"type", "labels", "series"},
+			},
+		},
+	}
+}
+
+func (t *chartTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params chartInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+	if err := params.validate(); err != nil {
+		return err.Error(), true, nil
+	}
+
+	send := imageSenderFrom(ctx)
+	if send == nil {
+		return "sending images is not available here", true, nil
+	}
+
+	data, err := renderChart(params)
+	if err != nil {
+		return "failed to render chart: " + err.Error(), true, nil
+	}
+	if err := send(ctx, chartImageFileName, data, "image/png"); err != nil {
+		return "failed to send chart: " + err.Error(), true, nil
+	}
+	return fmt.Sprintf("sent a %s chart of %d points to the chat", params.Type, len(params.Labels)), false, nil
+}
+
+// validate checks the spec against the chart type and the size bounds.
+func (p chartInput) validate() error {
+	switch p.Type {
+	case "bar":
+		if len(p.Series) != 1 {
+			return fmt.Errorf("bar charts take exactly one series, got %d", len(p.Series))
+		}
+	case "line":
+		if len(p.Series) == 0 || len(p.Series) > maxChartSeries {
+			return fmt.Errorf("line charts take 1 to %d series, got %d", maxChartSeries, len(p.Series))
+		}
+		if len(p.Labels) < 2 {
+			return fmt.Errorf("line charts need at least 2 labels, got %d", len(p.Labels))
+		}
+	default:
+		return fmt.Errorf("type must be bar or line, got %q", p.Type)
+	}
+	if len(p.Labels) == 0 || len(p.Labels) > maxChartPoints {
+		return fmt.Errorf("labels must have 1 to %d entries, got %d", maxChartPoints, len(p.Labels))
+	}
+	if len(p.Title) > maxChartTitleLen {
+		return fmt.Errorf("title is longer than %d characters", maxChartTitleLen)
+	}
+	for _, label := range p.Labels {
+		if len(label) > maxChartLabelLen {
+			return fmt.Errorf("label %q is longer than %d characters", label, maxChartLabelLen)
+		}
+	}
+	for i, s := range p.Series {
+		if len(s.Name) > maxChartLabelLen {
+			return fmt.Errorf("series name %q is longer than %d characters", s.Name, maxChartLabelLen)
+		}
+		if len(s.Values) != len(p.Labels) {
+			return fmt.Errorf("series %d has %d values for %d labels", i, len(s.Values), len(p.Labels))
+		}
+	}
+	return nil
+}
+
+// renderChart draws a validated spec as a PNG.
+func renderChart(p chartInput) ([]byte, error) {
+	var renderable interface {
+		Render(chart.RendererProvider, io.Writer) error
+	}
+	switch p.Type {
+	case "bar":
+		bars := make([]chart.Value, len(p.Labels))
+		for i, label := range p.Labels {
+			bars[i] = chart.Value{Label: label, Value: p.Series[0].Values[i]}
+		}
+		// Bars grow from zero, so the axis always includes it.
+		lo, hi := valueRange(p.Series)
+		lo, hi = math.Min(lo, 0), math.Max(hi, 0)
+		if lo == hi {
+			hi = 1
+		}
+		// Spread the bars across the chart, leaving room for the y axis.
+		slot := (chartWidth - 100) / len(bars)
+		renderable = chart.BarChart{
+			Title:        p.Title,
+			Width:        chartWidth,
+			Height:       chartHeight,
+			BarWidth:     max(slot*2/3, 1),
+			BarSpacing:   max(slot-slot*2/3, 1),
+			UseBaseValue: true,
+			YAxis:        chart.YAxis{Range: &chart.ContinuousRange{Min: lo, Max: hi}},
+			Bars:         bars,
+		}
+	case "line":
+		xs := make([]float64, len(p.Labels))
+		ticks := make([]chart.Tick, len(p.Labels))
+		for i, label := range p.Labels {
+			xs[i] = float64(i)
+			ticks[i] = chart.Tick{Value: float64(i), Label: label}
+		}
+		graph := chart.Chart{
+			Title:  p.Title,
+			Width:  chartWidth,
+			Height: chartHeight,
+			XAxis:  chart.XAxis{Ticks: ticks},
+		}
+		if lo, hi := valueRange(p.Series); lo == hi {
+			// A flat line has no range for the axis to span.
+			graph.YAxis.Range = &chart.ContinuousRange{Min: lo - 1, Max: hi + 1}
+		}
+		for _, s := range p.Series {
+			graph.Series = append(graph.Series, chart.ContinuousSeries{Name: s.Name, XValues: xs, YValues: s.Values})
+		}
+		if len(p.Series) > 1 {
+			graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+		}
+		renderable = graph
+	}
+
+	var buf bytes.Buffer
+	if err := renderable.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// valueRange returns the smallest and largest value across series.
+func valueRange(series []chartSeries) (lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, v := range s.Values {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	return lo, hi
+}
@@ -0,0 +1,89 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestChartTool_RendersPNG(t *testing.T) {
+	tests := map[string]string{
+		"bar":       `{"type":"bar","title":"Sales","labels":["Q1","Q2","Q3"],"series":[{"name":"2025","values":[3,-1,4.5]}]}`,
+		"flat bar":  `{"type":"bar","labels":["a","b"],"series":[{"values":[0,0]}]}`,
+		"line":      `{"type":"line","labels":["Mon","Tue","Wed"],"series":[{"name":"cpu","values":[10,30,20]},{"name":"mem","values":[50,55,60]}]}`,
+		"flat line": `{"type":"line","labels":["a","b"],"series":[{"values":[7,7]}]}`,
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			var gotName, gotType string
+			var gotData []byte
+			ctx := WithImageSender(context.Background(), func(ctx context.Context, name string, data []byte, mimeType string) error {
+				gotName, gotType, gotData = name, mimeType, data
+				return nil
+			})
+
+			result, isErr, err := NewChartTool().Execute(ctx, json.RawMessage(input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if isErr {
+				t.Fatalf("expected success, got: %s", result)
+			}
+			if gotName != "chart.png" || gotType != "image/png" {
+				t.Errorf("unexpected image sent: name=%q type=%q", gotName, gotType)
+			}
+			img, err := png.Decode(bytes.NewReader(gotData))
+			if err != nil {
+				t.Fatalf("sent data is not a PNG: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+				t.Errorf("expected a %dx%d image, got %dx%d", chartWidth, chartHeight, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestChartTool_InvalidSpec(t *testing.T) {
+	tests := map[string]struct {
+		input string
+		want  string
+	}{
+		"unknown type":       {`{"type":"pie","labels":["a"],"series":[{"values":[1]}]}`, "type must be bar or line"},
+		"bar with 2 series":  {`{"type":"bar","labels":["a"],"series":[{"values":[1]},{"values":[2]}]}`, "exactly one series"},
+		"no labels":          {`{"type":"bar","labels":[],"series":[{"values":[]}]}`, "labels must have"},
+		"mismatched values":  {`{"type":"line","labels":["a","b"],"series":[{"values":[1]}]}`, "has 1 values for 2 labels"},
+		"single-point line":  {`{"type":"line","labels":["a"],"series":[{"values":[1]}]}`, "at least 2 labels"},
+		"too many points":    {`{"type":"bar","labels":[` + strings.Repeat(`"x",`, maxChartPoints) + `"x"],"series":[{"values":[]}]}`, "labels must have"},
+		"non-numeric values": {`{"type":"bar","labels":["a"],"series":[{"values":["one"]}]}`, "invalid input"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			sent := false
+			ctx := WithImageSender(context.Background(), func(context.Context, string, []byte, string) error {
+				sent = true
+				return nil
+			})
+			result, isErr, err := NewChartTool().Execute(ctx, json.RawMessage(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !isErr || !strings.Contains(result, tt.want) {
+				t.Errorf("expected a tool error containing %q, got %q (isError=%v)", tt.want, result, isErr)
+			}
+			if sent {
+				t.Error("no image should be sent for an invalid spec")
+			}
+		})
+	}
+}
+
+func TestChartTool_NoSender(t *testing.T) {
+	_, isErr, _ := NewChartTool().Execute(context.Background(),
+		json.RawMessage(`{"type":"bar","labels":["a"],"series":[{"values":[1]}]}`))
+	if !isErr {
+		t.Error("expected isError=true without an image sender")
+	}
+}
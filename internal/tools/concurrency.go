@@ -0,0 +1,38 @@
+package tools
+
+import (
+	"context"
+	"strings"
+)
+
+// SetConcurrencyLimits caps how many calls of each named tool Execute runs
+// at once, across all threads. Calls over the limit wait for a free slot
+// until their context is done. Names are matched case-insensitively, since
+// the config loader lowercases them; tools without a positive limit are
+// unrestricted.
+func (r *Registry) SetConcurrencyLimits(limits map[string]int) {
+	slots := make(map[string]chan struct{}, len(limits))
+	for name, limit := range limits {
+		if limit > 0 {
+			slots[strings.ToLower(name)] = make(chan struct{}, limit)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slots = slots
+}
+
+// acquireSlot waits for a free slot in sem, returning the function that
+// frees it. A nil sem means no limit.
+func acquireSlot(ctx context.Context, sem chan struct{}) (release func(), err error) {
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingTool records how many of its calls overlap and runs each until
+// released.
+type blockingTool struct {
+	fakeTool
+	release chan struct{}
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (t *blockingTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	n := t.running.Add(1)
+	defer t.running.Add(-1)
+	for {
+		peak := t.peak.Load()
+		if n <= peak || t.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	<-t.release
+	return t.result, false, nil
+}
+
+func TestRegistry_ConcurrencyLimitSerializesCalls(t *testing.T) {
+	tool := &blockingTool{fakeTool: fakeTool{name: "Rate_Limited", result: "ok"}, release: make(chan struct{})}
+	reg := NewRegistry()
+	reg.Register(tool)
+	reg.SetConcurrencyLimits(map[string]int{"rate_limited": 1})
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := reg.Execute(context.Background(), "Rate_Limited", json.RawMessage(`{}`)); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+
+	// Let both calls reach the tool if the limit doesn't hold them back,
+	// then finish them one at a time.
+	time.Sleep(50 * time.Millisecond)
+	tool.release <- struct{}{}
+	tool.release <- struct{}{}
+	wg.Wait()
+
+	if peak := tool.peak.Load(); peak != 1 {
+		t.Errorf("expected calls to run one at a time, %d overlapped", peak)
+	}
+}
+
+func TestRegistry_ConcurrencyLimitRespectsContext(t *testing.T) {
+	tool := &blockingTool{fakeTool: fakeTool{name: "slow", result: "ok"}, release: make(chan struct{})}
+	reg := NewRegistry()
+	reg.Register(tool)
+	reg.SetConcurrencyLimits(map[string]int{"slow": 1})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reg.Execute(context.Background(), "slow", json.RawMessage(`{}`))
+	}()
+	for tool.running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := reg.Execute(ctx, "slow", json.RawMessage(`{}`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a queued call should give up when its context ends, got %v", err)
+	}
+
+	close(tool.release)
+	<-done
+}
@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// NewDateTimeTool returns the datetime tool, which reports the current time
+// in a given IANA timezone.
+func NewDateTimeTool() Tool {
+	return &dateTimeTool{now: time.Now}
+}
+
+type dateTimeTool struct {
+	now func() time.Time
+}
+
+type dateTimeInput struct {
+	Timezone string `json:"timezone"`
+}
+
+func (t *dateTimeTool) Name() string { return "datetime" }
+
+func (t *dateTimeTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "datetime",
+			Description: anthropic.String("Get the current date and time. Use this instead of guessing whenever the current time, date, or day of week matters."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"timezone": map[string]any{
+						"type":        "string",
+						"description": "IANA timezone name, e.g. \"Asia/Tokyo\" or \"America/New_York\" (optional, defaults to UTC)",
+					},
+				},
+			},
+		},
+	}
+}
+
+func (t *dateTimeTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params dateTimeInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+	if params.Timezone == "" {
+		params.Timezone = "UTC"
+	}
+
+	loc, err := time.LoadLocation(params.Timezone)
+	if err != nil {
+		return fmt.Sprintf("unknown timezone %q: use an IANA name like Europe/Paris", params.Timezone), true, nil
+	}
+
+	now := t.now().In(loc)
+	return fmt.Sprintf("%s (%s, %s)", now.Format(time.RFC3339), now.Weekday(), params.Timezone), false, nil
+}
@@ -0,0 +1,49 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFixedDateTimeTool() *dateTimeTool {
+	return &dateTimeTool{now: func() time.Time { return time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC) }}
+}
+
+func TestDateTime_Timezone(t *testing.T) {
+	tool := newFixedDateTimeTool()
+	result, isErr, err := tool.Execute(context.Background(), json.RawMessage(`{"timezone":"Asia/Tokyo"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isErr {
+		t.Fatalf("expected success, got: %s", result)
+	}
+	if result != "2025-03-14T21:00:00+09:00 (Friday, Asia/Tokyo)" {
+		t.Errorf("unexpected result: %q", result)
+	}
+}
+
+func TestDateTime_InvalidTimezone(t *testing.T) {
+	tool := newFixedDateTimeTool()
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"timezone":"Mars/Olympus_Mons"}`))
+	if !isErr {
+		t.Error("expected isError=true for unknown timezone")
+	}
+	if !strings.Contains(result, "unknown timezone") {
+		t.Errorf("expected 'unknown timezone' in result, got %q", result)
+	}
+}
+
+func TestDateTime_DefaultsToUTC(t *testing.T) {
+	tool := newFixedDateTimeTool()
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{}`))
+	if isErr {
+		t.Fatalf("expected success, got: %s", result)
+	}
+	if result != "2025-03-14T12:00:00Z (Friday, UTC)" {
+		t.Errorf("unexpected result: %q", result)
+	}
+}
@@ -0,0 +1,254 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// maxDiffLines bounds the lines left to compare once the files' common
+	// start and end are set aside; the comparison takes time and memory
+	// proportional to their product.
+	maxDiffLines  = 2000
+	maxDiffOutput = 64 << 10 // 64 KB
+	diffContext   = 3
+)
+
+// --- fs_diff ---
+
+type fsDiffTool struct {
+	sandboxDir string
+	perRoom    bool
+}
+
+type fsDiffInput struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (t *fsDiffTool) Name() string { return "fs_diff" }
+
+func (t *fsDiffTool) Cacheable() bool { return true }
+
+func (t *fsDiffTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "fs_diff",
+			Description: anthropic.String("Compare two text files in the sandbox directory and return a unified diff of the changes from the first to the second. Files must be at most 1MB; the diff is capped at 64KB."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"from": map[string]any{
+						"type":        "string",
+						"description": "Relative path of the original file within the sandbox directory",
+					},
+					"to": map[string]any{
+						"type":        "string",
+						"description": "Relative path of the changed file within the sandbox directory",
+					},
+				},
+				Required: []string{"from", "to"},
+			},
+		},
+	}
+}
+
+func (t *fsDiffTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params fsDiffInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+
+	from, msg := t.readText(ctx, params.From)
+	if msg != "" {
+		return msg, true, nil
+	}
+	to, msg := t.readText(ctx, params.To)
+	if msg != "" {
+		return msg, true, nil
+	}
+
+	diff, ok := unifiedDiff(params.From, params.To, from, to)
+	if !ok {
+		return fmt.Sprintf("files differ in too many lines to compare (max %d); use fs_read on parts of them instead", maxDiffLines), true, nil
+	}
+	if diff == "" {
+		return "files are identical", false, nil
+	}
+	if len(diff) > maxDiffOutput {
+		diff = diff[:maxDiffOutput] + "\n[diff truncated at 64KB]"
+	}
+	return diff, false, nil
+}
+
+// readText reads a sandbox file for diffing, or returns a message saying
+// why it can't be.
+func (t *fsDiffTool) readText(ctx context.Context, path string) (string, string) {
+	resolved, err := resolveToolPath(ctx, t.sandboxDir, t.perRoom, path)
+	if err != nil {
+		return "", fmt.Sprintf("%s: %v", path, err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", "file not found: " + path
+	}
+	if info.IsDir() {
+		return "", "path is a directory: " + path
+	}
+	if info.Size() > maxFileReadSize {
+		return "", fmt.Sprintf("file too large: %s is %d bytes (max %d)", path, info.Size(), maxFileReadSize)
+	}
+	data, err := os.ReadFile(resolved)
+	if err != nil {
+		return "", "failed to read file: " + err.Error()
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return "", "cannot diff binary file: " + path
+	}
+	return string(data), ""
+}
+
+// diffOp is one line of an edit script: ' ' kept, '-' removed, '+' added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff turning a into b, or "" if they are
+// equal. It reports false if the differing middle of the files is longer
+// than maxDiffLines.
+func unifiedDiff(nameA, nameB, a, b string) (string, bool) {
+	if a == b {
+		return "", true
+	}
+	ops, ok := diffLines(splitLines(a), splitLines(b))
+	if !ok {
+		return "", false
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	lineA, lineB := 1, 1 // line numbers at ops[i]
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			lineA, lineB = lineA+1, lineB+1
+			i++
+			continue
+		}
+
+		// A hunk runs from diffContext lines before this change to
+		// diffContext lines after the last change within 2*diffContext
+		// unchanged lines of the one before it.
+		start := max(i-diffContext, 0)
+		for k := i - 1; k >= start; k-- {
+			lineA, lineB = lineA-1, lineB-1
+		}
+		end := i
+		for k := i; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(ops))
+
+		var countA, countB int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(lineA, countA), hunkRange(lineB, countB))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		lineA, lineB = lineA+countA, lineB+countB
+		i = end
+	}
+	return sb.String(), true
+}
+
+// hunkRange formats one side of a hunk header. An empty side names the line
+// before it, as diff -u does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits text into lines, without a trailing empty line for a
+// final newline.
+func splitLines(text string) []string {
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines returns a shortest edit script from a to b, found by longest
+// common subsequence after setting the common start and end aside.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(midA) > maxDiffLines || len(midB) > maxDiffLines {
+		return nil, false
+	}
+
+	// lcs[i][j] is the LCS length of midA[i:] and midB[j:].
+	lcs := make([][]int32, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			ops = append(ops, diffOp{' ', midA[i]})
+			i, j = i+1, j+1
+		case j < len(midB) && (i == len(midA) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', midB[j]})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', midA[i]})
+			i++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops, true
+}
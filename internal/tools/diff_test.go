@@ -0,0 +1,94 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runDiff(t *testing.T, dir, from, to string) (string, bool) {
+	t.Helper()
+	input, _ := json.Marshal(fsDiffInput{From: from, To: to})
+	result, isErr, err := (&fsDiffTool{sandboxDir: dir}).Execute(context.Background(), input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return result, isErr
+}
+
+func TestFsDiff_TextFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "old.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "new.go"), []byte("package main\n\nfunc main() {\n\tprintln(\"hello\")\n\tprintln(\"bye\")\n}\n"), 0o644)
+
+	result, isErr := runDiff(t, dir, "old.go", "new.go")
+	if isErr {
+		t.Fatalf("unexpected error result: %s", result)
+	}
+	want := `--- old.go
++++ new.go
+@@ -1,5 +1,6 @@
+ package main
+ 
+ func main() {
+-	println("hi")
++	println("hello")
++	println("bye")
+ }
+`
+	if result != want {
+		t.Errorf("diff =\n%s\nwant\n%s", result, want)
+	}
+
+	if result, _ := runDiff(t, dir, "old.go", "old.go"); result != "files are identical" {
+		t.Errorf("expected identical files to be reported, got %q", result)
+	}
+}
+
+func TestFsDiff_SeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := range 30 {
+		a = append(a, strings.Repeat("x", i%5+1))
+	}
+	b = append(b, a...)
+	b[2], b[25] = "changed", "also changed"
+
+	got, ok := unifiedDiff("a", "b", strings.Join(a, "\n")+"\n", strings.Join(b, "\n")+"\n")
+	if !ok {
+		t.Fatal("diff refused")
+	}
+	if n := strings.Count(got, "@@ -"); n != 2 {
+		t.Errorf("expected two hunks for distant changes, got %d:\n%s", n, got)
+	}
+	if !strings.Contains(got, "@@ -1,6 +1,6 @@") || !strings.Contains(got, "@@ -23,7 +23,7 @@") {
+		t.Errorf("unexpected hunk headers:\n%s", got)
+	}
+}
+
+func TestFsDiff_MissingAndBinaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("text\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.bin"), []byte{0x89, 'P', 'N', 'G', 0, 0}, 0o644)
+
+	if result, isErr := runDiff(t, dir, "a.txt", "missing.txt"); !isErr || result != "file not found: missing.txt" {
+		t.Errorf("expected a missing file error, got %q", result)
+	}
+	if result, isErr := runDiff(t, dir, "b.bin", "a.txt"); !isErr || result != "cannot diff binary file: b.bin" {
+		t.Errorf("expected a binary file error, got %q", result)
+	}
+}
+
+func TestFsDiff_RejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("text\n"), 0o644)
+
+	for _, paths := range [][2]string{{"../../etc/passwd", "a.txt"}, {"a.txt", "../../etc/passwd"}} {
+		result, isErr := runDiff(t, dir, paths[0], paths[1])
+		if !isErr || !strings.Contains(result, "escapes sandbox") {
+			t.Errorf("diff(%s, %s) should be rejected, got %q", paths[0], paths[1], result)
+		}
+	}
+}
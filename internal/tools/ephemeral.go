@@ -0,0 +1,83 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// EphemeralSandboxes gives each conversation its own temporary directory
+// under a parent directory, created on the conversation's first filesystem
+// call and deleted by Remove, so file work doesn't outlive the thread.
+type EphemeralSandboxes struct {
+	parent string
+
+	mu   sync.Mutex
+	dirs map[string]string
+}
+
+// NewEphemeralSandboxes returns sandboxes created under parent.
+func NewEphemeralSandboxes(parent string) *EphemeralSandboxes {
+	return &EphemeralSandboxes{parent: parent, dirs: make(map[string]string)}
+}
+
+// Dir returns the conversation's directory, creating it if it doesn't exist
+// yet.
+func (s *EphemeralSandboxes) Dir(conversationID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if dir, ok := s.dirs[conversationID]; ok {
+		return dir, nil
+	}
+	dir, err := os.MkdirTemp(s.parent, "thread-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create thread sandbox: %w", err)
+	}
+	s.dirs[conversationID] = dir
+	return dir, nil
+}
+
+// Remove deletes the conversation's directory and everything in it, if it
+// has one.
+func (s *EphemeralSandboxes) Remove(conversationID string) {
+	s.mu.Lock()
+	dir, ok := s.dirs[conversationID]
+	delete(s.dirs, conversationID)
+	s.mu.Unlock()
+	if ok {
+		removeSandbox(dir)
+	}
+}
+
+// RemoveAll deletes every conversation's directory.
+func (s *EphemeralSandboxes) RemoveAll() {
+	s.mu.Lock()
+	dirs := s.dirs
+	s.dirs = make(map[string]string)
+	s.mu.Unlock()
+	for _, dir := range dirs {
+		removeSandbox(dir)
+	}
+}
+
+func removeSandbox(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove thread sandbox %s: %v", dir, err)
+	}
+}
+
+type ephemeralSandboxKey struct{}
+
+type ephemeralSandbox struct {
+	sandboxes      *EphemeralSandboxes
+	conversationID string
+}
+
+// WithEphemeralSandbox returns a context that points filesystem and shell
+// tools at the conversation's directory in sandboxes instead of their
+// configured sandbox.
+func WithEphemeralSandbox(ctx context.Context, sandboxes *EphemeralSandboxes, conversationID string) context.Context {
+	return context.WithValue(ctx, ephemeralSandboxKey{}, ephemeralSandbox{sandboxes, conversationID})
+}
@@ -0,0 +1,51 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEphemeralSandboxes(t *testing.T) {
+	parent := t.TempDir()
+	s := NewEphemeralSandboxes(parent)
+
+	a, err := s.Dir("$a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.Dir("$a"); again != a {
+		t.Errorf("expected the same directory for the same conversation, got %s and %s", a, again)
+	}
+	b, _ := s.Dir("$b")
+	if a == b || filepath.Dir(a) != parent || filepath.Dir(b) != parent {
+		t.Fatalf("expected distinct directories under %s, got %s and %s", parent, a, b)
+	}
+
+	s.Remove("$a")
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed, got %v", a, err)
+	}
+	s.Remove("$unknown")
+
+	s.RemoveAll()
+	if _, err := os.Stat(b); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed, got %v", b, err)
+	}
+}
+
+func TestSandboxRoot_Ephemeral(t *testing.T) {
+	parent := t.TempDir()
+	s := NewEphemeralSandboxes(parent)
+	ctx := WithEphemeralSandbox(WithRoomID(context.Background(), "!room:example.com"), s, "$thread")
+
+	root, err := sandboxRoot(ctx, parent, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := s.Dir("$thread")
+	if root != want {
+		t.Errorf("expected the conversation's sandbox %s over the room's, got %s", want, root)
+	}
+}
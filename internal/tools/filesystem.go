@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -22,6 +24,9 @@ func resolveSandboxedPath(sandboxDir, path string) (string, error) {
 	if path == "" {
 		return "", fmt.Errorf("path is empty")
 	}
+	if strings.ContainsRune(path, 0) {
+		return "", fmt.Errorf("path contains a NUL byte")
+	}
 
 	absSandbox, err := filepath.Abs(sandboxDir)
 	if err != nil {
@@ -47,9 +52,14 @@ func resolveSandboxedPath(sandboxDir, path string) (string, error) {
 	}
 
 	// File doesn't exist yet (valid for writes). Walk up to the nearest
-	// existing ancestor and verify it's within the sandbox.
+	// existing ancestor and verify it's within the sandbox. Anything on the
+	// way that exists without resolving is a dangling or looping symlink,
+	// which a write could follow out of the sandbox.
 	ancestor := joined
 	for {
+		if _, lerr := os.Lstat(ancestor); lerr == nil {
+			return "", fmt.Errorf("path contains a broken symlink")
+		}
 		parent := filepath.Dir(ancestor)
 		if parent == ancestor {
 			break
@@ -68,41 +78,111 @@ func resolveSandboxedPath(sandboxDir, path string) (string, error) {
 	return joined, nil
 }
 
+// isWithin reports whether path is dir or inside it. Both are cleaned and
+// compared component-wise, so a sibling sharing a prefix ("/sandbox-evil"
+// next to "/sandbox") is outside, and a root dir contains everything.
 func isWithin(path, dir string) bool {
-	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type roomIDKey struct{}
+
+// WithRoomID returns a context that tells room-aware tools which room the
+// call came from.
+func WithRoomID(ctx context.Context, roomID string) context.Context {
+	return context.WithValue(ctx, roomIDKey{}, roomID)
+}
+
+// sandboxRoot returns the directory a tool call may use: sandboxDir itself,
+// or with perRoom the calling room's subdirectory of it, created on first
+// use. Room IDs are path-escaped so they can't contain a separator. A
+// conversation's ephemeral sandbox, if the context has one, takes
+// precedence over both.
+func sandboxRoot(ctx context.Context, sandboxDir string, perRoom bool) (string, error) {
+	if e, ok := ctx.Value(ephemeralSandboxKey{}).(ephemeralSandbox); ok {
+		return e.sandboxes.Dir(e.conversationID)
+	}
+	if !perRoom {
+		return sandboxDir, nil
+	}
+	roomID, _ := ctx.Value(roomIDKey{}).(string)
+	if roomID == "" {
+		return "", fmt.Errorf("no room for per-room sandbox")
+	}
+	dir := filepath.Join(sandboxDir, url.PathEscape(roomID))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create room sandbox: %w", err)
+	}
+	return dir, nil
 }
 
-// NewFilesystemTools returns the fs_read, fs_write, and fs_list tools
-// operating within the given sandbox directory.
-func NewFilesystemTools(sandboxDir string) []Tool {
-	return []Tool{
-		&fsReadTool{sandboxDir: sandboxDir},
-		&fsWriteTool{sandboxDir: sandboxDir},
-		&fsListTool{sandboxDir: sandboxDir},
+// resolveToolPath resolves path within the sandbox for this call; see
+// sandboxRoot and resolveSandboxedPath.
+func resolveToolPath(ctx context.Context, sandboxDir string, perRoom bool, path string) (string, error) {
+	root, err := sandboxRoot(ctx, sandboxDir, perRoom)
+	if err != nil {
+		return "", err
 	}
+	return resolveSandboxedPath(root, path)
+}
+
+// NewFilesystemTools returns the fs_read, fs_write, fs_list, fs_diff, and
+// fs_send_image tools operating within the given sandbox directory. With
+// perRoom, each room gets its own subdirectory and can't see the others.
+// With readOnly, fs_write is left out so the sandbox can't be modified.
+func NewFilesystemTools(sandboxDir string, perRoom, readOnly bool) []Tool {
+	fsTools := []Tool{
+		&fsReadTool{sandboxDir: sandboxDir, perRoom: perRoom},
+		&fsListTool{sandboxDir: sandboxDir, perRoom: perRoom},
+		&fsDiffTool{sandboxDir: sandboxDir, perRoom: perRoom},
+		&fsSendImageTool{sandboxDir: sandboxDir, perRoom: perRoom},
+	}
+	if !readOnly {
+		fsTools = append(fsTools, &fsWriteTool{sandboxDir: sandboxDir, perRoom: perRoom})
+	}
+	return fsTools
 }
 
 // --- fs_read ---
 
-type fsReadTool struct{ sandboxDir string }
+type fsReadTool struct {
+	sandboxDir string
+	perRoom    bool
+}
 
 type fsReadInput struct {
-	Path string `json:"path"`
+	Path   string `json:"path"`
+	Offset *int64 `json:"offset,omitempty"`
+	Length *int64 `json:"length,omitempty"`
 }
 
 func (t *fsReadTool) Name() string { return "fs_read" }
 
+func (t *fsReadTool) Cacheable() bool { return true }
+
 func (t *fsReadTool) Definition() anthropic.ToolUnionParam {
 	return anthropic.ToolUnionParam{
 		OfTool: &anthropic.ToolParam{
 			Name:        "fs_read",
-			Description: anthropic.String("Read a file from the sandbox directory. Returns file contents as text. Max 1MB."),
+			Description: anthropic.String("Read a file from the sandbox directory. Returns file contents as text. Max 1MB per read; use offset and length to page through larger files."),
 			InputSchema: anthropic.ToolInputSchemaParam{
 				Properties: map[string]any{
 					"path": map[string]any{
 						"type":        "string",
 						"description": "Relative path within the sandbox directory",
 					},
+					"offset": map[string]any{
+						"type":        "integer",
+						"description": "Byte offset to start reading from (optional)",
+					},
+					"length": map[string]any{
+						"type":        "integer",
+						"description": "Maximum number of bytes to read, up to 1MB (optional)",
+					},
 				},
 				Required: []string{"path"},
 			},
@@ -113,10 +193,10 @@ func (t *fsReadTool) Definition() anthropic.ToolUnionParam {
 func (t *fsReadTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
 	var params fsReadInput
 	if err := json.Unmarshal(input, &params); err != nil {
-		return "invalid input: " + err.Error(), true, nil
+		return InvalidInput(err), true, nil
 	}
 
-	resolved, err := resolveSandboxedPath(t.sandboxDir, params.Path)
+	resolved, err := resolveToolPath(ctx, t.sandboxDir, t.perRoom, params.Path)
 	if err != nil {
 		return err.Error(), true, nil
 	}
@@ -128,6 +208,9 @@ func (t *fsReadTool) Execute(ctx context.Context, input json.RawMessage) (string
 	if info.IsDir() {
 		return "path is a directory, use fs_list instead", true, nil
 	}
+	if params.Offset != nil || params.Length != nil {
+		return readRange(resolved, info.Size(), params.Offset, params.Length)
+	}
 	if info.Size() > maxFileReadSize {
 		return fmt.Sprintf("file too large: %d bytes (max %d)", info.Size(), maxFileReadSize), true, nil
 	}
@@ -140,9 +223,49 @@ func (t *fsReadTool) Execute(ctx context.Context, input json.RawMessage) (string
 	return string(data), false, nil
 }
 
+// readRange reads a byte range of a file, prefixed with a note of which
+// bytes were returned out of the file's total size.
+func readRange(path string, size int64, offsetPtr, lengthPtr *int64) (string, bool, error) {
+	var offset int64
+	if offsetPtr != nil {
+		offset = *offsetPtr
+	}
+	length := int64(maxFileReadSize)
+	if lengthPtr != nil {
+		length = *lengthPtr
+	}
+
+	if offset < 0 || length < 0 {
+		return "offset and length must not be negative", true, nil
+	}
+	if length > maxFileReadSize {
+		length = maxFileReadSize
+	}
+	if offset >= size {
+		return fmt.Sprintf("(offset %d is at or past end of file, size %d bytes)", offset, size), false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "failed to read file: " + err.Error(), true, nil
+	}
+	defer f.Close()
+
+	buf := make([]byte, min(length, size-offset))
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return "failed to read file: " + err.Error(), true, nil
+	}
+
+	return fmt.Sprintf("(bytes %d-%d of %d)\n%s", offset, offset+int64(n), size, buf[:n]), false, nil
+}
+
 // --- fs_write ---
 
-type fsWriteTool struct{ sandboxDir string }
+type fsWriteTool struct {
+	sandboxDir string
+	perRoom    bool
+}
 
 type fsWriteInput struct {
 	Path    string `json:"path"`
@@ -176,10 +299,10 @@ func (t *fsWriteTool) Definition() anthropic.ToolUnionParam {
 func (t *fsWriteTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
 	var params fsWriteInput
 	if err := json.Unmarshal(input, &params); err != nil {
-		return "invalid input: " + err.Error(), true, nil
+		return InvalidInput(err), true, nil
 	}
 
-	resolved, err := resolveSandboxedPath(t.sandboxDir, params.Path)
+	resolved, err := resolveToolPath(ctx, t.sandboxDir, t.perRoom, params.Path)
 	if err != nil {
 		return err.Error(), true, nil
 	}
@@ -198,7 +321,10 @@ func (t *fsWriteTool) Execute(ctx context.Context, input json.RawMessage) (strin
 
 // --- fs_list ---
 
-type fsListTool struct{ sandboxDir string }
+type fsListTool struct {
+	sandboxDir string
+	perRoom    bool
+}
 
 type fsListInput struct {
 	Path string `json:"path"`
@@ -206,6 +332,8 @@ type fsListInput struct {
 
 func (t *fsListTool) Name() string { return "fs_list" }
 
+func (t *fsListTool) Cacheable() bool { return true }
+
 func (t *fsListTool) Definition() anthropic.ToolUnionParam {
 	return anthropic.ToolUnionParam{
 		OfTool: &anthropic.ToolParam{
@@ -226,14 +354,14 @@ func (t *fsListTool) Definition() anthropic.ToolUnionParam {
 func (t *fsListTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
 	var params fsListInput
 	if err := json.Unmarshal(input, &params); err != nil {
-		return "invalid input: " + err.Error(), true, nil
+		return InvalidInput(err), true, nil
 	}
 
 	if params.Path == "" {
 		params.Path = "."
 	}
 
-	resolved, err := resolveSandboxedPath(t.sandboxDir, params.Path)
+	resolved, err := resolveToolPath(ctx, t.sandboxDir, t.perRoom, params.Path)
 	if err != nil {
 		return err.Error(), true, nil
 	}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -162,3 +163,237 @@ func TestResolveSandboxedPath_EmptyPath(t *testing.T) {
 		t.Error("expected error for empty path")
 	}
 }
+
+func TestFsRead_Range(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "log.txt"), []byte("0123456789"), 0o644)
+
+	tool := &fsReadTool{sandboxDir: dir}
+	result, isErr, err := tool.Execute(context.Background(), json.RawMessage(`{"path":"log.txt","offset":2,"length":4}`))
+	if err != nil || isErr {
+		t.Fatalf("unexpected error: %v / %s", err, result)
+	}
+	if result != "(bytes 2-6 of 10)\n2345" {
+		t.Errorf("unexpected result: %q", result)
+	}
+}
+
+func TestFsRead_RangePastEOF(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "log.txt"), []byte("0123456789"), 0o644)
+
+	tool := &fsReadTool{sandboxDir: dir}
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"path":"log.txt","offset":8,"length":100}`))
+	if isErr {
+		t.Fatalf("unexpected error flag: %s", result)
+	}
+	if result != "(bytes 8-10 of 10)\n89" {
+		t.Errorf("expected truncated read at EOF, got %q", result)
+	}
+
+	result, isErr, _ = tool.Execute(context.Background(), json.RawMessage(`{"path":"log.txt","offset":50}`))
+	if isErr {
+		t.Fatalf("unexpected error flag: %s", result)
+	}
+	if !strings.Contains(result, "past end of file") {
+		t.Errorf("expected past-EOF note, got %q", result)
+	}
+}
+
+func TestFsRead_LargeFileRequiresRange(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "big.log"), make([]byte, maxFileReadSize+10), 0o644)
+
+	tool := &fsReadTool{sandboxDir: dir}
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"path":"big.log"}`))
+	if !isErr || !strings.Contains(result, "too large") {
+		t.Errorf("expected too-large error for full read, got %q", result)
+	}
+
+	result, isErr, _ = tool.Execute(context.Background(), json.RawMessage(`{"path":"big.log","offset":1048576}`))
+	if isErr {
+		t.Fatalf("unexpected error flag: %s", result)
+	}
+	if !strings.HasPrefix(result, "(bytes 1048576-1048586 of 1048586)") {
+		t.Errorf("unexpected range header: %q", result[:40])
+	}
+}
+
+func TestFilesystemTools_PerRoomIsolation(t *testing.T) {
+	dir := t.TempDir()
+	write := &fsWriteTool{sandboxDir: dir, perRoom: true}
+	read := &fsReadTool{sandboxDir: dir, perRoom: true}
+	roomA := WithRoomID(context.Background(), "!a:example.com")
+	roomB := WithRoomID(context.Background(), "!b:example.com")
+
+	if result, isErr, _ := write.Execute(roomA, json.RawMessage(`{"path":"notes.txt","content":"from A"}`)); isErr {
+		t.Fatalf("write in room A failed: %s", result)
+	}
+	if result, isErr, _ := write.Execute(roomB, json.RawMessage(`{"path":"notes.txt","content":"from B"}`)); isErr {
+		t.Fatalf("write in room B failed: %s", result)
+	}
+
+	if result, _, _ := read.Execute(roomA, json.RawMessage(`{"path":"notes.txt"}`)); result != "from A" {
+		t.Errorf("room A read %q", result)
+	}
+	if result, _, _ := read.Execute(roomB, json.RawMessage(`{"path":"notes.txt"}`)); result != "from B" {
+		t.Errorf("room B read %q", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err == nil {
+		t.Error("per-room writes should not land in the sandbox root")
+	}
+
+	// Room A can't climb out of its subdirectory into room B's.
+	for _, path := range []string{"../%21b:example.com/notes.txt", "../!b:example.com/notes.txt", "../../notes.txt"} {
+		input, _ := json.Marshal(fsReadInput{Path: path})
+		result, isErr, _ := read.Execute(roomA, input)
+		if !isErr || strings.Contains(result, "from B") {
+			t.Errorf("read %q from room A = %q, want an error", path, result)
+		}
+	}
+}
+
+func TestFilesystemTools_PerRoomRequiresRoom(t *testing.T) {
+	tool := &fsListTool{sandboxDir: t.TempDir(), perRoom: true}
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{}`))
+	if !isErr || !strings.Contains(result, "no room") {
+		t.Errorf("expected an error without a room, got %q", result)
+	}
+}
+
+func TestNewFilesystemTools_ReadOnly(t *testing.T) {
+	names := func(readOnly bool) []string {
+		var out []string
+		for _, tool := range NewFilesystemTools(t.TempDir(), false, readOnly) {
+			out = append(out, tool.Name())
+		}
+		return out
+	}
+
+	if got := names(false); !slices.Contains(got, "fs_write") {
+		t.Errorf("fs_write should be registered normally, got %v", got)
+	}
+	got := names(true)
+	if slices.Contains(got, "fs_write") {
+		t.Errorf("fs_write should be absent in read-only mode, got %v", got)
+	}
+	for _, want := range []string{"fs_read", "fs_list", "fs_diff", "fs_send_image"} {
+		if !slices.Contains(got, want) {
+			t.Errorf("%s should still be registered in read-only mode, got %v", want, got)
+		}
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/sandbox", "/sandbox", true},
+		{"/sandbox/a/b", "/sandbox", true},
+		{"/sandbox/a", "/sandbox/", true},
+		{"/sandbox/..foo", "/sandbox", true},
+		{"/sandbox-evil", "/sandbox", false},
+		{"/sandbox-evil/secret", "/sandbox", false},
+		{"/sandbox/../sandbox-evil", "/sandbox", false},
+		{"/", "/sandbox", false},
+		{"/etc/passwd", "/", true},
+		{"/sandbox/a", "", false},
+	}
+	for _, tt := range tests {
+		if got := isWithin(tt.path, tt.dir); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.path, tt.dir, got, tt.want)
+		}
+	}
+}
+
+// newAdversarialSandbox builds a sandbox next to a sibling sharing its name
+// as a prefix, with symlinks that try to leave it, and returns the sandbox.
+func newAdversarialSandbox(t testing.TB) string {
+	t.Helper()
+	parent := t.TempDir()
+	sandbox := filepath.Join(parent, "sandbox")
+	evil := filepath.Join(parent, "sandbox-evil")
+	for _, dir := range []string{filepath.Join(sandbox, "sub"), evil} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(sandbox, "inside.txt"), []byte("ok"), 0o644)
+	os.WriteFile(filepath.Join(evil, "secret"), []byte("secret"), 0o644)
+	for link, target := range map[string]string{
+		"out":      "../sandbox-evil",
+		"dangling": "../sandbox-evil/new.txt",
+		"loop1":    "loop2",
+		"loop2":    "loop1",
+		"ok":       "inside.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(sandbox, link)); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+	return sandbox
+}
+
+func TestResolveSandboxedPath_PrefixSibling(t *testing.T) {
+	sandbox := newAdversarialSandbox(t)
+	for _, path := range []string{"../sandbox-evil/secret", "sub/../../sandbox-evil/secret", "out/secret", "out"} {
+		if resolved, err := resolveSandboxedPath(sandbox, path); err == nil {
+			t.Errorf("%q resolved to %q, want an error", path, resolved)
+		}
+	}
+	if _, err := resolveSandboxedPath(sandbox, "ok"); err != nil {
+		t.Errorf("symlink within the sandbox should resolve: %v", err)
+	}
+}
+
+func TestResolveSandboxedPath_BrokenSymlinks(t *testing.T) {
+	sandbox := newAdversarialSandbox(t)
+	// Writing through a dangling link would create the file outside.
+	for _, path := range []string{"dangling", "loop1", "loop1/x"} {
+		if resolved, err := resolveSandboxedPath(sandbox, path); err == nil {
+			t.Errorf("%q resolved to %q, want an error", path, resolved)
+		}
+	}
+}
+
+func FuzzResolveSandboxedPath(f *testing.F) {
+	for _, seed := range []string{
+		"inside.txt", "new/file.txt", "../sandbox-evil/secret", "..%2fsandbox-evil%2fsecret",
+		"a\x00b", "..\\..\\etc\\passwd", "sub/..\\../sandbox-evil", "out/secret", "dangling",
+		"loop1/x", "ok", "/etc/passwd", "./../sandbox-evil", "sub/../../sandbox-evil", "....//....//",
+	} {
+		f.Add(seed)
+	}
+	sandbox := newAdversarialSandbox(f)
+	realSandbox, err := filepath.EvalSymlinks(sandbox)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		resolved, err := resolveSandboxedPath(sandbox, path)
+		if err != nil {
+			return
+		}
+		if strings.ContainsRune(resolved, 0) {
+			t.Fatalf("%q resolved to %q, which contains a NUL byte", path, resolved)
+		}
+		// Whatever exists of the resolved path must really be inside the
+		// sandbox once symlinks are followed, so a write there stays in.
+		existing := resolved
+		for {
+			if _, err := os.Lstat(existing); err == nil {
+				break
+			}
+			existing = filepath.Dir(existing)
+		}
+		real, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			t.Fatalf("%q resolved to %q, whose existing part %q doesn't resolve: %v", path, resolved, existing, err)
+		}
+		if !isWithin(real, realSandbox) {
+			t.Fatalf("%q resolved to %q, which is really %q outside the sandbox", path, resolved, real)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// OutputFormatter rewrites a tool's successful result before Claude sees
+// it. It reports false if the result doesn't suit it, such as when the
+// result isn't JSON, in which case the result is used unchanged.
+type OutputFormatter func(result string) (string, bool)
+
+// ParseOutputFormatter parses a tools.output_formatters spec:
+//
+//   - "raw": the result unchanged
+//   - "pretty": JSON re-indented for reading
+//   - "compact": JSON with insignificant whitespace removed
+//   - "jsonpath:<path>": only the parts of a JSON result that path selects,
+//     e.g. "jsonpath:$.items[*].name"
+//
+// Paths start at "$" and step through ".name", "['name']", "[index]"
+// (negative counts from the end), and the wildcards ".*" and "[*]". A path
+// with a wildcard yields a JSON array of its matches; a string match is
+// returned without quotes.
+func ParseOutputFormatter(spec string) (OutputFormatter, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "raw":
+		return func(result string) (string, bool) { return result, true }, nil
+	case "pretty":
+		return func(result string) (string, bool) {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, []byte(result), "", "  "); err != nil {
+				return "", false
+			}
+			return buf.String(), true
+		}, nil
+	case "compact":
+		return func(result string) (string, bool) {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, []byte(result)); err != nil {
+				return "", false
+			}
+			return buf.String(), true
+		}, nil
+	case "jsonpath":
+		path, err := parseJSONPath(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, err
+		}
+		return path.format, nil
+	default:
+		return nil, fmt.Errorf("unknown output formatter %q: use raw, pretty, compact, or jsonpath:<path>", spec)
+	}
+}
+
+// SetOutputFormatters sets the formatter Execute applies to each named
+// tool's successful results, from specs as ParseOutputFormatter takes
+// them. Names are matched case-insensitively, since the config loader
+// lowercases them; tools without a formatter return their results as is.
+func (r *Registry) SetOutputFormatters(specs map[string]string) error {
+	formatters := make(map[string]OutputFormatter, len(specs))
+	for name, spec := range specs {
+		f, err := ParseOutputFormatter(spec)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		formatters[strings.ToLower(name)] = f
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.formatters = formatters
+	return nil
+}
+
+// jsonPathStep is one step of a path: a key, an index, or a wildcard.
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+type jsonPath struct {
+	expr  string
+	steps []jsonPathStep
+	// multi is set when a wildcard can make the path match more than one
+	// value.
+	multi bool
+}
+
+func parseJSONPath(expr string) (*jsonPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("jsonpath %q must start with $", expr)
+	}
+	p := &jsonPath{expr: expr}
+	rest := expr[1:]
+	for rest != "" {
+		var step jsonPathStep
+		switch {
+		case strings.HasPrefix(rest, ".*"):
+			step.wildcard = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			step.key = rest[1 : end+1]
+			if step.key == "" {
+				return nil, fmt.Errorf("jsonpath %q has an empty key", expr)
+			}
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("jsonpath %q has an unclosed [", expr)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("jsonpath %q: [%s] must be an index, a quoted key, or *", expr, inner)
+				}
+				step.index, step.isIndex = n, true
+			}
+		default:
+			return nil, fmt.Errorf("jsonpath %q: unexpected %q", expr, rest)
+		}
+		p.multi = p.multi || step.wildcard
+		p.steps = append(p.steps, step)
+	}
+	return p, nil
+}
+
+// format applies the path to a JSON result.
+func (p *jsonPath) format(result string) (string, bool) {
+	dec := json.NewDecoder(strings.NewReader(result))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return "", false
+	}
+
+	matches := []any{doc}
+	for _, step := range p.steps {
+		var next []any
+		for _, v := range matches {
+			next = append(next, step.apply(v)...)
+		}
+		matches = next
+	}
+
+	var out any = matches
+	if !p.multi {
+		if len(matches) == 0 {
+			log.Printf("jsonpath %s matched nothing, returning the result unchanged", p.expr)
+			return "", false
+		}
+		out = matches[0]
+		if s, ok := out.(string); ok {
+			return s, true
+		}
+	} else if matches == nil {
+		out = []any{}
+	}
+	encoded, err := json.Marshal(out)
+	if err != nil {
+		return "", false
+	}
+	return string(encoded), true
+}
+
+// apply returns what the step selects from v.
+func (s jsonPathStep) apply(v any) []any {
+	switch v := v.(type) {
+	case map[string]any:
+		if s.wildcard {
+			out := make([]any, 0, len(v))
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				out = append(out, v[key])
+			}
+			return out
+		}
+		if child, ok := v[s.key]; ok && !s.isIndex {
+			return []any{child}
+		}
+	case []any:
+		if s.wildcard {
+			return v
+		}
+		if s.isIndex {
+			i := s.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				return []any{v[i]}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+const searchResult = `{"total": 2, "items": [{"name": "alpha", "stars": 10}, {"name": "beta", "stars": 3}]}`
+
+func TestOutputFormatter_JSONPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"$.items[*].name", `["alpha","beta"]`},
+		{"$.items[0].name", "alpha"},
+		{"$.items[-1]", `{"name":"beta","stars":3}`},
+		{"$['total']", "2"},
+		{"$.items[1].*", `["beta",3]`},
+		{"$.items[*].missing", `[]`},
+	}
+	for _, tt := range tests {
+		f, err := ParseOutputFormatter("jsonpath:" + tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		got, ok := f(searchResult)
+		if !ok || got != tt.want {
+			t.Errorf("%s = %q (%v), want %q", tt.path, got, ok, tt.want)
+		}
+	}
+
+	f, _ := ParseOutputFormatter("jsonpath:$.items[5]")
+	if _, ok := f(searchResult); ok {
+		t.Error("a path matching nothing should leave the result alone")
+	}
+	if _, ok := f("not json"); ok {
+		t.Error("a non-JSON result should be left alone")
+	}
+
+	for _, spec := range []string{"jsonpath:items", "jsonpath:$.items[x]", "jsonpath:$.items[0", "xml"} {
+		if _, err := ParseOutputFormatter(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestRegistry_OutputFormatters(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register(&fakeTool{name: "search", result: searchResult})
+	reg.Register(&fakeTool{name: "other", result: searchResult})
+	if err := reg.SetOutputFormatters(map[string]string{"search": "jsonpath:$.items[*].name"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := reg.Execute(context.Background(), "search", json.RawMessage(`{}`))
+	if err != nil || result != `["alpha","beta"]` {
+		t.Errorf("search = %q, %v; want the extracted names", result, err)
+	}
+
+	// Tools without a formatter pass their results through.
+	result, _, _ = reg.Execute(context.Background(), "other", json.RawMessage(`{}`))
+	if result != searchResult {
+		t.Errorf("other = %q, want the raw result", result)
+	}
+
+	if err := reg.SetOutputFormatters(map[string]string{"search": "yaml"}); err == nil {
+		t.Error("expected an unknown formatter to be rejected")
+	}
+}
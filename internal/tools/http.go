@@ -0,0 +1,125 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+const maxHTTPToolResponse = 64 << 10 // 64 KB
+
+// NewHTTPTool returns a tool defined in tools.http_tools. Each call sends
+// Claude's input to cfg.URL, as a JSON body or, for GET, as query
+// parameters, and returns the response body as the result. Responses
+// other than 2xx are returned as tool errors.
+func NewHTTPTool(cfg config.HTTPToolConfig, timeout time.Duration) (Tool, error) {
+	var schema any
+	if cfg.InputSchema != "" {
+		if err := json.Unmarshal([]byte(cfg.InputSchema), &schema); err != nil {
+			return nil, fmt.Errorf("input schema of %s: %w", cfg.Name, err)
+		}
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &httpTool{
+		cfg:    cfg,
+		schema: mcpSchemaToAnthropicSchema(schema),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+type httpTool struct {
+	cfg    config.HTTPToolConfig
+	schema anthropic.ToolInputSchemaParam
+	client *http.Client
+}
+
+func (t *httpTool) Name() string { return t.cfg.Name }
+
+func (t *httpTool) Definition() anthropic.ToolUnionParam {
+	param := &anthropic.ToolParam{
+		Name:        t.cfg.Name,
+		InputSchema: t.schema,
+	}
+	if t.cfg.Description != "" {
+		param.Description = anthropic.String(t.cfg.Description)
+	}
+	return anthropic.ToolUnionParam{OfTool: param}
+}
+
+func (t *httpTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	if len(input) == 0 {
+		input = json.RawMessage(`{}`)
+	}
+	var args map[string]any
+	if err := json.Unmarshal(input, &args); err != nil {
+		return InvalidInput(err), true, nil
+	}
+
+	req, err := t.newRequest(ctx, input, args)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("request to %s failed: %v", t.cfg.Name, err), true, nil
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPToolResponse+1))
+	if err != nil {
+		return fmt.Sprintf("reading response from %s failed: %v", t.cfg.Name, err), true, nil
+	}
+	result := string(body)
+	if len(body) > maxHTTPToolResponse {
+		result = string(body[:maxHTTPToolResponse]) + "\n[response truncated at 64KB]"
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Sprintf("HTTP %d: %s", resp.StatusCode, result), true, nil
+	}
+	return result, false, nil
+}
+
+// newRequest builds the call for one tool input. GET requests carry each
+// top-level input field as a query parameter, with non-string values
+// JSON-encoded; other methods send the input as the JSON body.
+func (t *httpTool) newRequest(ctx context.Context, input json.RawMessage, args map[string]any) (*http.Request, error) {
+	if t.cfg.Method != http.MethodGet {
+		req, err := http.NewRequestWithContext(ctx, t.cfg.Method, t.cfg.URL, bytes.NewReader(input))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}
+
+	u, err := url.Parse(t.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	for name, value := range args {
+		if s, ok := value.(string); ok {
+			query.Set(name, s)
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		query.Set(name, strings.TrimSpace(string(encoded)))
+	}
+	u.RawQuery = query.Encode()
+	return http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+}
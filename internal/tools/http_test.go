@@ -0,0 +1,104 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+func newTestHTTPTool(t *testing.T, method, url string) Tool {
+	t.Helper()
+	tool, err := NewHTTPTool(config.HTTPToolConfig{
+		Name:        "weather",
+		Description: "Current weather for a city",
+		URL:         url,
+		Method:      method,
+		InputSchema: `{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`,
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("NewHTTPTool: %v", err)
+	}
+	return tool
+}
+
+func TestHTTPTool_Definition(t *testing.T) {
+	def := newTestHTTPTool(t, "POST", "http://example.com").Definition().OfTool
+	if def.Name != "weather" || def.Description.Value != "Current weather for a city" {
+		t.Errorf("unexpected definition: %+v", def)
+	}
+	props, _ := def.InputSchema.Properties.(map[string]any)
+	if _, ok := props["city"]; !ok || len(def.InputSchema.Required) != 1 {
+		t.Errorf("schema not taken from config: %+v", def.InputSchema)
+	}
+}
+
+func TestHTTPTool_PostsInput(t *testing.T) {
+	var gotMethod, gotType, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotMethod, gotType, gotBody = r.Method, r.Header.Get("Content-Type"), string(body)
+		w.Write([]byte("sunny, 21°C"))
+	}))
+	defer srv.Close()
+
+	result, isErr, err := newTestHTTPTool(t, "POST", srv.URL).Execute(context.Background(), json.RawMessage(`{"city":"Lisbon"}`))
+	if err != nil || isErr {
+		t.Fatalf("unexpected failure: %q, %v", result, err)
+	}
+	if result != "sunny, 21°C" {
+		t.Errorf("result = %q, want the response body", result)
+	}
+	if gotMethod != "POST" || gotType != "application/json" || gotBody != `{"city":"Lisbon"}` {
+		t.Errorf("server got %s %q with body %q", gotMethod, gotType, gotBody)
+	}
+}
+
+func TestHTTPTool_GetSendsQuery(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	if _, isErr, err := newTestHTTPTool(t, "GET", srv.URL+"?units=metric").Execute(context.Background(), json.RawMessage(`{"city":"Lisbon","days":3}`)); err != nil || isErr {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+	if gotQuery != "city=Lisbon&days=3&units=metric" {
+		t.Errorf("query = %q", gotQuery)
+	}
+}
+
+func TestHTTPTool_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unknown city", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	result, isErr, err := newTestHTTPTool(t, "POST", srv.URL).Execute(context.Background(), json.RawMessage(`{"city":"Atlantis"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isErr || !strings.HasPrefix(result, "HTTP 404: unknown city") {
+		t.Errorf("expected a tool error with the status and body, got %q (isError=%v)", result, isErr)
+	}
+}
+
+func TestHTTPTool_TruncatesLargeResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", maxHTTPToolResponse+100)))
+	}))
+	defer srv.Close()
+
+	result, _, _ := newTestHTTPTool(t, "POST", srv.URL).Execute(context.Background(), json.RawMessage(`{}`))
+	if !strings.HasSuffix(result, "[response truncated at 64KB]") || len(result) > maxHTTPToolResponse+100 {
+		t.Errorf("expected a truncated result, got %d bytes", len(result))
+	}
+}
@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const maxImageSize = 10 << 20 // 10 MB
+
+// ImageSender posts an image into the conversation a tool call came from.
+type ImageSender func(ctx context.Context, name string, data []byte, mimeType string) error
+
+type imageSenderKey struct{}
+
+// WithImageSender returns a context that lets tools executed with it post
+// images via send.
+func WithImageSender(ctx context.Context, send ImageSender) context.Context {
+	return context.WithValue(ctx, imageSenderKey{}, send)
+}
+
+func imageSenderFrom(ctx context.Context) ImageSender {
+	send, _ := ctx.Value(imageSenderKey{}).(ImageSender)
+	return send
+}
+
+// --- fs_send_image ---
+
+type fsSendImageTool struct {
+	sandboxDir string
+	perRoom    bool
+}
+
+type fsSendImageInput struct {
+	Path string `json:"path"`
+}
+
+func (t *fsSendImageTool) Name() string { return "fs_send_image" }
+
+func (t *fsSendImageTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name:        "fs_send_image",
+			Description: anthropic.String("Post an image file from the sandbox directory into the chat so the user can see it. Supports PNG, JPEG, GIF, and WebP up to 10MB."),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"path": map[string]any{
+						"type":        "string",
+						"description": "Relative path of the image within the sandbox directory",
+					},
+				},
+				Required: []string{"path"},
+			},
+		},
+	}
+}
+
+func (t *fsSendImageTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params fsSendImageInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+
+	send := imageSenderFrom(ctx)
+	if send == nil {
+		return "sending images is not available here", true, nil
+	}
+
+	resolved, err := resolveToolPath(ctx, t.sandboxDir, t.perRoom, params.Path)
+	if err != nil {
+		return err.Error(), true, nil
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "file not found: " + params.Path, true, nil
+		}
+		return "failed to open file: " + err.Error(), true, nil
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxImageSize+1))
+	if err != nil {
+		return "failed to read file: " + err.Error(), true, nil
+	}
+	if len(data) > maxImageSize {
+		return "image is larger than 10MB", true, nil
+	}
+
+	mimeType := http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return fmt.Sprintf("%s is not an image (detected %s)", params.Path, mimeType), true, nil
+	}
+
+	if err := send(ctx, filepath.Base(params.Path), data, mimeType); err != nil {
+		return "failed to send image: " + err.Error(), true, nil
+	}
+	return fmt.Sprintf("sent %s (%s, %d bytes) to the chat", params.Path, mimeType, len(data)), false, nil
+}
@@ -0,0 +1,59 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// minimalPNG is the 8-byte PNG signature, enough for content sniffing.
+var minimalPNG = []byte("\x89PNG\r\n\x1a\n")
+
+func TestFsSendImage_Success(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pic.png"), minimalPNG, 0o644)
+
+	var gotName, gotType string
+	ctx := WithImageSender(context.Background(), func(ctx context.Context, name string, data []byte, mimeType string) error {
+		gotName, gotType = name, mimeType
+		return nil
+	})
+
+	tool := &fsSendImageTool{sandboxDir: dir}
+	result, isErr, err := tool.Execute(ctx, json.RawMessage(`{"path":"pic.png"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isErr {
+		t.Fatalf("expected success, got: %s", result)
+	}
+	if gotName != "pic.png" || gotType != "image/png" {
+		t.Errorf("unexpected image sent: name=%q type=%q", gotName, gotType)
+	}
+}
+
+func TestFsSendImage_NotAnImage(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0o644)
+	ctx := WithImageSender(context.Background(), func(context.Context, string, []byte, string) error { return nil })
+
+	tool := &fsSendImageTool{sandboxDir: dir}
+	result, isErr, _ := tool.Execute(ctx, json.RawMessage(`{"path":"notes.txt"}`))
+	if !isErr || !strings.Contains(result, "not an image") {
+		t.Errorf("expected 'not an image' error, got %q", result)
+	}
+}
+
+func TestFsSendImage_NoSender(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pic.png"), minimalPNG, 0o644)
+
+	tool := &fsSendImageTool{sandboxDir: dir}
+	_, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"path":"pic.png"}`))
+	if !isErr {
+		t.Error("expected isError=true without an image sender")
+	}
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
@@ -19,23 +23,42 @@ type mcpConnection struct {
 	session *mcp.ClientSession
 }
 
+// MCPServerStatus reports how connecting to one MCP server went. A server
+// can be Connected with a non-nil Err if listing its tools failed partway;
+// ToolCount is how many of its tools were registered either way.
+type MCPServerStatus struct {
+	Name      string
+	Connected bool
+	ToolCount int
+	Err       error
+}
+
 // MCPManager manages connections to MCP servers.
 type MCPManager struct {
 	connections []*mcpConnection
+	statuses    []MCPServerStatus
+	progress    *progressRouter
+	transport   func(config.MCPServerConfig) (mcp.Transport, error)
 }
 
 func NewMCPManager() *MCPManager {
-	return &MCPManager{}
+	return &MCPManager{progress: newProgressRouter(), transport: createTransport}
 }
 
 // Connect establishes connections to the configured MCP servers, discovers
-// their tools, and registers them in the given Registry.
+// their tools, and registers them in the given Registry. Servers that fail
+// are skipped; the returned error lists them, and Status reports every
+// server individually.
 func (m *MCPManager) Connect(ctx context.Context, servers []config.MCPServerConfig, registry *Registry) error {
 	var errs []string
 
 	for _, serverCfg := range servers {
-		transport, err := createTransport(serverCfg)
+		status := MCPServerStatus{Name: serverCfg.Name}
+
+		transport, err := m.transport(serverCfg)
 		if err != nil {
+			status.Err = err
+			m.statuses = append(m.statuses, status)
 			errs = append(errs, fmt.Sprintf("%s: %v", serverCfg.Name, err))
 			continue
 		}
@@ -43,13 +66,18 @@ func (m *MCPManager) Connect(ctx context.Context, servers []config.MCPServerConf
 		client := mcp.NewClient(&mcp.Implementation{
 			Name:    "matrix-claude-bot",
 			Version: "1.0.0",
-		}, nil)
+		}, &mcp.ClientOptions{
+			ProgressNotificationHandler: m.progress.handle,
+		})
 
 		session, err := client.Connect(ctx, transport, nil)
 		if err != nil {
-			errs = append(errs, fmt.Sprintf("%s: connection failed: %v", serverCfg.Name, err))
+			status.Err = fmt.Errorf("connection failed: %w", err)
+			m.statuses = append(m.statuses, status)
+			errs = append(errs, fmt.Sprintf("%s: %v", serverCfg.Name, status.Err))
 			continue
 		}
+		status.Connected = true
 
 		conn := &mcpConnection{
 			name:    serverCfg.Name,
@@ -57,12 +85,15 @@ func (m *MCPManager) Connect(ctx context.Context, servers []config.MCPServerConf
 		}
 		m.connections = append(m.connections, conn)
 
-		toolCount := 0
 		for tool, err := range session.Tools(ctx, nil) {
 			if err != nil {
-				errs = append(errs, fmt.Sprintf("%s: tool listing failed: %v", serverCfg.Name, err))
+				status.Err = fmt.Errorf("tool listing failed: %w", err)
+				errs = append(errs, fmt.Sprintf("%s: %v", serverCfg.Name, status.Err))
 				break
 			}
+			if !mcpToolAllowed(serverCfg, tool.Name) {
+				continue
+			}
 
 			wrapped := &mcpTool{
 				serverName:  serverCfg.Name,
@@ -70,12 +101,14 @@ func (m *MCPManager) Connect(ctx context.Context, servers []config.MCPServerConf
 				description: tool.Description,
 				inputSchema: tool.InputSchema,
 				session:     session,
+				progress:    m.progress,
+				readOnly:    tool.Annotations != nil && tool.Annotations.ReadOnlyHint,
 			}
 			registry.Register(wrapped)
-			toolCount++
+			status.ToolCount++
 		}
 
-		log.Printf("MCP server %q connected: %d tools", serverCfg.Name, toolCount)
+		m.statuses = append(m.statuses, status)
 	}
 
 	if len(errs) > 0 {
@@ -84,6 +117,21 @@ func (m *MCPManager) Connect(ctx context.Context, servers []config.MCPServerConf
 	return nil
 }
 
+// mcpToolAllowed reports whether the server's config lets its tool name be
+// registered: it must be in AllowedTools, if that is set, and not in
+// BlockedTools.
+func mcpToolAllowed(cfg config.MCPServerConfig, name string) bool {
+	if len(cfg.AllowedTools) > 0 && !slices.Contains(cfg.AllowedTools, name) {
+		return false
+	}
+	return !slices.Contains(cfg.BlockedTools, name)
+}
+
+// Status returns one entry per server passed to Connect, in config order.
+func (m *MCPManager) Status() []MCPServerStatus {
+	return m.statuses
+}
+
 // Close shuts down all MCP sessions.
 func (m *MCPManager) Close() {
 	for _, conn := range m.connections {
@@ -99,6 +147,10 @@ func createTransport(cfg config.MCPServerConfig) (mcp.Transport, error) {
 		if cfg.Command == "" {
 			return nil, fmt.Errorf("stdio transport requires 'command'")
 		}
+		// exec.Command would only report this once the client tries to start it.
+		if _, err := exec.LookPath(cfg.Command); err != nil {
+			return nil, fmt.Errorf("command %q is not an executable on PATH: %w", cfg.Command, err)
+		}
 		cmd := exec.Command(cfg.Command, cfg.Args...)
 		for k, v := range cfg.Env {
 			cmd.Env = append(cmd.Env, k+"="+v)
@@ -109,12 +161,18 @@ func createTransport(cfg config.MCPServerConfig) (mcp.Transport, error) {
 		if cfg.URL == "" {
 			return nil, fmt.Errorf("sse transport requires 'url'")
 		}
+		if err := validateServerURL(cfg.URL); err != nil {
+			return nil, err
+		}
 		return &mcp.SSEClientTransport{Endpoint: cfg.URL}, nil
 
 	case "streamable":
 		if cfg.URL == "" {
 			return nil, fmt.Errorf("streamable transport requires 'url'")
 		}
+		if err := validateServerURL(cfg.URL); err != nil {
+			return nil, err
+		}
 		return &mcp.StreamableClientTransport{Endpoint: cfg.URL}, nil
 
 	default:
@@ -122,6 +180,18 @@ func createTransport(cfg config.MCPServerConfig) (mcp.Transport, error) {
 	}
 }
 
+// validateServerURL rejects URLs the HTTP transports could never reach.
+func validateServerURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", raw, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q: must be an absolute http or https URL", raw)
+	}
+	return nil
+}
+
 // mcpTool wraps a single MCP server tool as a local Tool.
 type mcpTool struct {
 	serverName  string
@@ -129,12 +199,17 @@ type mcpTool struct {
 	description string
 	inputSchema any
 	session     *mcp.ClientSession
+	progress    *progressRouter
+	readOnly    bool
 }
 
 func (t *mcpTool) Name() string {
 	return t.serverName + "_" + t.toolName
 }
 
+// Cacheable trusts the server's read-only annotation.
+func (t *mcpTool) Cacheable() bool { return t.readOnly }
+
 func (t *mcpTool) Definition() anthropic.ToolUnionParam {
 	return anthropic.ToolUnionParam{
 		OfTool: &anthropic.ToolParam{
@@ -153,10 +228,19 @@ func (t *mcpTool) Execute(ctx context.Context, input json.RawMessage) (string, b
 		}
 	}
 
-	result, err := t.session.CallTool(ctx, &mcp.CallToolParams{
+	params := &mcp.CallToolParams{
 		Name:      t.toolName,
 		Arguments: args,
-	})
+	}
+	if report := progressReporterFrom(ctx); report != nil && t.progress != nil {
+		token, done := t.progress.register(report)
+		defer done()
+		// SetProgressToken only writes into an existing Meta map.
+		params.Meta = mcp.Meta{}
+		params.SetProgressToken(token)
+	}
+
+	result, err := t.session.CallTool(ctx, params)
 	if err != nil {
 		return "", false, fmt.Errorf("MCP tool call failed: %w", err)
 	}
@@ -165,8 +249,45 @@ func (t *mcpTool) Execute(ctx context.Context, input json.RawMessage) (string, b
 	return text, result.IsError, nil
 }
 
-// mcpSchemaToAnthropicSchema converts an MCP tool's InputSchema to the
-// Anthropic ToolInputSchemaParam format.
+// progressRouter delivers MCP progress notifications to the reporter of the
+// tool call that asked for them, matched by progress token.
+type progressRouter struct {
+	mu        sync.Mutex
+	next      int
+	reporters map[string]ProgressReporter
+}
+
+func newProgressRouter() *progressRouter {
+	return &progressRouter{reporters: make(map[string]ProgressReporter)}
+}
+
+// register returns a fresh progress token routed to report, and a func that
+// stops routing it.
+func (r *progressRouter) register(report ProgressReporter) (string, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	token := "progress-" + strconv.Itoa(r.next)
+	r.reporters[token] = report
+	return token, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.reporters, token)
+	}
+}
+
+func (r *progressRouter) handle(ctx context.Context, req *mcp.ProgressNotificationClientRequest) {
+	token, _ := req.Params.ProgressToken.(string)
+	r.mu.Lock()
+	report := r.reporters[token]
+	r.mu.Unlock()
+	if report != nil {
+		report(req.Params.Message, req.Params.Progress, req.Params.Total)
+	}
+}
+
+// mcpSchemaToAnthropicSchema converts an MCP tool's InputSchema (or an HTTP
+// tool's configured schema) to the Anthropic ToolInputSchemaParam format.
 func mcpSchemaToAnthropicSchema(schema any) anthropic.ToolInputSchemaParam {
 	if schema == nil {
 		return anthropic.ToolInputSchemaParam{
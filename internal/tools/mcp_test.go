@@ -1,7 +1,16 @@
 package tools
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/feline-dis/matrix-claude-bot/internal/config"
 	"github.com/modelcontextprotocol/go-sdk/mcp"
@@ -129,6 +138,29 @@ func TestCreateTransport_StdioMissingCommand(t *testing.T) {
 	}
 }
 
+func TestCreateTransport_StdioNonexistentCommand(t *testing.T) {
+	cfg := config.MCPServerConfig{
+		Name:      "test",
+		Command:   "definitely-not-a-real-mcp-server",
+		Transport: "stdio",
+	}
+	_, err := createTransport(cfg)
+	if err == nil || !strings.Contains(err.Error(), "definitely-not-a-real-mcp-server") {
+		t.Errorf("expected error naming the missing command, got %v", err)
+	}
+}
+
+func TestCreateTransport_StdioNotExecutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.MCPServerConfig{Name: "test", Command: path, Transport: "stdio"}
+	if _, err := createTransport(cfg); err == nil {
+		t.Error("expected error for a command without execute permission")
+	}
+}
+
 func TestCreateTransport_SSE(t *testing.T) {
 	cfg := config.MCPServerConfig{
 		Name:      "test",
@@ -170,6 +202,17 @@ func TestCreateTransport_Streamable(t *testing.T) {
 	}
 }
 
+func TestCreateTransport_MalformedURL(t *testing.T) {
+	for _, url := range []string{"localhost:8080/mcp", "://nope", "ftp://example.com/mcp", "http:///mcp"} {
+		for _, transport := range []string{"sse", "streamable"} {
+			cfg := config.MCPServerConfig{Name: "test", URL: url, Transport: transport}
+			if _, err := createTransport(cfg); err == nil {
+				t.Errorf("%s %q: expected error for malformed URL", transport, url)
+			}
+		}
+	}
+}
+
 func TestCreateTransport_Unknown(t *testing.T) {
 	cfg := config.MCPServerConfig{
 		Name:      "test",
@@ -180,3 +223,160 @@ func TestCreateTransport_Unknown(t *testing.T) {
 		t.Error("expected error for unknown transport")
 	}
 }
+
+type echoArgs struct {
+	Text string `json:"text"`
+}
+
+// startFakeMCPServer runs an in-memory MCP server with "echo" and "slow"
+// tools and returns the client side of its transport. "slow" reports two
+// progress steps, then waits for release (if non-nil) before finishing.
+func startFakeMCPServer(t *testing.T, release <-chan struct{}) mcp.Transport {
+	t.Helper()
+	server := mcp.NewServer(&mcp.Implementation{Name: "fake", Version: "1.0.0"}, nil)
+	mcp.AddTool(server, &mcp.Tool{Name: "echo", Description: "Echo text"},
+		func(ctx context.Context, req *mcp.CallToolRequest, args echoArgs) (*mcp.CallToolResult, any, error) {
+			return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: args.Text}}}, nil, nil
+		})
+
+	mcp.AddTool(server, &mcp.Tool{Name: "slow", Description: "Report progress, then finish"},
+		func(ctx context.Context, req *mcp.CallToolRequest, args struct{}) (*mcp.CallToolResult, any, error) {
+			if token := req.Params.GetProgressToken(); token != nil {
+				for i := 1; i <= 2; i++ {
+					req.Session.NotifyProgress(ctx, &mcp.ProgressNotificationParams{
+						ProgressToken: token,
+						Message:       fmt.Sprintf("step %d", i),
+						Progress:      float64(i),
+						Total:         2,
+					})
+				}
+			}
+			if release != nil {
+				select {
+				case <-release:
+				case <-ctx.Done():
+				}
+			}
+			return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: "done"}}}, nil, nil
+		})
+
+	clientT, serverT := mcp.NewInMemoryTransports()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, err := server.Connect(ctx, serverT, nil); err != nil {
+		t.Fatalf("server connect: %v", err)
+	}
+	return clientT
+}
+
+func TestMCPManager_ConnectPartialFailure(t *testing.T) {
+	healthy := startFakeMCPServer(t, nil)
+	m := NewMCPManager()
+	m.transport = func(cfg config.MCPServerConfig) (mcp.Transport, error) {
+		if cfg.Name == "good" {
+			return healthy, nil
+		}
+		return nil, fmt.Errorf("refused")
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reg := NewRegistry()
+	err := m.Connect(ctx, []config.MCPServerConfig{{Name: "good"}, {Name: "bad"}}, reg)
+	if err == nil {
+		t.Error("expected an error naming the failed server")
+	}
+
+	if !reg.HasLocalTool("good_echo") {
+		t.Errorf("tools from the healthy server should be registered, got %v", reg.LocalToolNames())
+	}
+
+	status := m.Status()
+	if len(status) != 2 {
+		t.Fatalf("expected status for both servers, got %+v", status)
+	}
+	if good := status[0]; good.Name != "good" || !good.Connected || good.ToolCount != 2 || good.Err != nil {
+		t.Errorf("unexpected status for healthy server: %+v", good)
+	}
+	if bad := status[1]; bad.Name != "bad" || bad.Connected || bad.Err == nil {
+		t.Errorf("unexpected status for failed server: %+v", bad)
+	}
+}
+
+func TestMCPManager_ToolFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		blocked []string
+		want    []string
+	}{
+		{"all by default", nil, nil, []string{"fake_echo", "fake_slow"}},
+		{"allowlist", []string{"echo"}, nil, []string{"fake_echo"}},
+		{"blocklist", nil, []string{"slow"}, []string{"fake_echo"}},
+		{"blocked wins", []string{"echo", "slow"}, []string{"echo"}, []string{"fake_slow"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := startFakeMCPServer(t, nil)
+			m := NewMCPManager()
+			m.transport = func(cfg config.MCPServerConfig) (mcp.Transport, error) { return transport, nil }
+			defer m.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			reg := NewRegistry()
+			server := config.MCPServerConfig{Name: "fake", AllowedTools: tt.allowed, BlockedTools: tt.blocked}
+			if err := m.Connect(ctx, []config.MCPServerConfig{server}, reg); err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+
+			got := reg.LocalToolNames()
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("registered %v, want %v", got, tt.want)
+			}
+			if count := m.Status()[0].ToolCount; count != len(tt.want) {
+				t.Errorf("ToolCount = %d, want %d", count, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestMCPTool_ReportsProgress(t *testing.T) {
+	release := make(chan struct{})
+	healthy := startFakeMCPServer(t, release)
+	m := NewMCPManager()
+	m.transport = func(config.MCPServerConfig) (mcp.Transport, error) { return healthy, nil }
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reg := NewRegistry()
+	if err := m.Connect(ctx, []config.MCPServerConfig{{Name: "fake"}}, reg); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	// Notifications arrive asynchronously, so the tool is held open until
+	// both have been seen.
+	var mu sync.Mutex
+	var updates []string
+	ctx = WithProgressReporter(ctx, func(message string, progress, total float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, fmt.Sprintf("%s %g/%g", message, progress, total))
+		if len(updates) == 2 {
+			close(release)
+		}
+	})
+	result, isErr, err := reg.Execute(ctx, "fake_slow", json.RawMessage(`{}`))
+	if err != nil || isErr || result != "done" {
+		t.Fatalf("Execute = %q, %v, %v", result, isErr, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != 2 || updates[0] != "step 1 1/2" || updates[1] != "step 2 2/2" {
+		t.Errorf("progress updates = %v", updates)
+	}
+}
@@ -0,0 +1,21 @@
+package tools
+
+import "context"
+
+// ProgressReporter receives progress updates from a running tool. total is
+// zero when unknown. It may be called from a goroutine other than the one
+// running the tool.
+type ProgressReporter func(message string, progress, total float64)
+
+type progressReporterKey struct{}
+
+// WithProgressReporter returns a context that lets tools executed with it
+// report progress via report.
+func WithProgressReporter(ctx context.Context, report ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, report)
+}
+
+func progressReporterFrom(ctx context.Context) ProgressReporter {
+	report, _ := ctx.Value(progressReporterKey{}).(ProgressReporter)
+	return report
+}
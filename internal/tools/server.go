@@ -0,0 +1,58 @@
+package tools
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/anthropics/anthropic-sdk-go"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+// serverTools maps the names accepted in tools.server_tools to the
+// definitions of tools the Anthropic API runs on its side.
+var serverTools = map[string]func(config.Config) anthropic.ToolUnionParam{
+	"web_search": func(cfg config.Config) anthropic.ToolUnionParam {
+		return anthropic.ToolUnionParam{OfWebSearchTool20250305: newWebSearchParam(cfg)}
+	},
+	"web_fetch": func(config.Config) anthropic.ToolUnionParam {
+		return anthropic.ToolUnionParam{OfWebFetchTool20250910: &anthropic.WebFetchTool20250910Param{}}
+	},
+	"code_execution": func(config.Config) anthropic.ToolUnionParam {
+		return anthropic.ToolUnionParam{OfCodeExecutionTool20250825: &anthropic.CodeExecutionTool20250825Param{}}
+	},
+}
+
+// NewServerTool returns the server tool definition for a name listed in
+// tools.server_tools, with any options cfg sets for it.
+func NewServerTool(name string, cfg config.Config) (anthropic.ToolUnionParam, error) {
+	def, ok := serverTools[name]
+	if !ok {
+		return anthropic.ToolUnionParam{}, fmt.Errorf("unknown server tool %q (known: %s)", name, strings.Join(ServerToolNames(), ", "))
+	}
+	return def(cfg), nil
+}
+
+// newWebSearchParam applies the tools.web_search options. Unset options are
+// left out so the API defaults apply.
+func newWebSearchParam(cfg config.Config) *anthropic.WebSearchTool20250305Param {
+	p := &anthropic.WebSearchTool20250305Param{
+		AllowedDomains: cfg.WebSearchAllowedDomains,
+		BlockedDomains: cfg.WebSearchBlockedDomains,
+	}
+	if cfg.WebSearchMaxUses > 0 {
+		p.MaxUses = anthropic.Int(cfg.WebSearchMaxUses)
+	}
+	return p
+}
+
+// ServerToolNames returns the names NewServerTool accepts, sorted.
+func ServerToolNames() []string {
+	names := make([]string, 0, len(serverTools))
+	for name := range serverTools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
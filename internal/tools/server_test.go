@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/feline-dis/matrix-claude-bot/internal/config"
+)
+
+func TestNewServerTool_ConfiguredNamesProduceDefinitions(t *testing.T) {
+	reg := NewRegistry()
+	for _, name := range []string{"web_search", "web_fetch", "code_execution"} {
+		def, err := NewServerTool(name, config.Config{})
+		if err != nil {
+			t.Fatalf("NewServerTool(%q): %v", name, err)
+		}
+		reg.AddServerTool(def)
+	}
+
+	defs := reg.ServerDefinitions()
+	if len(defs) != 3 {
+		t.Fatalf("expected 3 server definitions, got %d", len(defs))
+	}
+	if defs[0].OfWebSearchTool20250305 == nil || defs[1].OfWebFetchTool20250910 == nil || defs[2].OfCodeExecutionTool20250825 == nil {
+		t.Errorf("unexpected definitions: %+v", defs)
+	}
+
+	// The API identifies each tool by its type and name, so check what is
+	// actually sent.
+	for i, want := range []string{`"name":"web_search"`, `"name":"web_fetch"`, `"name":"code_execution"`} {
+		data, err := json.Marshal(defs[i])
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		if !strings.Contains(string(data), want) {
+			t.Errorf("definition %d = %s, want %s", i, data, want)
+		}
+	}
+}
+
+func TestNewServerTool_Unknown(t *testing.T) {
+	_, err := NewServerTool("teleport", config.Config{})
+	if err == nil || !strings.Contains(err.Error(), "web_search") {
+		t.Errorf("expected error listing known tools, got %v", err)
+	}
+}
+
+func TestNewServerTool_WebSearchOptionsFromConfig(t *testing.T) {
+	cfg := config.Config{
+		WebSearchAllowedDomains: []string{"go.dev", "pkg.go.dev"},
+		WebSearchMaxUses:        3,
+	}
+	def, err := NewServerTool("web_search", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	p := def.OfWebSearchTool20250305
+	if p == nil {
+		t.Fatal("expected a web search definition")
+	}
+	if len(p.AllowedDomains) != 2 || p.AllowedDomains[0] != "go.dev" {
+		t.Errorf("AllowedDomains = %v", p.AllowedDomains)
+	}
+	if p.BlockedDomains != nil {
+		t.Errorf("BlockedDomains = %v, want unset", p.BlockedDomains)
+	}
+	if p.MaxUses.Value != 3 {
+		t.Errorf("MaxUses = %v, want 3", p.MaxUses)
+	}
+
+	blocked, _ := NewServerTool("web_search", config.Config{WebSearchBlockedDomains: []string{"example.com"}})
+	data, _ := json.Marshal(blocked)
+	if !strings.Contains(string(data), `"blocked_domains":["example.com"]`) || strings.Contains(string(data), "max_uses") {
+		t.Errorf("unexpected request JSON: %s", data)
+	}
+}
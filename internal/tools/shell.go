@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const maxShellOutput = 16 << 10 // 16 KB per stream
+
+// NewShellTool returns the shell_exec tool, which runs one of the allowed
+// binaries inside sandboxDir. Arguments are passed straight to the process,
+// never through a shell, so there's no globbing, piping, or interpolation,
+// and any argument naming a path outside the sandbox is refused. With
+// perRoom, commands run in the calling room's sandbox subdirectory.
+func NewShellTool(sandboxDir string, perRoom bool, allowed []string, timeout time.Duration) Tool {
+	return &shellExecTool{sandboxDir: sandboxDir, perRoom: perRoom, allowed: allowed, timeout: timeout}
+}
+
+type shellExecTool struct {
+	sandboxDir string
+	perRoom    bool
+	allowed    []string
+	timeout    time.Duration
+}
+
+type shellExecInput struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+func (t *shellExecTool) Name() string { return "shell_exec" }
+
+func (t *shellExecTool) Definition() anthropic.ToolUnionParam {
+	return anthropic.ToolUnionParam{
+		OfTool: &anthropic.ToolParam{
+			Name: "shell_exec",
+			Description: anthropic.String(fmt.Sprintf("Run a command in the sandbox directory and return its exit code and output. "+
+				"Only these commands are allowed: %s. Arguments are passed as-is without a shell, so pipes, redirects, and globs don't work. "+
+				"Paths must be relative and stay inside the sandbox. "+
+				"Output is capped at 16KB per stream.", strings.Join(t.allowed, ", "))),
+			InputSchema: anthropic.ToolInputSchemaParam{
+				Properties: map[string]any{
+					"command": map[string]any{
+						"type":        "string",
+						"description": "Name of the command to run, e.g. \"ls\"",
+					},
+					"args": map[string]any{
+						"type":        "array",
+						"items":       map[string]any{"type": "string"},
+						"description": "Arguments to pass to the command (optional)",
+					},
+				},
+				Required: []string{"command"},
+			},
+		},
+	}
+}
+
+func (t *shellExecTool) Execute(ctx context.Context, input json.RawMessage) (string, bool, error) {
+	var params shellExecInput
+	if err := json.Unmarshal(input, &params); err != nil {
+		return InvalidInput(err), true, nil
+	}
+	if !slices.Contains(t.allowed, params.Command) {
+		return fmt.Sprintf("command %q is not allowed; allowed commands: %s", params.Command, strings.Join(t.allowed, ", ")), true, nil
+	}
+
+	dir, err := sandboxRoot(ctx, t.sandboxDir, t.perRoom)
+	if err != nil {
+		return err.Error(), true, nil
+	}
+	if err := checkShellArgs(dir, params.Args); err != nil {
+		return err.Error(), true, nil
+	}
+
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	stdout := &cappedBuffer{limit: maxShellOutput}
+	stderr := &cappedBuffer{limit: maxShellOutput}
+	cmd := exec.CommandContext(ctx, params.Command, params.Args...)
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Sprintf("command timed out after %s", t.timeout), true, nil
+	} else if ctx.Err() != nil {
+		return "command was cancelled", true, nil
+	}
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return "failed to run command: " + err.Error(), true, nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "exit code: %d\n", exitCode)
+	if stdout.Len() > 0 {
+		fmt.Fprintf(&b, "--- stdout ---\n%s\n", stdout)
+	}
+	if stderr.Len() > 0 {
+		fmt.Fprintf(&b, "--- stderr ---\n%s\n", stderr)
+	}
+	return b.String(), exitCode != 0, nil
+}
+
+// checkShellArgs refuses arguments that name a path outside root: absolute
+// paths, "~", anything climbing out with "..", and symlinks in the sandbox
+// that lead outside it. Option values are checked the same way; see
+// shellArgPaths. Every argument is treated as a possible path, since only
+// the command knows which ones are.
+func checkShellArgs(root string, args []string) error {
+	for _, arg := range args {
+		for _, c := range shellArgPaths(arg) {
+			if c == "" {
+				continue
+			}
+			if filepath.IsAbs(c) || strings.HasPrefix(c, "~") {
+				return fmt.Errorf("argument %q is an absolute path; use a path relative to the sandbox", arg)
+			}
+			if _, err := resolveSandboxedPath(root, c); err != nil {
+				return fmt.Errorf("argument %q: %v", arg, err)
+			}
+		}
+	}
+	return nil
+}
+
+// shellArgPaths returns the parts of arg that may be a path: the argument
+// itself, the value of a "--flag=value" option, or, for short options such
+// as "-f/etc/passwd" or "-rf../x" whose value may follow any bundled
+// letter, everything after each letter.
+func shellArgPaths(arg string) []string {
+	switch {
+	case strings.HasPrefix(arg, "--"):
+		if _, value, ok := strings.Cut(arg, "="); ok {
+			return []string{value}
+		}
+		return nil
+	case strings.HasPrefix(arg, "-"):
+		var paths []string
+		for i := 2; i < len(arg); i++ {
+			paths = append(paths, strings.TrimPrefix(arg[i:], "="))
+		}
+		return paths
+	default:
+		return []string{arg}
+	}
+}
+
+// cappedBuffer keeps the first limit bytes written to it and drops the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.Len(); room < len(p) {
+		c.truncated = true
+		c.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return c.Buffer.Write(p)
+}
+
+func (c *cappedBuffer) String() string {
+	if c.truncated {
+		return c.Buffer.String() + "\n... (output truncated)"
+	}
+	return c.Buffer.String()
+}
@@ -0,0 +1,118 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellExec_AllowedCommand(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0o644)
+
+	tool := NewShellTool(dir, false, []string{"ls"}, 5*time.Second)
+	result, isErr, err := tool.Execute(context.Background(), json.RawMessage(`{"command":"ls"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isErr {
+		t.Errorf("expected success, got: %s", result)
+	}
+	if !strings.Contains(result, "exit code: 0") || !strings.Contains(result, "notes.txt") {
+		t.Errorf("expected exit code and listing, got %q", result)
+	}
+}
+
+func TestShellExec_NoShellInterpolation(t *testing.T) {
+	dir := t.TempDir()
+	tool := NewShellTool(dir, false, []string{"echo"}, 5*time.Second)
+	result, _, _ := tool.Execute(context.Background(), json.RawMessage(`{"command":"echo","args":["$HOME; rm -rf *"]}`))
+	if !strings.Contains(result, "$HOME; rm -rf *") {
+		t.Errorf("expected argument to be passed literally, got %q", result)
+	}
+}
+
+func TestShellExec_DisallowedBinary(t *testing.T) {
+	tool := NewShellTool(t.TempDir(), false, []string{"ls"}, 5*time.Second)
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"command":"rm","args":["-rf","."]}`))
+	if !isErr {
+		t.Error("expected isError=true for a disallowed command")
+	}
+	if !strings.Contains(result, "not allowed") {
+		t.Errorf("expected 'not allowed' in result, got %q", result)
+	}
+}
+
+func TestShellExec_Timeout(t *testing.T) {
+	tool := NewShellTool(t.TempDir(), false, []string{"sleep"}, 100*time.Millisecond)
+	start := time.Now()
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"command":"sleep","args":["5"]}`))
+	if !isErr {
+		t.Error("expected isError=true on timeout")
+	}
+	if !strings.Contains(result, "timed out") {
+		t.Errorf("expected 'timed out' in result, got %q", result)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("command was not killed promptly")
+	}
+}
+
+func TestShellExec_RefusesPathsOutsideSandbox(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hi"), 0o644)
+	os.Symlink("/etc", filepath.Join(dir, "etc"))
+	tool := NewShellTool(dir, false, []string{"cat", "ls", "grep"}, 5*time.Second)
+
+	for _, input := range []string{
+		`{"command":"cat","args":["/etc/passwd"]}`,
+		`{"command":"ls","args":["../.."]}`,
+		`{"command":"ls","args":["sub/../../x"]}`,
+		`{"command":"grep","args":["-r","x","/"]}`,
+		`{"command":"grep","args":["--file=/etc/passwd","notes.txt"]}`,
+		`{"command":"grep","args":["-f/etc/passwd","notes.txt"]}`,
+		`{"command":"grep","args":["-f../../etc/passwd","notes.txt"]}`,
+		`{"command":"grep","args":["-rf/etc/passwd","."]}`,
+		`{"command":"ls","args":["-C/"]}`,
+		`{"command":"cat","args":["etc/passwd"]}`,
+		`{"command":"ls","args":["~"]}`,
+	} {
+		result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(input))
+		if !isErr || strings.Contains(result, "exit code") {
+			t.Errorf("%s: expected the command to be refused, got %q", input, result)
+		}
+	}
+
+	result, isErr, _ := tool.Execute(context.Background(), json.RawMessage(`{"command":"cat","args":["./notes.txt"]}`))
+	if isErr || !strings.Contains(result, "hi") {
+		t.Errorf("expected a path inside the sandbox to work, got %q", result)
+	}
+	result, isErr, _ = tool.Execute(context.Background(), json.RawMessage(`{"command":"grep","args":["-rn","hi","."]}`))
+	if isErr || !strings.Contains(result, "notes.txt") {
+		t.Errorf("expected bundled short options to work, got %q", result)
+	}
+}
+
+func TestShellExec_CancelledIsNotTimeout(t *testing.T) {
+	tool := NewShellTool(t.TempDir(), false, []string{"sleep"}, 5*time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	result, isErr, _ := tool.Execute(ctx, json.RawMessage(`{"command":"sleep","args":["5"]}`))
+	if !isErr || !strings.Contains(result, "cancelled") {
+		t.Errorf("expected a cancellation error, got %q", result)
+	}
+}
+
+func TestCappedBuffer_Truncates(t *testing.T) {
+	buf := &cappedBuffer{limit: 4}
+	buf.Write([]byte("abc"))
+	buf.Write([]byte("defg"))
+	if got := buf.String(); got != "abcd\n... (output truncated)" {
+		t.Errorf("unexpected buffer contents: %q", got)
+	}
+}
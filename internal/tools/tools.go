@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 )
@@ -17,12 +20,31 @@ type Tool interface {
 	Execute(ctx context.Context, input json.RawMessage) (result string, isError bool, err error)
 }
 
+const invalidInputPrefix = "invalid input: "
+
+// InvalidInput is the result a tool returns, with isError set, when Claude's
+// input doesn't decode against the tool's schema.
+func InvalidInput(err error) string {
+	return invalidInputPrefix + err.Error()
+}
+
+// IsInvalidInput reports whether a tool result came from InvalidInput.
+func IsInvalidInput(result string) bool {
+	return strings.HasPrefix(result, invalidInputPrefix)
+}
+
 // Registry holds both locally-executed tools and server-side tool
 // definitions (like web search) that the Anthropic API handles.
 type Registry struct {
 	mu          sync.RWMutex
 	localTools  map[string]Tool
 	serverTools []anthropic.ToolUnionParam
+	cache       *resultCache
+	// slots holds a semaphore per lowercased tool name with a
+	// concurrency limit.
+	slots map[string]chan struct{}
+	// formatters rewrites results per lowercased tool name.
+	formatters map[string]OutputFormatter
 }
 
 func NewRegistry() *Registry {
@@ -58,16 +80,77 @@ func (r *Registry) Definitions() []anthropic.ToolUnionParam {
 	return defs
 }
 
+// EnableResultCache makes Execute reuse successful results of Cacheable
+// tools for ttl. Calling any other tool empties the cache, since it may
+// have changed what the reads would return.
+func (r *Registry) EnableResultCache(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = newResultCache(ttl)
+}
+
 // Execute runs a locally-registered tool by name.
 func (r *Registry) Execute(ctx context.Context, name string, input json.RawMessage) (string, bool, error) {
+	r.mu.RLock()
+	format := r.formatters[strings.ToLower(name)]
+	r.mu.RUnlock()
+
+	result, isError, err := r.execute(ctx, name, input)
+	if format != nil && err == nil && !isError {
+		if formatted, ok := format(result); ok {
+			result = formatted
+		}
+	}
+	return result, isError, err
+}
+
+// execute runs a tool call, through the result cache if one is enabled.
+func (r *Registry) execute(ctx context.Context, name string, input json.RawMessage) (string, bool, error) {
 	r.mu.RLock()
 	t, ok := r.localTools[name]
+	cache := r.cache
+	sem := r.slots[strings.ToLower(name)]
 	r.mu.RUnlock()
 
 	if !ok {
 		return "", false, fmt.Errorf("unknown tool: %s", name)
 	}
-	return t.Execute(ctx, input)
+	run := func() (string, bool, error) {
+		release, err := acquireSlot(ctx, sem)
+		if err != nil {
+			return "", false, fmt.Errorf("waiting for a free %s slot: %w", name, err)
+		}
+		defer release()
+		return t.Execute(ctx, input)
+	}
+	if cache == nil {
+		return run()
+	}
+
+	if !isCacheable(t) {
+		defer cache.clear()
+		return run()
+	}
+	key := cacheKey(ctx, name, input)
+	if result, ok := cache.get(key); ok {
+		return result, false, nil
+	}
+	result, isError, err := run()
+	if err == nil && !isError {
+		cache.put(key, result)
+	}
+	return result, isError, err
+}
+
+// Definition returns the definition of a locally-registered tool.
+func (r *Registry) Definition(name string) (anthropic.ToolUnionParam, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.localTools[name]
+	if !ok {
+		return anthropic.ToolUnionParam{}, false
+	}
+	return t.Definition(), true
 }
 
 func (r *Registry) HasLocalTool(name string) bool {
@@ -95,6 +178,13 @@ func (r *Registry) LocalToolNames() []string {
 	return names
 }
 
+// ServerDefinitions returns only the server-side tool definitions.
+func (r *Registry) ServerDefinitions() []anthropic.ToolUnionParam {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.serverTools)
+}
+
 // HasServerTools reports whether any server-side tools are registered.
 func (r *Registry) HasServerTools() bool {
 	r.mu.RLock()